@@ -0,0 +1,142 @@
+// Command psp2png converts Paint Shop Pro images to PNG.
+//
+// Usage:
+//
+//	psp2png [-flatten | -layer N | -composite] in.pspimage out.png
+//	psp2png [-flatten | -layer N | -composite] -o dir in.pspimage...
+//
+// By default the first raster layer is converted. -flatten composites all
+// of the visible layers, -layer N converts the layer at index N in storage
+// order (bottom-most first) and -composite converts the composite image or
+// thumbnail stored by Paint Shop Pro. With -o every input is written to dir
+// under its own name with the extension replaced by .png.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/samuel/go-psp/psp"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stderr))
+}
+
+// mode selects the image to convert.
+type mode struct {
+	flatten   bool
+	composite bool
+	layer     int // or -1
+}
+
+// run runs the command with the given arguments and returns its exit code.
+func run(args []string, stderr io.Writer) int {
+	fs := flag.NewFlagSet("psp2png", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: psp2png [-flatten | -layer N | -composite] in.pspimage out.png")
+		fmt.Fprintln(stderr, "       psp2png [-flatten | -layer N | -composite] -o dir in.pspimage...")
+		fs.PrintDefaults()
+	}
+	var m mode
+	fs.BoolVar(&m.flatten, "flatten", false, "composite all visible layers")
+	fs.BoolVar(&m.composite, "composite", false, "convert the stored composite image or thumbnail")
+	fs.IntVar(&m.layer, "layer", -1, "convert the layer at index `N`, bottom-most first")
+	outDir := fs.String("o", "", "write the PNG files to `dir`")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	n := 0
+	for _, set := range []bool{m.flatten, m.composite, m.layer >= 0} {
+		if set {
+			n++
+		}
+	}
+	if n > 1 {
+		fmt.Fprintln(stderr, "psp2png: -flatten, -layer and -composite are exclusive")
+		return 2
+	}
+
+	type job struct{ in, out string }
+	var jobs []job
+	if *outDir != "" {
+		if fs.NArg() == 0 {
+			fs.Usage()
+			return 2
+		}
+		for _, in := range fs.Args() {
+			base := strings.TrimSuffix(filepath.Base(in), filepath.Ext(in))
+			jobs = append(jobs, job{in, filepath.Join(*outDir, base+".png")})
+		}
+	} else {
+		if fs.NArg() != 2 {
+			fs.Usage()
+			return 2
+		}
+		jobs = append(jobs, job{fs.Arg(0), fs.Arg(1)})
+	}
+
+	status := 0
+	for _, j := range jobs {
+		if err := convert(j.in, j.out, m); err != nil {
+			fmt.Fprintf(stderr, "psp2png: %s: %v\n", j.in, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// convert writes the image of the PSP file in selected by m to out as PNG.
+func convert(in, out string, m mode) error {
+	f, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	img, err := decode(f, m)
+	if err != nil {
+		return err
+	}
+	w, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(w, img); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func decode(f *os.File, m mode) (image.Image, error) {
+	switch {
+	case m.flatten:
+		return psp.DecodeWithOptions(f, &psp.Options{Flatten: true})
+	case m.composite:
+		return psp.DecodeThumbnail(f)
+	case m.layer >= 0:
+		r, err := psp.OpenReader(f)
+		if err != nil {
+			return nil, err
+		}
+		if m.layer >= r.NumLayers() {
+			return nil, fmt.Errorf("no layer %d, the file has %d", m.layer, r.NumLayers())
+		}
+		img, err := r.LayerImage(m.layer)
+		if err != nil {
+			return nil, err
+		}
+		if img == nil {
+			return nil, fmt.Errorf("layer %d (%v) has no raster image", m.layer, r.LayerInfo(m.layer).Kind)
+		}
+		return img, nil
+	}
+	return psp.Decode(f)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/samuel/go-psp/psp"
+)
+
+// writeFixture writes a 4x4 document with an opaque red bottom layer and a
+// half transparent blue layer above it, along with a thumbnail.
+func writeFixture(t *testing.T, path string) {
+	red := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	blue := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for i := 0; i < len(red.Pix); i += 4 {
+		copy(red.Pix[i:], []byte{255, 0, 0, 255})
+		copy(blue.Pix[i:], []byte{0, 0, 128, 128})
+	}
+	var buf bytes.Buffer
+	err := psp.EncodeDocument(&buf, &psp.Document{
+		Width:  4,
+		Height: 4,
+		Layers: []*psp.Layer{
+			{Name: "Red", Kind: psp.LayerRaster, Opacity: 255, Visible: true, Image: red},
+			{Name: "Blue", Kind: psp.LayerRaster, Opacity: 255, Visible: true, Image: blue},
+		},
+	}, &psp.EncodeOptions{ThumbnailSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readPNG(t *testing.T, path string) image.Image {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.pspimage")
+	writeFixture(t, in)
+	for _, tc := range []struct {
+		flags []string
+		size  int
+		want  color.RGBA
+	}{
+		{nil, 4, color.RGBA{255, 0, 0, 255}},
+		{[]string{"-layer", "1"}, 4, color.RGBA{0, 0, 128, 128}},
+		{[]string{"-flatten"}, 4, color.RGBA{127, 0, 128, 255}},
+		{[]string{"-composite"}, 2, color.RGBA{127, 0, 128, 255}},
+	} {
+		out := filepath.Join(dir, "out.png")
+		var stderr bytes.Buffer
+		if code := run(append(tc.flags, in, out), &stderr); code != 0 {
+			t.Errorf("%v: exit code %d: %s", tc.flags, code, stderr.String())
+			continue
+		}
+		img := readPNG(t, out)
+		if b := img.Bounds(); b.Dx() != tc.size || b.Dy() != tc.size {
+			t.Errorf("%v: got bounds %v, want %dx%d", tc.flags, b, tc.size, tc.size)
+		}
+		if got := color.RGBAModel.Convert(img.At(0, 0)).(color.RGBA); got != tc.want {
+			t.Errorf("%v: got pixel %v, want %v", tc.flags, got, tc.want)
+		}
+	}
+}
+
+func TestRunBatch(t *testing.T) {
+	dir := t.TempDir()
+	outDir := filepath.Join(dir, "out")
+	if err := os.Mkdir(outDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	a, b := filepath.Join(dir, "a.pspimage"), filepath.Join(dir, "b.psp")
+	writeFixture(t, a)
+	writeFixture(t, b)
+	bad := filepath.Join(dir, "bad.psp")
+	if err := os.WriteFile(bad, []byte("not a psp file"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stderr bytes.Buffer
+	if code := run([]string{"-o", outDir, a, bad, b}, &stderr); code != 1 {
+		t.Errorf("got exit code %d with a bad input, want 1", code)
+	}
+	for _, name := range []string{"a.png", "b.png"} {
+		readPNG(t, filepath.Join(outDir, name))
+	}
+	// The error names the file and where in it decoding failed.
+	if msg := stderr.String(); !strings.Contains(msg, "bad.psp") || !strings.Contains(msg, "offset") {
+		t.Errorf("got error output %q", msg)
+	}
+}
+
+func TestRunUsage(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"in.psp"},
+		{"-o", "dir"},
+		{"-flatten", "-composite", "in.psp", "out.png"},
+	} {
+		var stderr bytes.Buffer
+		if code := run(args, &stderr); code != 2 {
+			t.Errorf("%q: got exit code %d, want 2", args, code)
+		}
+	}
+	var stderr bytes.Buffer
+	if code := run([]string{"-layer", "5", "missing.psp", "out.png"}, &stderr); code != 1 {
+		t.Errorf("missing input: got exit code %d, want 1", code)
+	}
+}
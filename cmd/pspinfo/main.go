@@ -0,0 +1,272 @@
+// Command pspinfo prints information about Paint Shop Pro images without
+// decoding their pixels.
+//
+// Usage:
+//
+//	pspinfo [-json] file.pspimage...
+//
+// For every file it prints the header fields, the creator metadata, the
+// layers and the number of saved alpha channels and composite images. A
+// part of a file that can't be read is reported as a warning and the rest
+// is printed anyway. -json prints a JSON object per file instead.
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/samuel/go-psp/psp"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// report is the information printed for a file.
+type report struct {
+	File          string    `json:"file"`
+	Version       string    `json:"version"`
+	Width         int       `json:"width"`
+	Height        int       `json:"height"`
+	BitDepth      int       `json:"bitDepth"`
+	Grayscale     bool      `json:"grayscale"`
+	Compression   string    `json:"compression"`
+	Resolution    float64   `json:"resolution"`
+	Unit          string    `json:"resolutionUnit"`
+	Metadata      *metadata `json:"metadata,omitempty"`
+	Layers        []layer   `json:"layers"`
+	AlphaChannels int       `json:"alphaChannels"`
+	Composites    int       `json:"composites"`
+	Warnings      []string  `json:"warnings,omitempty"`
+}
+
+type metadata struct {
+	Title       string     `json:"title,omitempty"`
+	Artist      string     `json:"artist,omitempty"`
+	Copyright   string     `json:"copyright,omitempty"`
+	Description string     `json:"description,omitempty"`
+	Created     *time.Time `json:"created,omitempty"`
+	Modified    *time.Time `json:"modified,omitempty"`
+}
+
+type layer struct {
+	Name      string `json:"name"`
+	Kind      string `json:"kind"`
+	Rect      string `json:"rect"`
+	BlendMode string `json:"blendMode"`
+	Opacity   int    `json:"opacity"`
+	Visible   bool   `json:"visible"`
+}
+
+// run runs the command with the given arguments and returns its exit code.
+func run(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("pspinfo", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: pspinfo [-json] file.pspimage...")
+		fs.PrintDefaults()
+	}
+	asJSON := fs.Bool("json", false, "print JSON rather than text")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	status := 0
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	for i, name := range fs.Args() {
+		r, err := inspect(name)
+		if err != nil {
+			fmt.Fprintf(stderr, "pspinfo: %s: %v\n", name, err)
+			status = 1
+			continue
+		}
+		if *asJSON {
+			if err := enc.Encode(r); err != nil {
+				fmt.Fprintf(stderr, "pspinfo: %v\n", err)
+				return 1
+			}
+			continue
+		}
+		if i > 0 {
+			fmt.Fprintln(stdout)
+		}
+		printReport(stdout, r)
+		for _, w := range r.Warnings {
+			fmt.Fprintf(stderr, "pspinfo: %s: warning: %s\n", name, w)
+		}
+	}
+	return status
+}
+
+// inspect gathers the information about the named file. Only a file that
+// can't be opened or whose header can't be read is an error; failures to
+// read the rest are recorded as warnings.
+func inspect(name string) (*report, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := psp.DecodeInfo(f)
+	if err != nil {
+		return nil, err
+	}
+	r := &report{
+		File:        name,
+		Version:     fmt.Sprintf("%d.%d", info.VersionMajor, info.VersionMinor),
+		Width:       info.Width,
+		Height:      info.Height,
+		BitDepth:    info.BitDepth,
+		Grayscale:   info.Grayscale,
+		Compression: strings.TrimPrefix(info.Compression.String(), "Compression"),
+		Resolution:  info.Resolution,
+		Unit:        strings.TrimPrefix(info.ResolutionUnit.String(), "Resolution"),
+		Layers:      []layer{},
+	}
+	warn := func(what string, err error) {
+		r.Warnings = append(r.Warnings, what+": "+err.Error())
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if meta, err := psp.DecodeMetadata(f); err != nil {
+		warn("metadata", err)
+	} else {
+		r.Metadata = &metadata{
+			Title:       meta.Title,
+			Artist:      meta.Artist,
+			Copyright:   meta.Copyright,
+			Description: meta.Description,
+		}
+		if !meta.Created.IsZero() {
+			r.Metadata.Created = &meta.Created
+		}
+		if !meta.Modified.IsZero() {
+			r.Metadata.Modified = &meta.Modified
+		}
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if lr, err := psp.OpenReader(f); err != nil {
+		warn("layers", err)
+	} else {
+		for i := 0; i < lr.NumLayers(); i++ {
+			l := lr.LayerInfo(i)
+			r.Layers = append(r.Layers, layer{
+				Name:      l.Name,
+				Kind:      strings.TrimPrefix(l.Kind.String(), "Layer"),
+				Rect:      l.Rect.String(),
+				BlendMode: strings.TrimPrefix(l.BlendMode.String(), "Blend"),
+				Opacity:   int(l.Opacity),
+				Visible:   l.Visible,
+			})
+		}
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if r.AlphaChannels, r.Composites, err = countBanks(f); err != nil {
+		warn("banks", err)
+	}
+	return r, nil
+}
+
+// countBanks returns the number of alpha channels and composite images
+// recorded at the start of the alpha and composite image banks.
+func countBanks(rd io.Reader) (alpha, composites int, err error) {
+	s, err := psp.NewBlockScanner(rd)
+	if err != nil {
+		return 0, 0, err
+	}
+	major, _ := s.Version()
+	for {
+		h, br, err := s.Next()
+		if err == io.EOF {
+			return alpha, composites, nil
+		} else if err != nil {
+			return alpha, composites, err
+		}
+		// Since version 4 the count is preceded by the size of the
+		// information chunk holding it.
+		if major >= 4 && (h.ID == psp.AlphaBankBlock || h.ID == psp.CompositeImageBankBlock) {
+			if _, err := io.CopyN(io.Discard, br, 4); err != nil {
+				return alpha, composites, err
+			}
+		}
+		switch h.ID {
+		case psp.AlphaBankBlock:
+			var n uint16
+			if err := binary.Read(br, binary.LittleEndian, &n); err != nil {
+				return alpha, composites, err
+			}
+			alpha += int(n)
+		case psp.CompositeImageBankBlock:
+			var n uint32
+			if err := binary.Read(br, binary.LittleEndian, &n); err != nil {
+				return alpha, composites, err
+			}
+			composites += int(n)
+		}
+	}
+}
+
+func printReport(w io.Writer, r *report) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "File:\t%s\n", r.File)
+	fmt.Fprintf(tw, "Version:\t%s\n", r.Version)
+	fmt.Fprintf(tw, "Dimensions:\t%dx%d\n", r.Width, r.Height)
+	fmt.Fprintf(tw, "Bit depth:\t%d", r.BitDepth)
+	if r.Grayscale {
+		fmt.Fprint(tw, " grayscale")
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintf(tw, "Compression:\t%s\n", r.Compression)
+	fmt.Fprintf(tw, "Resolution:\t%g per %s\n", r.Resolution, r.Unit)
+	if m := r.Metadata; m != nil {
+		for _, f := range []struct{ name, value string }{
+			{"Title", m.Title},
+			{"Artist", m.Artist},
+			{"Copyright", m.Copyright},
+			{"Description", m.Description},
+		} {
+			if f.value != "" {
+				fmt.Fprintf(tw, "%s:\t%s\n", f.name, f.value)
+			}
+		}
+		if m.Created != nil {
+			fmt.Fprintf(tw, "Created:\t%s\n", m.Created.Format(time.RFC3339))
+		}
+		if m.Modified != nil {
+			fmt.Fprintf(tw, "Modified:\t%s\n", m.Modified.Format(time.RFC3339))
+		}
+	}
+	fmt.Fprintf(tw, "Alpha channels:\t%d\n", r.AlphaChannels)
+	fmt.Fprintf(tw, "Composites:\t%d\n", r.Composites)
+	fmt.Fprintf(tw, "Layers:\t%d\n", len(r.Layers))
+	tw.Flush()
+
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for i, l := range r.Layers {
+		visible := "visible"
+		if !l.Visible {
+			visible = "hidden"
+		}
+		fmt.Fprintf(tw, "  %d\t%q\t%s\t%s\t%s\topacity %d\t%s\n", i, l.Name, l.Kind, l.Rect, l.BlendMode, l.Opacity, visible)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/samuel/go-psp/psp"
+)
+
+// writeFixture writes a document with two layers, the upper one hidden,
+// and a thumbnail. It returns the contents of the file.
+func writeFixture(t *testing.T, path string) []byte {
+	var buf bytes.Buffer
+	err := psp.EncodeDocument(&buf, &psp.Document{
+		Width:  6,
+		Height: 4,
+		Layers: []*psp.Layer{
+			{Name: "Background", Kind: psp.LayerRaster, Opacity: 255, Visible: true, Image: image.NewRGBA(image.Rect(0, 0, 6, 4))},
+			{Name: "Shade", Kind: psp.LayerRaster, Opacity: 128, BlendMode: psp.BlendMultiply, Image: image.NewRGBA(image.Rect(1, 1, 3, 3))},
+		},
+	}, &psp.EncodeOptions{Version: 7, ThumbnailSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRunJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "doc.pspimage")
+	writeFixture(t, path)
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-json", path}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr.String())
+	}
+	var r report
+	if err := json.Unmarshal(stdout.Bytes(), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Version != "7.0" || r.Width != 6 || r.Height != 4 || r.BitDepth != 24 || r.Compression != "None" {
+		t.Errorf("got header %+v", r)
+	}
+	if r.Metadata == nil || r.Composites != 1 || r.AlphaChannels != 0 || len(r.Warnings) != 0 {
+		t.Errorf("got metadata %v, %d composites, %d alpha channels and warnings %v", r.Metadata, r.Composites, r.AlphaChannels, r.Warnings)
+	}
+	want := []layer{
+		{Name: "Background", Kind: "Raster", Rect: "(0,0)-(6,4)", BlendMode: "Normal", Opacity: 255, Visible: true},
+		{Name: "Shade", Kind: "Raster", Rect: "(1,1)-(3,3)", BlendMode: "Multiply", Opacity: 128},
+	}
+	if len(r.Layers) != len(want) {
+		t.Fatalf("got layers %+v", r.Layers)
+	}
+	for i := range want {
+		if r.Layers[i] != want[i] {
+			t.Errorf("layer %d: got %+v, want %+v", i, r.Layers[i], want[i])
+		}
+	}
+}
+
+func TestRunText(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "doc.pspimage")
+	writeFixture(t, path)
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{path}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr.String())
+	}
+	for _, s := range []string{"Dimensions:", "6x4", "Composites:", `"Shade"`, "Multiply", "hidden"} {
+		if !strings.Contains(stdout.String(), s) {
+			t.Errorf("output lacks %q:\n%s", s, stdout.String())
+		}
+	}
+}
+
+func TestRunPartial(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "doc.pspimage")
+	data := writeFixture(t, path)
+	// Cutting the file short loses the layers but not the header.
+	if err := os.WriteFile(path, data[:len(data)/2], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	bad := filepath.Join(dir, "bad.psp")
+	if err := os.WriteFile(bad, []byte("not a psp file"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{path}, &stdout, &stderr); code != 0 {
+		t.Errorf("truncated file: got exit code %d: %s", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "6x4") || !strings.Contains(stderr.String(), "warning") {
+		t.Errorf("truncated file: got output %q and errors %q", stdout.String(), stderr.String())
+	}
+
+	stdout.Reset()
+	stderr.Reset()
+	if code := run([]string{bad, path}, &stdout, &stderr); code != 1 {
+		t.Errorf("bad file: got exit code %d, want 1", code)
+	}
+	if !strings.Contains(stderr.String(), "bad.psp") || !strings.Contains(stdout.String(), "6x4") {
+		t.Errorf("bad file: got output %q and errors %q", stdout.String(), stderr.String())
+	}
+
+	if code := run(nil, &stdout, &stderr); code != 2 {
+		t.Errorf("no arguments: got exit code %d, want 2", code)
+	}
+}
@@ -0,0 +1,163 @@
+// Command psplayers writes the raster layers of a Paint Shop Pro image to
+// separate PNG files.
+//
+// Usage:
+//
+//	psplayers [-skip-hidden] -o dir in.pspimage
+//
+// Every raster layer is written to dir as NNN-name.png, where NNN is the
+// index of the layer in storage order (bottom-most first) and name is its
+// name reduced to characters safe in file names. A PNG holds the stored
+// area of its layer, which may be smaller than the canvas. manifest.json
+// in dir records where each one goes on the canvas along with its opacity,
+// blend mode and visibility, so that the document can be put back
+// together. Layers without raster data are left out, as are hidden layers
+// with -skip-hidden.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/samuel/go-psp/psp"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stderr))
+}
+
+// manifest describes the layers written for a document.
+type manifest struct {
+	Width  int             `json:"width"`
+	Height int             `json:"height"`
+	Layers []manifestLayer `json:"layers"`
+}
+
+type manifestLayer struct {
+	Index int    `json:"index"` // in storage order, bottom-most first
+	Name  string `json:"name"`
+	File  string `json:"file"`
+
+	// Rect is the area of the canvas covered by the PNG, as left, top,
+	// right and bottom.
+	Rect [4]int `json:"rect"`
+
+	Opacity   int    `json:"opacity"` // 0 to 255
+	BlendMode string `json:"blendMode"`
+	Visible   bool   `json:"visible"`
+}
+
+// run runs the command with the given arguments and returns its exit code.
+func run(args []string, stderr io.Writer) int {
+	fs := flag.NewFlagSet("psplayers", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: psplayers [-skip-hidden] -o dir in.pspimage")
+		fs.PrintDefaults()
+	}
+	outDir := fs.String("o", "", "write the layers and manifest to `dir`")
+	skipHidden := fs.Bool("skip-hidden", false, "leave out hidden layers")
+	// Flags may follow the input file.
+	var inputs []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return 2
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		inputs = append(inputs, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(inputs) != 1 || *outDir == "" {
+		fs.Usage()
+		return 2
+	}
+	if err := extract(inputs[0], *outDir, *skipHidden); err != nil {
+		fmt.Fprintf(stderr, "psplayers: %s: %v\n", inputs[0], err)
+		return 1
+	}
+	return 0
+}
+
+// extract writes the raster layers of the PSP file in and their manifest
+// to dir.
+func extract(in, dir string, skipHidden bool) error {
+	f, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	doc, err := psp.DecodeDocument(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	m := manifest{Width: doc.Width, Height: doc.Height, Layers: []manifestLayer{}}
+	for i, l := range doc.Layers {
+		if l.Image == nil || skipHidden && !l.Visible {
+			continue
+		}
+		name := fmt.Sprintf("%03d-%s.png", i, sanitize(l.Name))
+		if err := writePNG(filepath.Join(dir, name), l); err != nil {
+			return err
+		}
+		b := l.Image.Bounds()
+		m.Layers = append(m.Layers, manifestLayer{
+			Index:     i,
+			Name:      l.Name,
+			File:      name,
+			Rect:      [4]int{b.Min.X, b.Min.Y, b.Max.X, b.Max.Y},
+			Opacity:   int(l.Opacity),
+			BlendMode: strings.TrimPrefix(l.BlendMode.String(), "Blend"),
+			Visible:   l.Visible,
+		})
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "manifest.json"), append(b, '\n'), 0o644)
+}
+
+func writePNG(path string, l *psp.Layer) error {
+	w, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(w, l.Image); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// sanitize reduces a layer name to letters, digits, dashes and
+// underscores, replacing runs of anything else with an underscore.
+func sanitize(name string) string {
+	var sb strings.Builder
+	replaced := false
+	for _, r := range name {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' {
+			sb.WriteRune(r)
+			replaced = false
+		} else if !replaced {
+			sb.WriteByte('_')
+			replaced = true
+		}
+	}
+	s := strings.Trim(sb.String(), "_")
+	if s == "" {
+		return "layer"
+	}
+	return s
+}
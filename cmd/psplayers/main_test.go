@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/samuel/go-psp/psp"
+)
+
+func writeFixture(t *testing.T, path string) {
+	var buf bytes.Buffer
+	err := psp.EncodeDocument(&buf, &psp.Document{
+		Width:  6,
+		Height: 4,
+		Layers: []*psp.Layer{
+			{Name: "Back ground/1", Kind: psp.LayerRaster, Opacity: 255, Visible: true, Image: image.NewRGBA(image.Rect(0, 0, 6, 4))},
+			{Name: "Shade", Kind: psp.LayerRaster, Opacity: 128, BlendMode: psp.BlendMultiply, Image: image.NewRGBA(image.Rect(1, 1, 3, 4))},
+			{Name: "", Kind: psp.LayerRaster, Opacity: 255, Visible: true, Image: image.NewRGBA(image.Rect(2, 0, 4, 2))},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+const wantManifest = `{
+  "width": 6,
+  "height": 4,
+  "layers": [
+    {
+      "index": 0,
+      "name": "Back ground/1",
+      "file": "000-Back_ground_1.png",
+      "rect": [
+        0,
+        0,
+        6,
+        4
+      ],
+      "opacity": 255,
+      "blendMode": "Normal",
+      "visible": true
+    },
+    {
+      "index": 1,
+      "name": "Shade",
+      "file": "001-Shade.png",
+      "rect": [
+        1,
+        1,
+        3,
+        4
+      ],
+      "opacity": 128,
+      "blendMode": "Multiply",
+      "visible": false
+    },
+    {
+      "index": 2,
+      "name": "",
+      "file": "002-layer.png",
+      "rect": [
+        2,
+        0,
+        4,
+        2
+      ],
+      "opacity": 255,
+      "blendMode": "Normal",
+      "visible": true
+    }
+  ]
+}
+`
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "doc.pspimage")
+	writeFixture(t, in)
+	out := filepath.Join(dir, "out")
+	var stderr bytes.Buffer
+	// The output flag may follow the input.
+	if code := run([]string{in, "-o", out}, &stderr); code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr.String())
+	}
+	b, err := os.ReadFile(filepath.Join(out, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != wantManifest {
+		t.Errorf("got manifest\n%s\nwant\n%s", b, wantManifest)
+	}
+	for _, tc := range []struct {
+		name string
+		w, h int
+	}{
+		{"000-Back_ground_1.png", 6, 4},
+		{"001-Shade.png", 2, 3},
+		{"002-layer.png", 2, 2},
+	} {
+		f, err := os.Open(filepath.Join(out, tc.name))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		cfg, err := png.DecodeConfig(f)
+		f.Close()
+		if err != nil || cfg.Width != tc.w || cfg.Height != tc.h {
+			t.Errorf("%s: got %dx%d, error %v; want %dx%d", tc.name, cfg.Width, cfg.Height, err, tc.w, tc.h)
+		}
+	}
+
+	out = filepath.Join(dir, "visible")
+	if code := run([]string{"-skip-hidden", "-o", out, in}, &stderr); code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr.String())
+	}
+	if _, err := os.Stat(filepath.Join(out, "001-Shade.png")); !os.IsNotExist(err) {
+		t.Errorf("hidden layer written with -skip-hidden")
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	dir := t.TempDir()
+	bad := filepath.Join(dir, "bad.psp")
+	if err := os.WriteFile(bad, []byte("not a psp file"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var stderr bytes.Buffer
+	if code := run([]string{"-o", dir, bad}, &stderr); code != 1 {
+		t.Errorf("bad file: got exit code %d, want 1", code)
+	}
+	for _, args := range [][]string{{bad}, {"-o", dir}, {"-o", dir, bad, bad}} {
+		if code := run(args, &stderr); code != 2 {
+			t.Errorf("%q: got exit code %d, want 2", args, code)
+		}
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"Background", "Background"},
+		{"Layer 1 (copy)", "Layer_1_copy"},
+		{"../../etc/passwd", "etc_passwd"},
+		{"Café-über_2", "Café-über_2"},
+		{"", "layer"},
+		{"***", "layer"},
+	} {
+		if got := sanitize(tc.in); got != tc.want {
+			t.Errorf("sanitize(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
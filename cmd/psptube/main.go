@@ -0,0 +1,223 @@
+// Command psptube slices a Paint Shop Pro picture tube into its cells.
+//
+// Usage:
+//
+//	psptube [-montage] -o dir in.tub
+//
+// Every cell of the tube is written to dir as cell-NNN.png, keeping its
+// transparency, and the settings of the tube to tube.json. -montage also
+// writes montage.png, a contact sheet of the cells with their indices in
+// the corner, for checking a tube at a glance. Files without a picture
+// tube block are refused.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/samuel/go-psp/psp"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stderr))
+}
+
+// tubeInfo is the contents of tube.json.
+type tubeInfo struct {
+	Name      string     `json:"name"`
+	StepSize  int        `json:"stepSize"`
+	Columns   int        `json:"columns"`
+	Rows      int        `json:"rows"`
+	CellCount int        `json:"cellCount"`
+	Placement string     `json:"placement"`
+	Selection string     `json:"selection"`
+	Cells     []cellInfo `json:"cells"`
+}
+
+type cellInfo struct {
+	Index int    `json:"index"`
+	File  string `json:"file"`
+
+	// Rect is the area of the sheet the cell was cut from, as left, top,
+	// right and bottom.
+	Rect [4]int `json:"rect"`
+}
+
+// errNotTube is returned for PSP files without a picture tube block.
+var errNotTube = errors.New("not a picture tube: the file has no tube block")
+
+// run runs the command with the given arguments and returns its exit code.
+func run(args []string, stderr io.Writer) int {
+	fs := flag.NewFlagSet("psptube", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: psptube [-montage] -o dir in.tub")
+		fs.PrintDefaults()
+	}
+	outDir := fs.String("o", "", "write the cells and settings to `dir`")
+	montage := fs.Bool("montage", false, "also write a contact sheet of the cells")
+	// Flags may follow the input file.
+	var inputs []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return 2
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		inputs = append(inputs, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(inputs) != 1 || *outDir == "" {
+		fs.Usage()
+		return 2
+	}
+	if err := extract(inputs[0], *outDir, *montage); err != nil {
+		fmt.Fprintf(stderr, "psptube: %s: %v\n", inputs[0], err)
+		return 1
+	}
+	return 0
+}
+
+// extract writes the cells and settings of the tube in to dir.
+func extract(in, dir string, montage bool) error {
+	f, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Check for the tube block before decoding any pixels.
+	meta, err := psp.DecodeMetadata(f)
+	if err != nil {
+		return err
+	}
+	if meta.Tube == nil {
+		return errNotTube
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	tube, frames, err := psp.DecodeTube(f)
+	if err != nil {
+		return err
+	}
+	if len(frames) == 0 {
+		return fmt.Errorf("tube has no cells (%dx%d grid, %d cells)", tube.Columns, tube.Rows, tube.CellCount)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	info := tubeInfo{
+		Name:      tube.Name,
+		StepSize:  tube.StepSize,
+		Columns:   tube.Columns,
+		Rows:      tube.Rows,
+		CellCount: tube.CellCount,
+		Placement: strings.TrimPrefix(tube.Placement.String(), "TubePlacement"),
+		Selection: strings.TrimPrefix(tube.Selection.String(), "TubeSelection"),
+	}
+	for i, frame := range frames {
+		name := fmt.Sprintf("cell-%03d.png", i)
+		if err := writePNG(filepath.Join(dir, name), frame); err != nil {
+			return err
+		}
+		b := frame.Bounds()
+		info.Cells = append(info.Cells, cellInfo{i, name, [4]int{b.Min.X, b.Min.Y, b.Max.X, b.Max.Y}})
+	}
+	b, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "tube.json"), append(b, '\n'), 0o644); err != nil {
+		return err
+	}
+	if montage {
+		return writePNG(filepath.Join(dir, "montage.png"), contactSheet(frames, tube.Columns))
+	}
+	return nil
+}
+
+func writePNG(path string, m image.Image) error {
+	w, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(w, m); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// gutter is the space between the cells of a contact sheet.
+const gutter = 4
+
+var (
+	sheetBackground = color.RGBA{0x80, 0x80, 0x80, 0xff}
+	labelBackground = color.RGBA{0, 0, 0, 0xff}
+	labelColor      = color.RGBA{0xff, 0xff, 0xff, 0xff}
+)
+
+// contactSheet lays out frames in a grid of the given number of columns
+// over a gray background, labelling each with its index.
+func contactSheet(frames []image.Image, columns int) *image.RGBA {
+	if columns <= 0 || columns > len(frames) {
+		columns = len(frames)
+	}
+	var w, h int
+	for _, f := range frames {
+		w = max(w, f.Bounds().Dx())
+		h = max(h, f.Bounds().Dy())
+	}
+	rows := (len(frames) + columns - 1) / columns
+	sheet := image.NewRGBA(image.Rect(0, 0, columns*(w+gutter)+gutter, rows*(h+gutter)+gutter))
+	draw.Draw(sheet, sheet.Rect, image.NewUniform(sheetBackground), image.Point{}, draw.Src)
+	for i, f := range frames {
+		at := image.Pt(gutter+i%columns*(w+gutter), gutter+i/columns*(h+gutter))
+		r := image.Rectangle{Min: at, Max: at.Add(f.Bounds().Size())}
+		draw.Draw(sheet, r, f, f.Bounds().Min, draw.Over)
+		drawLabel(sheet, at, i)
+	}
+	return sheet
+}
+
+// glyphs are the digits of a 3x5 pixel font.
+var glyphs = [10][5]string{
+	{"###", "#.#", "#.#", "#.#", "###"},
+	{".#.", "##.", ".#.", ".#.", "###"},
+	{"###", "..#", "###", "#..", "###"},
+	{"###", "..#", "###", "..#", "###"},
+	{"#.#", "#.#", "###", "..#", "..#"},
+	{"###", "#..", "###", "..#", "###"},
+	{"###", "#..", "###", "#.#", "###"},
+	{"###", "..#", "..#", "..#", "..#"},
+	{"###", "#.#", "###", "#.#", "###"},
+	{"###", "#.#", "###", "..#", "###"},
+}
+
+// drawLabel writes the number n at p in white on a black box.
+func drawLabel(dst *image.RGBA, p image.Point, n int) {
+	digits := fmt.Sprint(n)
+	box := image.Rect(0, 0, len(digits)*4+1, 7).Add(p)
+	draw.Draw(dst, box, image.NewUniform(labelBackground), image.Point{}, draw.Src)
+	for i, c := range digits {
+		g := glyphs[c-'0']
+		for y, row := range g {
+			for x := range row {
+				if row[x] == '#' {
+					dst.Set(p.X+1+i*4+x, p.Y+1+y, labelColor)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/samuel/go-psp/internal/pspgen"
+	"github.com/samuel/go-psp/psp"
+)
+
+// tubeFile returns a picture tube of three 2x2 cells in a 2x2 grid over a
+// 4x4 sheet. Cell i is filled with a color whose red is 50*(i+1), and the
+// right half of every cell is transparent.
+func tubeFile() []byte {
+	sheet := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			i := y/2*2 + x/2
+			c := color.NRGBA{uint8(50 * (i + 1)), 0, 0, 255}
+			if x%2 == 1 {
+				c.A = 0
+			}
+			sheet.SetNRGBA(x, y, c)
+		}
+	}
+	tube := pspgen.LE(uint16(1))
+	tube = append(tube, pspgen.FixedName("Dots", 513)...)
+	tube = append(tube, pspgen.LE(uint32(30), uint32(2), uint32(2), uint32(3), uint32(psp.TubePlacementConstant), uint32(psp.TubeSelectionIncremental))...)
+	layer := pspgen.Layer{
+		Name:     "Sheet",
+		Type:     pspgen.RasterType(5),
+		Rect:     sheet.Rect,
+		Opacity:  255,
+		Channels: append(pspgen.RGBChannels(sheet.Pix), pspgen.Channel{Bitmap: pspgen.DIBTransMask, Channel: pspgen.ChannelComposite, Data: pspgen.Plane(sheet.Pix, 4, 3)}),
+	}
+	return pspgen.NewFile(5).
+		Attrs(pspgen.Attrs{Width: 4, Height: 4, BitDepth: 24, LayerCount: 1}).
+		Block(pspgen.TubeBlock, tube).
+		Layers(pspgen.LayerBytes(5, pspgen.None, layer)).
+		Bytes()
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "dots.tub")
+	if err := os.WriteFile(in, tubeFile(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out")
+	var stderr bytes.Buffer
+	if code := run([]string{in, "-o", out, "-montage"}, &stderr); code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr.String())
+	}
+
+	b, err := os.ReadFile(filepath.Join(out, "tube.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info tubeInfo
+	if err := json.Unmarshal(b, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "Dots" || info.StepSize != 30 || info.Columns != 2 || info.Rows != 2 || info.CellCount != 3 ||
+		info.Placement != "Constant" || info.Selection != "Incremental" || len(info.Cells) != 3 {
+		t.Fatalf("got tube %s", b)
+	}
+	for i, c := range info.Cells {
+		x, y := i%2*2, i/2*2
+		if c.Index != i || c.Rect != [4]int{x, y, x + 2, y + 2} {
+			t.Errorf("cell %d: got %+v", i, c)
+		}
+		m := readPNG(t, filepath.Join(out, c.File))
+		if b := m.Bounds(); b.Dx() != 2 || b.Dy() != 2 {
+			t.Errorf("cell %d: got bounds %v", i, b)
+			continue
+		}
+		p := m.Bounds().Min
+		opaque := color.NRGBAModel.Convert(m.At(p.X, p.Y)).(color.NRGBA)
+		clear := color.NRGBAModel.Convert(m.At(p.X+1, p.Y)).(color.NRGBA)
+		if opaque != (color.NRGBA{uint8(50 * (i + 1)), 0, 0, 255}) || clear.A != 0 {
+			t.Errorf("cell %d: got pixels %v and %v", i, opaque, clear)
+		}
+	}
+
+	m := readPNG(t, filepath.Join(out, "montage.png"))
+	if b := m.Bounds(); b.Dx() != 2*(2+gutter)+gutter || b.Dy() != 2*(2+gutter)+gutter {
+		t.Errorf("got montage bounds %v", b)
+	}
+}
+
+func TestRunNotTube(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "plain.pspimage")
+	var buf bytes.Buffer
+	if err := psp.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(in, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out")
+	var stderr bytes.Buffer
+	if code := run([]string{"-o", out, in}, &stderr); code != 1 {
+		t.Errorf("got exit code %d, want 1", code)
+	}
+	if !strings.Contains(stderr.String(), "not a picture tube") {
+		t.Errorf("got error output %q", stderr.String())
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("output directory created for a file that isn't a tube")
+	}
+	if code := run([]string{in}, &stderr); code != 2 {
+		t.Errorf("missing -o: got exit code %d, want 2", code)
+	}
+}
+
+func TestDrawLabel(t *testing.T) {
+	m := image.NewRGBA(image.Rect(0, 0, 12, 8))
+	drawLabel(m, image.Pt(1, 1), 17)
+	var sb strings.Builder
+	for y := 2; y < 7; y++ {
+		for x := 2; x < 9; x++ {
+			if m.RGBAAt(x, y) == labelColor {
+				sb.WriteByte('#')
+			} else {
+				sb.WriteByte('.')
+			}
+		}
+		sb.WriteByte('\n')
+	}
+	want := ".#..###\n##....#\n.#....#\n.#....#\n###...#\n"
+	if sb.String() != want {
+		t.Errorf("got label\n%s\nwant\n%s", sb.String(), want)
+	}
+}
+
+func readPNG(t *testing.T, path string) image.Image {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	m, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
@@ -0,0 +1,64 @@
+package pspgen
+
+import (
+	"image"
+	"image/color"
+)
+
+// Corpus returns a set of small valid files covering each supported
+// version, compression method and kind of image, for seeding fuzzers.
+func Corpus() [][]byte {
+	var corpus [][]byte
+	for _, m := range Images() {
+		for major := uint16(3); major <= 9; major++ {
+			for comp := None; comp <= LZ77; comp++ {
+				corpus = append(corpus, Image(major, comp, m))
+			}
+		}
+	}
+	return corpus
+}
+
+// Images returns sample images of each kind Image supports, with odd sizes
+// and the smallest palettes.
+func Images() []image.Image {
+	one := image.NewPaletted(image.Rect(0, 0, 1, 1), color.Palette{color.RGBA{10, 20, 30, 255}})
+	two := image.NewPaletted(image.Rect(0, 0, 7, 3), color.Palette{
+		color.RGBA{0, 0, 0, 255},
+		color.RGBA{255, 128, 0, 255},
+	})
+	for i := range two.Pix {
+		two.Pix[i] = byte(i % 3 % 2)
+	}
+	gray := image.NewGray(image.Rect(0, 0, 5, 2))
+	for i := range gray.Pix {
+		gray.Pix[i] = byte(i * 25)
+	}
+	gray16 := image.NewGray16(image.Rect(0, 0, 3, 2))
+	for i := range gray16.Pix {
+		gray16.Pix[i] = byte(i*40 + 1)
+	}
+	opaque := image.NewRGBA(image.Rect(0, 0, 3, 3))
+	for i := range opaque.Pix {
+		opaque.Pix[i] = byte(i * 7)
+		if i%4 == 3 {
+			opaque.Pix[i] = 255
+		}
+	}
+	alpha := image.NewNRGBA(image.Rect(0, 0, 4, 2))
+	for i := 0; i < len(alpha.Pix); i += 4 {
+		alpha.Pix[i], alpha.Pix[i+1], alpha.Pix[i+2], alpha.Pix[i+3] = 200, byte(i*8), 50, byte(i*8)
+	}
+	deep := image.NewRGBA64(image.Rect(0, 0, 2, 3))
+	for i := range deep.Pix {
+		deep.Pix[i] = byte(i * 11)
+		if i%8 >= 6 {
+			deep.Pix[i] = 255
+		}
+	}
+	deepAlpha := image.NewNRGBA64(image.Rect(0, 0, 3, 1))
+	for i := range deepAlpha.Pix {
+		deepAlpha.Pix[i] = byte(i*13 + 2)
+	}
+	return []image.Image{one, two, gray, gray16, opaque, alpha, deep, deepAlpha}
+}
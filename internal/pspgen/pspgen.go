@@ -0,0 +1,521 @@
+// Package pspgen builds minimal Paint Shop Pro files for tests and fuzzing.
+//
+// It isn't an encoder: nothing is validated and every field is written as
+// given, so that tests can produce odd sizes, tiny palettes, unusual block
+// orders and malformed streams that a real encoder would refuse to write.
+// Block layouts follow the version given to each function: version 3 and
+// older use fixed size headers and names, version 4 and later are chunked.
+package pspgen
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"math"
+)
+
+// Magic numbers at the start of a file, block and chunk.
+var (
+	FileMagic  = []byte("Paint Shop Pro Image File\n\x1a\x00\x00\x00\x00\x00")
+	BlockMagic = []byte("~BK\x00")
+	ChunkMagic = []byte("~FL\x00")
+)
+
+// Block identifiers.
+const (
+	ImageBlock uint16 = iota
+	CreatorBlock
+	ColorBlock
+	LayerStartBlock
+	LayerBlock
+	ChannelBlock
+	SelectionBlock
+	AlphaBankBlock
+	AlphaChannelBlock
+	ThumbnailBlock
+	ExtendedDataBlock
+	TubeBlock
+	AdjustmentExtensionBlock
+	VectorExtensionBlock
+	ShapeBlock
+	PaintstyleBlock
+	CompositeImageBankBlock
+	CompositeAttributesBlock
+	JPEGBlock
+	LinestyleBlock
+	TableBankBlock
+	TableBlock
+	PaperBlock
+	PatternBlock
+	GradientBlock
+	GroupExtensionBlock
+	MaskExtensionBlock
+	BrushBlock
+	ArtMediaBlock
+	ArtMediaMapBlock
+	ArtMediaTileBlock
+	ArtMediaTextureBlock
+	ColorProfileBlock
+	RasterExtensionBlock
+)
+
+// Bitmap types of channels.
+const (
+	DIBImage uint16 = iota
+	DIBTransMask
+	DIBUserMask
+	DIBSelection
+	DIBAlphaMask
+	DIBThumbnail
+)
+
+// Channel types.
+const (
+	ChannelComposite uint16 = iota
+	ChannelRed
+	ChannelGreen
+	ChannelBlue
+)
+
+// Compression methods.
+const (
+	None uint16 = iota
+	RLE
+	LZ77
+)
+
+// LE encodes values in little-endian order as binary.Write does.
+func LE(v ...interface{}) []byte {
+	var buf bytes.Buffer
+	for _, x := range v {
+		if err := binary.Write(&buf, binary.LittleEndian, x); err != nil {
+			panic(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// Sized encodes values like LE, prefixed with their total size including
+// the four bytes of the size itself, as in the information chunks of
+// version 4 and later.
+func Sized(v ...interface{}) []byte {
+	p := LE(v...)
+	return append(LE(uint32(len(p)+4)), p...)
+}
+
+// Rect encodes a rectangle as four 32 bit coordinates.
+func Rect(r image.Rectangle) []byte {
+	return LE(int32(r.Min.X), int32(r.Min.Y), int32(r.Max.X), int32(r.Max.Y))
+}
+
+// Block returns a block with the given payload. Version 3 and older repeat
+// the payload length as the initial length.
+func Block(major, id uint16, payload []byte) []byte {
+	return InitBlock(major, id, payload, nil)
+}
+
+// InitBlock returns a block holding the fixed fields init followed by the
+// sub-blocks rest. Version 3 and older give the length of init as the
+// initial length, as PSP 3 and 5 do.
+func InitBlock(major, id uint16, init, rest []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(BlockMagic)
+	buf.Write(LE(id))
+	if major <= 3 {
+		buf.Write(LE(uint32(len(init))))
+	}
+	buf.Write(LE(uint32(len(init) + len(rest))))
+	buf.Write(init)
+	buf.Write(rest)
+	return buf.Bytes()
+}
+
+// Chunk returns an extended data chunk with the given payload.
+func Chunk(keyword uint16, payload []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(ChunkMagic)
+	buf.Write(LE(keyword, uint32(len(payload))))
+	buf.Write(payload)
+	return buf.Bytes()
+}
+
+// Compress compresses data with the given method. Unknown methods leave
+// the data as is.
+func Compress(comp uint16, data []byte) []byte {
+	var buf bytes.Buffer
+	switch comp {
+	case LZ77:
+		zw := zlib.NewWriter(&buf)
+		zw.Write(data)
+		zw.Close()
+	case RLE:
+		for len(data) > 0 {
+			n := 1
+			for n < len(data) && n < 127 && data[n] == data[0] {
+				n++
+			}
+			if n > 1 {
+				buf.WriteByte(byte(128 + n))
+				buf.WriteByte(data[0])
+			} else {
+				n = 0
+				for n < len(data) && n < 128 && (n+1 >= len(data) || data[n+1] != data[n]) {
+					n++
+				}
+				buf.WriteByte(byte(n))
+				buf.Write(data[:n])
+			}
+			data = data[n:]
+		}
+	default:
+		buf.Write(data)
+	}
+	return buf.Bytes()
+}
+
+// Channel is a channel of a layer, alpha channel or table entry.
+type Channel struct {
+	Bitmap  uint16
+	Channel uint16
+	Data    []byte // uncompressed
+}
+
+// ChannelBytes returns a channel sub-block with the data compressed with
+// comp.
+func ChannelBytes(major, comp uint16, c Channel) []byte {
+	return channelBytes(major, Compress(comp, c.Data), c, 0)
+}
+
+// channelBytes returns a channel sub-block holding the compressed data of
+// c, with expansion zero bytes ending its header.
+func channelBytes(major uint16, data []byte, c Channel, expansion int) []byte {
+	var p []byte
+	if major >= 4 {
+		p = LE(uint32(16 + expansion))
+	}
+	p = append(p, LE(uint32(len(data)), uint32(len(c.Data)), c.Bitmap, c.Channel)...)
+	p = append(p, make([]byte, expansion)...)
+	return InitBlock(major, ChannelBlock, p, data)
+}
+
+// Layer describes a layer block.
+type Layer struct {
+	Name      string
+	Type      byte // stored layer type, which depends on the version
+	Rect      image.Rectangle
+	SavedRect image.Rectangle // defaults to Rect
+	Opacity   byte
+	BlendMode byte
+	Hidden    bool
+	LinkGroup byte
+	MaskRect  image.Rectangle // used for both mask rectangles
+	Ranges    [][8]byte       // blend ranges, source then destination
+	Channels  []Channel
+	Empty     bool     // channels written without data, as empty layers may be
+	Extra     [][]byte // sub-blocks following the channels
+
+	// Expansion is the number of zero bytes ending the layer information,
+	// the bitmap information and the channel headers, as later versions
+	// add fields to them. Before version 4 they end the initial data.
+	Expansion int
+}
+
+// LayerBytes returns a layer sub-block including its channels, compressed
+// with comp. The bitmap count is always one and the channel count is the
+// number of channels given.
+func LayerBytes(major, comp uint16, l Layer) []byte {
+	var p bytes.Buffer
+	saved := l.SavedRect
+	if saved == (image.Rectangle{}) {
+		saved = l.Rect
+	}
+	if major >= 4 {
+		p.Write(LE(uint32(0), uint16(len(l.Name)), []byte(l.Name)))
+	} else {
+		p.Write(FixedName(l.Name, 256))
+	}
+	visible := byte(1)
+	if l.Hidden {
+		visible = 0
+	}
+	p.WriteByte(l.Type)
+	p.Write(Rect(l.Rect))
+	p.Write(Rect(saved))
+	p.Write([]byte{l.Opacity, l.BlendMode, visible, 0, l.LinkGroup})
+	p.Write(Rect(l.MaskRect))
+	p.Write(Rect(l.MaskRect))
+	var ranges [5][8]byte
+	copy(ranges[:], l.Ranges)
+	p.Write(LE(byte(0), byte(0), byte(0), uint16(len(l.Ranges)), ranges))
+	if major >= 6 {
+		p.Write(make([]byte, 5))
+	}
+	if major >= 4 {
+		p.Write(make([]byte, l.Expansion))
+		// The information chunk size, which includes itself.
+		b := p.Bytes()
+		copy(b, LE(uint32(len(b))))
+	}
+	switch {
+	case major >= 10:
+	case major >= 4:
+		p.Write(LE(uint32(8+l.Expansion), uint16(1), uint16(len(l.Channels))))
+		p.Write(make([]byte, l.Expansion))
+	default:
+		p.Write(LE(uint16(1), uint16(len(l.Channels))))
+		p.Write(make([]byte, l.Expansion))
+	}
+	init := p.Len()
+	for _, c := range l.Channels {
+		data := Compress(comp, c.Data)
+		if l.Empty {
+			data = nil
+		}
+		p.Write(channelBytes(major, data, c, l.Expansion))
+	}
+	for _, b := range l.Extra {
+		p.Write(b)
+	}
+	return InitBlock(major, LayerBlock, p.Bytes()[:init], p.Bytes()[init:])
+}
+
+// FixedName returns s in a zero padded field of n bytes.
+func FixedName(s string, n int) []byte {
+	b := make([]byte, n)
+	copy(b, s)
+	return b
+}
+
+// Attrs holds the fields of the general image attributes block.
+type Attrs struct {
+	Width, Height int
+	Resolution    float64
+	Metric        byte
+	Compression   uint16
+	BitDepth      uint16
+	Grayscale     bool
+	LayerCount    uint16
+	Contents      uint32 // graphic contents flags, written since version 4
+	Expansion     int    // zero bytes ending the block since version 4
+}
+
+// AttrsBytes returns a general image attributes block.
+func AttrsBytes(major uint16, a Attrs) []byte {
+	var p []byte
+	if major >= 4 {
+		p = LE(uint32(46 + a.Expansion))
+	}
+	gray := byte(0)
+	if a.Grayscale {
+		gray = 1
+	}
+	p = append(p, LE(int32(a.Width), int32(a.Height), math.Float64bits(a.Resolution), a.Metric,
+		a.Compression, a.BitDepth, uint16(1), uint32(0), gray, uint32(0),
+		int32(0), a.LayerCount)...)
+	if major >= 4 {
+		p = append(p, LE(a.Contents)...)
+		p = append(p, make([]byte, a.Expansion)...)
+	}
+	return Block(major, ImageBlock, p)
+}
+
+// PaletteBytes returns a color palette block holding p.
+func PaletteBytes(major uint16, p color.Palette) []byte {
+	var b []byte
+	if major >= 4 {
+		b = LE(uint32(8))
+	}
+	b = append(b, LE(uint32(len(p)))...)
+	for _, c := range p {
+		r, g, bl, _ := c.RGBA()
+		b = append(b, byte(bl>>8), byte(g>>8), byte(r>>8), 0)
+	}
+	return Block(major, ColorBlock, b)
+}
+
+// File assembles a file from top-level blocks.
+type File struct {
+	Major uint16
+	buf   bytes.Buffer
+}
+
+// NewFile returns a file of the given major version holding just the
+// header.
+func NewFile(major uint16) *File {
+	f := &File{Major: major}
+	f.buf.Write(FileMagic)
+	f.buf.Write(LE(major, uint16(0)))
+	return f
+}
+
+// Block appends a top-level block.
+func (f *File) Block(id uint16, payload []byte) *File {
+	f.buf.Write(Block(f.Major, id, payload))
+	return f
+}
+
+// Attrs appends a general image attributes block.
+func (f *File) Attrs(a Attrs) *File {
+	f.buf.Write(AttrsBytes(f.Major, a))
+	return f
+}
+
+// Palette appends a color palette block.
+func (f *File) Palette(p color.Palette) *File {
+	f.buf.Write(PaletteBytes(f.Major, p))
+	return f
+}
+
+// Layers appends a layer bank holding the given layer blocks.
+func (f *File) Layers(layers ...[]byte) *File {
+	return f.Block(LayerStartBlock, bytes.Join(layers, nil))
+}
+
+// Raw appends b as is.
+func (f *File) Raw(b []byte) *File {
+	f.buf.Write(b)
+	return f
+}
+
+// Bytes returns the file so far.
+func (f *File) Bytes() []byte {
+	return f.buf.Bytes()
+}
+
+// Image returns a single-layer file holding m, whose bounds must start at
+// the origin. An *image.Paletted is stored as 8 bit indexed color, an
+// *image.Gray as 8 bit grayscale, an *image.Gray16 as 16 bit grayscale, an
+// *image.RGBA as 24 bit color ignoring its alpha, an *image.NRGBA as 24
+// bit color with a transparency mask, an *image.RGBA64 as 48 bit color
+// ignoring its alpha and an *image.NRGBA64 as 64 bit color with a
+// transparency mask.
+func Image(major, comp uint16, m image.Image) []byte {
+	return ImageDepth(major, comp, 0, m)
+}
+
+// ImageDepth is like Image but stores m with the given bit depth, if not
+// zero: 1, 4 or 8 for an *image.Paletted, whose indices are packed into
+// rows padded to whole bytes, and 24 or 32 for an *image.NRGBA.
+func ImageDepth(major, comp, bitDepth uint16, m image.Image) []byte {
+	r := m.Bounds()
+	a := Attrs{Width: r.Dx(), Height: r.Dy(), Resolution: 72, Metric: 1, Compression: comp, LayerCount: 1}
+	l := Layer{Name: "Background", Type: RasterType(major), Rect: r, Opacity: 255}
+	var palette color.Palette
+	switch m := m.(type) {
+	case *image.Paletted:
+		a.BitDepth = 8
+		palette = m.Palette
+		bits := 8
+		if bitDepth != 0 {
+			bits = int(bitDepth)
+		}
+		l.Channels = []Channel{{DIBImage, ChannelComposite, Pack(m.Pix, r.Dx(), bits)}}
+	case *image.Gray:
+		a.BitDepth = 8
+		a.Grayscale = true
+		l.Channels = []Channel{{DIBImage, ChannelComposite, m.Pix}}
+	case *image.Gray16:
+		a.BitDepth = 16
+		a.Grayscale = true
+		l.Channels = []Channel{{DIBImage, ChannelComposite, Swap16(m.Pix)}}
+	case *image.RGBA:
+		a.BitDepth = 24
+		l.Channels = RGBChannels(m.Pix)
+	case *image.NRGBA:
+		a.BitDepth = 24
+		l.Channels = append(RGBChannels(m.Pix), Channel{DIBTransMask, ChannelComposite, Plane(m.Pix, 4, 3)})
+	case *image.RGBA64:
+		a.BitDepth = 48
+		l.Channels = RGB16Channels(m.Pix)
+	case *image.NRGBA64:
+		a.BitDepth = 64
+		l.Channels = append(RGB16Channels(m.Pix), Channel{DIBTransMask, ChannelComposite, Swap16(Plane16(m.Pix, 4, 3))})
+	default:
+		panic("pspgen: unsupported image type")
+	}
+	if bitDepth != 0 {
+		a.BitDepth = bitDepth
+	}
+	f := NewFile(major).Attrs(a)
+	if palette != nil {
+		f.Palette(palette)
+	}
+	return f.Layers(LayerBytes(major, comp, l)).Bytes()
+}
+
+// Pack packs the bits low bits of each of the samples of rows of w pixels,
+// most significant first, into rows padded to whole bytes. Samples of 8
+// bits or more are returned as they are.
+func Pack(pix []byte, w, bits int) []byte {
+	if bits >= 8 || w == 0 {
+		return pix
+	}
+	stride := (w*bits + 7) / 8
+	p := make([]byte, len(pix)/w*stride)
+	for i, v := range pix {
+		y, x := i/w, i%w
+		shift := 8 - bits - x*bits%8
+		p[y*stride+x*bits/8] |= (v & (1<<bits - 1)) << shift
+	}
+	return p
+}
+
+// RasterType returns the stored type of a raster layer, which is 0 before
+// version 6 and 1 since.
+func RasterType(major uint16) byte {
+	if major >= 6 {
+		return 1
+	}
+	return 0
+}
+
+// RGBChannels splits 32 bit RGBA pixels into red, green and blue
+// channels.
+func RGBChannels(pix []byte) []Channel {
+	chans := make([]Channel, 3)
+	for c := range chans {
+		chans[c] = Channel{DIBImage, uint16(c + 1), Plane(pix, 4, c)}
+	}
+	return chans
+}
+
+// RGB16Channels splits 64 bit RGBA pixels into red, green and blue
+// channels of little-endian 16 bit samples.
+func RGB16Channels(pix []byte) []Channel {
+	chans := make([]Channel, 3)
+	for c := range chans {
+		chans[c] = Channel{DIBImage, uint16(c + 1), Swap16(Plane16(pix, 4, c))}
+	}
+	return chans
+}
+
+// Plane16 is like Plane for 16 bit samples.
+func Plane16(pix []byte, n, c int) []byte {
+	p := make([]byte, 0, len(pix)/n)
+	for i := c * 2; i+1 < len(pix); i += n * 2 {
+		p = append(p, pix[i], pix[i+1])
+	}
+	return p
+}
+
+// Swap16 swaps the bytes of 16 bit samples, converting between the
+// big-endian order of the image package and the little-endian order of
+// the format.
+func Swap16(pix []byte) []byte {
+	p := make([]byte, len(pix))
+	for i := 0; i+1 < len(pix); i += 2 {
+		p[i], p[i+1] = pix[i+1], pix[i]
+	}
+	return p
+}
+
+// Plane returns every sample c of pixels of n samples each.
+func Plane(pix []byte, n, c int) []byte {
+	p := make([]byte, 0, len(pix)/n)
+	for i := c; i < len(pix); i += n {
+		p = append(p, pix[i])
+	}
+	return p
+}
@@ -0,0 +1,146 @@
+package psp
+
+// Adjustment holds the parameters of an adjustment layer.
+type Adjustment interface {
+	Kind() AdjustmentKind
+}
+
+// BrightnessContrast is a brightness/contrast adjustment. Both values range
+// from -100 to 100.
+type BrightnessContrast struct {
+	Brightness int
+	Contrast   int
+}
+
+// Invert is an adjustment that inverts the colors beneath it.
+type Invert struct{}
+
+// Threshold is an adjustment that turns every pixel whose luminance is at
+// least Level white and every other pixel black.
+type Threshold struct {
+	Level int
+}
+
+// Posterize is an adjustment that reduces each channel to Levels levels.
+type Posterize struct {
+	Levels int
+}
+
+// RawAdjustment holds the unparsed parameters of an adjustment this package
+// doesn't interpret, or of one whose parameters are malformed.
+type RawAdjustment struct {
+	Type AdjustmentKind
+	Data []byte
+}
+
+func (*BrightnessContrast) Kind() AdjustmentKind { return AdjustmentBrightnessContrast }
+func (*Invert) Kind() AdjustmentKind             { return AdjustmentInvert }
+func (*Threshold) Kind() AdjustmentKind          { return AdjustmentThreshold }
+func (*Posterize) Kind() AdjustmentKind          { return AdjustmentPosterize }
+func (a *RawAdjustment) Kind() AdjustmentKind    { return a.Type }
+
+// decodeAdjustmentExtension reads an adjustment layer extension block ending
+// at end. The block is small, so it's read whole and parsed from memory which
+// keeps a malformed payload from reading past the block.
+func (d *decoder) decodeAdjustmentExtension(end int64) Adjustment {
+	buf := make([]byte, end-d.offset)
+	d.read(buf)
+	return parseAdjustment(buf)
+}
+
+// parseAdjustment parses the adjustment information chunk holding the
+// adjustment type, followed by a chunk with the type-specific parameters.
+func parseAdjustment(buf []byte) Adjustment {
+	info, rest, ok := splitChunk(buf)
+	if !ok || len(info) < 2 {
+		return &RawAdjustment{Data: buf}
+	}
+	kind := AdjustmentKind(decodeUint16(info))
+	params, _, ok := splitChunk(rest)
+	if !ok {
+		return &RawAdjustment{Type: kind, Data: rest}
+	}
+	switch kind {
+	case AdjustmentBrightnessContrast:
+		if len(params) >= 8 {
+			return &BrightnessContrast{
+				Brightness: int(int32(decodeUint32(params[0:4]))),
+				Contrast:   int(int32(decodeUint32(params[4:8]))),
+			}
+		}
+	case AdjustmentInvert:
+		return &Invert{}
+	case AdjustmentThreshold:
+		if len(params) >= 4 {
+			return &Threshold{Level: int(int32(decodeUint32(params)))}
+		}
+	case AdjustmentPosterize:
+		if len(params) >= 4 {
+			return &Posterize{Levels: int(int32(decodeUint32(params)))}
+		}
+	}
+	return &RawAdjustment{Type: kind, Data: params}
+}
+
+// splitChunk splits a chunk that starts with its own size from buf and
+// returns its contents following the size field along with the rest of buf.
+func splitChunk(buf []byte) (chunk, rest []byte, ok bool) {
+	if len(buf) < 4 {
+		return nil, buf, false
+	}
+	n := decodeUint32(buf)
+	if n < 4 || uint64(n) > uint64(len(buf)) {
+		return nil, buf, false
+	}
+	return buf[4:n], buf[n:], true
+}
+
+// adjustFunc returns a function applying a to a straight 16-bit color, or
+// nil if the adjustment isn't supported.
+func adjustFunc(a Adjustment) func(r, g, b uint32) (uint32, uint32, uint32) {
+	switch a := a.(type) {
+	case *Invert:
+		return func(r, g, b uint32) (uint32, uint32, uint32) {
+			return 0xffff - r, 0xffff - g, 0xffff - b
+		}
+	case *BrightnessContrast:
+		f := func(c uint32) uint32 {
+			v := (float64(c)/0xffff-0.5)*float64(100+a.Contrast)/100 + 0.5 + float64(a.Brightness)/100
+			return clamp16(v * 0xffff)
+		}
+		return func(r, g, b uint32) (uint32, uint32, uint32) {
+			return f(r), f(g), f(b)
+		}
+	case *Threshold:
+		level := uint32(a.Level) * 0x101
+		return func(r, g, b uint32) (uint32, uint32, uint32) {
+			if (19595*r+38470*g+7471*b+1<<15)>>16 >= level {
+				return 0xffff, 0xffff, 0xffff
+			}
+			return 0, 0, 0
+		}
+	case *Posterize:
+		if a.Levels < 2 {
+			return nil
+		}
+		n := float64(a.Levels - 1)
+		f := func(c uint32) uint32 {
+			step := float64(int(float64(c)*n/0xffff + 0.5))
+			return clamp16(step * 0xffff / n)
+		}
+		return func(r, g, b uint32) (uint32, uint32, uint32) {
+			return f(r), f(g), f(b)
+		}
+	}
+	return nil
+}
+
+func clamp16(v float64) uint32 {
+	switch {
+	case v <= 0:
+		return 0
+	case v >= 0xffff:
+		return 0xffff
+	}
+	return uint32(v + 0.5)
+}
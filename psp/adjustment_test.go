@@ -0,0 +1,64 @@
+package psp
+
+import (
+	"bytes"
+	"image"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeAdjustments(t *testing.T) {
+	const major = 7
+	bg := testRGBA(image.Rect(0, 0, 2, 2), 3)
+	adjLayer := func(extra []byte) []byte {
+		return layerBytes(major, CompressionNone, testLayer{
+			layerType: byte(LayerAdjustment),
+			rect:      bg.Rect,
+			opacity:   255,
+			blendMode: byte(BlendAdjust),
+			extra:     [][]byte{extra},
+		})
+	}
+	malformed := blockBytes(major, AdjustmentExtensionBlock, concat(
+		sizedChunk(uint16(AdjustmentThreshold)),
+		uint32Bytes(1000), // parameter chunk claims more than the block holds
+		[]byte{1, 2},
+	))
+	data := newFileBuilder(major).
+		attrs(testAttrs{width: 2, height: 2, bitDepth: 24, layerCount: 7}).
+		block(LayerStartBlock, concat(
+			adjLayer(adjustmentBytes(major, AdjustmentBrightnessContrast, int32(-20), int32(35))),
+			adjLayer(adjustmentBytes(major, AdjustmentInvert)),
+			adjLayer(adjustmentBytes(major, AdjustmentThreshold, int32(128))),
+			adjLayer(adjustmentBytes(major, AdjustmentPosterize, int32(4))),
+			adjLayer(adjustmentBytes(major, AdjustmentCurve, []byte{1, 2, 3})),
+			adjLayer(malformed),
+			layerBytes(major, CompressionNone, testLayer{
+				layerType: byte(LayerRaster),
+				rect:      bg.Rect,
+				channels:  rgbChannels(bg),
+			}),
+		)).
+		bytes()
+	doc, err := DecodeDocument(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Adjustment{
+		&BrightnessContrast{Brightness: -20, Contrast: 35},
+		&Invert{},
+		&Threshold{Level: 128},
+		&Posterize{Levels: 4},
+		&RawAdjustment{Type: AdjustmentCurve, Data: []byte{1, 2, 3}},
+		&RawAdjustment{Type: AdjustmentThreshold, Data: []byte{0xe8, 3, 0, 0, 1, 2}},
+	}
+	for i, w := range want {
+		l := doc.Layers[i]
+		if l.Kind != LayerAdjustment || !reflect.DeepEqual(l.Adjustment, w) {
+			t.Errorf("layer %d: got %s %#v, want %#v", i, l.Kind, l.Adjustment, w)
+		}
+	}
+	if !reflect.DeepEqual(doc.Layers[6].Image, bg) {
+		t.Error("raster layer after adjustment layers was not decoded correctly")
+	}
+}
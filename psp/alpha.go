@@ -0,0 +1,72 @@
+package psp
+
+import "image"
+
+// AlphaChannel is a saved alpha channel (selection) of a document. Mask has
+// bounds equal to the stored area of the channel, which may be smaller than
+// Rect.
+type AlphaChannel struct {
+	Name string
+	Rect image.Rectangle
+	Mask *image.Gray
+}
+
+// decodeAlphaBank reads an alpha bank block ending at end. The bank starts
+// with an information chunk holding the channel count, followed by an alpha
+// channel sub-block for each channel.
+func (d *decoder) decodeAlphaBank(end int64) []AlphaChannel {
+	if d.versionMajor >= 4 {
+		chunkEnd := d.readChunkSize()
+		d.readUint16() // channel count
+		d.skipTo(chunkEnd)
+	} else {
+		d.readUint16()
+	}
+	var channels []AlphaChannel
+	var bh blockHeader
+	for d.offset < end {
+		d.readBlockHeader(&bh)
+		blockEnd := d.offset + int64(bh.dataLen)
+		if bh.id == AlphaChannelBlock {
+			channels = append(channels, d.decodeAlphaChannel(blockEnd))
+		}
+		d.skipTo(blockEnd)
+	}
+	return channels
+}
+
+// decodeAlphaChannel reads an alpha channel block ending at end. Its layout
+// mirrors that of a layer: an information chunk with the name and
+// rectangles, a bitmap information chunk and then the channel sub-blocks.
+func (d *decoder) decodeAlphaChannel(end int64) AlphaChannel {
+	var a AlphaChannel
+	var saved image.Rectangle
+	if d.versionMajor >= 4 {
+		chunkEnd := d.readChunkSize()
+		a.Name, _ = d.readName()
+		a.Rect = d.readRect()
+		saved = d.readRect()
+		d.skipTo(chunkEnd)
+		d.skipTo(d.readChunkSize()) // bitmap and channel counts
+	} else {
+		a.Name, _ = d.readName()
+		a.Rect = d.readRect()
+		saved = d.readRect()
+		d.readUint16() // bitmap count
+		d.readUint16() // channel count
+		d.skipInitialData(d.offset)
+	}
+	var bh blockHeader
+	for d.offset < end {
+		d.readBlockHeader(&bh)
+		blockEnd := d.offset + int64(bh.dataLen)
+		if bh.id == ChannelBlock {
+			compressedLen, bitmapType, _ := d.readChannelHeader()
+			if bitmapType == dibAlphaMask && d.dibs.has(dibAlphaMask) {
+				a.Mask = d.readGrayChannel(saved, compressedLen)
+			}
+		}
+		d.skipTo(blockEnd)
+	}
+	return a
+}
@@ -0,0 +1,43 @@
+package psp
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+func TestDecodeAlphaChannels(t *testing.T) {
+	img := testRGBA(image.Rect(0, 0, 3, 3), 1)
+	alphas := []testAlpha{
+		{name: "Cutout", rect: img.Rect, savedRect: image.Rect(0, 0, 2, 2), data: []byte{0, 255, 255, 0}},
+		{name: "Cutout", rect: img.Rect, savedRect: image.Rect(1, 1, 3, 2), data: []byte{10, 20}},
+		{name: "Sky", rect: img.Rect, savedRect: img.Rect, data: bytes.Repeat([]byte{128}, 9)},
+	}
+	for _, major := range []uint16{3, 5, 7} {
+		for _, comp := range []Compression{CompressionNone, CompressionRLE, CompressionLZ77} {
+			data := newFileBuilder(major).
+				attrs(testAttrs{width: 3, height: 3, bitDepth: 24, comp: comp, layerCount: 1}).
+				block(LayerStartBlock, layerBytes(major, comp, testLayer{
+					layerType: rasterType(major),
+					rect:      img.Rect,
+					channels:  rgbChannels(img),
+				})).
+				block(AlphaBankBlock, alphaBankBytes(major, comp, alphas...)).
+				bytes()
+			doc, err := DecodeDocument(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("v%d %d: %v", major, comp, err)
+			}
+			if len(doc.AlphaChannels) != len(alphas) {
+				t.Fatalf("v%d %d: got %d alpha channels", major, comp, len(doc.AlphaChannels))
+			}
+			for i, want := range alphas {
+				a := doc.AlphaChannels[i]
+				if a.Name != want.name || a.Rect != want.rect || a.Mask == nil ||
+					a.Mask.Rect != want.savedRect || !bytes.Equal(a.Mask.Pix, want.data) {
+					t.Errorf("v%d %d: alpha channel %d = %+v", major, comp, i, a)
+				}
+			}
+		}
+	}
+}
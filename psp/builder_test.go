@@ -0,0 +1,256 @@
+package psp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+
+	"github.com/samuel/go-psp/internal/pspgen"
+)
+
+// fileBuilder assembles synthetic PSP files for tests.
+type fileBuilder struct {
+	major uint16
+	f     *pspgen.File
+}
+
+func newFileBuilder(major uint16) *fileBuilder {
+	return &fileBuilder{major: major, f: pspgen.NewFile(major)}
+}
+
+// block appends a top-level block.
+func (b *fileBuilder) block(id BlockID, payload []byte) *fileBuilder {
+	b.f.Block(uint16(id), payload)
+	return b
+}
+
+func (b *fileBuilder) bytes() []byte {
+	return b.f.Bytes()
+}
+
+type testAttrs struct {
+	width, height int
+	res           float64
+	unit          ResolutionUnit
+	comp          Compression
+	bitDepth      uint16
+	grayscale     bool
+	layerCount    uint16
+	contents      GraphicContents
+}
+
+// attrs appends a general image attributes block.
+func (b *fileBuilder) attrs(a testAttrs) *fileBuilder {
+	b.f.Attrs(pspgen.Attrs{
+		Width:       a.width,
+		Height:      a.height,
+		Resolution:  a.res,
+		Metric:      byte(a.unit),
+		Compression: uint16(a.comp),
+		BitDepth:    a.bitDepth,
+		Grayscale:   a.grayscale,
+		LayerCount:  a.layerCount,
+		Contents:    uint32(a.contents),
+	})
+	return b
+}
+
+func blockBytes(major uint16, id BlockID, payload []byte) []byte {
+	return pspgen.Block(major, uint16(id), payload)
+}
+
+func chunkBytes(keyword uint16, payload []byte) []byte {
+	return pspgen.Chunk(keyword, payload)
+}
+
+func uint32Bytes(v uint32) []byte {
+	return pspgen.LE(v)
+}
+
+func concat(bs ...[]byte) []byte {
+	return bytes.Join(bs, nil)
+}
+
+type testLayer struct {
+	name      string
+	layerType byte
+	rect      image.Rectangle
+	savedRect image.Rectangle // defaults to rect
+	opacity   byte
+	blendMode byte
+	hidden    bool
+	linkGroup byte
+	maskRect  image.Rectangle // saved mask rectangle
+	ranges    []BlendRange
+	channels  []testChannel
+	extra     [][]byte // sub-blocks following the channels
+}
+
+type testChannel struct {
+	bitmap  bitmapType
+	channel channelType
+	data    []byte // uncompressed
+}
+
+func (c testChannel) gen() pspgen.Channel {
+	return pspgen.Channel{Bitmap: uint16(c.bitmap), Channel: uint16(c.channel), Data: c.data}
+}
+
+// layerBytes returns a complete layer sub-block, including its channels
+// compressed with comp.
+func layerBytes(major uint16, comp Compression, l testLayer) []byte {
+	gl := pspgen.Layer{
+		Name:      l.name,
+		Type:      l.layerType,
+		Rect:      l.rect,
+		SavedRect: l.savedRect,
+		Opacity:   l.opacity,
+		BlendMode: l.blendMode,
+		Hidden:    l.hidden,
+		LinkGroup: l.linkGroup,
+		MaskRect:  l.maskRect,
+		Extra:     l.extra,
+	}
+	for _, r := range l.ranges {
+		var b [8]byte
+		copy(b[:4], r.Source[:])
+		copy(b[4:], r.Destination[:])
+		gl.Ranges = append(gl.Ranges, b)
+	}
+	for _, c := range l.channels {
+		gl.Channels = append(gl.Channels, c.gen())
+	}
+	return pspgen.LayerBytes(major, uint16(comp), gl)
+}
+
+func channelBytes(major uint16, comp Compression, c testChannel) []byte {
+	return pspgen.ChannelBytes(major, uint16(comp), c.gen())
+}
+
+// rgbChannels splits img into red, green and blue channels.
+func rgbChannels(img *image.RGBA) []testChannel {
+	chans := make([]testChannel, 3)
+	for c := range chans {
+		chans[c] = testChannel{bitmap: dibImage, channel: channelType(c + 1)}
+		for i := c; i < len(img.Pix); i += 4 {
+			chans[c].data = append(chans[c].data, img.Pix[i])
+		}
+	}
+	return chans
+}
+
+// leBytes encodes values in little-endian order.
+func leBytes(v ...interface{}) []byte {
+	return pspgen.LE(v...)
+}
+
+// sizedChunk prefixes payload with its size, including the size field.
+func sizedChunk(payload ...interface{}) []byte {
+	return pspgen.Sized(payload...)
+}
+
+// shapeBytes returns a shape sub-block with the given definition following
+// the attributes chunk.
+func shapeBytes(major uint16, name string, kind ShapeKind, flags ShapeFlags, def ...[]byte) []byte {
+	attrs := sizedChunk(uint16(len(name)), []byte(name), uint16(kind), uint32(flags))
+	return blockBytes(major, ShapeBlock, concat(append([][]byte{attrs}, def...)...))
+}
+
+func vectorExtensionBytes(major uint16, shapes ...[]byte) []byte {
+	return blockBytes(major, VectorExtensionBlock,
+		concat(append([][]byte{sizedChunk(uint32(len(shapes)))}, shapes...)...))
+}
+
+func adjustmentBytes(major uint16, kind AdjustmentKind, params ...interface{}) []byte {
+	return blockBytes(major, AdjustmentExtensionBlock,
+		concat(sizedChunk(uint16(kind)), sizedChunk(params...)))
+}
+
+func groupExtensionBytes(major uint16, children int) []byte {
+	return blockBytes(major, GroupExtensionBlock, sizedChunk(uint32(children)))
+}
+
+// solidRGBA returns an opaque image of color c covering r.
+func solidRGBA(r image.Rectangle, c color.RGBA) *image.RGBA {
+	img := image.NewRGBA(r)
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	return img
+}
+
+type testAlpha struct {
+	name      string
+	rect      image.Rectangle
+	savedRect image.Rectangle
+	data      []byte
+}
+
+// alphaBankBytes returns an alpha bank block payload.
+func alphaBankBytes(major uint16, comp Compression, channels ...testAlpha) []byte {
+	var p bytes.Buffer
+	w := func(v ...interface{}) {
+		for _, x := range v {
+			binary.Write(&p, binary.LittleEndian, x)
+		}
+	}
+	rect := func(r image.Rectangle) []byte {
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, []int32{int32(r.Min.X), int32(r.Min.Y), int32(r.Max.X), int32(r.Max.Y)})
+		return buf.Bytes()
+	}
+	if major >= 4 {
+		w(sizedChunk(uint16(len(channels))))
+	} else {
+		w(uint16(len(channels)))
+	}
+	for _, a := range channels {
+		var c []byte
+		if major >= 4 {
+			c = concat(
+				sizedChunk(uint16(len(a.name)), []byte(a.name), rect(a.rect), rect(a.savedRect)),
+				sizedChunk(uint16(1), uint16(1)),
+			)
+		} else {
+			name := make([]byte, 256)
+			copy(name, a.name)
+			c = concat(name, rect(a.rect), rect(a.savedRect), []byte{1, 0, 1, 0})
+		}
+		c = concat(c, channelBytes(major, comp, testChannel{bitmap: dibAlphaMask, data: a.data}))
+		w(blockBytes(major, AlphaChannelBlock, c))
+	}
+	return p.Bytes()
+}
+
+func tubeBytes(name string, stepSize, columns, rows, cells int, placement TubePlacement, selection TubeSelection) []byte {
+	n := make([]byte, 513)
+	copy(n, name)
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint16(1))
+	buf.Write(n)
+	binary.Write(&buf, binary.LittleEndian, []uint32{
+		uint32(stepSize), uint32(columns), uint32(rows), uint32(cells),
+		uint32(placement), uint32(selection),
+	})
+	return buf.Bytes()
+}
+
+// tableBytes returns a table sub-block holding the given entry sub-blocks.
+func tableBytes(major uint16, name string, kind TableKind, entries ...[]byte) []byte {
+	info := sizedChunk(uint16(len(name)), []byte(name), uint16(kind), uint16(len(entries)))
+	return blockBytes(major, TableBlock, concat(append([][]byte{info}, entries...)...))
+}
+
+// tableEntryBytes returns a paper or pattern sub-block of a w by h bitmap.
+func tableEntryBytes(major uint16, comp Compression, id BlockID, name string, w, h int, channels ...testChannel) []byte {
+	p := sizedChunk(uint16(len(name)), []byte(name), int32(w), int32(h))
+	for _, c := range channels {
+		p = concat(p, channelBytes(major, comp, c))
+	}
+	return blockBytes(major, id, p)
+}
+
+func tableBankBytes(tables ...[]byte) []byte {
+	return concat(append([][]byte{sizedChunk(uint16(len(tables)))}, tables...)...)
+}
@@ -0,0 +1,123 @@
+package psp
+
+import (
+	"context"
+	"errors"
+	"image"
+	"io"
+)
+
+// DecodeBytes is like Decode for a file held in memory, such as one mapped
+// or fetched whole. Compressed channel data is decompressed where it lies
+// in data rather than being copied out first. Nothing decoded refers to
+// data.
+func DecodeBytes(data []byte) (image.Image, error) {
+	return DecodeBytesWithOptions(data, nil)
+}
+
+// DecodeBytesWithOptions is like DecodeBytes but with the given options. A
+// nil opts gives the defaults of DecodeBytes.
+func DecodeBytesWithOptions(data []byte, opts *Options) (image.Image, error) {
+	return decodeImage(context.Background(), &sliceReader{b: data}, opts)
+}
+
+// DecodeConfigBytes is like DecodeConfig for a file held in memory.
+func DecodeConfigBytes(data []byte) (image.Config, error) {
+	return decodeConfig(context.Background(), &sliceReader{b: data})
+}
+
+// DecodeInfoBytes is like DecodeInfo for a file held in memory.
+func DecodeInfoBytes(data []byte) (*Info, error) {
+	return DecodeInfo(&sliceReader{b: data})
+}
+
+// sliceReader is the input of a decoder reading a file in memory, from
+// which inPlace takes channel data without copying it.
+type sliceReader struct {
+	b   []byte
+	off int
+}
+
+func (s *sliceReader) Read(p []byte) (int, error) {
+	if s.off >= len(s.b) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.b[s.off:])
+	s.off += n
+	return n, nil
+}
+
+func (s *sliceReader) ReadByte() (byte, error) {
+	if s.off >= len(s.b) {
+		return 0, io.EOF
+	}
+	b := s.b[s.off]
+	s.off++
+	return b, nil
+}
+
+func (s *sliceReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("psp: negative offset")
+	}
+	if off >= int64(len(s.b)) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *sliceReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += int64(s.off)
+	case io.SeekEnd:
+		offset += int64(len(s.b))
+	}
+	if offset < 0 {
+		return 0, errors.New("psp: negative position")
+	}
+	s.off = int(offset)
+	return offset, nil
+}
+
+// Len returns the number of bytes left.
+func (s *sliceReader) Len() int { return max(len(s.b)-s.off, 0) }
+
+// Buffered returns the number of bytes left, which can all be read without
+// waiting.
+func (s *sliceReader) Buffered() int { return s.Len() }
+
+func (s *sliceReader) Peek(n int) ([]byte, error) {
+	if n > s.Len() {
+		return s.b[min(s.off, len(s.b)):], io.EOF
+	}
+	return s.b[s.off : s.off+n], nil
+}
+
+func (s *sliceReader) Discard(n int) (int, error) {
+	k := min(n, s.Len())
+	s.off += k
+	if k < n {
+		return k, io.EOF
+	}
+	return k, nil
+}
+
+// inPlace consumes the next n bytes of an input in memory and returns them
+// without copying. It reports false for other inputs and for ones holding
+// fewer bytes, which are left to be read as usual so that they fail as
+// usual.
+func (d *decoder) inPlace(n int) ([]byte, bool) {
+	s, ok := d.r.(*sliceReader)
+	if !ok || n > s.Len() {
+		return nil, false
+	}
+	b := s.b[s.off : s.off+n : s.off+n]
+	s.off += n
+	d.offset += int64(n)
+	return b, true
+}
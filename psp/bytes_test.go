@@ -0,0 +1,78 @@
+package psp
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"reflect"
+	"testing"
+
+	"github.com/samuel/go-psp/internal/pspgen"
+)
+
+func TestDecodeBytes(t *testing.T) {
+	// Decoding through a bytes.Reader is the reference.
+	check := func(name string, data []byte) {
+		t.Helper()
+		for _, opts := range []*Options{nil, {Parallelism: 4}} {
+			got, err := DecodeBytesWithOptions(data, opts)
+			want, werr := DecodeWithOptions(bytes.NewReader(data), opts)
+			if fmt.Sprint(err) != fmt.Sprint(werr) {
+				t.Errorf("%s, %+v: got error %v, want %v", name, opts, err, werr)
+			} else if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s, %+v: image mismatch", name, opts)
+			}
+		}
+		config, err := DecodeConfigBytes(data)
+		wconfig, werr := DecodeConfig(bytes.NewReader(data))
+		if fmt.Sprint(err) != fmt.Sprint(werr) || !reflect.DeepEqual(config, wconfig) {
+			t.Errorf("%s: got config %+v, %v, want %+v, %v", name, config, err, wconfig, werr)
+		}
+		info, err := DecodeInfoBytes(data)
+		winfo, werr := DecodeInfo(bytes.NewReader(data))
+		if fmt.Sprint(err) != fmt.Sprint(werr) || !reflect.DeepEqual(info, winfo) {
+			t.Errorf("%s: got info %+v, %v, want %+v, %v", name, info, err, winfo, werr)
+		}
+	}
+	for _, m := range pspgen.Images() {
+		for comp := pspgen.None; comp <= pspgen.LZ77; comp++ {
+			data := pspgen.Image(5, comp, m)
+			name := fmt.Sprintf("%T, compression %d", m, comp)
+			check(name, data)
+			for n := 0; n < len(data); n += 7 {
+				check(fmt.Sprintf("%s cut to %d bytes", name, n), data[:n])
+				corrupt := bytes.Clone(data)
+				corrupt[n] ^= 0x81
+				check(fmt.Sprintf("%s with byte %d corrupt", name, n), corrupt)
+			}
+		}
+	}
+
+	// Layers decoded by workers read the file in place as well.
+	data, _ := layersDocument(5, 40, CompressionLZ77)
+	check("layers", data)
+}
+
+func BenchmarkDecodeBytes(b *testing.B) {
+	m := benchImage(image.NewRGBA(image.Rect(0, 0, 256, 256)))
+	for _, comp := range []uint16{pspgen.RLE, pspgen.LZ77} {
+		data := pspgen.Image(5, comp, m)
+		for _, bc := range []struct {
+			name   string
+			decode func() (image.Image, error)
+		}{
+			{"Reader", func() (image.Image, error) { return Decode(bytes.NewReader(data)) }},
+			{"Bytes", func() (image.Image, error) { return DecodeBytes(data) }},
+		} {
+			b.Run(fmt.Sprintf("%v/%s", Compression(comp), bc.name), func(b *testing.B) {
+				b.SetBytes(int64(len(data)))
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := bc.decode(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
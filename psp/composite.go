@@ -0,0 +1,419 @@
+package psp
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
+)
+
+// ErrNoThumbnail is returned by DecodeThumbnail for files that don't hold a
+// preview image.
+var ErrNoThumbnail = errors.New("psp: no thumbnail")
+
+// ErrNoComposite is returned by DecodeComposite for an index beyond the
+// composites of the file.
+var ErrNoComposite = errors.New("psp: no such composite")
+
+// ErrNoJPEG is returned by DecodeJPEG for files without a JPEG compressed
+// composite.
+var ErrNoJPEG = errors.New("psp: no JPEG composite")
+
+// A Composite describes one of the composite images a file holds, the
+// full size composite or a reduced thumbnail, from its attributes.
+type Composite struct {
+	Width, Height int
+	BitDepth      uint16
+	Compression   Compression // CompressionJPEG for JPEG data
+	PlaneCount    uint16
+	ColorCount    uint32
+	Thumbnail     bool // a thumbnail rather than the full size composite
+}
+
+// compositeAttrs is the contents of a composite image attributes block.
+type compositeAttrs struct {
+	width, height int
+	bitDepth      uint16
+	comp          Compression
+	planeCount    uint16
+	colorCount    uint32
+	kind          uint16 // compositeImage or compositeThumbnail
+}
+
+func (a compositeAttrs) exported() Composite {
+	return Composite{
+		Width:       a.width,
+		Height:      a.height,
+		BitDepth:    a.bitDepth,
+		Compression: a.comp,
+		PlaneCount:  a.planeCount,
+		ColorCount:  a.colorCount,
+		Thumbnail:   a.kind == compositeThumbnail,
+	}
+}
+
+// DecodeThumbnail returns the preview image stored in the composite image
+// bank of a PSP file, or in the thumbnail block of files before version 4.
+// The thumbnail is preferred over a full size composite if the file holds
+// both.
+func DecodeThumbnail(r io.Reader) (img image.Image, err error) {
+	defer catchErrors(&err)
+	d := newDecoder(r, nil)
+	defer d.release()
+	var bh blockHeader
+	for !d.atEOF() {
+		d.readBlockHeader(&bh)
+		end := d.offset + int64(bh.dataLen)
+		switch {
+		case bh.id == CompositeImageBankBlock:
+			if img := d.decodeCompositeBank(end); img != nil {
+				return img, nil
+			}
+		case bh.id == ThumbnailBlock && d.versionMajor < 4:
+			return d.decodeThumbnailBlock(end), nil
+		}
+		d.skipTo(end)
+	}
+	return nil, ErrNoThumbnail
+}
+
+// DecodeComposite decodes composite image i of a PSP file, in the order
+// of Metadata.Composites. JPEG data is decoded with image/jpeg.
+func DecodeComposite(r io.Reader, i int) (img image.Image, err error) {
+	defer catchErrors(&err)
+	d := newDecoder(r, nil)
+	defer d.release()
+	n := 0
+	var bh blockHeader
+	for !d.atEOF() {
+		d.readBlockHeader(&bh)
+		end := d.offset + int64(bh.dataLen)
+		switch {
+		case bh.id == CompositeImageBankBlock:
+			if img := d.decodeBankComposite(end, i, &n); img != nil {
+				return img, nil
+			}
+		case bh.id == ThumbnailBlock && d.versionMajor < 4:
+			if n == i {
+				return d.decodeThumbnailBlock(end), nil
+			}
+			n++
+		}
+		d.skipTo(end)
+	}
+	return nil, ErrNoComposite
+}
+
+// decodeBankComposite reads a composite image bank block ending at end and
+// returns composite i, counting from *n for the composites of the banks
+// before it, or nil if the bank doesn't hold it.
+func (d *decoder) decodeBankComposite(end int64, i int, n *int) image.Image {
+	chunkEnd := d.readChunkSize()
+	d.readUint32() // composite count
+	d.skipTo(chunkEnd)
+	var a compositeAttrs
+	index := -1
+	var bh blockHeader
+	for d.offset < end {
+		d.readBlockHeader(&bh)
+		blockEnd := d.offset + int64(bh.dataLen)
+		var img image.Image
+		switch bh.id {
+		case CompositeAttributesBlock:
+			a = d.readCompositeAttrs()
+			index = *n
+			*n++
+		case ThumbnailBlock:
+			if index == i {
+				img = d.decodeCompositeImage(a, blockEnd)
+			}
+		case JPEGBlock:
+			if index == i {
+				img = d.decodeJPEGBlock()
+			}
+		}
+		d.skipTo(blockEnd)
+		if img != nil {
+			return img
+		}
+	}
+	return nil
+}
+
+// DecodeJPEG returns the JPEG data of a composite in the composite image
+// bank of a PSP file as stored, without decoding it, and the dimensions
+// given by its attributes. As with DecodeThumbnail, a thumbnail is
+// preferred over a full size composite.
+func DecodeJPEG(r io.Reader) (data []byte, width, height int, err error) {
+	defer catchErrors(&err)
+	d := newDecoder(r, nil)
+	defer d.release()
+	var bh blockHeader
+	for !d.atEOF() {
+		d.readBlockHeader(&bh)
+		end := d.offset + int64(bh.dataLen)
+		if bh.id == CompositeImageBankBlock {
+			if data, a := d.findCompositeJPEG(end); data != nil {
+				return data, a.width, a.height, nil
+			}
+		}
+		d.skipTo(end)
+	}
+	return nil, 0, 0, ErrNoJPEG
+}
+
+// findCompositeJPEG reads a composite image bank block ending at end and
+// returns the JPEG data of its thumbnail, or of its first JPEG composite if
+// the thumbnail isn't one, with the attributes of the composite.
+func (d *decoder) findCompositeJPEG(end int64) ([]byte, compositeAttrs) {
+	chunkEnd := d.readChunkSize()
+	d.readUint32() // composite count
+	d.skipTo(chunkEnd)
+	var a, firstAttrs compositeAttrs
+	var first []byte
+	var bh blockHeader
+	for d.offset < end {
+		d.readBlockHeader(&bh)
+		blockEnd := d.offset + int64(bh.dataLen)
+		var data []byte
+		switch bh.id {
+		case CompositeAttributesBlock:
+			a = d.readCompositeAttrs()
+		case JPEGBlock:
+			data = d.readJPEGBlock()
+		}
+		d.skipTo(blockEnd)
+		if data == nil {
+			continue
+		}
+		if a.kind == compositeThumbnail {
+			return data, a
+		}
+		if first == nil {
+			first, firstAttrs = data, a
+		}
+	}
+	return first, firstAttrs
+}
+
+// readCompositeBankAttrs reads the attributes of the composites of a
+// composite image bank block ending at end, passing over their data.
+func (d *decoder) readCompositeBankAttrs(end int64) []Composite {
+	chunkEnd := d.readChunkSize()
+	d.readUint32() // composite count
+	d.skipTo(chunkEnd)
+	var composites []Composite
+	var bh blockHeader
+	for d.offset < end {
+		d.readBlockHeader(&bh)
+		blockEnd := d.offset + int64(bh.dataLen)
+		if bh.id == CompositeAttributesBlock {
+			composites = append(composites, d.readCompositeAttrs().exported())
+		}
+		d.skipTo(blockEnd)
+	}
+	return composites
+}
+
+// decodeCompositeBank reads a composite image bank block ending at end and
+// returns its thumbnail, or its first composite if there is no thumbnail.
+// The bank starts with an information chunk holding the number of
+// composites, each of which is an attributes sub-block followed by either
+// a composite image or a JPEG sub-block.
+func (d *decoder) decodeCompositeBank(end int64) image.Image {
+	chunkEnd := d.readChunkSize()
+	d.readUint32() // composite count
+	d.skipTo(chunkEnd)
+	var a compositeAttrs
+	var first image.Image
+	var bh blockHeader
+	for d.offset < end {
+		d.readBlockHeader(&bh)
+		blockEnd := d.offset + int64(bh.dataLen)
+		var img image.Image
+		switch bh.id {
+		case CompositeAttributesBlock:
+			a = d.readCompositeAttrs()
+		case ThumbnailBlock: // Composite Image Block since PSP6
+			img = d.decodeCompositeImage(a, blockEnd)
+		case JPEGBlock:
+			img = d.decodeJPEGBlock()
+		}
+		d.skipTo(blockEnd)
+		if img == nil {
+			continue
+		}
+		if a.kind == compositeThumbnail {
+			return img
+		}
+		if first == nil {
+			first = img
+		}
+	}
+	return first
+}
+
+func (d *decoder) readCompositeAttrs() compositeAttrs {
+	chunkEnd := d.readChunkSize()
+	a := compositeAttrs{
+		width:      int(int32(d.readUint32())),
+		height:     int(int32(d.readUint32())),
+		bitDepth:   d.readUint16(),
+		comp:       Compression(d.readUint16()),
+		planeCount: d.readUint16(),
+		colorCount: d.readUint32(),
+		kind:       d.readUint16(),
+	}
+	d.skipTo(chunkEnd)
+	return a
+}
+
+// decodeThumbnailBlock reads a thumbnail block ending at end, which files
+// before version 4 hold in place of a composite image bank. Its fixed
+// fields take the place of the attributes of a composite, and the palette
+// and channel sub-blocks follow as in a composite image block.
+func (d *decoder) decodeThumbnailBlock(end int64) image.Image {
+	return d.decodeCompositeChannels(d.readThumbnailAttrs(), end)
+}
+
+// readThumbnailAttrs reads the fixed fields of a thumbnail block.
+func (d *decoder) readThumbnailAttrs() compositeAttrs {
+	a := compositeAttrs{
+		width:      int(int32(d.readUint32())),
+		height:     int(int32(d.readUint32())),
+		bitDepth:   d.readUint16(),
+		comp:       Compression(d.readUint16()),
+		planeCount: d.readUint16(),
+		colorCount: d.readUint32(),
+		kind:       compositeThumbnail,
+	}
+	d.readUint32() // palette entry count
+	d.skipInitialData(d.offset)
+	return a
+}
+
+// decodeCompositeImage reads a composite image block ending at end. It
+// holds an information chunk with the bitmap and channel counts, an
+// optional palette and the channel sub-blocks.
+func (d *decoder) decodeCompositeImage(a compositeAttrs, end int64) image.Image {
+	chunkEnd := d.readChunkSize()
+	d.readUint16() // bitmap count
+	d.readUint16() // channel count
+	d.skipTo(chunkEnd)
+	return d.decodeCompositeChannels(a, end)
+}
+
+// decodeCompositeChannels reads the palette and channel sub-blocks of a
+// composite image up to end, compressed as given by the attributes rather
+// than the document. 24 bit and 8 bit images are supported.
+func (d *decoder) decodeCompositeChannels(a compositeAttrs, end int64) image.Image {
+	if a.bitDepth != 8 && a.bitDepth != 24 {
+		d.error(UnsupportedError("composite image bit depth"))
+	}
+	switch a.comp {
+	case CompressionNone, CompressionRLE, CompressionLZ77:
+	default:
+		d.error(UnsupportedError("composite image compression " + a.comp.String()))
+	}
+	comp, palette := d.comp, d.palette
+	defer func() { d.comp, d.palette = comp, palette }()
+	d.comp, d.palette = a.comp, nil
+
+	r := image.Rect(0, 0, a.width, a.height)
+	d.checkSize(r.Dx(), r.Dy())
+	var planes [4][]byte // composite, red, green and blue
+	var alpha []byte
+	var bh blockHeader
+	for d.offset < end {
+		d.readBlockHeader(&bh)
+		blockEnd := d.offset + int64(bh.dataLen)
+		switch bh.id {
+		case ColorBlock:
+			d.decodeColorBlock(a.bitDepth)
+		case ChannelBlock:
+			compressedLen, bitmapType, channelType := d.readChannelHeader()
+			if !d.dibs.has(bitmapType) {
+				break
+			}
+			switch bitmapType {
+			case dibComposite, dibThumbnail:
+				if channelType <= channelBlue {
+					planes[channelType] = d.readGrayChannel(r, compressedLen).Pix
+				}
+			case dibCompositeTransMask, dibThumbnailTransMask:
+				alpha = d.readGrayChannel(r, compressedLen).Pix
+			}
+		}
+		d.skipTo(blockEnd)
+	}
+
+	if a.bitDepth == 8 {
+		if planes[channelComposite] == nil {
+			d.error(FormatError("missing composite image channel"))
+		}
+		if d.palette == nil {
+			return &image.Gray{Pix: planes[channelComposite], Stride: r.Dx(), Rect: r}
+		}
+		m := &image.Paletted{Pix: planes[channelComposite], Stride: r.Dx(), Rect: r, Palette: d.palette}
+		d.checkIndices(m)
+		return m
+	}
+	d.allocPixels(r.Dx(), r.Dy())
+	img := image.NewRGBA(r)
+	for c := channelRed; c <= channelBlue; c++ {
+		if planes[c] == nil {
+			d.error(FormatError("missing composite image channel"))
+		}
+		for i, v := range planes[c] {
+			img.Pix[i*4+int(c)-1] = v
+		}
+	}
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 255
+		if alpha != nil {
+			img.Pix[i] = alpha[i/4]
+		}
+	}
+	if alpha != nil {
+		premultiply(img)
+	}
+	return img
+}
+
+// decodeJPEGBlock reads and decodes a JPEG image block.
+func (d *decoder) decodeJPEGBlock() image.Image {
+	img, err := jpeg.Decode(bytes.NewReader(d.readJPEGBlock()))
+	switch err := err.(type) {
+	case nil:
+	case jpeg.FormatError:
+		d.error(FormatError("JPEG data: " + string(err)))
+	case jpeg.UnsupportedError:
+		d.error(UnsupportedError("JPEG data: " + string(err)))
+	default:
+		d.error(err)
+	}
+	return img
+}
+
+// readJPEGBlock reads a JPEG image block and returns its JPEG data. An
+// information chunk with the compressed and uncompressed sizes and the
+// image type is followed by the data.
+func (d *decoder) readJPEGBlock() []byte {
+	chunkEnd := d.readChunkSize()
+	n := int64(d.readUint32()) // compressed size
+	d.readUint32()             // uncompressed size
+	d.readUint16()             // image type
+	d.skipTo(chunkEnd)
+	// The data is read as it arrives rather than trusting n up front.
+	var buf bytes.Buffer
+	m, err := io.CopyN(&buf, d.r, n)
+	d.offset += m
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		d.error(err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,190 @@
+package psp
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeThumbnail(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 40; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(60 + x), uint8(100 + y*2), 90, 255})
+		}
+	}
+	for _, tc := range []struct {
+		name string
+		opts EncodeOptions
+		tol  int
+	}{
+		{"plain", EncodeOptions{Compression: CompressionRLE, ThumbnailSize: 10}, 0},
+		{"jpeg", EncodeOptions{ThumbnailSize: 10, ThumbnailJPEG: true}, 24},
+		{"version 3", EncodeOptions{Version: 3, Compression: CompressionRLE, ThumbnailSize: 10}, 0},
+	} {
+		var buf bytes.Buffer
+		if err := EncodeWithOptions(&buf, img, &tc.opts); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		got, err := Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got.Bounds() != img.Bounds() {
+			t.Errorf("%s: image bounds %v", tc.name, got.Bounds())
+		}
+		thumb, err := DecodeThumbnail(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if thumb.Bounds() != image.Rect(0, 0, 10, 5) {
+			t.Fatalf("%s: thumbnail bounds %v", tc.name, thumb.Bounds())
+		}
+		want := thumbnail(img, 10)
+		for y := 0; y < 5; y++ {
+			for x := 0; x < 10; x++ {
+				r0, g0, b0, _ := want.At(x, y).RGBA()
+				r1, g1, b1, _ := thumb.At(x, y).RGBA()
+				if !near(r0, r1, tc.tol) || !near(g0, g1, tc.tol) || !near(b0, b1, tc.tol) {
+					t.Errorf("%s: pixel %d,%d = %v, want %v", tc.name, x, y, thumb.At(x, y), want.At(x, y))
+				}
+			}
+		}
+	}
+}
+
+func near(a, b uint32, tol int) bool {
+	d := int(a>>8) - int(b>>8)
+	return d >= -tol && d <= tol
+}
+
+func TestThumbnailSize(t *testing.T) {
+	for _, tc := range []struct {
+		r    image.Rectangle
+		size int
+		want image.Rectangle
+	}{
+		{image.Rect(0, 0, 100, 50), 20, image.Rect(0, 0, 20, 10)},
+		{image.Rect(0, 0, 30, 90), 20, image.Rect(0, 0, 6, 20)},
+		{image.Rect(0, 0, 500, 1), 20, image.Rect(0, 0, 20, 1)},
+		{image.Rect(5, 5, 15, 10), 20, image.Rect(0, 0, 10, 5)},
+	} {
+		if got := thumbnail(image.NewRGBA(tc.r), tc.size).Bounds(); got != tc.want {
+			t.Errorf("thumbnail(%v, %d) = %v, want %v", tc.r, tc.size, got, tc.want)
+		}
+	}
+}
+
+func TestDecodeNoThumbnail(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, testRGBA(image.Rect(0, 0, 3, 3), 1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecodeThumbnail(&buf); err != ErrNoThumbnail {
+		t.Errorf("got error %v, want ErrNoThumbnail", err)
+	}
+}
+
+func TestDecodeJPEG(t *testing.T) {
+	img := testRGBA(image.Rect(0, 0, 40, 20), 3)
+	var buf bytes.Buffer
+	if err := EncodeWithOptions(&buf, img, &EncodeOptions{ThumbnailSize: 10, ThumbnailJPEG: true}); err != nil {
+		t.Fatal(err)
+	}
+	data, w, h, err := DecodeJPEG(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w != 10 || h != 5 {
+		t.Errorf("got dimensions %dx%d, want 10x5", w, h)
+	}
+	// The data is passed through as stored.
+	if !bytes.Contains(buf.Bytes(), data) || !bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+		t.Errorf("got %d bytes of data not as stored", len(data))
+	}
+	m, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Bounds() != image.Rect(0, 0, 10, 5) {
+		t.Errorf("got JPEG bounds %v", m.Bounds())
+	}
+
+	buf.Reset()
+	if err := EncodeWithOptions(&buf, img, &EncodeOptions{ThumbnailSize: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := DecodeJPEG(&buf); err != ErrNoJPEG {
+		t.Errorf("got error %v, want ErrNoJPEG", err)
+	}
+}
+
+func TestDecodeComposites(t *testing.T) {
+	full := testRGBA(image.Rect(0, 0, 4, 2), 5)
+	var composite []byte
+	for _, c := range rgbChannels(full) {
+		c.bitmap = dibComposite
+		composite = concat(composite, channelBytes(7, CompressionRLE, c))
+	}
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, testRGBA(image.Rect(0, 0, 2, 1), 6), nil); err != nil {
+		t.Fatal(err)
+	}
+	attrs := func(w, h int, comp Compression, kind uint16) []byte {
+		return blockBytes(7, CompositeAttributesBlock, leBytes(uint32(24), int32(w), int32(h), uint16(24), uint16(comp), uint16(1), uint32(1<<24), kind))
+	}
+	data := newFileBuilder(7).
+		attrs(testAttrs{width: 4, height: 2, bitDepth: 24, layerCount: 1}).
+		block(CompositeImageBankBlock, concat(
+			leBytes(uint32(8), uint32(2)),
+			attrs(4, 2, CompressionRLE, compositeImage),
+			blockBytes(7, ThumbnailBlock, concat(leBytes(uint32(8), uint16(1), uint16(3)), composite)),
+			attrs(2, 1, CompressionJPEG, compositeThumbnail),
+			blockBytes(7, JPEGBlock, concat(leBytes(uint32(14), uint32(jpg.Len()), uint32(6), uint16(0)), jpg.Bytes())),
+		)).
+		block(LayerStartBlock, nil).
+		bytes()
+
+	meta, err := DecodeMetadata(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Composite{
+		{Width: 4, Height: 2, BitDepth: 24, Compression: CompressionRLE, PlaneCount: 1, ColorCount: 1 << 24},
+		{Width: 2, Height: 1, BitDepth: 24, Compression: CompressionJPEG, PlaneCount: 1, ColorCount: 1 << 24, Thumbnail: true},
+	}
+	if !reflect.DeepEqual(meta.Composites, want) {
+		t.Errorf("got composites %+v, want %+v", meta.Composites, want)
+	}
+	img, err := DecodeComposite(bytes.NewReader(data), 0)
+	if err != nil || !reflect.DeepEqual(img, full) {
+		t.Errorf("composite 0: got %v", err)
+	}
+	img, err = DecodeComposite(bytes.NewReader(data), 1)
+	if err != nil || img.Bounds() != image.Rect(0, 0, 2, 1) {
+		t.Errorf("composite 1: got %v", err)
+	}
+	if _, err := DecodeComposite(bytes.NewReader(data), 2); err != ErrNoComposite {
+		t.Errorf("composite 2: got error %v, want ErrNoComposite", err)
+	}
+
+	// The thumbnail block of earlier versions is listed as a composite.
+	var buf bytes.Buffer
+	if err := EncodeWithOptions(&buf, full, &EncodeOptions{Version: 3, Compression: CompressionRLE, ThumbnailSize: 2}); err != nil {
+		t.Fatal(err)
+	}
+	meta, err = DecodeMetadata(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []Composite{{Width: 2, Height: 1, BitDepth: 24, Compression: CompressionRLE, PlaneCount: 1, ColorCount: 1 << 24, Thumbnail: true}}
+	if !reflect.DeepEqual(meta.Composites, want) {
+		t.Errorf("version 3: got composites %+v, want %+v", meta.Composites, want)
+	}
+	if img, err := DecodeComposite(bytes.NewReader(buf.Bytes()), 0); err != nil || img.Bounds() != image.Rect(0, 0, 2, 1) {
+		t.Errorf("version 3: got %v", err)
+	}
+}
@@ -2,76 +2,88 @@ package psp
 
 import "fmt"
 
-// Block identifiers (PSPBlockID)
-type blockID uint16
+// BlockID identifies the type of a block (PSPBlockID)
+type BlockID uint16
 
 const (
-	imageBlock               blockID = iota // General Image Attributes Block (main)
-	creatorBlock                            // Creator Data Block (main)
-	colorBlock                              // Color Palette Block (main and sub)
-	layerStartBlock                         // Layer Bank Block (main)
-	layerBlock                              // Layout Block (sub)
-	channelBlock                            // Channel block (sub)
-	selectionBlock                          // Selection block (main)
-	alphaBankBlock                          // Alpha bank block (main)
-	alphaChannelBlock                       // Alpha Channel Block (sub)
-	thumbnailBlock                          // Thumbnail Block (main)
-	extendedDataBlock                       // Extended Data Block (main)
-	tubeBlock                               // Picture Tube Data Block (main)
-	adjustmentExtensionBlock                // Adjustment Layer Extension Block (sub) (since PSP6
-	vectorExtensionBlock                    // Vector Layer Extension Block (sub) (since PSP6)
-	shapeBlock                              // Vector Shape Block (sub) (since PSP6)
-	paintstyleBlock                         // Paint Style Block (sub) (since PSP6)
-	compositeImageBankBlock                 // Composite Image Bank (main) (since PSP6)
-	compositeAttributesBlock                // Composite Image Attributes (sub) (since PSP6)
-	jpegBlock                               // JPEG Image Block (sub) (since PSP6)
-	linestyleBlock                          // Line Style Block (sub) (since PSP7)
-	tableBankBlock                          // Table Bank Block (main) (since PSP7)
-	tableBlock                              // Table Block (sub) (since PSP7)
-	paperBlock                              // Vector Table Paper Block (sub) (since PSP7)
-	patternBlock                            // Vector Table Pattern Block (sub) (since PSP7)
-	gradientBlock                           // Vector Table Gradient Block (not used) (since PSP8)
-	groupExtensionBlock                     // Group Layer Block (sub) (since PSP8)
-	maskExtensionBlock                      // Mask Layer Block (sub) (since PSP8)
-	brushBlock                              // Brush Data Block (main) (since PSP8)
+	ImageBlock               BlockID = iota // General Image Attributes Block (main)
+	CreatorBlock                            // Creator Data Block (main)
+	ColorBlock                              // Color Palette Block (main and sub)
+	LayerStartBlock                         // Layer Bank Block (main)
+	LayerBlock                              // Layout Block (sub)
+	ChannelBlock                            // Channel block (sub)
+	SelectionBlock                          // Selection block (main)
+	AlphaBankBlock                          // Alpha bank block (main)
+	AlphaChannelBlock                       // Alpha Channel Block (sub)
+	ThumbnailBlock                          // Thumbnail Block (main)
+	ExtendedDataBlock                       // Extended Data Block (main)
+	TubeBlock                               // Picture Tube Data Block (main)
+	AdjustmentExtensionBlock                // Adjustment Layer Extension Block (sub) (since PSP6
+	VectorExtensionBlock                    // Vector Layer Extension Block (sub) (since PSP6)
+	ShapeBlock                              // Vector Shape Block (sub) (since PSP6)
+	PaintstyleBlock                         // Paint Style Block (sub) (since PSP6)
+	CompositeImageBankBlock                 // Composite Image Bank (main) (since PSP6)
+	CompositeAttributesBlock                // Composite Image Attributes (sub) (since PSP6)
+	JPEGBlock                               // JPEG Image Block (sub) (since PSP6)
+	LinestyleBlock                          // Line Style Block (sub) (since PSP7)
+	TableBankBlock                          // Table Bank Block (main) (since PSP7)
+	TableBlock                              // Table Block (sub) (since PSP7)
+	PaperBlock                              // Vector Table Paper Block (sub) (since PSP7)
+	PatternBlock                            // Vector Table Pattern Block (sub) (since PSP7)
+	GradientBlock                           // Vector Table Gradient Block (not used) (since PSP8)
+	GroupExtensionBlock                     // Group Layer Block (sub) (since PSP8)
+	MaskExtensionBlock                      // Mask Layer Block (sub) (since PSP8)
+	BrushBlock                              // Brush Data Block (main) (since PSP8)
+	ArtMediaBlock                           // Art Media Layer Block (main) (since PSP9)
+	ArtMediaMapBlock                        // Art Media Layer map data Block (main) (since PSP9)
+	ArtMediaTileBlock                       // Art Media Layer map tile Block (main) (since PSP9)
+	ArtMediaTextureBlock                    // Art Media Layer map texture Block (main) (since PSP9)
+	ColorProfileBlock                       // ICC Color profile block (main) (since PSP10)
+	RasterExtensionBlock                    // Raster layer extension, name assumed (layer bank) (since PSP X3)
 )
 
-var blockTypes = map[blockID]string{
-	imageBlock:               "imageBlock",
-	creatorBlock:             "creatorBlock",
-	colorBlock:               "colorBlock",
-	layerStartBlock:          "layerStartBlock",
-	layerBlock:               "layerBlock",
-	channelBlock:             "channelBlock",
-	selectionBlock:           "selectionBlock",
-	alphaBankBlock:           "alphaBankBlock",
-	alphaChannelBlock:        "alphaChannelBlock",
-	thumbnailBlock:           "thumbnailBlock",
-	extendedDataBlock:        "extendedDataBlock",
-	tubeBlock:                "tubeBlock",
-	adjustmentExtensionBlock: "adjustmentExtensionBlock",
-	vectorExtensionBlock:     "vectorExtensionBlock",
-	shapeBlock:               "shapeBlock",
-	paintstyleBlock:          "paintstyleBlock",
-	compositeImageBankBlock:  "compositeImageBankBlock",
-	compositeAttributesBlock: "compositeAttributesBlock",
-	jpegBlock:                "jpegBlock",
-	linestyleBlock:           "linestyleBlock",
-	tableBankBlock:           "tableBankBlock",
-	tableBlock:               "tableBlock",
-	paperBlock:               "paperBlock",
-	patternBlock:             "patternBlock",
-	gradientBlock:            "gradientBlock",
-	groupExtensionBlock:      "groupExtensionBlock",
-	maskExtensionBlock:       "maskExtensionBlock",
-	brushBlock:               "brushBlock",
+var blockTypes = map[BlockID]string{
+	ImageBlock:               "ImageBlock",
+	CreatorBlock:             "CreatorBlock",
+	ColorBlock:               "ColorBlock",
+	LayerStartBlock:          "LayerStartBlock",
+	LayerBlock:               "LayerBlock",
+	ChannelBlock:             "ChannelBlock",
+	SelectionBlock:           "SelectionBlock",
+	AlphaBankBlock:           "AlphaBankBlock",
+	AlphaChannelBlock:        "AlphaChannelBlock",
+	ThumbnailBlock:           "ThumbnailBlock",
+	ExtendedDataBlock:        "ExtendedDataBlock",
+	TubeBlock:                "TubeBlock",
+	AdjustmentExtensionBlock: "AdjustmentExtensionBlock",
+	VectorExtensionBlock:     "VectorExtensionBlock",
+	ShapeBlock:               "ShapeBlock",
+	PaintstyleBlock:          "PaintstyleBlock",
+	CompositeImageBankBlock:  "CompositeImageBankBlock",
+	CompositeAttributesBlock: "CompositeAttributesBlock",
+	JPEGBlock:                "JPEGBlock",
+	LinestyleBlock:           "LinestyleBlock",
+	TableBankBlock:           "TableBankBlock",
+	TableBlock:               "TableBlock",
+	PaperBlock:               "PaperBlock",
+	PatternBlock:             "PatternBlock",
+	GradientBlock:            "GradientBlock",
+	GroupExtensionBlock:      "GroupExtensionBlock",
+	MaskExtensionBlock:       "MaskExtensionBlock",
+	BrushBlock:               "BrushBlock",
+	ArtMediaBlock:            "ArtMediaBlock",
+	ArtMediaMapBlock:         "ArtMediaMapBlock",
+	ArtMediaTileBlock:        "ArtMediaTileBlock",
+	ArtMediaTextureBlock:     "ArtMediaTextureBlock",
+	ColorProfileBlock:        "ColorProfileBlock",
+	RasterExtensionBlock:     "RasterExtensionBlock",
 }
 
-func (id blockID) String() string {
+func (id BlockID) String() string {
 	if s := blockTypes[id]; s != "" {
 		return s
 	}
-	return fmt.Sprintf("blockID(%d)", id)
+	return fmt.Sprintf("BlockID(%d)", id)
 }
 
 // Bitmap type (PSPDIBType)
@@ -116,6 +128,33 @@ func (bt bitmapType) String() string {
 	return fmt.Sprintf("bitmapType(%d)", bt)
 }
 
+// DIBTypes is a set of the kinds of bitmap a file stores channels for,
+// with a bit for each bitmap type of the format.
+type DIBTypes uint16
+
+const (
+	DIBImage              DIBTypes = 1 << iota // Layer color bitmap
+	DIBTransMask                               // Layer transparency mask bitmap
+	DIBUserMask                                // Layer user mask bitmap
+	DIBSelection                               // Selection mask bitmap
+	DIBAlphaMask                               // Alpha channel mask bitmap
+	DIBThumbnail                               // Thumbnail bitmap
+	DIBThumbnailTransMask                      // Thumbnail transparency mask (since PSP6)
+	DIBAdjustmentLayer                         // Adjustment layer bitmap (since PSP6)
+	DIBComposite                               // Composite image bitmap (since PSP6)
+	DIBCompositeTransMask                      // Composite image transparency (since PSP6)
+	DIBPaper                                   // Paper bitmap (since PSP7)
+	DIBPattern                                 // Pattern bitmap (since PSP7)
+	DIBPatternTransMask                        // Pattern transparency mask (since PSP7)
+
+	DIBAll = 1<<iota - 1 // Every bitmap type
+)
+
+// has reports whether the set holds the bitmap type bt.
+func (t DIBTypes) has(bt bitmapType) bool {
+	return bt < 16 && t&(1<<bt) != 0
+}
+
 // Channel types (PSPChannelType)
 type channelType uint16
 
@@ -140,44 +179,228 @@ func (ct channelType) String() string {
 	return fmt.Sprintf("channelType(%d)", ct)
 }
 
-// Possible metrics used to measure resolution. (PSP_METRIC)
-type metric byte
+// ResolutionUnit is the unit of the resolution of a document (PSP_METRIC)
+type ResolutionUnit byte
 
 const (
-	metricUndefined metric = iota
-	metricInch
-	metricCentimeters
+	ResolutionUndefined  ResolutionUnit = iota // Metric unknown
+	ResolutionInch                             // Resolution is in inches
+	ResolutionCentimeter                       // Resolution is in centimeters
 )
 
-// Possible types of compression (PSPCompression)
-type compression uint16
+func (u ResolutionUnit) String() string {
+	switch u {
+	case ResolutionUndefined:
+		return "ResolutionUndefined"
+	case ResolutionInch:
+		return "ResolutionInch"
+	case ResolutionCentimeter:
+		return "ResolutionCentimeter"
+	}
+	return fmt.Sprintf("ResolutionUnit(%d)", u)
+}
+
+// Compression is the method used to compress channel data (PSPCompression)
+type Compression uint16
 
 const (
-	compressionNone compression = iota
-	compressionRLE
-	compressionLZ77
+	CompressionNone Compression = iota // No compression
+	CompressionRLE                     // RLE compression
+	CompressionLZ77                    // LZ77 compression
+	CompressionJPEG                    // JPEG compression (only used by thumbnail and composite image) (since PSP6)
 )
 
-// Picture tube placement mode (TubePlacementMode)
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "CompressionNone"
+	case CompressionRLE:
+		return "CompressionRLE"
+	case CompressionLZ77:
+		return "CompressionLZ77"
+	case CompressionJPEG:
+		return "CompressionJPEG"
+	}
+	return fmt.Sprintf("Compression(%d)", c)
+}
+
+// GraphicContents are the flags of the general image attributes telling
+// what a file holds (PSPGraphicContents) (since PSP6)
+type GraphicContents uint32
+
 const (
-	tpmRandom   = iota // Place tube images in random intervals
-	tpmConstant        // Place tube images in constant intervals
+	// Layer types
+	ContentsRasterLayers     GraphicContents = 0x00000001 // At least one raster layer
+	ContentsVectorLayers     GraphicContents = 0x00000002 // At least one vector layer
+	ContentsAdjustmentLayers GraphicContents = 0x00000004 // At least one adjustment layer
+
+	// Additional attributes
+	ContentsThumbnail              GraphicContents = 0x01000000 // Has a thumbnail
+	ContentsThumbnailTransparency  GraphicContents = 0x02000000 // Thumbnail transp.
+	ContentsComposite              GraphicContents = 0x04000000 // Has a composite image
+	ContentsCompositeTransparency  GraphicContents = 0x08000000 // Composite transp.
+	ContentsFlatImage              GraphicContents = 0x10000000 // Just a background
+	ContentsSelection              GraphicContents = 0x20000000 // Has a selection
+	ContentsFloatingSelectionLayer GraphicContents = 0x40000000 // Has float. selection
+	ContentsAlphaChannels          GraphicContents = 0x80000000 // Has alpha channel(s)
 )
 
-// Picture tube selection mode (TubeSelectionMode)
+// HasRasterLayers reports whether the file has at least one raster layer.
+func (gc GraphicContents) HasRasterLayers() bool { return gc&ContentsRasterLayers != 0 }
+
+// HasVectorLayers reports whether the file has at least one vector layer.
+func (gc GraphicContents) HasVectorLayers() bool { return gc&ContentsVectorLayers != 0 }
+
+// HasAdjustmentLayers reports whether the file has at least one adjustment
+// layer.
+func (gc GraphicContents) HasAdjustmentLayers() bool { return gc&ContentsAdjustmentLayers != 0 }
+
+// HasThumbnail reports whether the file has a thumbnail.
+func (gc GraphicContents) HasThumbnail() bool { return gc&ContentsThumbnail != 0 }
+
+// HasComposite reports whether the file has a full size composite image.
+func (gc GraphicContents) HasComposite() bool { return gc&ContentsComposite != 0 }
+
+// IsFlat reports whether the file holds just a background.
+func (gc GraphicContents) IsFlat() bool { return gc&ContentsFlatImage != 0 }
+
+// HasSelection reports whether the file has a selection.
+func (gc GraphicContents) HasSelection() bool { return gc&ContentsSelection != 0 }
+
+// HasFloatingSelection reports whether the file has a floating selection
+// layer.
+func (gc GraphicContents) HasFloatingSelection() bool {
+	return gc&ContentsFloatingSelectionLayer != 0
+}
+
+// HasAlphaChannels reports whether the file has saved alpha channels.
+func (gc GraphicContents) HasAlphaChannels() bool { return gc&ContentsAlphaChannels != 0 }
+
+// Composite image types (PSPCompositeImageType) (since PSP6)
+const (
+	compositeImage     = iota // Composite image
+	compositeThumbnail        // Thumbnail image
+)
+
+// TubePlacement is the placement mode of a picture tube (TubePlacementMode)
+type TubePlacement uint32
+
 const (
-	tsmRandom      = iota // Randomly select the next image in tube to display
-	tsmIncremental        // Select each tube image in turn
-	tsmAngular            // Select image based on cursor direction
-	tsmPressure           // Select image based on pressure (from pressure-sensitive pad)
-	tsmVelocity           // Select image based on cursor speed/* Extended data field types.
+	TubePlacementRandom   TubePlacement = iota // Place tube images in random intervals
+	TubePlacementConstant                      // Place tube images in constant intervals
 )
 
+func (tp TubePlacement) String() string {
+	switch tp {
+	case TubePlacementRandom:
+		return "TubePlacementRandom"
+	case TubePlacementConstant:
+		return "TubePlacementConstant"
+	}
+	return fmt.Sprintf("TubePlacement(%d)", tp)
+}
+
+// TubeSelection is the selection mode of a picture tube (TubeSelectionMode)
+type TubeSelection uint32
+
+const (
+	TubeSelectionRandom      TubeSelection = iota // Randomly select the next image in tube to display
+	TubeSelectionIncremental                      // Select each tube image in turn
+	TubeSelectionAngular                          // Select image based on cursor direction
+	TubeSelectionPressure                         // Select image based on pressure (from pressure-sensitive pad)
+	TubeSelectionVelocity                         // Select image based on cursor speed
+)
+
+func (ts TubeSelection) String() string {
+	switch ts {
+	case TubeSelectionRandom:
+		return "TubeSelectionRandom"
+	case TubeSelectionIncremental:
+		return "TubeSelectionIncremental"
+	case TubeSelectionAngular:
+		return "TubeSelectionAngular"
+	case TubeSelectionPressure:
+		return "TubeSelectionPressure"
+	case TubeSelectionVelocity:
+		return "TubeSelectionVelocity"
+	}
+	return fmt.Sprintf("TubeSelection(%d)", ts)
+}
+
+// TableKind is the type of a table of vector fill resources (PSPTableType)
+// (since PSP7)
+type TableKind uint16
+
+const (
+	TableUndefined TableKind = iota // Undefined table type
+	TableGradient                   // Gradient table type
+	TablePaper                      // Paper table type
+	TablePattern                    // Pattern table type
+)
+
+func (tk TableKind) String() string {
+	switch tk {
+	case TableUndefined:
+		return "TableUndefined"
+	case TableGradient:
+		return "TableGradient"
+	case TablePaper:
+		return "TablePaper"
+	case TablePattern:
+		return "TablePattern"
+	}
+	return fmt.Sprintf("TableKind(%d)", tk)
+}
+
 // Extended data field types (PSPExtendedDataID)
 const (
 	xDataTrnsIndex = iota // Transparency index field
+	xDataGrid             // Image grid information (since PSP7)
+	xDataGuide            // Image guide information (since PSP7)
+	xDataEXIF             // Image Exif information (since PSP8)
+)
+
+// GridUnits is the unit of the grid spacing of a document (PSPGridUnitsType)
+// (since PSP7)
+type GridUnits uint16
+
+const (
+	GridUnitsPixels      GridUnits = iota // Grid units is pixels
+	GridUnitsInches                       // Grid units is inches
+	GridUnitsCentimeters                  // Grid units is centimeters
+)
+
+func (gu GridUnits) String() string {
+	switch gu {
+	case GridUnitsPixels:
+		return "GridUnitsPixels"
+	case GridUnitsInches:
+		return "GridUnitsInches"
+	case GridUnitsCentimeters:
+		return "GridUnitsCentimeters"
+	}
+	return fmt.Sprintf("GridUnits(%d)", gu)
+}
+
+// GuideOrientation is the orientation of an image guide
+// (PSPGuideOrientationType) (since PSP7)
+type GuideOrientation uint16
+
+const (
+	GuideHorizontal GuideOrientation = iota
+	GuideVertical
 )
 
+func (o GuideOrientation) String() string {
+	switch o {
+	case GuideHorizontal:
+		return "GuideHorizontal"
+	case GuideVertical:
+		return "GuideVertical"
+	}
+	return fmt.Sprintf("GuideOrientation(%d)", o)
+}
+
 // Creator field types (PSPCreatorFieldID)
 const (
 	crtrFldTitle   = iota // Image document title field
@@ -190,13 +413,27 @@ const (
 	crtrFldAppVer         // Creating app version field
 )
 
-// Creator application identifiers (PSPCreatorAppID)
+// CreatorApp identifies the application that wrote a file
+// (PSPCreatorAppID). Writers other than Paint Shop Pro store
+// CreatorAppUnknown or leave the field out.
+type CreatorApp uint32
+
 const (
-	creatorAppUnknown      = iota // Creator application unknown
-	creatorAppPaintShopPro        // Creator is Paint Shop Pro
+	CreatorAppUnknown      CreatorApp = iota // Creator application unknown
+	CreatorAppPaintShopPro                   // Creator is Paint Shop Pro
 )
 
-// Layer types (PSPLayerType)
+func (a CreatorApp) String() string {
+	switch a {
+	case CreatorAppUnknown:
+		return "CreatorAppUnknown"
+	case CreatorAppPaintShopPro:
+		return "CreatorAppPaintShopPro"
+	}
+	return fmt.Sprintf("CreatorApp(%d)", a)
+}
+
+// Layer types (PSPLayerTypePSP5)
 type layerType byte
 
 const (
@@ -214,6 +451,38 @@ func (lt layerType) String() string {
 	return fmt.Sprintf("layerType(%d)", lt)
 }
 
+// LayerKind is the kind of a layer. Its values match the layer types used
+// since PSP6 (PSPLayerTypePSP6). Layer types of older files are mapped onto
+// it by the decoder.
+type LayerKind byte
+
+const (
+	LayerUndefined         LayerKind = iota // Undefined layer type
+	LayerRaster                             // Standard raster layer
+	LayerFloatingSelection                  // Floating selection (raster layer)
+	LayerVector                             // Vector layer
+	LayerAdjustment                         // Adjustment layer
+	LayerMask                               // Mask layer (since PSP8)
+)
+
+func (lk LayerKind) String() string {
+	switch lk {
+	case LayerUndefined:
+		return "LayerUndefined"
+	case LayerRaster:
+		return "LayerRaster"
+	case LayerFloatingSelection:
+		return "LayerFloatingSelection"
+	case LayerVector:
+		return "LayerVector"
+	case LayerAdjustment:
+		return "LayerAdjustment"
+	case LayerMask:
+		return "LayerMask"
+	}
+	return fmt.Sprintf("LayerKind(%d)", lk)
+}
+
 // /* Graphic contents flags. (since PSP6)
 //  */
 // typedef enum {
@@ -243,15 +512,6 @@ func (lt layerType) String() string {
 //   keStyleAntiAliased = 0x00000010,      /* Anti­aliased property bit (since PSP8) */
 // } PSPCharacterProperties;
 
-// /* Table type. (since PSP7)
-//  */
-// typedef enum {
-//   keTTUndefined = 0,     /* Undefined table type */
-//   keTTGradientTable,     /* Gradient table type */
-//   keTTPaperTable,        /* Paper table type */
-//   keTTPatternTable       /* Pattern table type */
-// } PSPTableType;
-
 // /* Layer flags. (since PSP6)
 //  */
 // typedef enum {
@@ -259,89 +519,162 @@ func (lt layerType) String() string {
 //   keMaskPresenceFlag = 0x00000002,      /* Layer has a mask */
 // } PSPLayerProperties;
 
-// /* Shape property flags. (since PSP6)
-//  */
-// typedef enum {
-//   keShapeAntiAliased = 0x00000001,      /* Shape is anti­aliased */
-//   keShapeSelected    = 0x00000002,      /* Shape is selected */
-//   keShapeVisible     = 0x00000004,      /* Shape is visible */
-// } PSPShapeProperties;
+// ShapeFlags are the property flags of a vector shape (PSPShapeProperties)
+// (since PSP6)
+type ShapeFlags uint32
 
-// /* Polyline node type flags. (since PSP7)
-//  */
-// typedef enum {
-//   keNodeUnconstrained     = 0x0000,     /* Default node type */
-//   keNodeSmooth            = 0x0001,     /* Node is smooth */
-//   keNodeSymmetric         = 0x0002,     /* Node is symmetric */
-//   keNodeAligned           = 0x0004,     /* Node is aligned */
-//   keNodeActive            = 0x0008,     /* Node is active */
-//   keNodeLocked            = 0x0010,     /* Node is locked */
-//   keNodeSelected          = 0x0020,     /* Node is selected */
-//   keNodeVisible           = 0x0040,     /* Node is visible */
-//   keNodeClosed            = 0x0080,     /* Node is closed */
-
-//   /* TODO: This might be a thinko in the spec document only or in the image
-//    *       format itself. Need to investigate that later
-//    */
-//   keNodeLockedPSP6        = 0x0016,     /* Node is locked */
-//   keNodeSelectedPSP6      = 0x0032,     /* Node is selected */
-//   keNodeVisiblePSP6       = 0x0064,     /* Node is visible */
-//   keNodeClosedPSP6        = 0x0128,     /* Node is closed */
-
-// } PSPPolylineNodeTypes;
-
-// /* Blend modes. (since PSP6)
-//  */
-// typedef enum {
-//   PSP_BLEND_NORMAL,
-//   PSP_BLEND_DARKEN,
-//   PSP_BLEND_LIGHTEN,
-//   PSP_BLEND_HUE,
-//   PSP_BLEND_SATURATION,
-//   PSP_BLEND_COLOR,
-//   PSP_BLEND_LUMINOSITY,
-//   PSP_BLEND_MULTIPLY,
-//   PSP_BLEND_SCREEN,
-//   PSP_BLEND_DISSOLVE,
-//   PSP_BLEND_OVERLAY,
-//   PSP_BLEND_HARD_LIGHT,
-//   PSP_BLEND_SOFT_LIGHT,
-//   PSP_BLEND_DIFFERENCE,
-//   PSP_BLEND_DODGE,
-//   PSP_BLEND_BURN,
-//   PSP_BLEND_EXCLUSION,
-//   PSP_BLEND_TRUE_HUE, /* since PSP8 */
-//   PSP_BLEND_TRUE_SATURATION, /* since PSP8 */
-//   PSP_BLEND_TRUE_COLOR, /* since PSP8 */
-//   PSP_BLEND_TRUE_LIGHTNESS, /* since PSP8 */
-//   PSP_BLEND_ADJUST = 255,
-// } PSPBlendModes;
-
-// /* Adjustment layer types. (since PSP6)
-//  */
-// typedef enum {
-//   keAdjNone = 0,        /* Undefined adjustment layer type */
-//   keAdjLevel,           /* Level adjustment */
-//   keAdjCurve,           /* Curve adjustment */
-//   keAdjBrightContrast,  /* Brightness­contrast adjustment */
-//   keAdjColorBal,        /* Color balance adjustment */
-//   keAdjHSL,             /* HSL adjustment */
-//   keAdjChannelMixer,    /* Channel mixer adjustment */
-//   keAdjInvert,          /* Invert adjustment */
-//   keAdjThreshold,       /* Threshold adjustment */
-//   keAdjPoster           /* Posterize adjustment */
-// } PSPAdjustmentLayerType;
-
-// /* Vector shape types. (since PSP6)
-//  */
-// typedef enum {
-//   keVSTUnknown = 0,     /* Undefined vector type */
-//   keVSTText,            /* Shape represents lines of text */
-//   keVSTPolyline,        /* Shape represents a multiple segment line */
-//   keVSTEllipse,         /* Shape represents an ellipse (or circle) */
-//   keVSTPolygon,         /* Shape represents a closed polygon */
-//   keVSTGroup,           /* Shape represents a group shape (since PSP7) */
-// } PSPVectorShapeType;
+const (
+	ShapeAntiAliased ShapeFlags = 1 << iota // Shape is anti-aliased
+	ShapeSelected                           // Shape is selected
+	ShapeVisible                            // Shape is visible
+)
+
+// NodeFlags are the type flags of a polyline node (PSPPolylineNodeTypes)
+// (since PSP7)
+//
+// The PSP6 specification lists 0x0016, 0x0032, 0x0064 and 0x0128 for the
+// locked, selected, visible and closed flags, which looks like decimal values
+// mistakenly written as hex. Only the PSP7 values are defined here.
+type NodeFlags uint16
+
+const (
+	NodeUnconstrained NodeFlags = 0x0000 // Default node type
+	NodeSmooth        NodeFlags = 0x0001 // Node is smooth
+	NodeSymmetric     NodeFlags = 0x0002 // Node is symmetric
+	NodeAligned       NodeFlags = 0x0004 // Node is aligned
+	NodeActive        NodeFlags = 0x0008 // Node is active
+	NodeLocked        NodeFlags = 0x0010 // Node is locked
+	NodeSelected      NodeFlags = 0x0020 // Node is selected
+	NodeVisible       NodeFlags = 0x0040 // Node is visible
+	NodeClosed        NodeFlags = 0x0080 // Node is closed
+)
+
+// BlendMode is the blending mode of a layer (PSPBlendModes) (since PSP6)
+type BlendMode byte
+
+const (
+	BlendNormal BlendMode = iota
+	BlendDarken
+	BlendLighten
+	BlendHue
+	BlendSaturation
+	BlendColor
+	BlendLuminosity
+	BlendMultiply
+	BlendScreen
+	BlendDissolve
+	BlendOverlay
+	BlendHardLight
+	BlendSoftLight
+	BlendDifference
+	BlendDodge
+	BlendBurn
+	BlendExclusion
+	BlendTrueHue                  // since PSP8
+	BlendTrueSaturation           // since PSP8
+	BlendTrueColor                // since PSP8
+	BlendTrueLightness            // since PSP8
+	BlendAdjust         BlendMode = 255
+)
+
+var blendModes = map[BlendMode]string{
+	BlendNormal:         "BlendNormal",
+	BlendDarken:         "BlendDarken",
+	BlendLighten:        "BlendLighten",
+	BlendHue:            "BlendHue",
+	BlendSaturation:     "BlendSaturation",
+	BlendColor:          "BlendColor",
+	BlendLuminosity:     "BlendLuminosity",
+	BlendMultiply:       "BlendMultiply",
+	BlendScreen:         "BlendScreen",
+	BlendDissolve:       "BlendDissolve",
+	BlendOverlay:        "BlendOverlay",
+	BlendHardLight:      "BlendHardLight",
+	BlendSoftLight:      "BlendSoftLight",
+	BlendDifference:     "BlendDifference",
+	BlendDodge:          "BlendDodge",
+	BlendBurn:           "BlendBurn",
+	BlendExclusion:      "BlendExclusion",
+	BlendTrueHue:        "BlendTrueHue",
+	BlendTrueSaturation: "BlendTrueSaturation",
+	BlendTrueColor:      "BlendTrueColor",
+	BlendTrueLightness:  "BlendTrueLightness",
+	BlendAdjust:         "BlendAdjust",
+}
+
+func (bm BlendMode) String() string {
+	if s := blendModes[bm]; s != "" {
+		return s
+	}
+	return fmt.Sprintf("BlendMode(%d)", bm)
+}
+
+// AdjustmentKind is the type of an adjustment layer (PSPAdjustmentLayerType)
+// (since PSP6)
+type AdjustmentKind uint16
+
+const (
+	AdjustmentNone               AdjustmentKind = iota // Undefined adjustment layer type
+	AdjustmentLevel                                    // Level adjustment
+	AdjustmentCurve                                    // Curve adjustment
+	AdjustmentBrightnessContrast                       // Brightness-contrast adjustment
+	AdjustmentColorBalance                             // Color balance adjustment
+	AdjustmentHSL                                      // HSL adjustment
+	AdjustmentChannelMixer                             // Channel mixer adjustment
+	AdjustmentInvert                                   // Invert adjustment
+	AdjustmentThreshold                                // Threshold adjustment
+	AdjustmentPosterize                                // Posterize adjustment
+)
+
+var adjustmentKinds = map[AdjustmentKind]string{
+	AdjustmentNone:               "AdjustmentNone",
+	AdjustmentLevel:              "AdjustmentLevel",
+	AdjustmentCurve:              "AdjustmentCurve",
+	AdjustmentBrightnessContrast: "AdjustmentBrightnessContrast",
+	AdjustmentColorBalance:       "AdjustmentColorBalance",
+	AdjustmentHSL:                "AdjustmentHSL",
+	AdjustmentChannelMixer:       "AdjustmentChannelMixer",
+	AdjustmentInvert:             "AdjustmentInvert",
+	AdjustmentThreshold:          "AdjustmentThreshold",
+	AdjustmentPosterize:          "AdjustmentPosterize",
+}
+
+func (ak AdjustmentKind) String() string {
+	if s := adjustmentKinds[ak]; s != "" {
+		return s
+	}
+	return fmt.Sprintf("AdjustmentKind(%d)", ak)
+}
+
+// ShapeKind is the type of a vector shape (PSPVectorShapeType) (since PSP6)
+type ShapeKind uint16
+
+const (
+	ShapeUnknown  ShapeKind = iota // Undefined vector type
+	ShapeText                      // Shape represents lines of text
+	ShapePolyline                  // Shape represents a multiple segment line
+	ShapeEllipse                   // Shape represents an ellipse (or circle)
+	ShapePolygon                   // Shape represents a closed polygon
+	ShapeGroup                     // Shape represents a group shape (since PSP7)
+)
+
+func (sk ShapeKind) String() string {
+	switch sk {
+	case ShapeUnknown:
+		return "ShapeUnknown"
+	case ShapeText:
+		return "ShapeText"
+	case ShapePolyline:
+		return "ShapePolyline"
+	case ShapeEllipse:
+		return "ShapeEllipse"
+	case ShapePolygon:
+		return "ShapePolygon"
+	case ShapeGroup:
+		return "ShapeGroup"
+	}
+	return fmt.Sprintf("ShapeKind(%d)", sk)
+}
 
 // /* Text element types. (since PSP6)
 //  */
@@ -437,15 +770,6 @@ func (lt layerType) String() string {
 //   PSP_METRIC_CM                 /* Resolution is in centimeters */
 // } PSP_METRIC;
 
-// /* Possible types of compression.
-//  */
-// typedef enum {
-//   PSP_COMP_NONE = 0,            /* No compression */
-//   PSP_COMP_RLE,                 /* RLE compression */
-//   PSP_COMP_LZ77,                /* LZ77 compression */
-//   PSP_COMP_JPEG                 /* JPEG compression (only used by thumbnail and composite image) (since PSP6) */
-// } PSPCompression;
-
 // /* Picture tube placement mode.
 //  */
 // typedef enum {
@@ -465,15 +789,6 @@ func (lt layerType) String() string {
 //   tsmVelocity                   /* Select image based on cursor speed */
 // } TubeSelectionMode;
 
-// /* Extended data field types.
-//  */
-// typedef enum {
-//   PSP_XDATA_TRNS_INDEX = 0,     /* Transparency index field */
-//   PSP_XDATA_GRID,               /* Image grid information (since PSP7) */
-//   PSP_XDATA_GUIDE,              /* Image guide information (since PSP7) */
-//   PSP_XDATA_EXIF,               /* Image Exif information (since PSP8) */
-// } PSPExtendedDataID;
-
 // /* Creator field types.
 //  */
 // typedef enum {
@@ -487,21 +802,6 @@ func (lt layerType) String() string {
 //   PSP_CRTR_FLD_APP_VER          /* Creating app version field */
 // } PSPCreatorFieldID;
 
-// /* Grid units type. (since PSP7)
-//  */
-// typedef enum {
-//   keGridUnitsPixels = 0,        /* Grid units is pixels */
-//   keGridUnitsInches,            /* Grid units is inches */
-//   keGridUnitsCentimeters        /* Grid units is centimeters */
-// } PSPGridUnitsType;
-
-// /* Guide orientation type. (since PSP7)
-//  */
-// typedef enum  {
-//   keHorizontalGuide = 0,
-//   keVerticalGuide
-// } PSPGuideOrientationType;
-
 // /* Creator application identifiers.
 //  */
 // typedef enum {
@@ -515,14 +815,3 @@ func (lt layerType) String() string {
 //   PSP_LAYER_NORMAL = 0,         /* Normal layer */
 //   PSP_LAYER_FLOATING_SELECTION  /* Floating selection layer */
 // } PSPLayerTypePSP5;
-
-// /* Layer types. (since PSP6)
-//  */
-// typedef enum {
-//   keGLTUndefined = 0,           /* Undefined layer type */
-//   keGLTRaster,                  /* Standard raster layer */
-//   keGLTFloatingRasterSelection, /* Floating selection (raster layer) */
-//   keGLTVector,                  /* Vector layer */
-//   keGLTAdjustment,              /* Adjustment layer */
-//   keGLTMask                     /* Mask layer (since PSP8) */
-// } PSPLayerTypePSP6;
@@ -0,0 +1,100 @@
+package psp
+
+import "testing"
+
+func TestBlendModeString(t *testing.T) {
+	cases := []struct {
+		mode BlendMode
+		want string
+	}{
+		{BlendNormal, "BlendNormal"},
+		{BlendDarken, "BlendDarken"},
+		{BlendLighten, "BlendLighten"},
+		{BlendHue, "BlendHue"},
+		{BlendSaturation, "BlendSaturation"},
+		{BlendColor, "BlendColor"},
+		{BlendLuminosity, "BlendLuminosity"},
+		{BlendMultiply, "BlendMultiply"},
+		{BlendScreen, "BlendScreen"},
+		{BlendDissolve, "BlendDissolve"},
+		{BlendOverlay, "BlendOverlay"},
+		{BlendHardLight, "BlendHardLight"},
+		{BlendSoftLight, "BlendSoftLight"},
+		{BlendDifference, "BlendDifference"},
+		{BlendDodge, "BlendDodge"},
+		{BlendBurn, "BlendBurn"},
+		{BlendExclusion, "BlendExclusion"},
+		{BlendTrueHue, "BlendTrueHue"},
+		{BlendTrueSaturation, "BlendTrueSaturation"},
+		{BlendTrueColor, "BlendTrueColor"},
+		{BlendTrueLightness, "BlendTrueLightness"},
+		{BlendAdjust, "BlendAdjust"},
+		{21, "BlendMode(21)"},
+		{254, "BlendMode(254)"},
+	}
+	for _, c := range cases {
+		if got := c.mode.String(); got != c.want {
+			t.Errorf("BlendMode(%d).String() = %q, want %q", byte(c.mode), got, c.want)
+		}
+	}
+	if BlendTrueLightness != 20 || BlendAdjust != 255 {
+		t.Errorf("unexpected blend mode values %d, %d", BlendTrueLightness, BlendAdjust)
+	}
+}
+
+func TestTableKindString(t *testing.T) {
+	cases := map[TableKind]string{
+		TableUndefined: "TableUndefined",
+		TableGradient:  "TableGradient",
+		TablePaper:     "TablePaper",
+		TablePattern:   "TablePattern",
+		4:              "TableKind(4)",
+	}
+	for k, want := range cases {
+		if got := k.String(); got != want {
+			t.Errorf("TableKind(%d).String() = %q, want %q", uint16(k), got, want)
+		}
+	}
+}
+
+func TestGridUnitsString(t *testing.T) {
+	cases := map[GridUnits]string{
+		GridUnitsPixels:      "GridUnitsPixels",
+		GridUnitsInches:      "GridUnitsInches",
+		GridUnitsCentimeters: "GridUnitsCentimeters",
+		3:                    "GridUnits(3)",
+	}
+	for u, want := range cases {
+		if got := u.String(); got != want {
+			t.Errorf("GridUnits(%d).String() = %q, want %q", uint16(u), got, want)
+		}
+	}
+}
+
+func TestGuideOrientationString(t *testing.T) {
+	cases := map[GuideOrientation]string{
+		GuideHorizontal: "GuideHorizontal",
+		GuideVertical:   "GuideVertical",
+		2:               "GuideOrientation(2)",
+	}
+	for o, want := range cases {
+		if got := o.String(); got != want {
+			t.Errorf("GuideOrientation(%d).String() = %q, want %q", uint16(o), got, want)
+		}
+	}
+}
+
+func TestCompressionString(t *testing.T) {
+	cases := map[Compression]string{
+		CompressionNone: "CompressionNone",
+		CompressionRLE:  "CompressionRLE",
+		CompressionLZ77: "CompressionLZ77",
+		CompressionJPEG: "CompressionJPEG",
+		4:               "Compression(4)",
+	}
+	for c, want := range cases {
+		if got := c.String(); got != want {
+			t.Errorf("Compression(%d).String() = %q, want %q", uint16(c), got, want)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package psp
+
+import (
+	"context"
+	"image"
+	"io"
+)
+
+// A ContextError reports that decoding stopped because its context was
+// done. Err is the error of the context.
+type ContextError struct {
+	Err error
+}
+
+func (e ContextError) Error() string {
+	return "psp: decoding stopped: " + e.Err.Error()
+}
+
+func (e ContextError) Unwrap() error {
+	return e.Err
+}
+
+// DecodeContext is like Decode but stops with a ContextError once ctx is
+// done. The context is checked at every block and channel and whenever
+// more input is read.
+func DecodeContext(ctx context.Context, r io.Reader) (image.Image, error) {
+	return decodeImage(ctx, r, nil)
+}
+
+// DecodeConfigContext is like DecodeConfig but stops with a ContextError
+// once ctx is done.
+func DecodeConfigContext(ctx context.Context, r io.Reader) (image.Config, error) {
+	return decodeConfig(ctx, r)
+}
+
+func (d *decoder) checkContext() {
+	if d.ctx == nil {
+		return
+	}
+	if err := d.ctx.Err(); err != nil {
+		d.error(ContextError{err})
+	}
+}
+
+// contextReadSize bounds the reads of a contextReader, so that large
+// channels are read in several steps with a check of the context each.
+const contextReadSize = 32 << 10
+
+// contextReader fails reads once its context is done, so that decoding
+// stops even within large channels.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, ContextError{err}
+	}
+	if len(p) > contextReadSize {
+		p = p[:contextReadSize]
+	}
+	return r.r.Read(p)
+}
@@ -0,0 +1,60 @@
+package psp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"io"
+	"testing"
+)
+
+// cancelReader cancels a context once n bytes have been read through it.
+type cancelReader struct {
+	r      io.Reader
+	n      int
+	read   int
+	cancel context.CancelFunc
+}
+
+func (r *cancelReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.read += n
+	if r.read >= r.n {
+		r.cancel()
+	}
+	return n, err
+}
+
+func TestDecodeContext(t *testing.T) {
+	var buf bytes.Buffer
+	err := EncodeWithOptions(&buf, testRGBA(image.Rect(0, 0, 1000, 1000), 0), &EncodeOptions{Compression: CompressionNone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := DecodeContext(ctx, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecodeConfigContext(ctx, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, err := DecodeConfigContext(ctx, bytes.NewReader(data)); !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want context.Canceled", err)
+	}
+
+	// Decoding stops within a channel soon after the cancellation.
+	ctx, cancel = context.WithCancel(context.Background())
+	r := &cancelReader{r: bytes.NewReader(data), n: len(data) / 4, cancel: cancel}
+	img, err := DecodeContext(ctx, r)
+	var cerr ContextError
+	if !errors.As(err, &cerr) || cerr.Err != context.Canceled || img != nil {
+		t.Fatalf("got error %v, want a ContextError", err)
+	}
+	if r.read > r.n+64<<10 {
+		t.Errorf("read %d bytes after cancelling at %d", r.read-r.n, r.n)
+	}
+}
@@ -1,4 +1,4 @@
-// Package psp implements a Paint Shop Pro image decoder.
+// Package psp implements a Paint Shop Pro image decoder and encoder.
 package psp
 
 // https://github.com/GNOME/gimp/blob/2275d4b257e9de36f1ac749e591378e58b348754/plug-ins/common/file-psp.c
@@ -6,7 +6,7 @@ package psp
 import (
 	"bufio"
 	"bytes"
-	"compress/zlib"
+	"context"
 	"encoding/hex"
 	"fmt"
 	"image"
@@ -15,6 +15,8 @@ import (
 	"math"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,14 +27,12 @@ var (
 )
 
 type decoder struct {
-	r              *bufio.Reader
+	r              input
 	versionMinor   uint16
 	versionMajor   uint16
 	width          int
 	height         int
-	res            float64
-	resMetric      metric
-	comp           compression
+	comp           Compression
 	colorModel     color.Model
 	bitDepth       uint16
 	planeCount     uint16
@@ -41,16 +41,49 @@ type decoder struct {
 	totalImageSize uint32
 	activeLayer    int32
 	layerCount     uint16
-	xDataTrnsIndex uint16
-	creator        creator
+	contents       GraphicContents
+	layerBankEnd   int64 // offset of the end of the layer bank block
+	xDataTrnsIndex int   // transparent palette index, or -1
+	meta           Metadata
 	palette        color.Palette
+	alphaChannels  []AlphaChannel
+	tables         []Table
+	decodeBanks    bool // decode the table and alpha banks instead of skipping them
+	ctx            context.Context
+	opts           *Options
+	limits         limits
+	pixels         *atomic.Int64 // of the bitmaps allocated, shared with layer workers
+	dibs           DIBTypes      // kinds of bitmap decoded
+	features       Features      // of the blocks read
+	layer          int           // index of the layer being decoded, or -1
+	channel        int           // index of the channel within the layer, or -1
+	blocks         []openBlock
 	tmpBuf         []byte
+	scratch        *scratch      // pooled buffers and decompressors
+	lr             *limitedInput // channel data being decompressed
+	zlibReader     io.ReadCloser // reused for LZ77 channel data
+	flateReader    io.ReadCloser // reused for raw deflate channel data
+	pending        []channelJob  // channels of the layer left to decompress
+	rows           rowFunc       // if not nil, streams the first color layer for DecodeRows
+	rowsDone       bool          // rows has been given every row of the layer
+	offset         int64         // number of bytes consumed from r
+	inputEnd       int64         // offset of the end of the input, or -1 if unknown
+	seeker         io.ReadSeeker // if not nil, the input, which skip seeks
+	readerAt       readSeekerAt  // the input, if it can be read at any offset, or nil
+	base           int64         // position of the start of the file in seeker and readerAt
+}
+
+// readSeekerAt is an input that parts can be read from independently of
+// each other, such as an *os.File or *bytes.Reader.
+type readSeekerAt interface {
+	io.ReadSeeker
+	io.ReaderAt
 }
 
 type blockHeader struct {
-	id      blockID
+	id      BlockID
 	dataLen uint32
-	initLen uint32 // Only for major ver <= 3
+	initLen uint32 // Only for major ver <= 3, the length of the fixed fields
 }
 
 type chunkHeader struct {
@@ -58,37 +91,6 @@ type chunkHeader struct {
 	dataLen      uint32
 }
 
-type creator struct {
-	title            string
-	creationDate     time.Time
-	modificationDate time.Time
-	artist           string
-	copyright        string
-	description      string
-	appID            uint32
-	appVersion       uint32
-}
-
-type layer struct {
-	name                  string
-	layerType             layerType
-	rect                  image.Rectangle
-	savedRect             image.Rectangle
-	opacity               byte
-	blendingMode          byte
-	visible               bool
-	transparencyProtected bool
-	linkGroupID           byte
-	maskRectangle         image.Rectangle
-	savedMaskRectangle    image.Rectangle
-	maskLinked            bool
-	maskDisabled          bool
-	invertMaskOnBlend     bool
-	blendRangeCount       uint16
-	bitmapCount           uint16
-	channelCount          uint16
-}
-
 // A FormatError reports that the input is not a valid PCX.
 type FormatError string
 
@@ -103,23 +105,277 @@ func (e UnsupportedError) Error() string {
 	return "psp: unsupported variant: " + string(e)
 }
 
+// A DecodeError records where in the input decoding failed. It wraps the
+// underlying error, such as a FormatError, UnsupportedError, LimitError or
+// io.ErrUnexpectedEOF, for use with errors.Is and errors.As.
+type DecodeError struct {
+	Offset  int64  // offset in the input at which the error was found
+	Block   string // innermost enclosing block, or "" outside of blocks
+	Layer   int    // index of the layer being decoded, or -1
+	Channel int    // index of the channel within the layer, or -1
+	Err     error
+}
+
+func (e *DecodeError) Error() string {
+	where := fmt.Sprintf("offset %d", e.Offset)
+	if e.Block != "" {
+		where += " in " + e.Block
+	}
+	if e.Layer >= 0 {
+		where += fmt.Sprintf(", layer %d", e.Layer)
+	}
+	if e.Channel >= 0 {
+		where += fmt.Sprintf(", channel %d", e.Channel)
+	}
+	return e.Err.Error() + " (" + where + ")"
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// openBlock is a block whose contents are being read.
+type openBlock struct {
+	id   BlockID
+	end  int64
+	init int64 // end of the initial data of a version 3 block, else zero
+}
+
+// A LimitError reports that the input exceeds one of the resource limits
+// of Options. Limit is the name of the exceeded Options field.
+type LimitError struct {
+	Limit string
+	Value int
+	Max   int
+}
+
+func (e LimitError) Error() string {
+	return fmt.Sprintf("psp: %s limit %d exceeded: %d", e.Limit, e.Max, e.Value)
+}
+
 func init() {
 	image.RegisterFormat("psp", string(fileMagic), Decode, DecodeConfig)
 }
 
 // Decode reads a PSP image from r and returns it as an image.Image.
-// The type of Image returned depends on the PSP contents.
-func Decode(r io.Reader) (img image.Image, err error) {
+// The type of Image returned depends on the PSP contents. The image is that
+// of the first layer holding color data.
+//
+// Color layers are returned as *image.RGBA, or *image.RGBA64 for 16 bits
+// per channel, like the decoders of the standard library, whose images
+// draw fastest. A transparency mask is stored as straight alpha, so the
+// colors are premultiplied by it, which loses precision where a layer is
+// nearly transparent. Options.NonPremultiplied keeps the stored values.
+//
+// Indexed layers, of 1, 4 or 8 bits per pixel, are returned as
+// *image.Paletted with the palette of the file, which for 1 bit images
+// takes precedence over the grayscale flag. 1 bit images without one are
+// black and white, in color.Gray for grayscale images. A palette that some
+// pixels index beyond is extended with opaque black, a problem reported to
+// Options.Warn. The palettes of images of other bit depths are ignored
+// with a warning.
+func Decode(r io.Reader) (image.Image, error) {
+	return DecodeWithOptions(r, nil)
+}
+
+// DecodeWithOptions is like Decode but with the given options. A nil opts
+// gives the defaults of Decode.
+func DecodeWithOptions(r io.Reader, opts *Options) (image.Image, error) {
+	return decodeImage(context.Background(), r, opts)
+}
+
+func decodeImage(ctx context.Context, r io.Reader, opts *Options) (img image.Image, err error) {
 	defer catchErrors(&err)
-	d := newDecoder(r)
+	d := newContextDecoder(ctx, r, opts)
+	defer d.release()
+	d.checkSize(d.width, d.height)
+	if opts != nil && opts.Flatten {
+		if !d.decodeMetadataBlocks() {
+			d.error(FormatError("missing layer bank block"))
+		}
+		doc := &Document{
+			Width:      d.width,
+			Height:     d.height,
+			ColorModel: d.colorModel,
+			Layers:     d.decodeLayers(),
+		}
+		return doc.Flatten(opts), nil
+	}
 	return d.decode(), nil
 }
 
+// DecodeWithMetadata reads a PSP image from r and returns it along with the
+// document metadata stored in the file.
+func DecodeWithMetadata(r io.Reader) (img image.Image, meta *Metadata, err error) {
+	defer catchErrors(&err)
+	d := newDecoder(r, nil)
+	defer d.release()
+	d.checkSize(d.width, d.height)
+	img = d.decode()
+	d.decodeTrailingBlocks()
+	return img, &d.meta, nil
+}
+
+// DecodeDocument reads a PSP file from r and returns all of its layers along
+// with the document metadata.
+func DecodeDocument(r io.Reader) (doc *Document, err error) {
+	return DecodeDocumentWithOptions(r, nil)
+}
+
+// DecodeDocumentWithOptions is like DecodeDocument but with the given
+// options. A nil opts gives the defaults of DecodeDocument.
+func DecodeDocumentWithOptions(r io.Reader, opts *Options) (doc *Document, err error) {
+	defer catchErrors(&err)
+	d := newDecoder(r, opts)
+	defer d.release()
+	d.checkSize(d.width, d.height)
+	d.decodeBanks = true
+	if !d.decodeMetadataBlocks() {
+		d.error(FormatError("missing layer bank block"))
+	}
+	doc = &Document{
+		Width:      d.width,
+		Height:     d.height,
+		ColorModel: d.colorModel,
+		Layers:     d.decodeLayers(),
+	}
+	d.decodeTrailingBlocks()
+	doc.Root = layerTree(doc.Layers)
+	doc.Metadata = d.meta
+	doc.AlphaChannels = d.alphaChannels
+	doc.Tables = d.tables
+	doc.Features = contentsFeatures(d.contents) | d.features | documentFeatures(doc.Layers, d.meta.Composites)
+	return doc, nil
+}
+
+// DecodeMetadata returns the document metadata of a PSP image without
+// decoding any pixel data. The layer bank is skipped as a whole and the
+// blocks after it are read as well.
+func DecodeMetadata(r io.Reader) (meta *Metadata, err error) {
+	defer catchErrors(&err)
+	d := newDecoder(r, nil)
+	defer d.release()
+	if d.decodeMetadataBlocks() {
+		d.skipTo(d.layerBankEnd)
+		d.decodeTrailingBlocks()
+	}
+	return &d.meta, nil
+}
+
 // DecodeConfig returns the color model and dimensions of a PSP image
 // without decoding the entire image.
-func DecodeConfig(r io.Reader) (config image.Config, err error) {
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	return decodeConfig(context.Background(), r)
+}
+
+// decodeConfig reads no more than the file header and general image
+// attributes block of r, and takes the fields it needs from them without
+// setting up a decoder. Indexed images, whose color model is their
+// palette, and input that is not valid are left to a decoder, so that the
+// errors are those of decoding.
+func decodeConfig(ctx context.Context, r io.Reader) (image.Config, error) {
+	inputEnd := remaining(r)
+	if ctx.Done() != nil {
+		r = &contextReader{ctx, r}
+	}
+	buf := make([]byte, 36+14+64)
+	hdr, err := readFileHeader(r, buf)
+	if err == nil {
+		if config, ok := parseConfig(hdr, inputEnd); ok {
+			return config, nil
+		}
+	}
+	// The decoder reads again what was read, and fails where reading did.
+	rest := r
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		rest = failingReader{err}
+	}
+	return decodeConfigSlow(ctx, io.MultiReader(bytes.NewReader(hdr), rest), inputEnd)
+}
+
+// readFileHeader reads the file header and general image attributes block
+// of r into buf, which is large enough for both, and returns what it read.
+// It stops early where they are not valid.
+func readFileHeader(r io.Reader, buf []byte) ([]byte, error) {
+	n, err := io.ReadFull(r, buf[:36])
+	if err != nil || !bytes.Equal(buf[:32], fileMagic) {
+		return buf[:n], err
+	}
+	bhLen := 14
+	if decodeUint16(buf[32:34]) > 3 {
+		bhLen = 10
+	}
+	m, err := io.ReadFull(r, buf[n:n+bhLen])
+	n += m
+	if err != nil {
+		return buf[:n], err
+	}
+	bh := buf[n-bhLen : n]
+	dataLen := decodeUint32(bh[bhLen-4:])
+	if !bytes.Equal(bh[:4], blockMagic) || BlockID(decodeUint16(bh[4:6])) != ImageBlock || dataLen < 38 || dataLen > 64 {
+		return buf[:n], nil
+	}
+	m, err = io.ReadFull(r, buf[n:n+int(dataLen)])
+	return buf[:n+m], err
+}
+
+// parseConfig returns the configuration of an image with the file header
+// and general image attributes block hdr, if they pass the checks of the
+// decoder.
+func parseConfig(hdr []byte, inputEnd int64) (image.Config, bool) {
+	major := decodeUint16(hdr[32:34])
+	bhLen := 14
+	if major > 3 {
+		bhLen = 10
+	}
+	if major < 1 || len(hdr) < 36+bhLen || inputEnd >= 0 && int64(len(hdr)) > inputEnd {
+		return image.Config{}, false
+	}
+	buf := hdr[36+bhLen:]
+	if len(buf) < 38 {
+		return image.Config{}, false
+	}
+	if major >= 4 {
+		buf = buf[4:]
+	}
+	width := int(int32(decodeUint32(buf[0:4])))
+	height := int(int32(decodeUint32(buf[4:8])))
+	comp := Compression(decodeUint16(buf[17:19]))
+	bitDepth := decodeUint16(buf[19:21])
+	grayscale := buf[27] == 1
+	if width <= 0 || height <= 0 || comp > CompressionLZ77 || indexed(bitDepth, grayscale) {
+		return image.Config{}, false
+	}
+	model, err := imageColorModel(bitDepth, grayscale)
+	if err != nil {
+		return image.Config{}, false
+	}
+	return image.Config{ColorModel: model, Width: width, Height: height}, true
+}
+
+// failingReader fails with err, as an earlier read of the input did.
+type failingReader struct {
+	err error
+}
+
+func (r failingReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+func decodeConfigSlow(ctx context.Context, r io.Reader, inputEnd int64) (config image.Config, err error) {
 	defer catchErrors(&err)
-	d := newDecoder(r)
+	d := newRawDecoder(ctx, r, nil)
+	defer d.release()
+	d.inputEnd = inputEnd
+	d.readHeader()
+	if indexed(d.bitDepth, d.grayscale) {
+		// The palette is the color model of indexed images, so read on to
+		// the color palette block ahead of the layers.
+		d.decodeMetadataBlocks()
+		if d.palette != nil {
+			d.colorModel = d.layerPalette()
+		}
+	}
 	return image.Config{
 		ColorModel: d.colorModel,
 		Width:      d.width,
@@ -127,59 +383,365 @@ func DecodeConfig(r io.Reader) (config image.Config, err error) {
 	}, nil
 }
 
+// catchErrors recovers the panics of decoding into *err. Runtime errors are
+// bugs and keep panicking; other values, such as those a panicking reader
+// passes to panic, become errors.
 func catchErrors(err *error) {
 	if r := recover(); r != nil {
-		if _, ok := r.(runtime.Error); ok {
+		switch r := r.(type) {
+		case runtime.Error:
 			panic(r)
+		case error:
+			*err = r
+		default:
+			*err = fmt.Errorf("psp: panic during decoding: %v", r)
 		}
-		*err = r.(error)
 	}
 }
 
-func newDecoder(r io.Reader) *decoder {
+func newDecoder(r io.Reader, opts *Options) *decoder {
+	return newContextDecoder(context.Background(), r, opts)
+}
+
+// newContextDecoder returns a decoder that stops with a ContextError once
+// ctx is done.
+func newContextDecoder(ctx context.Context, r io.Reader, opts *Options) *decoder {
+	d := newRawDecoder(ctx, r, opts)
+	d.readHeader()
+	return d
+}
+
+// newRawDecoder returns a decoder that has yet to read the file header.
+func newRawDecoder(ctx context.Context, r io.Reader, opts *Options) *decoder {
+	inputEnd := remaining(r)
+	input := r
+	if ctx.Done() != nil {
+		input = &contextReader{ctx, r}
+	}
 	d := &decoder{
-		r:      bufio.NewReader(r),
-		tmpBuf: make([]byte, 64),
+		ctx:            ctx,
+		opts:           opts,
+		limits:         opts.limits(),
+		pixels:         new(atomic.Int64),
+		dibs:           opts.dibTypes(DIBAll),
+		layer:          -1,
+		channel:        -1,
+		xDataTrnsIndex: -1,
+		inputEnd:       inputEnd,
+	}
+	d.useScratch(input)
+	// Inputs that can't seek, such as pipes, may still claim to.
+	if rs, ok := r.(io.ReadSeeker); ok {
+		if base, err := rs.Seek(0, io.SeekCurrent); err == nil {
+			d.seeker, d.base = rs, base
+			d.readerAt, _ = r.(readSeekerAt)
+		}
 	}
-	d.readHeader()
 	return d
-	// if err == io.EOF {
-	// 	err = io.ErrUnexpectedEOF
-	// }
+}
+
+// input is what a decoder reads from: the *bufio.Reader of its scratch
+// buffers, or the reader it was given if that reads from memory or is
+// buffered already.
+type input interface {
+	io.Reader
+	io.ByteReader
+	Peek(n int) ([]byte, error)
+	Discard(n int) (int, error)
+	Buffered() int
+}
+
+// memReader is the input of a reader over a byte slice or string, which is
+// read from as is rather than copied into a buffer.
+type memReader struct {
+	r interface {
+		io.Reader
+		io.ByteReader
+		io.ReaderAt
+		io.Seeker
+		Len() int
+	}
+	peek []byte
+}
+
+func (m *memReader) Read(p []byte) (int, error) { return m.r.Read(p) }
+func (m *memReader) ReadByte() (byte, error)    { return m.r.ReadByte() }
+
+// Buffered returns the number of bytes left, which can all be read without
+// waiting.
+func (m *memReader) Buffered() int { return m.r.Len() }
+
+func (m *memReader) Peek(n int) ([]byte, error) {
+	if cap(m.peek) < n {
+		m.peek = make([]byte, n)
+	}
+	pos, err := m.r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	k, err := m.r.ReadAt(m.peek[:n], pos)
+	return m.peek[:k], err
+}
+
+func (m *memReader) Discard(n int) (int, error) {
+	k := min(n, m.r.Len())
+	if _, err := m.r.Seek(int64(k), io.SeekCurrent); err != nil {
+		return 0, err
+	}
+	if k < n {
+		return k, io.EOF
+	}
+	return k, nil
+}
+
+// limitedInput reads up to n bytes of an input. It reads single bytes as
+// well, so that the decompressors read from it directly rather than
+// through buffers of their own.
+type limitedInput struct {
+	r input
+	n int64 // bytes left
+}
+
+func (l *limitedInput) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+func (l *limitedInput) ReadByte() (byte, error) {
+	if l.n <= 0 {
+		return 0, io.EOF
+	}
+	b, err := l.r.ReadByte()
+	if err == nil {
+		l.n--
+	}
+	return b, err
+}
+
+// scratch holds the input buffer, scratch buffers, block stack and
+// decompressors of a decoder, which are pooled for the decoders that
+// follow.
+type scratch struct {
+	r           *bufio.Reader
+	mem         memReader
+	buf         []byte
+	blocks      []openBlock
+	slab        [rleSlabSize]byte
+	br          bytes.Reader // channel data decompressed in place
+	lr          limitedInput
+	zlibReader  io.ReadCloser
+	flateReader io.ReadCloser
+}
+
+var scratchPool = sync.Pool{
+	New: func() interface{} {
+		return &scratch{r: bufio.NewReader(nil), buf: make([]byte, 64), blocks: make([]openBlock, 0, 8)}
+	},
+}
+
+// maxPooledScratch bounds the scratch buffers kept in the pool. They grow
+// to hold a channel of the largest layer decoded.
+const maxPooledScratch = 1 << 20
+
+// useScratch gives d buffers from the pool, reading its input from r.
+// Readers over memory and buffered readers are read from directly, and
+// others through the pooled *bufio.Reader.
+func (d *decoder) useScratch(r io.Reader) {
+	s := scratchPool.Get().(*scratch)
+	switch r := r.(type) {
+	case *bytes.Reader:
+		s.mem.r = r
+		d.r = &s.mem
+	case *strings.Reader:
+		s.mem.r = r
+		d.r = &s.mem
+	case *bufio.Reader:
+		d.r = r
+	case *sliceReader:
+		d.r = r
+	default:
+		s.r.Reset(r)
+		d.r = s.r
+	}
+	d.scratch, d.tmpBuf, d.lr = s, s.buf, &s.lr
+	d.blocks = s.blocks[:0]
+	d.zlibReader, d.flateReader = s.zlibReader, s.flateReader
+}
+
+// release returns the buffers of d to the pool once decoding is done.
+// Nothing decoded refers to them, and d is not used afterwards.
+func (d *decoder) release() {
+	s := d.scratch
+	if s == nil {
+		return
+	}
+	s.r.Reset(nil)
+	s.mem.r = nil
+	if cap(d.tmpBuf) <= maxPooledScratch {
+		s.buf = d.tmpBuf[:cap(d.tmpBuf)]
+	}
+	s.blocks = d.blocks[:0]
+	s.br.Reset(nil)
+	s.lr = limitedInput{}
+	s.zlibReader, s.flateReader = d.zlibReader, d.flateReader
+	d.scratch, d.r, d.tmpBuf, d.lr, d.blocks = nil, nil, nil, nil, nil
+	d.zlibReader, d.flateReader = nil, nil
+	scratchPool.Put(s)
+}
+
+// remaining returns the number of bytes left in r if it can tell without
+// reading, as buffers and readers over a byte slice or string can through
+// their Len method and files and other seekers can by seeking, or -1.
+func remaining(r io.Reader) int64 {
+	switch r := r.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len())
+	case io.Seeker:
+		cur, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		end, err := r.Seek(0, io.SeekEnd)
+		if _, serr := r.Seek(cur, io.SeekStart); err != nil || serr != nil || end < cur {
+			return -1
+		}
+		return end - cur
+	}
+	return -1
 }
 
 func (d *decoder) error(err error) {
-	panic(err)
+	if err == io.EOF {
+		// Clean ends of the input are found with atEOF, so running out of
+		// input anywhere else is unexpected.
+		err = io.ErrUnexpectedEOF
+	}
+	e := &DecodeError{Offset: d.offset, Layer: d.layer, Channel: d.channel, Err: err}
+	if b, ok := d.innermostBlock(); ok {
+		e.Block = b.id.String()
+	}
+	panic(e)
+}
+
+// innermostBlock returns the innermost block that the current offset lies
+// within. A structure that ends exactly at the end of a block was still
+// read within it.
+func (d *decoder) innermostBlock() (openBlock, bool) {
+	for i := len(d.blocks) - 1; i >= 0; i-- {
+		if d.blocks[i].end >= d.offset {
+			return d.blocks[i], true
+		}
+	}
+	return openBlock{}, false
+}
+
+// skipInitialData skips to the end of the initial data of the innermost
+// version 3 block, of which the fields up to known are understood. Writers
+// that give the whole block as its initial data leave nothing to skip, as
+// the sub-blocks following the fields would be skipped with it.
+func (d *decoder) skipInitialData(known int64) {
+	b, ok := d.innermostBlock()
+	if !ok || b.init >= b.end {
+		return
+	}
+	d.skipChunkRest(b.init, known)
+}
+
+// blockEnd returns the end offset of the innermost block, if any.
+func (d *decoder) blockEnd() (int64, bool) {
+	b, ok := d.innermostBlock()
+	return b.end, ok
+}
+
+// maxBytesPerPixel is the size of a pixel of the largest image type the
+// decoder allocates, 16 bit RGBA.
+const maxBytesPerPixel = 8
+
+// checkSize fails with a LimitError if a bitmap of the given size exceeds
+// the limits, and with a FormatError if the size is negative or the bitmap
+// couldn't be addressed at all.
+func (d *decoder) checkSize(width, height int) {
+	if width < 0 || height < 0 {
+		d.error(FormatError(fmt.Sprintf("invalid bitmap size %dx%d", width, height)))
+	}
+	if width > d.limits.width {
+		d.error(LimitError{"MaxWidth", width, d.limits.width})
+	}
+	if height > d.limits.height {
+		d.error(LimitError{"MaxHeight", height, d.limits.height})
+	}
+	if width > 0 && height > math.MaxInt/maxBytesPerPixel/width {
+		d.error(FormatError(fmt.Sprintf("bitmap size %dx%d overflows", width, height)))
+	}
 }
 
+// allocPixels counts a bitmap of the given size, checked by checkSize,
+// against the pixels allocated for the file, failing with a LimitError if
+// they exceed the limit.
+func (d *decoder) allocPixels(width, height int) {
+	n := int64(width) * int64(height)
+	if total := d.pixels.Add(n); total > int64(d.limits.pixels) {
+		d.error(LimitError{"MaxPixels", int(total), d.limits.pixels})
+	}
+}
+
+// readHeader reads the file header and the general image attributes block
+// and checks that the image is one the decoder supports.
 func (d *decoder) readHeader() {
+	d.readVersion()
+	var bh blockHeader
+	d.readBlockHeader(&bh)
+	if bh.id != ImageBlock {
+		d.error(FormatError("missing general image attributes block"))
+	}
+	d.readImageAttributes(bh.dataLen)
+	d.checkImageAttributes()
+}
+
+// readVersion reads the file header up to the version numbers.
+func (d *decoder) readVersion() {
 	d.read(d.tmpBuf[:36])
 	if !bytes.Equal(d.tmpBuf[:32], fileMagic) {
 		d.error(FormatError("not a PSP file"))
 	}
 	d.versionMajor = decodeUint16(d.tmpBuf[32:34])
 	d.versionMinor = decodeUint16(d.tmpBuf[34:36])
-	if d.versionMajor < 3 {
-		d.error(UnsupportedError("only major versions >= 3 are supported"))
+	switch {
+	case d.versionMajor < 1:
+		d.error(UnsupportedError("only major versions >= 1 are supported"))
+	case d.versionMajor < 3:
+		// Versions 1 and 2 come from Paint Shop Pro 3 and 4 and were never
+		// documented. They use the same fixed-length structures that
+		// version 3 does, so they are read as such.
+		d.warn(WarnVersion, fmt.Sprintf("major version %d is read as version 3", d.versionMajor))
 	}
+}
 
-	var bh blockHeader
-	d.readBlockHeader(&bh)
-	if bh.id != imageBlock {
-		d.error(FormatError("missing general image attributes block"))
-	} else if bh.dataLen < 38 || bh.dataLen > 64 {
+// readImageAttributes reads the data of a general image attributes block of
+// the given length. Fields added by later versions are skipped.
+func (d *decoder) readImageAttributes(dataLen uint32) {
+	if dataLen < 38 {
 		d.error(FormatError("invalid length for general image attributes block"))
 	}
-	d.read(d.tmpBuf[:bh.dataLen])
-	buf := d.tmpBuf[:bh.dataLen]
+	n := min(int(dataLen), 46)
+	d.read(d.tmpBuf[:n])
+	d.skip(int(dataLen) - n)
+	buf := d.tmpBuf[:n]
 	if d.versionMajor >= 4 {
 		buf = buf[4:]
 	}
 	d.width = int(int32(decodeUint32(buf[0:4])))
 	d.height = int(int32(decodeUint32(buf[4:8])))
-	d.res = math.Float64frombits(decodeUint64(buf[8:16]))
-	d.resMetric = metric(buf[16])
-	d.comp = compression(decodeUint16(buf[17:19]))
+	d.meta.Resolution = math.Float64frombits(decodeUint64(buf[8:16]))
+	d.meta.ResolutionUnit = ResolutionUnit(buf[16])
+	d.comp = Compression(decodeUint16(buf[17:19]))
 	d.bitDepth = decodeUint16(buf[19:21])
 	d.planeCount = decodeUint16(buf[21:23])
 	d.colorCount = decodeUint32(buf[23:27])
@@ -187,82 +749,220 @@ func (d *decoder) readHeader() {
 	d.totalImageSize = decodeUint32(buf[28:32])
 	d.activeLayer = int32(decodeUint32(buf[32:36]))
 	d.layerCount = decodeUint16(buf[36:38])
+	if d.versionMajor >= 4 && len(buf) >= 42 {
+		d.contents = GraphicContents(decodeUint32(buf[38:42]))
+	}
+}
 
-	// Validate some values
+// checkImageAttributes validates the general image attributes and picks
+// the color model of the image.
+func (d *decoder) checkImageAttributes() {
+	if d.width <= 0 || d.height <= 0 {
+		d.error(FormatError(fmt.Sprintf("invalid image size %dx%d", d.width, d.height)))
+	}
 	switch d.comp {
-	case compressionNone, compressionRLE, compressionLZ77:
+	case CompressionNone, CompressionRLE, CompressionLZ77:
 	default:
-		d.error(UnsupportedError(fmt.Sprintf("unsupported compression (%04x)", d.comp)))
+		d.error(UnsupportedError(fmt.Sprintf("unsupported compression (%04x)", uint16(d.comp))))
 	}
-	if d.grayscale {
-		switch d.bitDepth {
-		case 8:
-			d.colorModel = color.GrayModel
+	m, err := imageColorModel(d.bitDepth, d.grayscale)
+	if err != nil {
+		d.error(err)
+	}
+	d.colorModel = m
+}
+
+// indexed reports whether images of the given bit depth are indexed, with
+// their palette as their color model. 1 bit grayscale images are, with a
+// palette of black and white if they have none.
+func indexed(bitDepth uint16, grayscale bool) bool {
+	return bitDepth <= 8 && !grayscale || bitDepth == 1
+}
+
+// imageColorModel returns the color model of images of the given bit
+// depth, which for indexed images is replaced by their palette.
+func imageColorModel(bitDepth uint16, grayscale bool) (color.Model, error) {
+	if grayscale {
+		switch bitDepth {
+		case 1, 8:
+			return color.GrayModel, nil
 		case 16:
-			d.colorModel = color.Gray16Model
-		default:
-			d.error(UnsupportedError(fmt.Sprintf("unsupported bit depth %d for grayscale image", d.bitDepth)))
+			return color.Gray16Model, nil
 		}
-	} else {
-		switch d.bitDepth {
-		// case 1: // TODO: not sure how to decode this properly
-		case 16:
-			d.colorModel = color.Gray16Model
-		case 8, 24:
-			d.colorModel = color.RGBAModel
-		case 48, 64:
-			d.colorModel = color.RGBA64Model
+		return nil, UnsupportedError(fmt.Sprintf("unsupported bit depth %d for grayscale image", bitDepth))
+	}
+	switch bitDepth {
+	case 16:
+		return color.Gray16Model, nil
+	case 1, 4, 8, 24, 32:
+		return color.RGBAModel, nil
+	case 48, 64:
+		return color.RGBA64Model, nil
+	}
+	return nil, UnsupportedError(fmt.Sprintf("unsupported bit depth %d", bitDepth))
+}
+
+func (d *decoder) decode() image.Image {
+	d.dibs = d.opts.dibTypes(DIBImage | DIBTransMask)
+	if !d.decodeMetadataBlocks() {
+		d.error(FormatError("missing layer bank block"))
+	}
+	skipHidden := d.opts != nil && d.opts.SkipHidden
+	for _, l := range d.decodeLayers() {
+		if l.Image != nil && (l.Visible || !skipHidden) {
+			return l.Image
+		}
+	}
+	d.error(FormatError("no raster layers"))
+	return nil
+}
+
+// decodeTrailingBlocks processes the top-level blocks that follow the layer
+// bank up to the end of the input. Some versions of Paint Shop Pro write
+// the creator and extended data blocks here, so their fields are merged
+// into those read ahead of the layers.
+func (d *decoder) decodeTrailingBlocks() {
+	for !d.atEOF() {
+		if b, _ := d.r.Peek(len(blockMagic)); !bytes.Equal(b, blockMagic) {
+			d.recoverable("trailing data after the last block")
+			return
+		}
+		var bh blockHeader
+		d.readBlockHeader(&bh)
+		end := d.offset + int64(bh.dataLen)
+		switch bh.id {
+		case ExtendedDataBlock:
+			d.decodeExtendedDataBlock(int64(bh.dataLen))
+		case CreatorBlock:
+			d.decodeCreatorBlock(int64(bh.dataLen))
+		case AlphaBankBlock:
+			if d.decodeBanks {
+				d.alphaChannels = append(d.alphaChannels, d.decodeAlphaBank(end)...)
+			}
+		case TubeBlock:
+			d.meta.Tube = d.decodeTubeBlock()
+		case CompositeImageBankBlock:
+			d.meta.Composites = append(d.meta.Composites, d.readCompositeBankAttrs(end)...)
+		case ThumbnailBlock:
+			if d.versionMajor < 4 {
+				d.meta.Composites = append(d.meta.Composites, d.readThumbnailAttrs().exported())
+			} else {
+				d.decodeOtherBlock(bh)
+			}
+		case TableBankBlock:
+			if d.decodeBanks {
+				d.tables = append(d.tables, d.decodeTableBank(end)...)
+			}
+		case ImageBlock, ColorBlock, LayerStartBlock:
+			d.recoverableAs(WarnIgnoredBlock, "ignored %v after the layer bank", bh.id)
 		default:
-			d.error(UnsupportedError(fmt.Sprintf("unsupported bit depth %d", d.bitDepth)))
+			d.decodeOtherBlock(bh)
 		}
+		d.skipTo(end)
 	}
-	// fmt.Printf("%+v\n", d)
 }
 
-func (d *decoder) decode() image.Image {
+// atEOF reports whether the input ends cleanly at the current position.
+func (d *decoder) atEOF() bool {
+	_, err := d.r.Peek(1)
+	return err == io.EOF
+}
+
+// decodeMetadataBlocks processes the top-level blocks that precede the layer
+// bank. It returns true once the layer bank block header has been read, or
+// false if the input ends cleanly at a block boundary before that.
+func (d *decoder) decodeMetadataBlocks() bool {
+	defer d.defaultPalette()
 	for {
+		if d.atEOF() {
+			return false
+		}
 		var bh blockHeader
 		d.readBlockHeader(&bh)
 		switch bh.id {
-		case extendedDataBlock:
+		case ExtendedDataBlock:
 			d.decodeExtendedDataBlock(int64(bh.dataLen))
-		case creatorBlock:
+		case CreatorBlock:
 			d.decodeCreatorBlock(int64(bh.dataLen))
-		case colorBlock:
-			d.decodeColorBlock(int(bh.dataLen))
-		case layerStartBlock:
-			img, _ := d.decodeLayers()
-			return img
-		case compositeImageBankBlock: // TODO
-			// length?: uint32
-			// number of thumbnails?: uint32
-			// sub blocks
-			//   block ID 0x11 (len 0x18):
-			//     length?: uint32
-			//     width?: int32
-			//     height?: int32
-			//     0x0008: uint16
-			//     0x0002: uint16
-			//     0x0001: uint16
-			//     0x 00 0x01 0x00 0x00 0x01 0x00
-			//   block ID 0x09 (len 0x0b36)
-			//     0x08 0x00 0x 00 0x00 0x01 0x00 0x01 0x00
-			//     sub blocks
-			//       block ID 0x02 (len 0x0408)
-			//       block ID 0x05 (len 0x0712)
-			fallthrough
-		default:
+		case ColorBlock:
+			if !indexed(d.bitDepth, d.grayscale) {
+				// Images of other bit depths store no indices into it.
+				d.warn(WarnIgnoredBlock, fmt.Sprintf("ignored %v of a %d bit image", bh.id, d.bitDepth))
+				d.skip(int(bh.dataLen))
+				break
+			}
+			d.decodeColorBlock(d.bitDepth)
+		case TubeBlock:
+			end := d.offset + int64(bh.dataLen)
+			d.meta.Tube = d.decodeTubeBlock()
+			d.skipTo(end)
+		case TableBankBlock:
+			if !d.decodeBanks {
+				d.skip(int(bh.dataLen))
+				break
+			}
+			end := d.offset + int64(bh.dataLen)
+			d.tables = append(d.tables, d.decodeTableBank(end)...)
+			d.skipTo(end)
+		case LayerStartBlock:
+			d.layerBankEnd = d.offset + int64(bh.dataLen)
+			return true
+		case ImageBlock:
+			d.recoverableAs(WarnIgnoredBlock, "ignored repeated %v", bh.id)
 			d.skip(int(bh.dataLen))
+		case CompositeImageBankBlock:
+			end := d.offset + int64(bh.dataLen)
+			d.meta.Composites = append(d.meta.Composites, d.readCompositeBankAttrs(end)...)
+			d.skipTo(end)
+		case ThumbnailBlock:
+			end := d.offset + int64(bh.dataLen)
+			if d.versionMajor < 4 {
+				d.meta.Composites = append(d.meta.Composites, d.readThumbnailAttrs().exported())
+			} else {
+				d.decodeOtherBlock(bh)
+			}
+			d.skipTo(end)
+		default:
+			end := d.offset + int64(bh.dataLen)
+			d.decodeOtherBlock(bh)
+			d.skipTo(end)
 		}
 	}
 }
 
-func (d *decoder) decodeColorBlock(ln int) {
+// defaultPalette gives 1 bit images without a color palette block black
+// and white, as gray for grayscale images. A palette that is stored takes
+// precedence over the grayscale flag.
+func (d *decoder) defaultPalette() {
+	if d.palette != nil || d.bitDepth != 1 {
+		return
+	}
+	if d.grayscale {
+		d.palette = color.Palette{color.Gray{0}, color.Gray{255}}
+	} else {
+		d.palette = color.Palette{color.RGBA{0, 0, 0, 255}, color.RGBA{255, 255, 255, 255}}
+	}
+}
+
+// decodeColorBlock reads the palette of an image of the given bit depth.
+// The number of entries is checked against the size of the block and the
+// bit depth before anything is allocated.
+func (d *decoder) decodeColorBlock(bitDepth uint16) {
 	if d.versionMajor >= 4 {
 		d.readUint32() // TODO: 0x08 maybe color type/format
 	}
-	nColors := int(d.readUint32())
-	if len(d.tmpBuf) < nColors*4 {
+	n := int64(d.readUint32())
+	if end, ok := d.blockEnd(); ok && n*4 > end-d.offset {
+		d.error(FormatError(fmt.Sprintf("palette of %d entries overruns its block", n)))
+	}
+	if n > int64(d.limits.paletteEntries) {
+		d.error(LimitError{"MaxPaletteEntries", int(n), d.limits.paletteEntries})
+	}
+	if bitDepth <= 8 && n > 1<<bitDepth {
+		d.error(FormatError(fmt.Sprintf("palette of %d entries for bit depth %d", n, bitDepth)))
+	}
+	nColors := int(n)
+	if cap(d.tmpBuf) < nColors*4 {
 		d.tmpBuf = make([]byte, nColors*4)
 	}
 	d.read(d.tmpBuf[:nColors*4])
@@ -277,221 +977,6 @@ func (d *decoder) decodeColorBlock(ln int) {
 	}
 }
 
-func (d *decoder) decodeLayers() (image.Image, *layer) {
-	var layer layer
-	var img image.Image
-	var imgRGBA *image.RGBA
-	var imgRGBA64 *image.RGBA64
-	var imgGray16 *image.Gray16
-	var imgPaletted *image.Paletted
-	var layerBytes int
-	channel := 0
-	for {
-		var bh blockHeader
-		d.readBlockHeader(&bh)
-		switch bh.id {
-		case layerBlock:
-			// headerLen := d.readUint32()
-			// println(headerLen)
-			if d.versionMajor >= 4 {
-				d.readUint32() // length? doesn't really match
-				nameLen := d.readUint16()
-				layer.name = d.readString(int(nameLen))
-			} else {
-				layer.name = strings.TrimSpace(d.readString(256))
-			}
-			layer.layerType = layerType(d.readByte())
-			layer.rect = d.readRect()
-			layer.savedRect = d.readRect()
-			layer.opacity = d.readByte()
-			layer.blendingMode = d.readByte()
-			layer.visible = d.readByte() != 0
-			layer.transparencyProtected = d.readByte() != 0
-			layer.linkGroupID = d.readByte()
-			layer.maskRectangle = d.readRect()
-			layer.savedMaskRectangle = d.readRect()
-			layer.maskLinked = d.readByte() != 0
-			layer.maskDisabled = d.readByte() != 0
-			layer.invertMaskOnBlend = d.readByte() != 0
-			layer.blendRangeCount = d.readUint16()
-			/*
-				TODO:
-					blend ranges (4 bytes per range) * 5
-						source blend range
-						destination blend range
-			*/
-			d.skip(4 * 2 * 5)
-			// TODO: not sure about these versions or what's going on
-			if d.versionMajor >= 10 {
-				d.skip(5)
-				// TODO: not sure how to read or calculate these
-				if d.palette != nil {
-					layer.channelCount = 1
-				} else {
-					switch d.bitDepth {
-					case 1: // TODO: not sure how to decode this properly
-						layer.channelCount = 1
-					case 8:
-						layer.channelCount = 1
-					case 16:
-						layer.channelCount = 1
-					case 24, 48:
-						layer.channelCount = 3
-					case 32, 64:
-						layer.channelCount = 4
-					default:
-						d.error(FormatError("unknown channel count"))
-					}
-				}
-			} else if d.versionMajor >= 6 {
-				d.skip(9)
-				layer.bitmapCount = d.readUint16()
-				layer.channelCount = d.readUint16()
-			} else if d.versionMajor >= 4 {
-				d.skip(4)
-				layer.bitmapCount = d.readUint16()
-				layer.channelCount = d.readUint16()
-			} else {
-				layer.bitmapCount = d.readUint16()
-				layer.channelCount = d.readUint16()
-			}
-			// fmt.Printf("%+v\n", layer)
-			if layer.channelCount == 0 {
-				break
-			}
-			channel = 0
-			if d.palette != nil {
-				imgPaletted = image.NewPaletted(layer.savedRect, d.palette)
-				img = imgPaletted
-				layerBytes = layer.savedRect.Dx() * layer.savedRect.Dy()
-				if d.bitDepth == 1 {
-					layerBytes /= 8
-				}
-			} else if d.bitDepth == 16 {
-				imgGray16 = image.NewGray16(layer.savedRect)
-				img = imgGray16
-				layerBytes = layer.savedRect.Dx() * layer.savedRect.Dy() * 2
-			} else if d.bitDepth == 24 || d.bitDepth == 32 {
-				imgRGBA = image.NewRGBA(layer.savedRect)
-				img = imgRGBA
-				for i := 3; i < len(imgRGBA.Pix); i += 4 {
-					imgRGBA.Pix[i] = 255
-				}
-				layerBytes = layer.savedRect.Dx() * layer.savedRect.Dy()
-			} else if d.bitDepth == 48 || d.bitDepth == 64 {
-				imgRGBA64 = image.NewRGBA64(layer.savedRect)
-				img = imgRGBA64
-				for i := 6; i < len(imgRGBA64.Pix); i += 8 {
-					imgRGBA64.Pix[i] = 255
-					imgRGBA64.Pix[i+1] = 255
-				}
-				layerBytes = layer.savedRect.Dx() * layer.savedRect.Dy() * 2
-			}
-		case channelBlock:
-			if d.versionMajor >= 4 {
-				headerLen := d.readUint32()
-				if headerLen != 16 {
-					d.error(FormatError("invalid channel block info len"))
-				}
-			}
-			compressedLayerLen := int(d.readUint32())
-			// uncompressedImageLen := int(d.readUint32())
-			bitmapType := bitmapType(d.readUint16())
-			channelType := channelType(d.readUint16())
-			if bitmapType != dibImage {
-				// TODO: ignoring other bitmap types (e.g. mask)
-				d.skip(int(bh.dataLen - 4*3 - 2*2))
-
-				channel++
-				if channel == int(layer.channelCount) {
-					return img, &layer
-				}
-				break
-			}
-			// fmt.Printf("Channel\n")
-			// fmt.Printf("\tcompressed layer len = %d\n", compressedLayerLen)
-			// fmt.Printf("\tuncompressed image len = %d\n", uncompressedImageLen)
-			// fmt.Printf("\tbitmap type = %s\n", bitmapType)
-			// fmt.Printf("\tchannel type = %s\n", channelType)
-
-			if cap(d.tmpBuf) < layerBytes {
-				d.tmpBuf = make([]byte, layerBytes)
-			}
-			buf := d.tmpBuf[:layerBytes]
-
-			switch d.comp {
-			case compressionLZ77:
-				zr, err := zlib.NewReader(io.LimitReader(d.r, int64(compressedLayerLen)))
-				if err != nil {
-					d.error(err)
-				}
-				_, err = io.ReadFull(zr, buf)
-				zr.Close()
-				if err != nil {
-					d.error(err)
-				}
-			case compressionRLE:
-				j := 0
-				for n := compressedLayerLen; n > 0; n-- {
-					if run := int(d.readByte()); run > 128 {
-						b := d.readByte()
-						n--
-						for i := 0; i < run-128; i++ {
-							buf[j] = b
-							j++
-						}
-					} else {
-						n -= run
-						d.read(buf[j : j+run])
-						j += run
-					}
-				}
-			case compressionNone:
-				d.read(buf)
-			}
-
-			if imgRGBA != nil {
-				for i := int(channelType) - 1; i < len(imgRGBA.Pix); i += 4 {
-					imgRGBA.Pix[i] = buf[i/4]
-				}
-			} else if imgRGBA64 != nil {
-				for i := (int(channelType) - 1) * 2; i < len(imgRGBA64.Pix); i += 8 {
-					imgRGBA64.Pix[i] = buf[2*(i/8)+1]
-					imgRGBA64.Pix[i+1] = buf[2*(i/8)]
-				}
-			} else if imgGray16 != nil {
-				for i := 0; i < len(buf); i += 2 {
-					imgGray16.Pix[i] = buf[i+1]
-					imgGray16.Pix[i+1] = buf[i]
-				}
-			} else {
-				if d.bitDepth == 1 {
-					for i, b := range buf {
-						for j := 0; j < 8; j++ {
-							imgPaletted.Pix[i*8+j] = b >> 7
-							b <<= 1
-						}
-					}
-				} else {
-					imgPaletted.Pix = buf
-				}
-			}
-
-			channel++
-			if channel == int(layer.channelCount) {
-				return img, &layer
-			}
-		case 33:
-			// TODO: No idea what this block is (shows up in major version 13). seems to be all zeros
-			d.skip(int(bh.dataLen))
-			n := int(d.readUint32())
-			d.skip(n - 4)
-		default:
-			d.skip(int(bh.dataLen))
-		}
-	}
-}
-
 func (d *decoder) dump(n int) {
 	if cap(d.tmpBuf) < n {
 		d.tmpBuf = make([]byte, n)
@@ -501,57 +986,236 @@ func (d *decoder) dump(n int) {
 }
 
 func (d *decoder) decodeExtendedDataBlock(totalLen int64) {
+	blockEnd := d.offset + totalLen
 	var ch chunkHeader
-	for totalLen > 0 {
-		d.readChunkHeader(&ch)
-		totalLen -= 10 + int64(ch.dataLen)
+	for d.nextChunk(&ch, blockEnd) {
+		end := d.offset + int64(ch.dataLen)
+		// Exif data cut short by its block is kept as far as it goes.
+		if ch.fieldKeyword != xDataEXIF && !d.checkChunk(&ch, blockEnd) {
+			return
+		}
 		switch ch.fieldKeyword {
 		case xDataTrnsIndex:
-			// TODO
-			fallthrough
-		default:
-			d.skip(int(ch.dataLen))
+			d.xDataTrnsIndex = int(d.readUint16())
+		case xDataGrid:
+			d.meta.Grid = &Grid{
+				HorizontalSpacing: int(d.readUint32()),
+				VerticalSpacing:   int(d.readUint32()),
+				Units:             GridUnits(d.readUint16()),
+			}
+		case xDataGuide:
+			d.meta.Guides = append(d.meta.Guides, Guide{
+				Orientation: GuideOrientation(d.readUint16()),
+				Position:    int(int32(d.readUint32())),
+			})
+		case xDataEXIF:
+			var ok bool
+			if d.meta.EXIF, ok = d.readEXIF(int64(ch.dataLen), blockEnd); !ok {
+				return
+			}
 		}
+		d.skipTo(end)
 	}
 }
 
+// readEXIF reads an Exif chunk of n bytes. The data may be large, so it is
+// read as it arrives rather than allocated up front. A chunk cut short by
+// the end of the input or of its block is returned truncated along with a
+// warning, and ok set to false.
+func (d *decoder) readEXIF(n, blockEnd int64) (data []byte, ok bool) {
+	ok = true
+	if d.offset+n > blockEnd {
+		n = blockEnd - d.offset
+		ok = false
+	}
+	var buf bytes.Buffer
+	m, err := io.CopyN(&buf, d.r, n)
+	d.offset += m
+	if err == io.EOF {
+		ok = false
+	} else if err != nil {
+		d.error(err)
+	}
+	if !ok {
+		d.warn(WarnFormat, "truncated Exif data")
+	}
+	return buf.Bytes(), ok
+}
+
+// creatorTime returns the time of a creator timestamp of v seconds since
+// the Unix epoch, or the zero Time if v is zero. With Options.Location
+// the seconds count to the wall-clock time in that location rather than
+// in UTC.
+func (d *decoder) creatorTime(v uint32) time.Time {
+	if v == 0 {
+		return time.Time{}
+	}
+	t := time.Unix(int64(v), 0).UTC()
+	if d.opts == nil || d.opts.Location == nil {
+		return t
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, d.opts.Location)
+}
+
 func (d *decoder) decodeCreatorBlock(totalLen int64) {
+	blockEnd := d.offset + totalLen
 	var ch chunkHeader
-	for totalLen > 0 {
-		d.readChunkHeader(&ch)
-		totalLen -= 10 + int64(ch.dataLen)
+	for d.nextChunk(&ch, blockEnd) {
+		if !d.checkChunk(&ch, blockEnd) {
+			return
+		}
+		end := d.offset + int64(ch.dataLen)
 		switch ch.fieldKeyword {
 		case crtrFldTitle:
-			d.creator.title = d.readString(int(ch.dataLen))
+			d.meta.Title, d.meta.RawTitle = d.readText(int(ch.dataLen))
 		case crtrFldCrtDate:
-			d.creator.creationDate = time.Unix(int64(d.readUint32()), 0)
+			d.meta.RawCreated = d.readUint32()
+			d.meta.Created = d.creatorTime(d.meta.RawCreated)
 		case crtrFldModDate:
-			d.creator.modificationDate = time.Unix(int64(d.readUint32()), 0)
+			d.meta.RawModified = d.readUint32()
+			d.meta.Modified = d.creatorTime(d.meta.RawModified)
 		case crtrFldArtist:
-			d.creator.artist = d.readString(int(ch.dataLen))
+			d.meta.Artist, d.meta.RawArtist = d.readText(int(ch.dataLen))
 		case crtrFldCpyrght:
-			d.creator.copyright = d.readString(int(ch.dataLen))
+			d.meta.Copyright, d.meta.RawCopyright = d.readText(int(ch.dataLen))
 		case crtrFldDesc:
-			d.creator.description = d.readString(int(ch.dataLen))
+			d.meta.Description, d.meta.RawDescription = d.readText(int(ch.dataLen))
 		case crtrFldAppID:
-			d.creator.appID = d.readUint32()
+			d.meta.AppID = CreatorApp(d.readUint32())
 		case crtrFldAppVer:
-			d.creator.appVersion = d.readUint32()
-		default:
-			d.skip(int(ch.dataLen))
+			d.meta.AppVersion = AppVersion(d.readUint32())
 		}
+		d.skipTo(end)
 	}
 }
 
 func (d *decoder) skip(n int) {
-	_, err := d.r.Discard(n)
+	if d.seeker != nil && n > d.r.Buffered() {
+		end := d.offset + int64(n)
+		if d.inputEnd >= 0 && end > d.inputEnd {
+			// Fail where discarding would have.
+			d.seekTo(d.inputEnd)
+			d.error(io.ErrUnexpectedEOF)
+		}
+		d.seekTo(end)
+		return
+	}
+	n, err := d.r.Discard(n)
+	d.offset += int64(n)
 	if err != nil {
 		d.error(err)
 	}
 }
 
+// seekTo moves the input of a decoder reading from a seeker to the given
+// offset.
+func (d *decoder) seekTo(offset int64) {
+	if _, err := d.seeker.Seek(d.base+offset, io.SeekStart); err != nil {
+		d.error(err)
+	}
+	// Readers used directly move with the seeker.
+	if d.r == input(d.scratch.r) {
+		if d.ctx.Done() != nil {
+			d.scratch.r.Reset(&contextReader{d.ctx, d.seeker})
+		} else {
+			d.scratch.r.Reset(d.seeker)
+		}
+	}
+	d.offset = offset
+}
+
+// skipTo discards input up to the absolute offset end. Structures that
+// were read past end are a recoverable problem, and reading continues from
+// where they ended.
+func (d *decoder) skipTo(end int64) {
+	if d.offset > end {
+		d.recoverable("structure overruns its declared length by %d bytes", d.offset-end)
+		return
+	}
+	d.skip(int(end - d.offset))
+}
+
+// recoverable reports a deviation from the format that decoding can get
+// past. It fails with a FormatError in strict mode and is a warning
+// otherwise.
+func (d *decoder) recoverable(format string, v ...interface{}) {
+	d.recoverableAs(WarnFormat, format, v...)
+}
+
+// recoverableAs is like recoverable but warns with the given code.
+func (d *decoder) recoverableAs(code WarningCode, format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	if d.opts != nil && d.opts.Strict {
+		d.error(FormatError(msg))
+	}
+	d.warn(code, msg)
+}
+
+// warn reports a warning found at the current offset.
+func (d *decoder) warn(code WarningCode, msg string) {
+	if d.opts == nil || d.opts.Warn == nil {
+		return
+	}
+	w := Warning{Code: code, Offset: d.offset, Layer: d.layer, Message: msg}
+	if b, ok := d.innermostBlock(); ok {
+		w.Block = b.id.String()
+	}
+	d.opts.Warn(w)
+}
+
+// checkKnown reports a block of unknown type as a recoverable problem.
+func (d *decoder) checkKnown(id BlockID) {
+	if _, ok := blockTypes[id]; !ok {
+		d.recoverableAs(WarnUnknownBlock, "skipped unknown %v", id)
+	}
+}
+
+// decodeOtherBlock passes a top-level block the decoder has no use for to
+// the BlockHandler of the options, if any, or else checks that its type is
+// known. An error from the handler is a recoverable problem. The caller
+// skips whatever the handler leaves unread.
+func (d *decoder) decodeOtherBlock(bh blockHeader) {
+	if d.opts == nil || d.opts.BlockHandler == nil {
+		d.checkKnown(bh.id)
+		return
+	}
+	err := d.opts.BlockHandler(bh.id, &blockDataReader{d, int64(bh.dataLen)})
+	if err == nil {
+		return
+	}
+	if d.opts.Strict {
+		d.error(err)
+	}
+	d.warn(WarnBlockHandler, fmt.Sprintf("handler for %v: %v", bh.id, err))
+}
+
+// blockDataReader reads the data of a block from a decoder, keeping its
+// offset up to date.
+type blockDataReader struct {
+	d *decoder
+	n int64 // bytes left in the block
+}
+
+func (r *blockDataReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+	n, err := r.d.r.Read(p)
+	r.d.offset += int64(n)
+	r.n -= int64(n)
+	if err == io.EOF && r.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
 func (d *decoder) read(b []byte) {
-	if _, err := io.ReadFull(d.r, b); err != nil {
+	n, err := io.ReadFull(d.r, b)
+	d.offset += int64(n)
+	if err != nil {
 		d.error(err)
 	}
 }
@@ -566,16 +1230,48 @@ func (d *decoder) readRect() image.Rectangle {
 	)
 }
 
+// readBitmapRect reads the rectangle of a stored bitmap. Unlike readRect
+// it fails on inverted rectangles rather than swapping their coordinates,
+// and on sizes that don't fit in an int.
+func (d *decoder) readBitmapRect() image.Rectangle {
+	d.read(d.tmpBuf[:16])
+	x0 := int64(int32(decodeUint32(d.tmpBuf[:4])))
+	y0 := int64(int32(decodeUint32(d.tmpBuf[4:8])))
+	x1 := int64(int32(decodeUint32(d.tmpBuf[8:12])))
+	y1 := int64(int32(decodeUint32(d.tmpBuf[12:16])))
+	if x1 < x0 || y1 < y0 || x1-x0 > math.MaxInt || y1-y0 > math.MaxInt {
+		d.error(FormatError(fmt.Sprintf("invalid bitmap rectangle (%d,%d)-(%d,%d)", x0, y0, x1, y1)))
+	}
+	return image.Rect(int(x0), int(y0), int(x1), int(y1))
+}
+
+// readString reads a string of n bytes.
 func (d *decoder) readString(n int) string {
-	// sanity check
-	if n > 1024 {
-		d.error(FormatError("bad string length"))
+	return string(d.readStringBytes(n))
+}
+
+// readStringBytes reads the n bytes of a string field. Short ones are read
+// into the scratch buffer, which is only valid until the next read. Long
+// ones are read as they arrive, so a bad length fails on the input running
+// out rather than on a large allocation.
+func (d *decoder) readStringBytes(n int) []byte {
+	if end, ok := d.blockEnd(); n < 0 || ok && d.offset+int64(n) > end {
+		d.error(FormatError("string overruns its block"))
 	}
-	if cap(d.tmpBuf) < n {
-		d.tmpBuf = make([]byte, n)
+	if n > d.limits.stringLength {
+		d.error(LimitError{"MaxStringLength", n, d.limits.stringLength})
 	}
-	d.read(d.tmpBuf[:n])
-	return string(d.tmpBuf[:n])
+	if n <= cap(d.tmpBuf) {
+		d.read(d.tmpBuf[:n])
+		return d.tmpBuf[:n]
+	}
+	var buf bytes.Buffer
+	m, err := io.CopyN(&buf, d.r, int64(n))
+	d.offset += m
+	if err != nil {
+		d.error(err)
+	}
+	return buf.Bytes()
 }
 
 func (d *decoder) readByte() byte {
@@ -583,6 +1279,7 @@ func (d *decoder) readByte() byte {
 	if err != nil {
 		d.error(err)
 	}
+	d.offset++
 	return b
 }
 
@@ -596,9 +1293,53 @@ func (d *decoder) readUint32() uint32 {
 	return decodeUint32(d.tmpBuf[:4])
 }
 
+// readChunkSize reads the size field that starts many fixed structures and
+// returns the absolute offset at which the structure ends. The size includes
+// the field itself.
+func (d *decoder) readChunkSize() int64 {
+	start := d.offset
+	return start + int64(d.readUint32())
+}
+
+func (d *decoder) readFloat64() float64 {
+	d.read(d.tmpBuf[:8])
+	return math.Float64frombits(decodeUint64(d.tmpBuf[:8]))
+}
+
+// chunkHeaderLen is the size of the header of a chunk: the magic, the
+// field keyword and the data length.
+const chunkHeaderLen = 10
+
 func (d *decoder) readChunkHeader(ch *chunkHeader) {
-	d.read(d.tmpBuf[:10])
-	d.decodeChunkHeader(d.tmpBuf[:10], ch)
+	d.read(d.tmpBuf[:chunkHeaderLen])
+	d.decodeChunkHeader(d.tmpBuf[:chunkHeaderLen], ch)
+}
+
+// nextChunk reads the header of the next chunk in a block ending at
+// blockEnd. It returns false at the end of the block, skipping any slack
+// too short to hold another chunk.
+func (d *decoder) nextChunk(ch *chunkHeader, blockEnd int64) bool {
+	if blockEnd-d.offset < chunkHeaderLen {
+		d.skipTo(blockEnd)
+		return false
+	}
+	d.readChunkHeader(ch)
+	return true
+}
+
+// checkChunk reports whether the data of a chunk, whose header has just
+// been read, fits in its block ending at blockEnd. A chunk that overruns
+// the block is a recoverable problem, past which the rest of the block is
+// skipped so that the next block is read from where it starts.
+func (d *decoder) checkChunk(ch *chunkHeader, blockEnd int64) bool {
+	n := blockEnd - d.offset
+	if int64(ch.dataLen) <= n {
+		return true
+	}
+	d.recoverable("chunk %d at offset %d claims %d bytes but only %d remain in its block",
+		ch.fieldKeyword, d.offset-chunkHeaderLen, ch.dataLen, n)
+	d.skipTo(blockEnd)
+	return false
 }
 
 func (d *decoder) decodeChunkHeader(buf []byte, ch *chunkHeader) {
@@ -613,6 +1354,11 @@ func (d *decoder) decodeChunkHeader(buf []byte, ch *chunkHeader) {
 // readBlockHeader reads the next block from the file. it accepts a block
 // rather than returning one so that the buffer can be reused.
 func (d *decoder) readBlockHeader(bh *blockHeader) {
+	d.checkContext()
+	// Forget the blocks this one follows rather than nests in.
+	for n := len(d.blocks); n > 0 && d.blocks[n-1].end <= d.offset; n-- {
+		d.blocks = d.blocks[:n-1]
+	}
 	if d.versionMajor > 3 {
 		d.read(d.tmpBuf[:10])
 		bh.initLen = 0xDEADBEEF
@@ -625,7 +1371,22 @@ func (d *decoder) readBlockHeader(bh *blockHeader) {
 	if !bytes.Equal(d.tmpBuf[:4], blockMagic) {
 		d.error(FormatError("bad block magic"))
 	}
-	bh.id = blockID(decodeUint16(d.tmpBuf[4:6]))
+	bh.id = BlockID(decodeUint16(d.tmpBuf[4:6]))
+	d.features |= blockFeature(bh.id)
+	end := d.offset + int64(bh.dataLen)
+	// A length beyond the end of the enclosing block or of the input is
+	// reported as such rather than as whatever reading past it runs into.
+	if parent, ok := d.blockEnd(); ok && end > parent {
+		d.error(FormatError(fmt.Sprintf("%s claims %d bytes but only %d remain in its parent block", bh.id, bh.dataLen, parent-d.offset)))
+	}
+	if d.inputEnd >= 0 && end > d.inputEnd {
+		d.error(FormatError(fmt.Sprintf("%s claims %d bytes but only %d remain", bh.id, bh.dataLen, d.inputEnd-d.offset)))
+	}
+	var init int64
+	if d.versionMajor <= 3 {
+		init = d.offset + int64(bh.initLen)
+	}
+	d.blocks = append(d.blocks, openBlock{bh.id, end, init})
 	// fmt.Printf("BLOCK %s %+v\n", bh.id, bh)
 }
 
@@ -1,10 +1,24 @@
 package psp
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
 	"image/png"
+	"io"
+	"math"
+	"math/rand"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/samuel/go-psp/internal/pspgen"
 )
 
 func TestDecode(t *testing.T) {
@@ -57,3 +71,830 @@ func TestDecodeConfig(t *testing.T) {
 	}
 	fmt.Printf("%+v\n", config)
 }
+
+// TestDecodeConfigHeader checks DecodeConfig against a decoder reading the
+// file header, on valid files and on every cut and corruption of their
+// headers.
+func TestDecodeConfigHeader(t *testing.T) {
+	check := func(name string, data []byte) {
+		t.Helper()
+		got, err := DecodeConfig(bytes.NewReader(data))
+		want, werr := decodeConfigSlow(context.Background(), bytes.NewReader(data), int64(len(data)))
+		if fmt.Sprint(err) != fmt.Sprint(werr) || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, %v, want %+v, %v", name, got, err, want, werr)
+		}
+	}
+	for _, m := range pspgen.Images() {
+		for _, major := range []uint16{1, 3, 5, 9} {
+			data := pspgen.Image(major, pspgen.LZ77, m)
+			name := fmt.Sprintf("%T v%d", m, major)
+			check(name, data)
+			for n := 0; n < 120; n++ {
+				check(fmt.Sprintf("%s cut to %d bytes", name, n), data[:n])
+				corrupt := bytes.Clone(data)
+				corrupt[n] ^= 0x81
+				check(fmt.Sprintf("%s with byte %d corrupt", name, n), corrupt)
+			}
+		}
+	}
+
+	// Only the header and attributes are read.
+	data := pspgen.Image(5, pspgen.LZ77, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	r := &countingReader{ReadSeeker: bytes.NewReader(data)}
+	if _, err := DecodeConfig(r); err != nil {
+		t.Fatal(err)
+	}
+	if want := 36 + 10 + int64(decodeUint32(data[42:46])); r.n != want {
+		t.Errorf("read %d bytes, want %d", r.n, want)
+	}
+}
+
+func TestDecodeGenerated(t *testing.T) {
+	for _, m := range pspgen.Images() {
+		for major := uint16(3); major <= 9; major++ {
+			for _, comp := range []Compression{CompressionNone, CompressionRLE, CompressionLZ77} {
+				name := fmt.Sprintf("%T %v v%d %v", m, m.Bounds().Max, major, comp)
+				img, err := Decode(bytes.NewReader(pspgen.Image(major, uint16(comp), m)))
+				if err != nil {
+					t.Errorf("%s: %v", name, err)
+					continue
+				}
+				if img.Bounds() != m.Bounds() {
+					t.Errorf("%s: got bounds %v", name, img.Bounds())
+					continue
+				}
+				if x, y, ok := sameColors(img, m); !ok {
+					t.Errorf("%s: pixel %d,%d = %v, want %v", name, x, y, img.At(x, y), m.At(x, y))
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeExpansion(t *testing.T) {
+	// Later versions add fields to the end of structures with stored
+	// lengths, which earlier readers skip.
+	m := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	for i := range m.Pix {
+		m.Pix[i] = byte(i * 11)
+	}
+	file := func(major uint16, expansion int) []byte {
+		a := pspgen.Attrs{Width: 3, Height: 2, Resolution: 72, Metric: 1, Compression: pspgen.RLE,
+			BitDepth: 24, LayerCount: 1, Expansion: expansion}
+		l := pspgen.Layer{Name: "Layer", Type: pspgen.RasterType(major), Rect: m.Rect, Opacity: 255,
+			Channels:  append(pspgen.RGBChannels(m.Pix), pspgen.Channel{Bitmap: pspgen.DIBTransMask, Channel: pspgen.ChannelComposite, Data: pspgen.Plane(m.Pix, 4, 3)}),
+			Expansion: expansion}
+		f := pspgen.NewFile(major).Attrs(a)
+		if major >= 4 {
+			pad := make([]byte, expansion)
+			f.Block(pspgen.CreatorBlock, concat(
+				chunkBytes(crtrFldAppID, concat(uint32Bytes(uint32(CreatorAppPaintShopPro)), pad)),
+				chunkBytes(crtrFldArtist, []byte("Artist"))))
+			f.Block(pspgen.ExtendedDataBlock, chunkBytes(xDataGrid, concat(leBytes(uint32(4), uint32(8), uint16(GridUnitsInches)), pad)))
+		}
+		return f.Layers(pspgen.LayerBytes(major, pspgen.RLE, l)).Bytes()
+	}
+	for _, major := range []uint16{3, 5, 7, 10} {
+		want := file(major, 0)
+		wantImg, err := DecodeWithOptions(bytes.NewReader(want), &Options{Strict: true})
+		if err != nil {
+			t.Fatalf("v%d: %v", major, err)
+		}
+		wantMeta, err := DecodeMetadata(bytes.NewReader(want))
+		if err != nil {
+			t.Fatalf("v%d: %v", major, err)
+		}
+		for _, expansion := range []int{1, 7, 40} {
+			name := fmt.Sprintf("v%d expanded by %d", major, expansion)
+			data := file(major, expansion)
+			img, err := DecodeWithOptions(bytes.NewReader(data), &Options{Strict: true})
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+				continue
+			}
+			if !reflect.DeepEqual(img, wantImg) {
+				t.Errorf("%s: got a different image", name)
+			}
+			meta, err := decodeMetadataWithOptions(data, &Options{Strict: true})
+			if err != nil || !reflect.DeepEqual(meta, wantMeta) {
+				t.Errorf("%s: got metadata %+v, %v, want %+v", name, meta, err, wantMeta)
+			}
+			config, err := DecodeConfig(bytes.NewReader(data))
+			if err != nil || config.Width != 3 || config.Height != 2 {
+				t.Errorf("%s: got config %+v, %v", name, config, err)
+			}
+		}
+	}
+}
+
+// sameColors reports whether a and b have the same colors, within the
+// rounding of premultiplying alpha, and otherwise the first pixel that
+// differs.
+func sameColors(a, b image.Image) (x, y int, ok bool) {
+	r := b.Bounds()
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c0 := color.RGBAModel.Convert(a.At(x, y)).(color.RGBA)
+			c1 := color.RGBAModel.Convert(b.At(x, y)).(color.RGBA)
+			if c0.A != c1.A || diff(c0.R, c1.R) > 1 || diff(c0.G, c1.G) > 1 || diff(c0.B, c1.B) > 1 {
+				return x, y, false
+			}
+		}
+	}
+	return 0, 0, true
+}
+
+func diff(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+func TestDecodeWithOptions(t *testing.T) {
+	hidden := solidRGBA(image.Rect(0, 0, 4, 4), color.RGBA{255, 0, 0, 255})
+	top := solidRGBA(image.Rect(1, 1, 3, 3), color.RGBA{0, 0, 255, 255})
+	in := &Document{
+		Width:  4,
+		Height: 4,
+		Layers: []*Layer{
+			{Name: "Hidden", Opacity: 255, Image: hidden},
+			{Name: "Top", Opacity: 255, Visible: true, Image: top},
+		},
+	}
+	var buf bytes.Buffer
+	if err := EncodeDocument(&buf, in, nil); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	for _, tc := range []struct {
+		name string
+		opts *Options
+		want image.Image
+	}{
+		{"default", nil, hidden},
+		{"skip hidden", &Options{SkipHidden: true}, top},
+	} {
+		img, err := DecodeWithOptions(bytes.NewReader(data), tc.opts)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(img, tc.want) {
+			t.Errorf("%s: got the wrong layer", tc.name)
+		}
+	}
+
+	doc, err := DecodeDocument(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := DecodeWithOptions(bytes.NewReader(data), &Options{Flatten: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := doc.Flatten(nil); !reflect.DeepEqual(img, want) {
+		t.Error("flattened image differs from Document.Flatten")
+	}
+
+	// Warnings are reported for the legacy versions.
+	img1 := testRGBA(image.Rect(0, 0, 1, 1), 0)
+	old := newFileBuilder(2).
+		attrs(testAttrs{width: 1, height: 1, bitDepth: 24, layerCount: 1}).
+		block(LayerStartBlock, layerBytes(2, CompressionNone, testLayer{
+			rect: img1.Rect, opacity: 255, channels: rgbChannels(img1),
+		})).
+		bytes()
+	var warnings []Warning
+	if _, err := DecodeWithOptions(bytes.NewReader(old), &Options{Warn: func(w Warning) { warnings = append(warnings, w) }}); err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 {
+		t.Errorf("got warnings %v, want one", warnings)
+	}
+}
+
+func TestDecodeLimits(t *testing.T) {
+	wide := new(bytes.Buffer)
+	if err := Encode(wide, testRGBA(image.Rect(0, 0, 100, 10), 0)); err != nil {
+		t.Fatal(err)
+	}
+	layered := new(bytes.Buffer)
+	l := testRGBA(image.Rect(0, 0, 2, 2), 0)
+	doc := &Document{Width: 2, Height: 2, Layers: []*Layer{{Image: l}, {Image: l}, {Image: l}}}
+	if err := EncodeDocument(layered, doc, nil); err != nil {
+		t.Fatal(err)
+	}
+	big := make(color.Palette, 200)
+	for i := range big {
+		big[i] = color.RGBA{byte(i), 0, 0, 255}
+	}
+	paletted := pspgen.Image(5, pspgen.None, image.NewPaletted(image.Rect(0, 0, 2, 2), big))
+	// A layer needn't lie within the canvas, nor hold the data to fill it.
+	huge := pspgen.NewFile(7).
+		Attrs(pspgen.Attrs{Width: 1, Height: 1, BitDepth: 48, LayerCount: 1}).
+		Layers(pspgen.LayerBytes(7, pspgen.None, pspgen.Layer{
+			Type:      pspgen.RasterType(7),
+			Rect:      image.Rect(0, 0, 16000, 16000),
+			SavedRect: image.Rect(0, 0, 16000, 16000),
+			Opacity:   255,
+			Channels:  []pspgen.Channel{{Bitmap: pspgen.DIBImage, Channel: pspgen.ChannelRed, Data: make([]byte, 3)}},
+		})).
+		Bytes()
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		opts *Options
+		err  error
+	}{
+		{"width", wide.Bytes(), &Options{MaxWidth: 50}, LimitError{"MaxWidth", 100, 50}},
+		{"height", wide.Bytes(), &Options{MaxHeight: 5}, LimitError{"MaxHeight", 10, 5}},
+		{"within limits", wide.Bytes(), &Options{MaxWidth: 100, MaxHeight: 10}, nil},
+		{"layers", layered.Bytes(), &Options{MaxLayers: 2}, LimitError{"MaxLayers", 3, 2}},
+		{"default pixels", huge, nil, LimitError{"MaxPixels", 16000 * 16000, DefaultMaxPixels}},
+		{"pixels", layered.Bytes(), &Options{MaxPixels: 3}, LimitError{"MaxPixels", 4, 3}},
+		{"within pixels", layered.Bytes(), &Options{MaxPixels: 12}, nil},
+		{"default palette", paletted, nil, nil},
+		{"palette", paletted, &Options{MaxPaletteEntries: 199}, LimitError{"MaxPaletteEntries", 200, 199}},
+		{"disabled", paletted, &Options{MaxPaletteEntries: -1}, nil},
+	} {
+		_, err := DecodeWithOptions(bytes.NewReader(tc.data), tc.opts)
+		var lerr LimitError
+		if errors.As(err, &lerr) {
+			err = lerr
+		}
+		if err != tc.err {
+			t.Errorf("%s: got error %v, want %v", tc.name, err, tc.err)
+		}
+	}
+	if s, want := (LimitError{"MaxPixels", 12, 3}).Error(), "psp: MaxPixels limit 3 exceeded: 12"; s != want {
+		t.Errorf("got message %q, want %q", s, want)
+	}
+}
+
+func TestDecodePaletteSize(t *testing.T) {
+	attrs := pspgen.Attrs{Width: 1, Height: 1, BitDepth: 8, LayerCount: 1}
+	for _, tc := range []struct {
+		name     string
+		bitDepth uint16
+		payload  []byte
+	}{
+		{"huge", 8, pspgen.LE(uint32(8), uint32(0x40000000))},
+		{"overrun", 8, pspgen.LE(uint32(8), uint32(3), make([]byte, 8))},
+		{"8 bit", 8, pspgen.LE(uint32(8), uint32(257), make([]byte, 257*4))},
+	} {
+		attrs.BitDepth = tc.bitDepth
+		data := pspgen.NewFile(5).Attrs(attrs).Block(pspgen.ColorBlock, tc.payload).Bytes()
+		_, err := DecodeWithOptions(bytes.NewReader(data), &Options{MaxPaletteEntries: -1})
+		var ferr FormatError
+		if !errors.As(err, &ferr) {
+			t.Errorf("%s: got error %v, want a FormatError", tc.name, err)
+		}
+	}
+}
+
+func TestDecodeInvalidSize(t *testing.T) {
+	unlimited := &Options{MaxWidth: -1, MaxHeight: -1}
+	layer := func(saved image.Rectangle) []byte {
+		return pspgen.NewFile(5).
+			Attrs(pspgen.Attrs{Width: 2, Height: 2, BitDepth: 24, LayerCount: 1}).
+			Layers(pspgen.LayerBytes(5, pspgen.None, pspgen.Layer{
+				Rect:      image.Rect(0, 0, 2, 2),
+				SavedRect: saved,
+				Opacity:   255,
+				Channels:  []pspgen.Channel{{Bitmap: pspgen.DIBImage, Channel: pspgen.ChannelRed, Data: make([]byte, 4)}},
+			})).
+			Bytes()
+	}
+	// Rect normalizes its arguments, so inverted rectangles are built by
+	// hand.
+	inverted := image.Rectangle{Min: image.Pt(2, 0), Max: image.Pt(0, 2)}
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"negative width", pspgen.NewFile(5).Attrs(pspgen.Attrs{Width: -1, Height: 1, BitDepth: 24}).Bytes()},
+		{"zero height", pspgen.NewFile(5).Attrs(pspgen.Attrs{Width: 1, Height: 0, BitDepth: 24}).Bytes()},
+		{"overflow", pspgen.NewFile(5).Attrs(pspgen.Attrs{Width: math.MaxInt32, Height: math.MaxInt32, BitDepth: 24}).Bytes()},
+		{"inverted layer", layer(inverted)},
+		{"huge layer", layer(image.Rect(math.MinInt32, math.MinInt32, math.MaxInt32, math.MaxInt32))},
+	} {
+		_, err := DecodeWithOptions(bytes.NewReader(tc.data), unlimited)
+		var ferr FormatError
+		if !errors.As(err, &ferr) {
+			t.Errorf("%s: got error %v, want a FormatError", tc.name, err)
+		}
+	}
+}
+
+func TestDecodeProgress(t *testing.T) {
+	l := testRGBA(image.Rect(0, 0, 3, 2), 0)
+	doc := &Document{Width: 3, Height: 2, Layers: []*Layer{{Image: l}, {Image: l}}}
+	var buf bytes.Buffer
+	if err := EncodeDocument(&buf, doc, nil); err != nil {
+		t.Fatal(err)
+	}
+	var calls int
+	var last, total int64
+	opts := &Options{Progress: func(done, t int64) {
+		calls++
+		if done < last {
+			panic("progress went backwards")
+		}
+		last, total = done, t
+	}}
+	if _, err := DecodeWithOptions(bytes.NewReader(buf.Bytes()), opts); err != nil {
+		t.Fatal(err)
+	}
+	// Three channels and the layer itself for each layer.
+	if calls != 8 {
+		t.Errorf("got %d calls, want 8", calls)
+	}
+	if last != total || total <= 0 {
+		t.Errorf("finished at %d of %d", last, total)
+	}
+
+	opts.Progress = func(done, total int64) { panic("boom") }
+	_, err := DecodeWithOptions(bytes.NewReader(buf.Bytes()), opts)
+	var perr ProgressError
+	if !errors.As(err, &perr) || perr.Value != "boom" {
+		t.Errorf("got error %v, want a ProgressError", err)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	img := testRGBA(image.Rect(0, 0, 2, 2), 0)
+	file := func(unknown bool, extra ...[]byte) []byte {
+		b := newFileBuilder(5).attrs(testAttrs{width: 2, height: 2, bitDepth: 24, layerCount: 1})
+		if unknown {
+			b.block(200, nil)
+		}
+		return b.block(LayerStartBlock, layerBytes(5, CompressionNone, testLayer{
+			rect:     img.Rect,
+			opacity:  255,
+			channels: rgbChannels(img),
+			extra:    extra,
+		})).bytes()
+	}
+	for _, tc := range []struct {
+		name  string
+		data  []byte
+		layer int
+		code  WarningCode
+		block string
+	}{
+		{"unknown block", file(true), -1, WarnUnknownBlock, "BlockID(200)"},
+		{"extra channel", file(false, channelBytes(5, CompressionNone, rgbChannels(img)[0])), 0, WarnFormat, "ChannelBlock"},
+		{"short chunk", file(false, blockBytes(5, GroupExtensionBlock, leBytes(uint32(4), uint32(0)))), 0, WarnFormat, "GroupExtensionBlock"},
+	} {
+		var warnings []Warning
+		opts := &Options{Warn: func(w Warning) { warnings = append(warnings, w) }}
+		if _, err := DecodeWithOptions(bytes.NewReader(tc.data), opts); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+		if len(warnings) != 1 || warnings[0].Layer != tc.layer {
+			t.Errorf("%s: got warnings %v, want one for layer %d", tc.name, warnings, tc.layer)
+			continue
+		}
+		if w := warnings[0]; w.Code != tc.code || w.Block != tc.block || w.Offset <= 0 || w.Offset > int64(len(tc.data)) {
+			t.Errorf("%s: got %v at offset %d in %q, want %v in %q", tc.name, w.Code, w.Offset, w.Block, tc.code, tc.block)
+		}
+		_, err := DecodeWithOptions(bytes.NewReader(tc.data), &Options{Strict: true})
+		var ferr FormatError
+		if !errors.As(err, &ferr) {
+			t.Errorf("%s: got error %v in strict mode, want a FormatError", tc.name, err)
+		}
+	}
+
+	// Trailing data after the last block.
+	var buf bytes.Buffer
+	if err := Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString("garbage")
+	for _, strict := range []bool{false, true} {
+		var warnings []Warning
+		err := func() (err error) {
+			defer catchErrors(&err)
+			d := newDecoder(bytes.NewReader(buf.Bytes()), &Options{
+				Strict: strict,
+				Warn:   func(w Warning) { warnings = append(warnings, w) },
+			})
+			d.decode()
+			d.decodeTrailingBlocks()
+			return nil
+		}()
+		if strict && err == nil || !strict && (err != nil || len(warnings) != 1) {
+			t.Errorf("strict %v: got error %v and warnings %v", strict, err, warnings)
+		}
+	}
+}
+
+func TestBlockHandler(t *testing.T) {
+	img := testRGBA(image.Rect(0, 0, 2, 2), 0)
+	data := newFileBuilder(5).
+		attrs(testAttrs{width: 2, height: 2, bitDepth: 24, layerCount: 1}).
+		block(200, []byte("payload")).
+		block(LayerStartBlock, layerBytes(5, CompressionNone, testLayer{
+			rect:     img.Rect,
+			opacity:  255,
+			channels: rgbChannels(img),
+		})).
+		block(201, []byte("trailing")).
+		bytes()
+
+	// Read only part of the first block to check the rest is skipped.
+	var got []string
+	opts := &Options{
+		BlockHandler: func(id BlockID, r io.Reader) error {
+			b := make([]byte, 4)
+			n, _ := io.ReadFull(r, b)
+			got = append(got, fmt.Sprintf("%v:%s", id, b[:n]))
+			return nil
+		},
+		Warn: func(w Warning) { t.Errorf("unexpected warning %v", w) },
+	}
+	d := newDecoder(bytes.NewReader(data), opts)
+	if err := func() (err error) {
+		defer catchErrors(&err)
+		if m := d.decode(); !reflect.DeepEqual(m, img) {
+			t.Error("decoded image differs")
+		}
+		d.decodeTrailingBlocks()
+		return nil
+	}(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "[BlockID(200):payl BlockID(201):trai]"; fmt.Sprint(got) != want {
+		t.Errorf("got blocks %v, want %v", got, want)
+	}
+
+	errBad := errors.New("bad block")
+	var warnings []Warning
+	opts = &Options{
+		BlockHandler: func(BlockID, io.Reader) error { return errBad },
+		Warn:         func(w Warning) { warnings = append(warnings, w) },
+	}
+	if _, err := DecodeWithOptions(bytes.NewReader(data), opts); err != nil || len(warnings) != 1 {
+		t.Errorf("got error %v and warnings %v, want one warning", err, warnings)
+	}
+	opts.Strict = true
+	if _, err := DecodeWithOptions(bytes.NewReader(data), opts); !errors.Is(err, errBad) {
+		t.Errorf("got error %v in strict mode, want %v", err, errBad)
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	img := testRGBA(image.Rect(0, 0, 2, 2), 0)
+	chans := rgbChannels(img)
+	layer := layerBytes(5, CompressionNone, testLayer{rect: img.Rect, opacity: 255, channels: chans})
+	// Cut the file within the data of the second channel.
+	cut := len(layer) - len(channelBytes(5, CompressionNone, chans[2])) - 2
+	data := newFileBuilder(5).
+		attrs(testAttrs{width: 2, height: 2, bitDepth: 24, layerCount: 1}).
+		block(LayerStartBlock, layer).
+		bytes()
+	data = data[:len(data)-len(layer)+cut]
+
+	_, err := Decode(io.MultiReader(bytes.NewReader(data)))
+	var derr *DecodeError
+	if !errors.As(err, &derr) {
+		t.Fatalf("got error %v, want a DecodeError", err)
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("got error %v, want io.ErrUnexpectedEOF", err)
+	}
+	if derr.Offset != int64(len(data)) || derr.Block != "ChannelBlock" || derr.Layer != 0 || derr.Channel != 1 {
+		t.Errorf("got %+v", derr)
+	}
+
+	data = newFileBuilder(5).
+		attrs(testAttrs{width: 2, height: 2, bitDepth: 24, layerCount: 1}).
+		block(LayerStartBlock, []byte("~BX\x00\x04\x00\x00\x00\x00\x00")).
+		bytes()
+	_, err = Decode(bytes.NewReader(data))
+	var ferr FormatError
+	if !errors.As(err, &ferr) || !errors.As(err, &derr) || derr.Block != "LayerStartBlock" || derr.Layer != -1 {
+		t.Errorf("got error %v, want a FormatError within the layer bank", err)
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	for _, comp := range []Compression{CompressionNone, CompressionRLE, CompressionLZ77} {
+		var buf bytes.Buffer
+		if err := EncodeWithOptions(&buf, testRGBA(image.Rect(0, 0, 9, 7), 5), &EncodeOptions{Compression: comp}); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+		// Cut within the file header, within every block header and within
+		// the data of the last channel.
+		cuts := []int{0, 20, len(data) - 3}
+		for i := 0; ; i++ {
+			j := bytes.Index(data[i:], blockMagic)
+			if j < 0 {
+				break
+			}
+			i += j
+			cuts = append(cuts, i+6)
+		}
+		for _, n := range cuts {
+			// Hide the length of the input, which is otherwise checked
+			// against the block lengths up front.
+			_, err := Decode(io.MultiReader(bytes.NewReader(data[:n])))
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("%v cut at %d: got error %v, want io.ErrUnexpectedEOF", comp, n, err)
+			}
+		}
+	}
+}
+
+func TestDecodeBlockOverrun(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, testRGBA(image.Rect(0, 0, 9, 7), 5)); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	_, err := Decode(bytes.NewReader(data[:len(data)-3]))
+	var ferr FormatError
+	if !errors.As(err, &ferr) || !strings.Contains(err.Error(), "but only") {
+		t.Errorf("truncated input: got error %v, want a FormatError about the remaining bytes", err)
+	}
+
+	// A layer claiming more than its bank holds, in a stream.
+	data = pspgen.NewFile(5).
+		Attrs(pspgen.Attrs{Width: 1, Height: 1, BitDepth: 24, LayerCount: 1}).
+		Layers(pspgen.Block(5, pspgen.LayerBlock, make([]byte, 100))[:20]).
+		Raw(make([]byte, 200)).
+		Bytes()
+	_, err = Decode(io.MultiReader(bytes.NewReader(data)))
+	if !errors.As(err, &ferr) || !strings.Contains(err.Error(), "parent block") {
+		t.Errorf("nested overrun: got error %v, want a FormatError about the parent block", err)
+	}
+}
+
+// panicReader panics with a string once its input is used up.
+type panicReader struct {
+	r io.Reader
+}
+
+func (r panicReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err == io.EOF {
+		panic("reader exploded")
+	}
+	return n, err
+}
+
+func TestDecodeReaderPanic(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, testRGBA(image.Rect(0, 0, 2, 2), 0)); err != nil {
+		t.Fatal(err)
+	}
+	_, err := Decode(panicReader{bytes.NewReader(buf.Bytes()[:50])})
+	if err == nil || !strings.Contains(err.Error(), "reader exploded") {
+		t.Errorf("got error %v, want one from the panic", err)
+	}
+}
+
+// BenchmarkDecodeSmall decodes images so small, like thumbnails, that
+// setting up the decoder costs as much as the pixels. The input buffers
+// and decompressors come from a pool, so allocations beyond the limits
+// are a regression.
+func BenchmarkDecodeSmall(b *testing.B) {
+	img := testRGBA(image.Rect(0, 0, 16, 16), 1)
+	for _, tc := range []struct {
+		comp      Compression
+		maxAllocs float64
+	}{
+		{CompressionNone, 8},
+		{CompressionRLE, 8},
+		{CompressionLZ77, 11},
+	} {
+		b.Run(tc.comp.String(), func(b *testing.B) {
+			var buf bytes.Buffer
+			if err := EncodeWithOptions(&buf, img, &EncodeOptions{Compression: tc.comp}); err != nil {
+				b.Fatal(err)
+			}
+			decode := func() {
+				if _, err := Decode(bytes.NewReader(buf.Bytes())); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if n := testing.AllocsPerRun(100, decode); n > tc.maxAllocs {
+				b.Errorf("got %v allocations per decode, want at most %v", n, tc.maxAllocs)
+			}
+			b.SetBytes(int64(buf.Len()))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				decode()
+			}
+		})
+	}
+}
+
+// TestDecodeInputs checks that readers used directly decode the same as
+// readers the decoder buffers, including where they fail.
+func TestDecodeInputs(t *testing.T) {
+	for i, data := range pspgen.Corpus() {
+		for _, n := range []int{len(data), len(data) * 2 / 3, len(data) / 3} {
+			// The buffered readers of the same methods are the reference.
+			br := bytes.NewReader(data[:n])
+			for _, tc := range []struct{ r, ref io.Reader }{
+				{bytes.NewReader(data[:n]), struct{ *bytes.Reader }{br}},
+				{strings.NewReader(string(data[:n])), struct{ *bytes.Reader }{br}},
+				{bufio.NewReader(bytes.NewReader(data[:n])), struct{ io.Reader }{br}},
+			} {
+				br.Reset(data[:n])
+				want, werr := DecodeDocument(tc.ref)
+				got, err := DecodeDocument(tc.r)
+				if fmt.Sprint(err) != fmt.Sprint(werr) {
+					t.Errorf("corpus file %d cut to %d bytes, %T: got error %v, want %v", i, n, tc.r, err, werr)
+				} else if !reflect.DeepEqual(got, want) {
+					t.Errorf("corpus file %d cut to %d bytes, %T: document mismatch", i, n, tc.r)
+				}
+			}
+		}
+	}
+}
+
+// BenchmarkDecodeInput compares a reader over memory, which is read from
+// directly, with one the decoder copies through a buffer.
+func BenchmarkDecodeInput(b *testing.B) {
+	var buf bytes.Buffer
+	img := testRGBA(image.Rect(0, 0, 512, 512), 1)
+	if err := EncodeWithOptions(&buf, img, &EncodeOptions{Compression: CompressionNone}); err != nil {
+		b.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		r    func() io.Reader
+	}{
+		{"bytes.Reader", func() io.Reader { return bytes.NewReader(buf.Bytes()) }},
+		{"io.Reader", func() io.Reader { return struct{ io.Reader }{bytes.NewReader(buf.Bytes())} }},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			b.SetBytes(int64(buf.Len()))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := Decode(tc.r()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// sizedReader hides that a reader can seek, while its length stays known.
+type sizedReader struct {
+	r *bytes.Reader
+}
+
+func (s sizedReader) Read(p []byte) (int, error) { return s.r.Read(p) }
+func (s sizedReader) Len() int                   { return s.r.Len() }
+
+func TestSkipSeeks(t *testing.T) {
+	data := make([]byte, 1<<16)
+	for i := range data {
+		data[i] = byte(i) ^ byte(i>>8)
+	}
+	rs := &countingReader{ReadSeeker: bytes.NewReader(data)}
+	d := newRawDecoder(context.Background(), rs, nil)
+	defer d.release()
+	// Skips within the buffer discard and longer ones seek.
+	for _, step := range []struct{ skip, read int }{
+		{0, 3},
+		{10000, 2},
+		{1, 1},
+		{4000, 5},
+		{30000, 1},
+		{2, 0},
+		{100, 4},
+		{20000, 8},
+	} {
+		want := d.offset + int64(step.skip+step.read)
+		d.skip(step.skip)
+		if p, err := d.r.Peek(1); err != nil || p[0] != data[d.offset] {
+			t.Fatalf("at %d: peeked %v, %v, want %#x", d.offset, p, err, data[d.offset])
+		}
+		if step.read > 0 {
+			b := make([]byte, step.read)
+			b[0] = d.readByte()
+			d.read(b[1:])
+			if !bytes.Equal(b, data[d.offset-int64(step.read):d.offset]) {
+				t.Fatalf("at %d: read %x, want %x", d.offset, b, data[d.offset-int64(step.read):d.offset])
+			}
+		}
+		if d.offset != want {
+			t.Fatalf("got offset %d, want %d", d.offset, want)
+		}
+	}
+	if rs.n > int64(len(data)/4) {
+		t.Errorf("read %d of %d bytes", rs.n, len(data))
+	}
+
+	// Skipping past the end fails where discarding does.
+	skipPastEnd := func(r io.Reader) error {
+		d := newRawDecoder(context.Background(), r, nil)
+		defer d.release()
+		return func() (err error) {
+			defer catchErrors(&err)
+			d.skip(100)
+			d.skip(len(data))
+			return nil
+		}()
+	}
+	rs.Seek(0, io.SeekStart)
+	err := skipPastEnd(rs)
+	want := skipPastEnd(struct{ io.Reader }{bytes.NewReader(data)})
+	var de *DecodeError
+	if !errors.As(err, &de) || de.Offset != int64(len(data)) || !errors.Is(err, io.ErrUnexpectedEOF) || err.Error() != want.Error() {
+		t.Errorf("got error %v, want %v", err, want)
+	}
+}
+
+func TestDecodeMetadataSeeks(t *testing.T) {
+	img := testRGBA(image.Rect(0, 0, 256, 256), 1)
+	var buf bytes.Buffer
+	if err := EncodeWithOptions(&buf, img, &EncodeOptions{Compression: CompressionNone}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	rs := &countingReader{ReadSeeker: bytes.NewReader(data)}
+	meta, err := DecodeMetadata(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := DecodeMetadata(struct{ io.Reader }{bytes.NewReader(data)})
+	if !reflect.DeepEqual(meta, want) {
+		t.Errorf("got metadata %+v, want %+v", meta, want)
+	}
+	if rs.n > int64(len(data)/4) {
+		t.Errorf("read %d of %d bytes to skip the layers", rs.n, len(data))
+	}
+	// A file cut short within the layers fails as it does without seeking.
+	cut := bytes.NewReader(data[:len(data)/2])
+	_, err = DecodeMetadata(&countingReader{ReadSeeker: cut})
+	cut.Seek(0, io.SeekStart)
+	_, werr := DecodeMetadata(sizedReader{cut})
+	if err == nil || err.Error() != werr.Error() {
+		t.Errorf("got error %v, want %v", err, werr)
+	}
+}
+
+func BenchmarkDecodeConfig(b *testing.B) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, testRGBA(image.Rect(0, 0, 64, 64), 1)); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := DecodeConfig(bytes.NewReader(buf.Bytes())); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchImage returns an image of the given type with noisy but compressible
+// pixels.
+func benchImage(m draw.Image) image.Image {
+	rnd := rand.New(rand.NewSource(1))
+	b := m.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			v := uint16(x*y) + uint16(rnd.Intn(512))
+			m.Set(x, y, color.NRGBA64{v, v * 3, v * 7, 0xffff - v/2})
+		}
+	}
+	return m
+}
+
+func BenchmarkDecode(b *testing.B) {
+	r := image.Rect(0, 0, 256, 256)
+	palette := make(color.Palette, 256)
+	for i := range palette {
+		palette[i] = color.RGBA{byte(i), byte(i * 3), byte(i * 7), 255}
+	}
+	for _, bc := range []struct {
+		name string
+		comp uint16
+		m    image.Image
+	}{
+		{"Paletted", pspgen.LZ77, benchImage(image.NewPaletted(r, palette))},
+		{"RGB/LZ77", pspgen.LZ77, benchImage(image.NewRGBA(r))},
+		{"RGB/RLE", pspgen.RLE, benchImage(image.NewRGBA(r))},
+		{"RGBA64/LZ77", pspgen.LZ77, benchImage(image.NewNRGBA64(r))},
+	} {
+		data := pspgen.Image(5, bc.comp, bc.m)
+		b.Run(bc.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := Decode(bytes.NewReader(data)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package psp
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+)
+
+// maxDumpData is the number of bytes of an uninterpreted block or chunk
+// that DumpStructure includes in its output.
+const maxDumpData = 32
+
+// structure is the output of DumpStructure.
+type structure struct {
+	VersionMajor uint16           `json:"versionMajor"`
+	VersionMinor uint16           `json:"versionMinor"`
+	Blocks       []*structureNode `json:"blocks"`
+
+	// Error is the error that stopped parsing and StoppedAt the offset at
+	// which it occurred.
+	Error     string `json:"error,omitempty"`
+	StoppedAt *int64 `json:"stoppedAt,omitempty"`
+}
+
+// structureNode is a block or a chunk of a block. Offset is the position
+// of its header and Length the length of the data following the header.
+type structureNode struct {
+	Block    string                 `json:"block,omitempty"`
+	Chunk    *uint16                `json:"chunk,omitempty"`
+	Offset   int64                  `json:"offset"`
+	Length   uint32                 `json:"length"`
+	Fields   map[string]interface{} `json:"fields,omitempty"`
+	Data     string                 `json:"data,omitempty"` // hex, cut to maxDumpData bytes
+	Children []*structureNode       `json:"children,omitempty"`
+}
+
+// DumpStructure writes the structure of the PSP file read from r to w as
+// JSON: the blocks, their sub-blocks and chunks with their offsets and
+// lengths, and the header fields of the image, layers, channels and other
+// structures the package knows. The data of other blocks and chunks is cut
+// to a few bytes, and pixel data is skipped rather than decompressed.
+//
+// A file that can't be parsed to the end is still dumped as far as it
+// goes, with the error and the offset at which parsing stopped. The
+// returned error only reports failures to write to w.
+func DumpStructure(r io.Reader, w io.Writer) error {
+	d := newRawDecoder(context.Background(), r, nil)
+	defer d.release()
+	s := &structure{Blocks: []*structureNode{}}
+	if err := d.dumpFile(s); err != nil {
+		s.Error = err.Error()
+		offset := d.offset
+		s.StoppedAt = &offset
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
+
+func (d *decoder) dumpFile(s *structure) (err error) {
+	defer catchErrors(&err)
+	d.readVersion()
+	s.VersionMajor, s.VersionMinor = d.versionMajor, d.versionMinor
+	d.dumpBlocks(&s.Blocks, -1)
+	return nil
+}
+
+// dumpBlocks appends the blocks up to the offset end, or up to the end of
+// the input if end is negative, to nodes. A node is appended before its
+// data is read so that it is kept if reading fails.
+func (d *decoder) dumpBlocks(nodes *[]*structureNode, end int64) {
+	var bh blockHeader
+	for end < 0 && !d.atEOF() || end >= 0 && d.offset < end {
+		n := &structureNode{Offset: d.offset}
+		*nodes = append(*nodes, n)
+		d.readBlockHeader(&bh)
+		n.Block, n.Length = bh.id.String(), bh.dataLen
+		blockEnd := d.offset + int64(bh.dataLen)
+		d.dumpBlock(n, bh.id, blockEnd)
+		d.skipTo(blockEnd)
+	}
+}
+
+// dumpBlock fills in the node of a block of type id ending at end.
+func (d *decoder) dumpBlock(n *structureNode, id BlockID, end int64) {
+	switch id {
+	case ImageBlock:
+		d.readImageAttributes(n.Length)
+		n.Fields = map[string]interface{}{
+			"width":          d.width,
+			"height":         d.height,
+			"resolution":     d.meta.Resolution,
+			"resolutionUnit": d.meta.ResolutionUnit.String(),
+			"compression":    d.comp.String(),
+			"bitDepth":       d.bitDepth,
+			"planeCount":     d.planeCount,
+			"colorCount":     d.colorCount,
+			"grayscale":      d.grayscale,
+			"totalImageSize": d.totalImageSize,
+			"activeLayer":    d.activeLayer,
+			"layerCount":     d.layerCount,
+			"contents":       d.contents,
+		}
+	case CreatorBlock, ExtendedDataBlock:
+		d.dumpChunks(n, end)
+	case ColorBlock:
+		if d.versionMajor >= 4 {
+			d.readUint32()
+		}
+		n.Fields = map[string]interface{}{"entries": d.readUint32()}
+	case LayerStartBlock:
+		d.dumpBlocks(&n.Children, end)
+	case LayerBlock:
+		var l Layer
+		d.readLayerInfo(&l)
+		n.Fields = map[string]interface{}{
+			"name":          l.Name,
+			"kind":          l.Kind.String(),
+			"rect":          l.Rect.String(),
+			"savedRect":     l.SavedRect.String(),
+			"opacity":       l.Opacity,
+			"blendMode":     l.BlendMode.String(),
+			"visible":       l.Visible,
+			"maskRect":      l.MaskRect.String(),
+			"savedMaskRect": l.SavedMaskRect.String(),
+			"bitmapCount":   l.BitmapCount,
+			"channelCount":  l.ChannelCount,
+		}
+		if !d.channelsDeclared() {
+			// The counts aren't stored.
+			delete(n.Fields, "bitmapCount")
+			delete(n.Fields, "channelCount")
+		}
+		d.dumpBlocks(&n.Children, end)
+	case ChannelBlock:
+		compressedLen, bt, ct := d.readChannelHeader()
+		n.Fields = map[string]interface{}{
+			"compressedLength": compressedLen,
+			"bitmapType":       bt.String(),
+			"channelType":      ct.String(),
+		}
+	case AlphaBankBlock, TableBankBlock, CompositeImageBankBlock:
+		var count uint32
+		switch {
+		case d.versionMajor < 4:
+			count = uint32(d.readUint16())
+		case id == CompositeImageBankBlock:
+			chunkEnd := d.readChunkSize()
+			count = d.readUint32()
+			d.skipTo(chunkEnd)
+		default:
+			chunkEnd := d.readChunkSize()
+			count = uint32(d.readUint16())
+			d.skipTo(chunkEnd)
+		}
+		n.Fields = map[string]interface{}{"count": count}
+		d.dumpBlocks(&n.Children, end)
+	case AlphaChannelBlock:
+		var chunkEnd int64
+		if d.versionMajor >= 4 {
+			chunkEnd = d.readChunkSize()
+		}
+		name, _ := d.readName()
+		n.Fields = map[string]interface{}{
+			"name":      name,
+			"rect":      d.readRect().String(),
+			"savedRect": d.readRect().String(),
+		}
+		if d.versionMajor >= 4 {
+			d.skipTo(chunkEnd)
+			d.skipTo(d.readChunkSize())
+		} else {
+			d.skip(4) // bitmap and channel counts
+			d.skipInitialData(d.offset)
+		}
+		d.dumpBlocks(&n.Children, end)
+	case TableBlock:
+		chunkEnd := d.readChunkSize()
+		name, _ := d.readText(int(d.readUint16()))
+		kind := TableKind(d.readUint16())
+		n.Fields = map[string]interface{}{
+			"name":    name,
+			"kind":    kind.String(),
+			"entries": d.readUint16(),
+		}
+		d.skipTo(chunkEnd)
+		if kind == TablePaper || kind == TablePattern {
+			d.dumpBlocks(&n.Children, end)
+		} else {
+			d.dumpData(n, end)
+		}
+	case PaperBlock, PatternBlock:
+		chunkEnd := d.readChunkSize()
+		name, _ := d.readText(int(d.readUint16()))
+		n.Fields = map[string]interface{}{
+			"name":   name,
+			"width":  int32(d.readUint32()),
+			"height": int32(d.readUint32()),
+		}
+		d.skipTo(chunkEnd)
+		d.dumpBlocks(&n.Children, end)
+	case CompositeAttributesBlock:
+		a := d.readCompositeAttrs()
+		n.Fields = map[string]interface{}{
+			"width":       a.width,
+			"height":      a.height,
+			"bitDepth":    a.bitDepth,
+			"compression": a.comp.String(),
+			"planeCount":  a.planeCount,
+			"colorCount":  a.colorCount,
+			"thumbnail":   a.kind == compositeThumbnail,
+		}
+	case ThumbnailBlock:
+		if d.versionMajor < 4 {
+			// A top-level thumbnail block.
+			a := d.readThumbnailAttrs()
+			n.Fields = map[string]interface{}{
+				"width":       a.width,
+				"height":      a.height,
+				"bitDepth":    a.bitDepth,
+				"compression": a.comp.String(),
+				"planeCount":  a.planeCount,
+				"colorCount":  a.colorCount,
+			}
+			d.dumpBlocks(&n.Children, end)
+			break
+		}
+		if d.versionMajor < 6 {
+			d.dumpData(n, end)
+			break
+		}
+		// A composite image block within the composite image bank.
+		chunkEnd := d.readChunkSize()
+		n.Fields = map[string]interface{}{
+			"bitmapCount":  d.readUint16(),
+			"channelCount": d.readUint16(),
+		}
+		d.skipTo(chunkEnd)
+		d.dumpBlocks(&n.Children, end)
+	case JPEGBlock:
+		chunkEnd := d.readChunkSize()
+		n.Fields = map[string]interface{}{
+			"compressedLength":   d.readUint32(),
+			"uncompressedLength": d.readUint32(),
+			"imageType":          d.readUint16(),
+		}
+		d.skipTo(chunkEnd)
+	default:
+		d.dumpData(n, end)
+	}
+}
+
+// dumpChunks appends the chunks of a block ending at end to its node.
+func (d *decoder) dumpChunks(n *structureNode, end int64) {
+	var ch chunkHeader
+	for d.nextChunk(&ch, end) {
+		keyword := ch.fieldKeyword
+		c := &structureNode{Chunk: &keyword, Offset: d.offset - chunkHeaderLen, Length: ch.dataLen}
+		n.Children = append(n.Children, c)
+		if !d.checkChunk(&ch, end) {
+			return
+		}
+		chunkEnd := d.offset + int64(ch.dataLen)
+		d.dumpData(c, chunkEnd)
+		d.skipTo(chunkEnd)
+	}
+}
+
+// dumpData sets the data of a node to the first bytes before end.
+func (d *decoder) dumpData(n *structureNode, end int64) {
+	k := end - d.offset
+	if k > maxDumpData {
+		k = maxDumpData
+	}
+	if k <= 0 {
+		return
+	}
+	d.read(d.tmpBuf[:k])
+	n.Data = hex.EncodeToString(d.tmpBuf[:k])
+}
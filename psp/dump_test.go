@@ -0,0 +1,79 @@
+package psp
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"strings"
+	"testing"
+)
+
+func TestDumpStructure(t *testing.T) {
+	img := testRGBA(image.Rect(0, 0, 2, 2), 0)
+	data := newFileBuilder(5).
+		attrs(testAttrs{width: 2, height: 2, bitDepth: 24, layerCount: 1}).
+		block(CreatorBlock, chunkBytes(crtrFldAppID, leBytes(uint32(1)))).
+		block(LayerStartBlock, layerBytes(5, CompressionNone, testLayer{
+			name:     "Background",
+			rect:     img.Rect,
+			opacity:  255,
+			channels: rgbChannels(img),
+		})).
+		block(200, []byte(strings.Repeat("x", 100))).
+		bytes()
+
+	var out bytes.Buffer
+	if err := DumpStructure(bytes.NewReader(data), &out); err != nil {
+		t.Fatal(err)
+	}
+	var s structure
+	if err := json.Unmarshal(out.Bytes(), &s); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, out.Bytes())
+	}
+	if s.VersionMajor != 5 || s.Error != "" || s.StoppedAt != nil {
+		t.Errorf("got version %d and error %q", s.VersionMajor, s.Error)
+	}
+	var names []string
+	for _, b := range s.Blocks {
+		names = append(names, b.Block)
+	}
+	if got, want := strings.Join(names, " "), "ImageBlock CreatorBlock LayerStartBlock BlockID(200)"; got != want {
+		t.Fatalf("got blocks %s, want %s", got, want)
+	}
+	if w := s.Blocks[0].Fields["width"]; w != 2.0 {
+		t.Errorf("got width %v", w)
+	}
+	if c := s.Blocks[1].Children; len(c) != 1 || c[0].Chunk == nil || *c[0].Chunk != crtrFldAppID || c[0].Data != "01000000" {
+		t.Errorf("got creator chunks %+v", c)
+	}
+	layers := s.Blocks[2].Children
+	if len(layers) != 1 || layers[0].Block != "LayerBlock" || layers[0].Fields["name"] != "Background" {
+		t.Fatalf("got layers %+v", layers)
+	}
+	if c := layers[0].Children; len(c) != 3 || c[0].Block != "ChannelBlock" || c[0].Fields["channelType"] != "channelRed" || c[0].Data != "" {
+		t.Errorf("got channels %+v", c)
+	}
+	if d := s.Blocks[3].Data; len(d) != 2*maxDumpData {
+		t.Errorf("got %d hex digits of unknown block data, want %d", len(d), 2*maxDumpData)
+	}
+	for _, b := range s.Blocks {
+		if !bytes.Equal(data[b.Offset:b.Offset+4], blockMagic) {
+			t.Errorf("%s: offset %d is not at a block header", b.Block, b.Offset)
+		}
+	}
+
+	// Broken input is dumped up to where parsing stopped.
+	broken := append([]byte(nil), data...)
+	copy(broken[layers[0].Offset:], "junk")
+	out.Reset()
+	if err := DumpStructure(bytes.NewReader(broken), &out); err != nil {
+		t.Fatal(err)
+	}
+	s = structure{}
+	if err := json.Unmarshal(out.Bytes(), &s); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, out.Bytes())
+	}
+	if len(s.Blocks) != 3 || !strings.Contains(s.Error, "bad block magic") || s.StoppedAt == nil || *s.StoppedAt <= layers[0].Offset {
+		t.Errorf("got %d blocks, error %q at %v", len(s.Blocks), s.Error, s.StoppedAt)
+	}
+}
@@ -0,0 +1,680 @@
+package psp
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"math"
+)
+
+type encoder struct {
+	major     uint16
+	comp      Compression
+	bitDepth  uint16
+	grayscale bool
+	palette   color.Palette
+	contents  GraphicContents
+}
+
+// plane is the uncompressed data of a channel.
+type plane struct {
+	bitmap  bitmapType
+	channel channelType
+	data    []byte
+}
+
+// EncodeOptions are the encoding parameters.
+type EncodeOptions struct {
+	// Version is the major version of the file format to write, from 3
+	// (PSP5) to 9. Version 3 files have fixed size block headers and layer
+	// names and no composite image bank. Zero means version 5.
+	Version int
+
+	// Compression is the method used to compress channel data.
+	Compression Compression
+
+	// ThumbnailSize, if positive, embeds a preview of the flattened
+	// document scaled down to fit within ThumbnailSize pixels square.
+	// Files of version 4 and later store it in the composite image bank,
+	// older ones in a thumbnail block.
+	ThumbnailSize int
+
+	// ThumbnailJPEG stores the preview JPEG compressed rather than with
+	// Compression. Only the composite image bank can hold JPEG previews.
+	ThumbnailJPEG bool
+}
+
+// Encode writes the image m to w as a single-layer PSP file with LZ77
+// compressed channels. An *image.Paletted is stored as 8 bit indexed color
+// along with its palette and *image.Gray and *image.Gray16 as 8 and 16 bit
+// grayscale. *image.RGBA64 and *image.NRGBA64 are stored as 48 bit color,
+// or as 64 bit color with a transparency mask if they aren't opaque. Other
+// images are converted to *image.RGBA and stored as 24 bit color, with a
+// transparency mask holding the alpha of images that aren't opaque.
+func Encode(w io.Writer, m image.Image) error {
+	return EncodeWithOptions(w, m, nil)
+}
+
+// EncodeWithOptions is like Encode but with the given options. A nil opts
+// gives the defaults of Encode.
+func EncodeWithOptions(w io.Writer, m image.Image, opts *EncodeOptions) error {
+	// The layer always starts at the document origin.
+	m = atOrigin(m)
+	r := m.Bounds()
+	return EncodeDocument(w, &Document{
+		Width:  r.Dx(),
+		Height: r.Dy(),
+		Layers: []*Layer{{
+			Name:    "Background",
+			Kind:    LayerRaster,
+			Rect:    r,
+			Opacity: 255,
+			Visible: true,
+			Image:   m,
+		}},
+	}, opts)
+}
+
+// EncodeDocument writes the raster layers of doc to w as a layered PSP
+// file. Only the dimensions and layers of the document are used, and of
+// each layer its name, rectangle, opacity, blend mode, visibility, link
+// group and image. The part of a layer's image within Rect is stored, and a layer
+// with an empty Rect takes the bounds of its image. The image of the first
+// layer that has one decides how all layers are stored, as described for
+// Encode; the images of other layers are converted to match. Names are
+// stored in the Windows-1252 code page, and names with characters outside
+// of it fail with an UnsupportedError, as do documents without pixels.
+func EncodeDocument(w io.Writer, doc *Document, opts *EncodeOptions) error {
+	// The decoder refuses files without pixels.
+	if doc.Width <= 0 || doc.Height <= 0 || doc.Width > math.MaxInt32 || doc.Height > math.MaxInt32 {
+		return UnsupportedError(fmt.Sprintf("image size %dx%d", doc.Width, doc.Height))
+	}
+	e := &encoder{major: 5, comp: CompressionLZ77, contents: ContentsRasterLayers}
+	var thumb *image.RGBA
+	if opts != nil {
+		switch {
+		case opts.Version == 0:
+		case opts.Version < 3 || opts.Version > 9:
+			return UnsupportedError(fmt.Sprintf("encoding version %d", opts.Version))
+		default:
+			e.major = uint16(opts.Version)
+		}
+		switch opts.Compression {
+		case CompressionNone, CompressionRLE, CompressionLZ77:
+		default:
+			return UnsupportedError("compression " + opts.Compression.String())
+		}
+		e.comp = opts.Compression
+		if opts.ThumbnailJPEG && e.major < 4 {
+			return UnsupportedError("JPEG thumbnails before version 4")
+		}
+		if opts.ThumbnailSize > 0 {
+			thumb = thumbnail(doc.Flatten(nil), opts.ThumbnailSize)
+			e.contents |= ContentsThumbnail
+		}
+	}
+	for _, l := range doc.Layers {
+		if err := e.checkLayer(l); err != nil {
+			return err
+		}
+		if err := e.checkName(l.Name); err != nil {
+			return err
+		}
+	}
+	e.setFormat(doc.Layers)
+
+	var bank bytes.Buffer
+	for _, l := range doc.Layers {
+		e.writeLayer(&bank, l)
+	}
+	var out bytes.Buffer
+	out.Write(fileMagic)
+	put(&out, e.major, uint16(0))
+	e.writeAttributes(&out, doc.Width, doc.Height, len(doc.Layers))
+	if e.palette != nil {
+		e.writePalette(&out)
+	}
+	if thumb != nil {
+		if err := e.writeThumbnail(&out, thumb, opts.ThumbnailJPEG); err != nil {
+			return err
+		}
+	}
+	e.writeBlock(&out, LayerStartBlock, bank.Bytes())
+
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// checkLayer reports why l can't be written, either because its kind
+// doesn't exist in the target version or because only raster layers are
+// encoded.
+func (e *encoder) checkLayer(l *Layer) error {
+	switch {
+	case l.hasRaster():
+		return nil
+	case l.Kind == LayerMask && e.major < 8:
+		return UnsupportedError(fmt.Sprintf("%v in version %d files, which need version 8", l.Kind, e.major))
+	case e.major < 6:
+		return UnsupportedError(fmt.Sprintf("%v in version %d files, which need version 6", l.Kind, e.major))
+	}
+	return UnsupportedError("encoding " + l.Kind.String() + " layers")
+}
+
+// atOrigin returns m moved so that its bounds start at the origin. Images
+// of the types Encode knows share their pixels with m; others are copied to
+// an *image.RGBA.
+func atOrigin(m image.Image) image.Image {
+	b := m.Bounds()
+	if b.Min == (image.Point{}) {
+		return m
+	}
+	r := b.Sub(b.Min)
+	switch m := m.(type) {
+	case *image.RGBA:
+		c := *m
+		c.Rect = r
+		return &c
+	case *image.RGBA64:
+		c := *m
+		c.Rect = r
+		return &c
+	case *image.NRGBA:
+		c := *m
+		c.Rect = r
+		return &c
+	case *image.NRGBA64:
+		c := *m
+		c.Rect = r
+		return &c
+	case *image.Gray:
+		c := *m
+		c.Rect = r
+		return &c
+	case *image.Gray16:
+		c := *m
+		c.Rect = r
+		return &c
+	case *image.Paletted:
+		c := *m
+		c.Rect = r
+		return &c
+	}
+	img := image.NewRGBA(r)
+	draw.Draw(img, r, m, b.Min, draw.Src)
+	return img
+}
+
+// setFormat picks the bit depth and palette from the first layer image.
+func (e *encoder) setFormat(layers []*Layer) {
+	e.bitDepth = 24
+	var m image.Image
+	for _, l := range layers {
+		if l.Image != nil {
+			m = l.Image
+			break
+		}
+	}
+	switch m := m.(type) {
+	case *image.Paletted:
+		e.bitDepth = 8
+		e.palette = m.Palette
+	case *image.Gray:
+		e.bitDepth = 8
+		e.grayscale = true
+	case *image.Gray16:
+		e.bitDepth = 16
+		e.grayscale = true
+	case *image.RGBA64, *image.NRGBA64:
+		e.bitDepth = 48
+		for _, l := range layers {
+			if l.Image != nil && !opaque(l.Image) {
+				e.bitDepth = 64
+			}
+		}
+	}
+}
+
+func opaque(m image.Image) bool {
+	if o, ok := m.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+// checkName reports why the name of a layer can't be written. Names are
+// stored in the Windows-1252 code page, as the decoder reads them, with a
+// 16 bit length, or before version 4 NUL terminated in a field of 256
+// bytes.
+func (e *encoder) checkName(name string) error {
+	b, ok := encodeWindows1252(name)
+	if !ok {
+		return UnsupportedError(fmt.Sprintf("layer name %q outside of the Windows-1252 code page", name))
+	}
+	if e.major < 4 && len(b) > 255 {
+		return UnsupportedError(fmt.Sprintf("layer name of %d bytes in version %d files, which hold 255", len(b), e.major))
+	}
+	if len(b) > math.MaxUint16 {
+		return UnsupportedError(fmt.Sprintf("layer name of %d bytes", len(b)))
+	}
+	return nil
+}
+
+// writeLayer writes the layer block of l.
+func (e *encoder) writeLayer(w *bytes.Buffer, l *Layer) {
+	r := l.Rect
+	var saved image.Rectangle
+	var planes []plane
+	if l.Image != nil {
+		if r.Empty() {
+			r = l.Image.Bounds()
+		}
+		saved = r.Intersect(l.Image.Bounds())
+		planes = e.planes(l.Image, saved)
+	}
+	var p bytes.Buffer
+	e.writeLayerInfo(&p, l, r, saved, planes)
+	initLen := p.Len()
+	for _, pl := range planes {
+		e.writeChannel(&p, pl.bitmap, pl.channel, pl.data)
+	}
+	e.writeBlockInit(w, LayerBlock, p.Bytes(), initLen)
+}
+
+// planes converts the part r of m to the channels of the chosen format.
+func (e *encoder) planes(m image.Image, r image.Rectangle) []plane {
+	switch {
+	case e.palette != nil:
+		img, ok := m.(*image.Paletted)
+		if !ok {
+			img = image.NewPaletted(r, e.palette)
+			draw.Draw(img, r, m, r.Min, draw.Src)
+		}
+		pix := img.Pix[img.PixOffset(r.Min.X, r.Min.Y):]
+		return []plane{{dibImage, channelComposite, packPlane(pix, img.Stride, r, 1, 0)}}
+	case e.grayscale && e.bitDepth == 8:
+		img, ok := m.(*image.Gray)
+		if !ok {
+			img = image.NewGray(r)
+			draw.Draw(img, r, m, r.Min, draw.Src)
+		}
+		pix := img.Pix[img.PixOffset(r.Min.X, r.Min.Y):]
+		return []plane{{dibImage, channelComposite, packPlane(pix, img.Stride, r, 1, 0)}}
+	case e.grayscale:
+		img, ok := m.(*image.Gray16)
+		if !ok {
+			img = image.NewGray16(r)
+			draw.Draw(img, r, m, r.Min, draw.Src)
+		}
+		pix := img.Pix[img.PixOffset(r.Min.X, r.Min.Y):]
+		return []plane{{dibImage, channelComposite, packPlane16(pix, img.Stride, r, 1, 0)}}
+	case e.bitDepth >= 48:
+		img, ok := m.(*image.NRGBA64)
+		if !ok {
+			img = image.NewNRGBA64(r)
+			draw.Draw(img, r, m, r.Min, draw.Src)
+		}
+		pix := img.Pix[img.PixOffset(r.Min.X, r.Min.Y):]
+		var planes []plane
+		for c := 0; c < 3; c++ {
+			planes = append(planes, plane{dibImage, channelType(c + 1), packPlane16(pix, img.Stride, r, 4, c)})
+		}
+		if e.bitDepth == 64 {
+			planes = append(planes, plane{dibTransMask, channelComposite, packPlane16(pix, img.Stride, r, 4, 3)})
+		}
+		return planes
+	}
+	var pix []byte
+	var stride int
+	var masked bool
+	if img, ok := m.(*image.NRGBA); ok {
+		// The samples are stored as they are, without the loss of
+		// premultiplying them first.
+		pix, stride = img.Pix[img.PixOffset(r.Min.X, r.Min.Y):], img.Stride
+		masked = !opaque(img.SubImage(r))
+	} else {
+		img, ok := m.(*image.RGBA)
+		if !ok {
+			img = image.NewRGBA(r)
+			draw.Draw(img, r, m, r.Min, draw.Src)
+		}
+		pix, stride = img.Pix[img.PixOffset(r.Min.X, r.Min.Y):], img.Stride
+		masked = !opaque(img.SubImage(r))
+		if masked {
+			pix, stride = unpremultiply(pix, stride, r), r.Dx()*4
+		}
+	}
+	var planes []plane
+	for c := 0; c < 3; c++ {
+		planes = append(planes, plane{dibImage, channelType(c + 1), packPlane(pix, stride, r, 4, c)})
+	}
+	if masked {
+		planes = append(planes, plane{dibTransMask, channelComposite, packPlane(pix, stride, r, 4, 3)})
+	}
+	return planes
+}
+
+// unpremultiply returns a packed copy of the premultiplied RGBA pixels
+// covering bounds b with the alpha divided out of the color samples. The
+// division is rounded so that premultiplying again gives back the original
+// samples.
+func unpremultiply(pix []byte, stride int, b image.Rectangle) []byte {
+	w := b.Dx() * 4
+	p := make([]byte, 0, w*b.Dy())
+	for y := 0; y < b.Dy(); y++ {
+		p = append(p, pix[y*stride:y*stride+w]...)
+	}
+	for i := 0; i < len(p); i += 4 {
+		a := uint32(p[i+3])
+		if a == 0 || a == 255 {
+			continue
+		}
+		for c := i; c < i+3; c++ {
+			p[c] = uint8((uint32(p[c])*255 + a/2) / a)
+		}
+	}
+	return p
+}
+
+// packPlane gathers the samples of channel c from pixel data with the given
+// stride and number of bytes per pixel covering bounds b into a tightly
+// packed plane.
+func packPlane(pix []byte, stride int, b image.Rectangle, bpp, c int) []byte {
+	p := make([]byte, 0, b.Dx()*b.Dy())
+	for y := 0; y < b.Dy(); y++ {
+		row := pix[y*stride:]
+		for x := c; x < b.Dx()*bpp; x += bpp {
+			p = append(p, row[x])
+		}
+	}
+	return p
+}
+
+// packPlane16 is like packPlane for pixels of spp 16 bit samples. Samples
+// are stored in little-endian order rather than the big-endian order of the
+// image package.
+func packPlane16(pix []byte, stride int, b image.Rectangle, spp, c int) []byte {
+	p := make([]byte, 0, b.Dx()*b.Dy()*2)
+	for y := 0; y < b.Dy(); y++ {
+		row := pix[y*stride:]
+		for x := c * 2; x < b.Dx()*spp*2; x += spp * 2 {
+			p = append(p, row[x+1], row[x])
+		}
+	}
+	return p
+}
+
+// writePalette writes the color palette block and, if the palette has a
+// fully transparent entry, an extended data block naming it as the
+// transparency index.
+func (e *encoder) writePalette(w *bytes.Buffer) {
+	var p bytes.Buffer
+	if e.major >= 4 {
+		put(&p, uint32(8))
+	}
+	put(&p, uint32(len(e.palette)))
+	trns := -1
+	for i, c := range e.palette {
+		nc := color.NRGBAModel.Convert(c).(color.NRGBA)
+		p.Write([]byte{nc.B, nc.G, nc.R, 0})
+		if nc.A == 0 && trns < 0 {
+			trns = i
+		}
+	}
+	e.writeBlock(w, ColorBlock, p.Bytes())
+	if trns >= 0 {
+		var x bytes.Buffer
+		x.Write(chunkMagic)
+		put(&x, uint16(xDataTrnsIndex), uint32(2), uint16(trns))
+		e.writeBlock(w, ExtendedDataBlock, x.Bytes())
+	}
+}
+
+// writeAttributes writes the general image attributes block.
+func (e *encoder) writeAttributes(w *bytes.Buffer, width, height, layers int) {
+	var p bytes.Buffer
+	if e.major >= 4 {
+		put(&p, uint32(46))
+	}
+	colors := uint32(1) << e.bitDepth
+	if e.palette != nil {
+		colors = uint32(len(e.palette))
+	}
+	gray := byte(0)
+	if e.grayscale {
+		gray = 1
+	}
+	put(&p, int32(width), int32(height), math.Float64bits(72), byte(ResolutionInch),
+		uint16(e.comp), e.bitDepth, uint16(1), colors, gray,
+		uint32(width*height*int(e.bitDepth)/8), int32(0), uint16(layers))
+	if e.major >= 4 {
+		put(&p, e.contents)
+	}
+	e.writeBlock(w, ImageBlock, p.Bytes())
+}
+
+// writeLayerInfo writes the layer information and, for version 4 and
+// later, the layer bitmap information chunks of a raster layer in the
+// layout read by readLayerInfo. The bitmap count includes the transparency
+// mask.
+func (e *encoder) writeLayerInfo(w *bytes.Buffer, l *Layer, r, saved image.Rectangle, planes []plane) {
+	var p bytes.Buffer
+	name, _ := encodeWindows1252(l.Name)
+	if e.major >= 4 {
+		put(&p, uint16(len(name)), name)
+	} else {
+		n := make([]byte, 256)
+		copy(n, name)
+		p.Write(n)
+	}
+	layerType := byte(layerNormal)
+	if e.major >= 6 {
+		layerType = byte(LayerRaster)
+	}
+	visible := byte(0)
+	if l.Visible {
+		visible = 1
+	}
+	put(&p, layerType)
+	putRect(&p, r)
+	putRect(&p, saved)
+	put(&p, l.Opacity, byte(l.BlendMode), visible, byte(0), l.LinkGroup)
+	putRect(&p, image.Rectangle{})
+	putRect(&p, image.Rectangle{})
+	put(&p, byte(0), byte(0), byte(0), uint16(0), make([]byte, 4*2*5))
+	if e.major >= 6 {
+		p.Write(make([]byte, 5))
+	}
+	if e.major >= 4 {
+		put(w, uint32(p.Len()+4))
+	}
+	w.Write(p.Bytes())
+	bitmaps := uint16(0)
+	for i, pl := range planes {
+		if i == 0 || pl.bitmap != planes[i-1].bitmap {
+			bitmaps++
+		}
+	}
+	if e.major >= 4 {
+		put(w, uint32(8), bitmaps, uint16(len(planes)))
+	} else {
+		put(w, bitmaps, uint16(len(planes)))
+	}
+}
+
+// thumbnail scales m down with a box filter to fit within size by size
+// pixels, keeping its aspect ratio. Images that already fit are copied.
+func thumbnail(m image.Image, size int) *image.RGBA {
+	b := m.Bounds()
+	w, h := b.Dx(), b.Dy()
+	switch {
+	case w > size && w >= h:
+		w, h = size, h*size/w
+	case h > size:
+		w, h = w*size/h, size
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/h, b.Min.Y+(y+1)*b.Dy()/h
+		for x := 0; x < w; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/w, b.Min.X+(x+1)*b.Dx()/w
+			var sr, sg, sb, sa, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					r, g, b, a := m.At(sx, sy).RGBA()
+					sr, sg, sb, sa = sr+r>>8, sg+g>>8, sb+b>>8, sa+a>>8
+					n++
+				}
+			}
+			if n > 0 {
+				dst.SetRGBA(x, y, color.RGBA{uint8(sr / n), uint8(sg / n), uint8(sb / n), uint8(sa / n)})
+			}
+		}
+	}
+	return dst
+}
+
+// writeThumbnail writes the preview image m as 24 bit color, either in a
+// composite image bank holding a single thumbnail or, before version 4, in
+// a thumbnail block.
+func (e *encoder) writeThumbnail(w *bytes.Buffer, m *image.RGBA, useJPEG bool) error {
+	r := m.Bounds()
+	var planes [][]byte
+	for c := 0; c < 3; c++ {
+		planes = append(planes, packPlane(m.Pix, m.Stride, r, 4, c))
+	}
+	var p bytes.Buffer
+	if e.major < 4 {
+		put(&p, int32(r.Dx()), int32(r.Dy()), uint16(24), uint16(e.comp), uint16(1), uint32(1<<24), uint32(0))
+		initLen := p.Len()
+		for c, pl := range planes {
+			e.writeChannel(&p, dibThumbnail, channelType(c+1), pl)
+		}
+		e.writeBlockInit(w, ThumbnailBlock, p.Bytes(), initLen)
+		return nil
+	}
+
+	comp := e.comp
+	if useJPEG {
+		comp = CompressionJPEG
+	}
+	put(&p, uint32(8), uint32(1))
+	var attrs bytes.Buffer
+	put(&attrs, uint32(24), int32(r.Dx()), int32(r.Dy()), uint16(24), uint16(comp),
+		uint16(1), uint32(1<<24), uint16(compositeThumbnail))
+	e.writeBlock(&p, CompositeAttributesBlock, attrs.Bytes())
+	var img bytes.Buffer
+	if useJPEG {
+		var data bytes.Buffer
+		if err := jpeg.Encode(&data, m, nil); err != nil {
+			return err
+		}
+		put(&img, uint32(14), uint32(data.Len()), uint32(len(m.Pix)/4*3), uint16(0))
+		img.Write(data.Bytes())
+		e.writeBlock(&p, JPEGBlock, img.Bytes())
+	} else {
+		put(&img, uint32(8), uint16(1), uint16(len(planes)))
+		for c, pl := range planes {
+			e.writeChannel(&img, dibThumbnail, channelType(c+1), pl)
+		}
+		e.writeBlock(&p, ThumbnailBlock, img.Bytes())
+	}
+	e.writeBlock(w, CompositeImageBankBlock, p.Bytes())
+	return nil
+}
+
+// writeChannel writes a channel block holding the uncompressed data.
+func (e *encoder) writeChannel(w *bytes.Buffer, bt bitmapType, ct channelType, data []byte) {
+	var p bytes.Buffer
+	compressed := e.compress(data)
+	if e.major >= 4 {
+		put(&p, uint32(16))
+	}
+	put(&p, uint32(len(compressed)), uint32(len(data)), uint16(bt), uint16(ct))
+	initLen := p.Len()
+	p.Write(compressed)
+	e.writeBlockInit(w, ChannelBlock, p.Bytes(), initLen)
+}
+
+func (e *encoder) compress(data []byte) []byte {
+	switch e.comp {
+	case CompressionRLE:
+		return rle(data)
+	case CompressionLZ77:
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		zw.Write(data)
+		zw.Close()
+		return buf.Bytes()
+	}
+	return data
+}
+
+// rle compresses data with the run-length encoding read by readChannelData.
+// A control byte above 128 repeats the following byte that many times less
+// 128, so runs are at most 127 bytes long. Any other control byte is the
+// length of a literal segment of up to 128 bytes. Runs shorter than three
+// bytes are left in literal segments as they wouldn't save anything.
+func rle(data []byte) []byte {
+	var out []byte
+	for len(data) > 0 {
+		n := 1
+		for n < len(data) && n < 127 && data[n] == data[0] {
+			n++
+		}
+		if n > 2 {
+			out = append(out, byte(128+n), data[0])
+			data = data[n:]
+			continue
+		}
+		n = 0
+		for n < len(data) && n < 128 {
+			if n+2 < len(data) && data[n] == data[n+1] && data[n] == data[n+2] {
+				break
+			}
+			n++
+		}
+		out = append(out, byte(n))
+		out = append(out, data[:n]...)
+		data = data[n:]
+	}
+	return out
+}
+
+func (e *encoder) writeBlock(w *bytes.Buffer, id BlockID, payload []byte) {
+	e.writeBlockInit(w, id, payload, len(payload))
+}
+
+// writeBlockInit writes a block whose payload starts with initLen bytes of
+// fixed fields, the initial data length of version 3 block headers.
+func (e *encoder) writeBlockInit(w *bytes.Buffer, id BlockID, payload []byte, initLen int) {
+	w.Write(blockMagic)
+	put(w, uint16(id))
+	if e.major <= 3 {
+		put(w, uint32(initLen))
+	}
+	put(w, uint32(len(payload)))
+	w.Write(payload)
+}
+
+// put writes values to w in little-endian order.
+func put(w *bytes.Buffer, v ...interface{}) {
+	for _, x := range v {
+		binary.Write(w, binary.LittleEndian, x)
+	}
+}
+
+func putRect(w *bytes.Buffer, r image.Rectangle) {
+	put(w, int32(r.Min.X), int32(r.Min.Y), int32(r.Max.X), int32(r.Max.Y))
+}
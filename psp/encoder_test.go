@@ -0,0 +1,460 @@
+package psp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	img := testRGBA(image.Rect(0, 0, 7, 5), 11)
+	var buf bytes.Buffer
+	if err := Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	got, format, err := image.Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "psp" {
+		t.Errorf("got format %q", format)
+	}
+	if !reflect.DeepEqual(got, img) {
+		t.Error("round trip mismatch")
+	}
+}
+
+func TestEncodeConvert(t *testing.T) {
+	// Images are moved to the origin and converted to RGBA.
+	src := image.NewNRGBA(image.Rect(2, 3, 5, 5))
+	for i := range src.Pix {
+		src.Pix[i] = byte(i * 13)
+	}
+	for i := 3; i < len(src.Pix); i += 4 {
+		src.Pix[i] = 255
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Bounds() != image.Rect(0, 0, 3, 2) {
+		t.Fatalf("got bounds %v", got.Bounds())
+	}
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 3; x++ {
+			want := color.RGBAModel.Convert(src.At(x+2, y+3))
+			if c := got.At(x, y); c != want {
+				t.Errorf("pixel %d,%d = %v, want %v", x, y, c, want)
+			}
+		}
+	}
+}
+
+func TestEncodePaletted(t *testing.T) {
+	pal := color.Palette{
+		color.RGBA{255, 0, 0, 255},
+		color.NRGBA{1, 2, 3, 0},
+		color.RGBA{0, 0, 255, 255},
+	}
+	img := image.NewPaletted(image.Rect(0, 0, 4, 3), pal)
+	for i := range img.Pix {
+		img.Pix[i] = byte(i % 3)
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := DecodeConfig(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Width != 4 || cfg.Height != 3 {
+		t.Errorf("got %dx%d", cfg.Width, cfg.Height)
+	}
+	m, err := Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := m.(*image.Paletted)
+	if !ok {
+		t.Fatalf("got %T, want *image.Paletted", m)
+	}
+	if !bytes.Equal(got.Pix, img.Pix) {
+		t.Errorf("got indices %v, want %v", got.Pix, img.Pix)
+	}
+	if len(got.Palette) != len(pal) {
+		t.Fatalf("got %d palette entries, want %d", len(got.Palette), len(pal))
+	}
+	for i, c := range pal {
+		if color.NRGBAModel.Convert(got.Palette[i]) != color.NRGBAModel.Convert(c) {
+			t.Errorf("palette entry %d = %v, want %v", i, got.Palette[i], c)
+		}
+	}
+}
+
+func TestEncodeGray(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 5, 2))
+	gray16 := image.NewGray16(image.Rect(0, 0, 5, 2))
+	for i := range gray.Pix {
+		gray.Pix[i] = byte(i * 25)
+	}
+	for i := range gray16.Pix {
+		// Distinct high and low bytes catch both truncation and swapped
+		// byte order.
+		gray16.Pix[i] = byte(i*37 + 1)
+	}
+	for _, img := range []image.Image{gray, gray16} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, img); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := DecodeConfig(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.ColorModel != img.ColorModel() {
+			t.Errorf("%T: got color model %v", img, cfg.ColorModel)
+		}
+		got, err := Decode(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, img) {
+			t.Errorf("%T: round trip mismatch, got %T", img, got)
+		}
+	}
+}
+
+func TestEncodeDeep(t *testing.T) {
+	r := image.Rect(0, 0, 4, 3)
+	opaque := image.NewRGBA64(r)
+	translucent := image.NewNRGBA64(r)
+	for i := range opaque.Pix {
+		opaque.Pix[i] = byte(i*41 + 3)
+		translucent.Pix[i] = byte(i*29 + 7)
+	}
+	for i := 6; i < len(opaque.Pix); i += 8 {
+		opaque.Pix[i], opaque.Pix[i+1] = 0xff, 0xff
+	}
+	for _, c := range []struct {
+		img   image.Image
+		depth int
+	}{
+		{opaque, 48},
+		{translucent, 64},
+	} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, c.img); err != nil {
+			t.Fatal(err)
+		}
+		if depth := int(newDecoder(bytes.NewReader(buf.Bytes()), nil).bitDepth); depth != c.depth {
+			t.Errorf("%T: got bit depth %d, want %d", c.img, depth, c.depth)
+		}
+		got, err := Decode(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := got.(*image.RGBA64); !ok {
+			t.Fatalf("%T: got %T, want *image.RGBA64", c.img, got)
+		}
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				if want := color.RGBA64Model.Convert(c.img.At(x, y)); got.At(x, y) != want {
+					t.Errorf("%T: pixel %d,%d = %v, want %v", c.img, x, y, got.At(x, y), want)
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeAlpha(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for i := 0; i < len(img.Pix); i += 4 {
+		a := byte(i / 4)
+		img.Pix[i+3] = a
+		for c := 0; c < 3; c++ {
+			img.Pix[i+c] = byte(int(a) * ((i/4*7 + c*40) % 256) / 255)
+		}
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := DecodeDocument(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := doc.Layers[0]; l.BitmapCount != 2 || l.ChannelCount != 4 {
+		t.Errorf("got %d bitmaps and %d channels, want 2 and 4", l.BitmapCount, l.ChannelCount)
+	}
+	got, err := Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, img) {
+		t.Error("round trip mismatch")
+	}
+
+	// Opaque images are stored without a mask.
+	buf.Reset()
+	if err := Encode(&buf, testRGBA(image.Rect(0, 0, 4, 4), 3)); err != nil {
+		t.Fatal(err)
+	}
+	doc, err = DecodeDocument(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := doc.Layers[0]; l.BitmapCount != 1 || l.ChannelCount != 3 {
+		t.Errorf("got %d bitmaps and %d channels, want 1 and 3", l.BitmapCount, l.ChannelCount)
+	}
+}
+
+func TestEncodeNRGBA(t *testing.T) {
+	// Straight samples are stored as they are, however transparent.
+	src := image.NewNRGBA(image.Rect(1, 2, 5, 4))
+	for i := 0; i < len(src.Pix); i += 4 {
+		copy(src.Pix[i:], []byte{200, 100, 50, byte(i * 9)})
+	}
+	src.SetNRGBA(1, 2, color.NRGBA{200, 100, 50, 3})
+	var buf bytes.Buffer
+	if err := Encode(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeWithOptions(&buf, &Options{NonPremultiplied: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &image.NRGBA{Pix: src.Pix, Stride: src.Stride, Rect: image.Rect(0, 0, 4, 2)}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestEncodeCompression(t *testing.T) {
+	img := testRGBA(image.Rect(0, 0, 40, 9), 3)
+	// Add runs of every length around the limits of the RLE encoding.
+	for y := 0; y < 9; y++ {
+		for x := 0; x < 40 && x < y*5; x++ {
+			i := img.PixOffset(x, y)
+			img.Pix[i], img.Pix[i+1], img.Pix[i+2] = 7, 7, 7
+		}
+	}
+	for _, comp := range []Compression{CompressionNone, CompressionRLE, CompressionLZ77} {
+		var buf bytes.Buffer
+		if err := EncodeWithOptions(&buf, img, &EncodeOptions{Compression: comp}); err != nil {
+			t.Fatal(err)
+		}
+		if got := newDecoder(bytes.NewReader(buf.Bytes()), nil).comp; got != comp {
+			t.Errorf("%v: file claims %v", comp, got)
+		}
+		got, err := Decode(&buf)
+		if err != nil {
+			t.Fatalf("%v: %v", comp, err)
+		}
+		if !reflect.DeepEqual(got, img) {
+			t.Errorf("%v: round trip mismatch", comp)
+		}
+	}
+	if err := EncodeWithOptions(new(bytes.Buffer), img, &EncodeOptions{Compression: 3}); err == nil {
+		t.Error("expected an error for JPEG compression")
+	}
+}
+
+func TestRLE(t *testing.T) {
+	cases := [][]byte{
+		nil,
+		{1},
+		{1, 1},
+		{1, 1, 1},
+		bytes.Repeat([]byte{9}, 127),
+		bytes.Repeat([]byte{9}, 128),
+		bytes.Repeat([]byte{9}, 300),
+		bytes.Repeat([]byte{1, 2}, 200),
+		concat(bytes.Repeat([]byte{1, 2}, 64), bytes.Repeat([]byte{3}, 130), []byte{4, 4, 5}),
+	}
+	for _, data := range cases {
+		enc := rle(data)
+		dec := make([]byte, len(data))
+		err := func() (err error) {
+			defer catchErrors(&err)
+			d := &decoder{r: bufio.NewReader(bytes.NewReader(enc)), comp: CompressionRLE}
+			d.readChannelData(dec, len(enc))
+			return nil
+		}()
+		if err != nil {
+			t.Errorf("%d bytes: %v", len(data), err)
+		} else if !bytes.Equal(dec, data) {
+			t.Errorf("%d bytes: round trip mismatch", len(data))
+		}
+	}
+	if n := len(rle(bytes.Repeat([]byte{1, 2}, 200))); n > 404 {
+		t.Errorf("literal data expanded to %d bytes", n)
+	}
+}
+
+func TestEncodeDocument(t *testing.T) {
+	bg := testRGBA(image.Rect(0, 0, 6, 4), 1)
+	small := testRGBA(image.Rect(2, 1, 4, 3), 60)
+	// Partially off the canvas on the top left, and with more image than
+	// the layer covers on the right.
+	off := testRGBA(image.Rect(-2, -1, 5, 2), 120)
+	in := &Document{
+		Width:  6,
+		Height: 4,
+		Layers: []*Layer{
+			{Name: "Background", Rect: bg.Rect, Opacity: 255, Visible: true, LinkGroup: 3, Image: bg},
+			{Name: "Small", Opacity: 128, BlendMode: BlendScreen, Visible: true, Image: small},
+			{Name: "Off canvas", Rect: image.Rect(-2, -1, 3, 2), Opacity: 200, BlendMode: BlendMultiply, LinkGroup: 3, Image: off},
+		},
+	}
+	for _, comp := range []Compression{CompressionNone, CompressionRLE, CompressionLZ77} {
+		var buf bytes.Buffer
+		if err := EncodeDocument(&buf, in, &EncodeOptions{Compression: comp}); err != nil {
+			t.Fatal(err)
+		}
+		doc, err := DecodeDocument(&buf)
+		if err != nil {
+			t.Fatalf("%v: %v", comp, err)
+		}
+		if doc.Width != 6 || doc.Height != 4 || len(doc.Layers) != 3 {
+			t.Fatalf("%v: got %dx%d with %d layers", comp, doc.Width, doc.Height, len(doc.Layers))
+		}
+		rects := []image.Rectangle{bg.Rect, small.Rect, image.Rect(-2, -1, 3, 2)}
+		for i, l := range doc.Layers {
+			want := in.Layers[i]
+			if l.Name != want.Name || l.Opacity != want.Opacity || l.BlendMode != want.BlendMode || l.Visible != want.Visible || l.LinkGroup != want.LinkGroup {
+				t.Errorf("%v: layer %d = %+v, want %+v", comp, i, l, want)
+			}
+			if l.Rect != rects[i] || l.SavedRect != rects[i] {
+				t.Errorf("%v: layer %d rects %v %v, want %v", comp, i, l.Rect, l.SavedRect, rects[i])
+			}
+			wantImg := want.Image.(*image.RGBA).SubImage(rects[i])
+			for y := rects[i].Min.Y; y < rects[i].Max.Y; y++ {
+				for x := rects[i].Min.X; x < rects[i].Max.X; x++ {
+					if l.Image.At(x, y) != wantImg.At(x, y) {
+						t.Errorf("%v: layer %d differs at %d,%d", comp, i, x, y)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeDocumentUnsupported(t *testing.T) {
+	doc := &Document{Width: 1, Height: 1, Layers: []*Layer{{Kind: LayerVector}}}
+	if err := EncodeDocument(new(bytes.Buffer), doc, nil); err == nil {
+		t.Error("expected an error for a vector layer")
+	}
+
+	// Files without pixels aren't written, as they aren't read.
+	for _, r := range []image.Rectangle{image.Rect(0, 0, 0, 0), image.Rect(0, 0, 3, 0), image.Rect(2, 2, 2, 5)} {
+		var uerr UnsupportedError
+		if err := Encode(new(bytes.Buffer), image.NewRGBA(r)); !errors.As(err, &uerr) {
+			t.Errorf("%v: got error %v, want an UnsupportedError", r, err)
+		}
+	}
+	doc = &Document{Width: -1, Height: 1}
+	if err := EncodeDocument(new(bytes.Buffer), doc, nil); err == nil {
+		t.Error("expected an error for a negative width")
+	}
+}
+
+func TestEncodeLayerNames(t *testing.T) {
+	img := testRGBA(image.Rect(0, 0, 2, 2), 0)
+	for _, version := range []int{3, 5} {
+		for _, name := range []string{"Arrière-plan", "€ 5 — Œuvre", strings.Repeat("x", 255)} {
+			doc := &Document{Width: 2, Height: 2, Layers: []*Layer{{Name: name, Opacity: 255, Image: img}}}
+			var buf bytes.Buffer
+			if err := EncodeDocument(&buf, doc, &EncodeOptions{Version: version}); err != nil {
+				t.Fatalf("v%d %q: %v", version, name, err)
+			}
+			got, err := DecodeDocument(&buf)
+			if err != nil {
+				t.Fatalf("v%d %q: %v", version, name, err)
+			}
+			if got.Layers[0].Name != name {
+				t.Errorf("v%d: got name %q, want %q", version, got.Layers[0].Name, name)
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		version int
+	}{
+		{"日本", 5},
+		{"\u0080", 5},
+		{"bad \xff utf-8", 5},
+		{strings.Repeat("x", 1<<16), 5},
+		{strings.Repeat("x", 256), 3},
+	} {
+		doc := &Document{Width: 2, Height: 2, Layers: []*Layer{{Name: tc.name, Opacity: 255, Image: img}}}
+		err := EncodeDocument(new(bytes.Buffer), doc, &EncodeOptions{Version: tc.version})
+		var uerr UnsupportedError
+		if !errors.As(err, &uerr) {
+			t.Errorf("v%d %.20q: got error %v, want an UnsupportedError", tc.version, tc.name, err)
+		}
+	}
+}
+
+func TestEncodeVersion(t *testing.T) {
+	img := testRGBA(image.Rect(0, 0, 5, 4), 9)
+	img.Pix[3] = 100
+	in := &Document{
+		Width:  5,
+		Height: 4,
+		Layers: []*Layer{
+			{Name: "Background", Opacity: 255, Visible: true, Image: img},
+			{Name: "Top", Opacity: 64, Visible: true, Image: testRGBA(image.Rect(1, 1, 3, 3), 40)},
+		},
+	}
+	for v := 3; v <= 9; v++ {
+		var buf bytes.Buffer
+		if err := EncodeDocument(&buf, in, &EncodeOptions{Version: v, ThumbnailSize: 2}); err != nil {
+			t.Fatalf("version %d: %v", v, err)
+		}
+		if d := newDecoder(bytes.NewReader(buf.Bytes()), nil); int(d.versionMajor) != v {
+			t.Errorf("wrote version %d, want %d", d.versionMajor, v)
+		}
+		doc, err := DecodeDocument(&buf)
+		if err != nil {
+			t.Fatalf("version %d: %v", v, err)
+		}
+		for i, l := range doc.Layers {
+			if l.Name != in.Layers[i].Name {
+				t.Errorf("version %d: layer %d named %q", v, i, l.Name)
+			}
+		}
+		if !reflect.DeepEqual(doc.Layers[0].Image, img) {
+			t.Errorf("version %d: background differs", v)
+		}
+	}
+}
+
+func TestEncodeVersionInvalid(t *testing.T) {
+	img := testRGBA(image.Rect(0, 0, 1, 1), 0)
+	for _, tc := range []struct {
+		doc  *Document
+		opts EncodeOptions
+	}{
+		{&Document{Width: 1, Height: 1, Layers: []*Layer{{Image: img}}}, EncodeOptions{Version: 2}},
+		{&Document{Width: 1, Height: 1, Layers: []*Layer{{Image: img}}}, EncodeOptions{Version: 10}},
+		{&Document{Width: 1, Height: 1, Layers: []*Layer{{Image: img}}}, EncodeOptions{Version: 3, ThumbnailSize: 1, ThumbnailJPEG: true}},
+		{&Document{Width: 1, Height: 1, Layers: []*Layer{{Kind: LayerMask}}}, EncodeOptions{Version: 7}},
+		{&Document{Width: 1, Height: 1, Layers: []*Layer{{Kind: LayerVector}}}, EncodeOptions{Version: 5}},
+	} {
+		err := EncodeDocument(new(bytes.Buffer), tc.doc, &tc.opts)
+		if _, ok := err.(UnsupportedError); !ok {
+			t.Errorf("%+v: got error %v, want an UnsupportedError", tc.opts, err)
+		}
+	}
+}
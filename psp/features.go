@@ -0,0 +1,156 @@
+package psp
+
+import "strings"
+
+// Features are the kinds of content a PSP file holds, as a set of flags.
+type Features uint32
+
+const (
+	FeatureRasterLayers      Features = 1 << iota // raster layers
+	FeatureVectorLayers                           // vector layers
+	FeatureAdjustmentLayers                       // adjustment layers
+	FeatureGroupLayers                            // group layers (since PSP8)
+	FeatureMaskLayers                             // mask layers (since PSP8)
+	FeatureFloatingSelection                      // a floating selection layer
+	FeatureUserMasks                              // layers with a user mask
+	FeatureSelection                              // a saved selection
+	FeatureAlphaChannels                          // saved alpha channels
+	FeatureThumbnail                              // a thumbnail
+	FeatureComposite                              // a full size composite image
+	FeatureTables                                 // paper and pattern tables (since PSP7)
+	FeaturePictureTube                            // picture tube settings
+	FeatureArtMedia                               // art media layers (since PSP9)
+	FeatureColorProfile                           // an ICC color profile (since PSP10)
+	FeatureBrush                                  // brush data (since PSP8)
+	FeatureUnknownBlocks                          // blocks of unknown type
+)
+
+var featureNames = []string{
+	"RasterLayers",
+	"VectorLayers",
+	"AdjustmentLayers",
+	"GroupLayers",
+	"MaskLayers",
+	"FloatingSelection",
+	"UserMasks",
+	"Selection",
+	"AlphaChannels",
+	"Thumbnail",
+	"Composite",
+	"Tables",
+	"PictureTube",
+	"ArtMedia",
+	"ColorProfile",
+	"Brush",
+	"UnknownBlocks",
+}
+
+// SupportedFeatures are the features this package reproduces: those
+// decoded into a Document and, for layers, drawn by Flatten. Vector layers
+// are decoded but not rendered, user masks are decoded but not applied,
+// and adjustment layers are only applied by Flatten with ApplyAdjustments
+// and then only some kinds of them, so they are not among them.
+const SupportedFeatures = FeatureRasterLayers | FeatureGroupLayers |
+	FeatureFloatingSelection | FeatureAlphaChannels | FeatureThumbnail | FeatureComposite |
+	FeatureTables | FeaturePictureTube
+
+// Unsupported returns the features of f that aren't among
+// SupportedFeatures.
+func (f Features) Unsupported() Features {
+	return f &^ SupportedFeatures
+}
+
+// String returns the names of the features joined by "|".
+func (f Features) String() string {
+	if f == 0 {
+		return "0"
+	}
+	var names []string
+	for i, name := range featureNames {
+		if f&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// contentsFeatures returns the features told of by graphic contents flags.
+func contentsFeatures(gc GraphicContents) Features {
+	var f Features
+	for _, c := range []struct {
+		flag    GraphicContents
+		feature Features
+	}{
+		{ContentsRasterLayers, FeatureRasterLayers},
+		{ContentsVectorLayers, FeatureVectorLayers},
+		{ContentsAdjustmentLayers, FeatureAdjustmentLayers},
+		{ContentsThumbnail, FeatureThumbnail},
+		{ContentsComposite, FeatureComposite},
+		{ContentsSelection, FeatureSelection},
+		{ContentsFloatingSelectionLayer, FeatureFloatingSelection},
+		{ContentsAlphaChannels, FeatureAlphaChannels},
+	} {
+		if gc&c.flag != 0 {
+			f |= c.feature
+		}
+	}
+	return f
+}
+
+// blockFeature returns the feature a block of type id belongs to, if any.
+// Layers and composites are told apart by their contents instead.
+func blockFeature(id BlockID) Features {
+	switch id {
+	case SelectionBlock:
+		return FeatureSelection
+	case AlphaBankBlock:
+		return FeatureAlphaChannels
+	case TableBankBlock:
+		return FeatureTables
+	case TubeBlock:
+		return FeaturePictureTube
+	case ArtMediaBlock, ArtMediaMapBlock, ArtMediaTileBlock, ArtMediaTextureBlock:
+		return FeatureArtMedia
+	case ColorProfileBlock:
+		return FeatureColorProfile
+	case BrushBlock:
+		return FeatureBrush
+	}
+	if _, ok := blockTypes[id]; !ok {
+		return FeatureUnknownBlocks
+	}
+	return 0
+}
+
+// documentFeatures returns the features of the layers and composites of a
+// decoded document.
+func documentFeatures(layers []*Layer, composites []Composite) Features {
+	var f Features
+	for _, l := range layers {
+		switch {
+		case l.group:
+			f |= FeatureGroupLayers
+		case l.Kind == LayerRaster:
+			f |= FeatureRasterLayers
+		case l.Kind == LayerVector:
+			f |= FeatureVectorLayers
+		case l.Kind == LayerAdjustment:
+			f |= FeatureAdjustmentLayers
+		case l.Kind == LayerMask:
+			f |= FeatureMaskLayers
+		case l.Kind == LayerFloatingSelection:
+			f |= FeatureFloatingSelection
+		}
+		if l.UserMask != nil {
+			f |= FeatureUserMasks
+		}
+	}
+	for _, c := range composites {
+		if c.Thumbnail {
+			f |= FeatureThumbnail
+		} else {
+			f |= FeatureComposite
+		}
+	}
+	return f
+}
@@ -0,0 +1,63 @@
+package psp
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+func TestDocumentFeatures(t *testing.T) {
+	doc, err := DecodeDocument(bytes.NewReader(nestedGroupsFile()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := FeatureRasterLayers | FeatureGroupLayers; doc.Features != want || doc.Features.Unsupported() != 0 {
+		t.Errorf("got features %v, want %v", doc.Features, want)
+	}
+
+	const major = 8
+	img := testRGBA(image.Rect(0, 0, 2, 2), 3)
+	mask := testChannel{bitmap: dibUserMask, data: []byte{0, 255, 255, 0}}
+	data := newFileBuilder(major).
+		attrs(testAttrs{width: 2, height: 2, bitDepth: 24, layerCount: 2, contents: ContentsRasterLayers | ContentsVectorLayers}).
+		block(200, nil).
+		block(LayerStartBlock, concat(
+			layerBytes(major, CompressionNone, testLayer{
+				layerType: byte(LayerRaster),
+				rect:      img.Rect,
+				maskRect:  img.Rect,
+				opacity:   255,
+				channels:  append(rgbChannels(img), mask),
+			}),
+			layerBytes(major, CompressionNone, testLayer{
+				layerType: byte(LayerVector),
+				rect:      img.Rect,
+				extra:     [][]byte{vectorExtensionBytes(major)},
+			}),
+		)).
+		bytes()
+	doc, err = DecodeDocument(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := FeatureRasterLayers | FeatureVectorLayers | FeatureUserMasks | FeatureUnknownBlocks
+	if doc.Features != want {
+		t.Errorf("got features %v, want %v", doc.Features, want)
+	}
+	if got, want := doc.Features.Unsupported().String(), "VectorLayers|UserMasks|UnknownBlocks"; got != want {
+		t.Errorf("got unsupported features %s, want %s", got, want)
+	}
+
+	info, err := DecodeInfo(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := FeatureRasterLayers | FeatureVectorLayers; info.Features != want {
+		t.Errorf("got info features %v, want %v", info.Features, want)
+	}
+
+	// Adjustments are only partly applied, and only when asked to.
+	if FeatureAdjustmentLayers.Unsupported() == 0 {
+		t.Error("adjustment layers are among the supported features")
+	}
+}
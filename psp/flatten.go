@@ -0,0 +1,297 @@
+package psp
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// Flatten composites the layers of the document onto a transparent canvas
+// of the document's size. The result is an *image.RGBA64 for 16-bit per
+// channel documents and an *image.RGBA otherwise. opts may be nil.
+//
+// Hidden layers are left out and the others are drawn with their opacity
+// and blend mode. Blend modes other than the separable ones are drawn as
+// BlendNormal, and user masks are not applied; each is reported to the
+// Warn function of opts, as are vector and mask layers, which aren't
+// drawn.
+// Group layers are composited as a unit: their children are flattened on
+// their own and the result is drawn with the group's opacity. Adjustment
+// layers only affect the layers beneath them within the same group. A
+// floating selection is drawn onto the layer beneath it, as PSP shows it,
+// and the two are drawn with the opacity and blend mode of that layer.
+func (doc *Document) Flatten(opts *Options) image.Image {
+	root := doc.Root
+	if root == nil {
+		root = layerTree(doc.Layers)
+	}
+	f := &flattener{
+		doc:   doc,
+		opts:  opts,
+		index: make(map[*Layer]int, len(doc.Layers)),
+	}
+	for i, l := range doc.Layers {
+		f.index[l] = i
+	}
+	return f.group(root)
+}
+
+type flattener struct {
+	doc   *Document
+	opts  *Options
+	index map[*Layer]int
+}
+
+// newCanvas returns a transparent image of the document's depth with
+// bounds r.
+func (f *flattener) newCanvas(r image.Rectangle) draw.RGBA64Image {
+	switch f.doc.ColorModel {
+	case color.RGBA64Model, color.Gray16Model:
+		return image.NewRGBA64(r)
+	}
+	return image.NewRGBA(r)
+}
+
+// group composites the children of g onto a new canvas.
+func (f *flattener) group(g *Layer) draw.RGBA64Image {
+	dst := f.newCanvas(image.Rect(0, 0, f.doc.Width, f.doc.Height))
+	for i, l := range g.Children {
+		if !l.Visible || i > 0 && floatsOn(l, g.Children[i-1]) {
+			// A floating selection is drawn with its target.
+			continue
+		}
+		switch {
+		case l.group:
+			f.checkBlendMode(l)
+			drawLayer(dst, f.group(l), l.Opacity, l.BlendMode)
+		case l.Kind == LayerAdjustment:
+			if f.opts != nil && f.opts.ApplyAdjustments {
+				applyAdjustment(dst, l, f.index[l], f.opts)
+			}
+		case l.Image != nil:
+			f.checkBlendMode(l)
+			f.checkMask(l)
+			img := l.Image
+			if i+1 < len(g.Children) && floatsOn(g.Children[i+1], l) {
+				img = f.float(l.Image, g.Children[i+1])
+			}
+			drawLayer(dst, img, l.Opacity, l.BlendMode)
+		case l.Kind == LayerVector || l.Kind == LayerMask:
+			f.warn(WarnLayerKind, l, "%v not drawn", l.Kind)
+		}
+	}
+	return dst
+}
+
+// warn reports a feature of layer l that flattening doesn't honor.
+func (f *flattener) warn(code WarningCode, l *Layer, format string, v ...interface{}) {
+	if f.opts == nil || f.opts.Warn == nil {
+		return
+	}
+	index, ok := f.index[l]
+	if !ok {
+		index = -1
+	}
+	f.opts.Warn(Warning{Code: code, Offset: -1, Layer: index, Message: fmt.Sprintf(format, v...)})
+}
+
+// checkBlendMode warns if the blend mode of l is drawn as BlendNormal.
+func (f *flattener) checkBlendMode(l *Layer) {
+	if l.BlendMode != BlendNormal && blendFunc(l.BlendMode) == nil {
+		f.warn(WarnBlendMode, l, "%v drawn as %v", l.BlendMode, BlendNormal)
+	}
+}
+
+// checkMask warns if l has a user mask in use, which isn't applied.
+func (f *flattener) checkMask(l *Layer) {
+	if l.UserMask != nil && !l.MaskDisabled {
+		f.warn(WarnMask, l, "user mask not applied")
+	}
+}
+
+// floatsOn reports whether l is a floating selection over target, the
+// raster layer beneath it.
+func floatsOn(l, target *Layer) bool {
+	return l.Kind == LayerFloatingSelection && target.Kind != LayerFloatingSelection &&
+		target.hasRaster() && !target.group && target.Image != nil
+}
+
+// float returns the image of a layer with the floating selection sel drawn
+// onto it at its offset.
+func (f *flattener) float(img image.Image, sel *Layer) image.Image {
+	if !sel.Visible || sel.Image == nil {
+		return img
+	}
+	dst := f.newCanvas(img.Bounds().Union(sel.Image.Bounds()))
+	draw.Draw(dst, img.Bounds(), img, img.Bounds().Min, draw.Src)
+	f.checkBlendMode(sel)
+	drawLayer(dst, sel.Image, sel.Opacity, sel.BlendMode)
+	return dst
+}
+
+// drawLayer draws src over dst at the given opacity and blend mode.
+func drawLayer(dst draw.RGBA64Image, src image.Image, opacity uint8, mode BlendMode) {
+	b := src.Bounds()
+	blend := blendFunc(mode)
+	if blend == nil {
+		if opacity == 255 {
+			draw.Draw(dst, b, src, b.Min, draw.Over)
+			return
+		}
+		mask := image.NewUniform(color.Alpha{opacity})
+		draw.DrawMask(dst, b, src, b.Min, mask, image.Point{}, draw.Over)
+		return
+	}
+	b = b.Intersect(dst.Bounds())
+	op := float64(opacity) / 0xff
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			sr, sg, sb, sa := src.At(x, y).RGBA()
+			if sa == 0 || opacity == 0 {
+				continue
+			}
+			d := dst.RGBA64At(x, y)
+			as := float64(sa) / 0xffff * op
+			ab := float64(d.A) / 0xffff
+			// The blended color applies where both layers are present
+			// and each layer's own color elsewhere, as in the W3C
+			// compositing model.
+			channel := func(s uint32, bk uint16) uint16 {
+				cs := float64(s) / 0xffff * op // premultiplied
+				cb := float64(bk) / 0xffff
+				v := cs*(1-ab) + cb*(1-as)
+				if d.A != 0 {
+					v += as * ab * blend(float64(bk)/float64(d.A), float64(s)/float64(sa))
+				}
+				return uint16(math.Min(v, 1)*0xffff + 0.5)
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{
+				R: channel(sr, d.R),
+				G: channel(sg, d.G),
+				B: channel(sb, d.B),
+				A: uint16((as+ab*(1-as))*0xffff + 0.5),
+			})
+		}
+	}
+}
+
+// blendFunc returns the function blending a backdrop color b with a source
+// color s for the separable blend modes, both straight and between 0 and
+// 1, or nil for BlendNormal and modes drawn as it.
+func blendFunc(mode BlendMode) func(b, s float64) float64 {
+	switch mode {
+	case BlendMultiply:
+		return func(b, s float64) float64 { return b * s }
+	case BlendScreen:
+		return screen
+	case BlendDarken:
+		return math.Min
+	case BlendLighten:
+		return math.Max
+	case BlendOverlay:
+		return func(b, s float64) float64 { return hardLight(s, b) }
+	case BlendHardLight:
+		return hardLight
+	case BlendSoftLight:
+		return softLight
+	case BlendDifference:
+		return func(b, s float64) float64 { return math.Abs(b - s) }
+	case BlendDodge:
+		return func(b, s float64) float64 {
+			switch {
+			case b == 0:
+				return 0
+			case s >= 1:
+				return 1
+			}
+			return math.Min(1, b/(1-s))
+		}
+	case BlendBurn:
+		return func(b, s float64) float64 {
+			switch {
+			case b >= 1:
+				return 1
+			case s == 0:
+				return 0
+			}
+			return 1 - math.Min(1, (1-b)/s)
+		}
+	case BlendExclusion:
+		return func(b, s float64) float64 { return b + s - 2*b*s }
+	}
+	return nil
+}
+
+func screen(b, s float64) float64 {
+	return b + s - b*s
+}
+
+func hardLight(b, s float64) float64 {
+	if s <= 0.5 {
+		return b * 2 * s
+	}
+	return screen(b, 2*s-1)
+}
+
+func softLight(b, s float64) float64 {
+	if s <= 0.5 {
+		return b - (1-2*s)*b*(1-b)
+	}
+	d := math.Sqrt(b)
+	if b <= 0.25 {
+		d = ((16*b-12)*b + 4) * b
+	}
+	return b + (2*s-1)*(d-b)
+}
+
+// applyAdjustment applies the adjustment layer l to dst, weighted by the
+// layer's opacity and adjustment mask.
+func applyAdjustment(dst draw.RGBA64Image, l *Layer, index int, opts *Options) {
+	adjust := adjustFunc(l.Adjustment)
+	if adjust == nil {
+		kind := AdjustmentNone
+		if l.Adjustment != nil {
+			kind = l.Adjustment.Kind()
+		}
+		opts.warn(Warning{Code: WarnAdjustment, Offset: -1, Layer: index, Message: "unsupported adjustment " + kind.String()})
+		return
+	}
+	b := dst.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			strength := uint32(l.Opacity) * 0x101
+			if m := l.AdjustmentMask; m != nil && (image.Point{x, y}).In(m.Rect) {
+				strength = strength * uint32(m.GrayAt(x, y).Y) / 0xff
+			}
+			if strength == 0 {
+				continue
+			}
+			c := dst.RGBA64At(x, y)
+			if c.A == 0 {
+				continue
+			}
+			// Adjustments operate on straight colors.
+			a := uint32(c.A)
+			r := uint32(c.R) * 0xffff / a
+			g := uint32(c.G) * 0xffff / a
+			bl := uint32(c.B) * 0xffff / a
+			ar, ag, ab := adjust(r, g, bl)
+			r = mix(r, ar, strength)
+			g = mix(g, ag, strength)
+			bl = mix(bl, ab, strength)
+			dst.SetRGBA64(x, y, color.RGBA64{
+				R: uint16(r * a / 0xffff),
+				G: uint16(g * a / 0xffff),
+				B: uint16(bl * a / 0xffff),
+				A: c.A,
+			})
+		}
+	}
+}
+
+// mix interpolates from a to b by t/0xffff.
+func mix(a, b, t uint32) uint32 {
+	return (a*(0xffff-t) + b*t + 0x7fff) / 0xffff
+}
@@ -0,0 +1,330 @@
+package psp
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"reflect"
+	"testing"
+)
+
+// adjustmentDoc returns a 2x1 document with the given pixels in a background
+// layer followed by a single adjustment layer.
+func adjustmentDoc(t *testing.T, px [2]color.RGBA, adj []byte, opacity byte, mask []byte) *Document {
+	const major = 7
+	bg := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	bg.SetRGBA(0, 0, px[0])
+	bg.SetRGBA(1, 0, px[1])
+	var chans []testChannel
+	if mask != nil {
+		chans = []testChannel{{bitmap: dibAdjustmentLayer, data: mask}}
+	}
+	data := newFileBuilder(major).
+		attrs(testAttrs{width: 2, height: 1, bitDepth: 24, comp: CompressionRLE, layerCount: 2}).
+		block(LayerStartBlock, concat(
+			layerBytes(major, CompressionRLE, testLayer{
+				layerType: byte(LayerRaster),
+				rect:      bg.Rect,
+				opacity:   255,
+				channels:  rgbChannels(bg),
+			}),
+			layerBytes(major, CompressionRLE, testLayer{
+				layerType: byte(LayerAdjustment),
+				rect:      bg.Rect,
+				opacity:   opacity,
+				blendMode: byte(BlendAdjust),
+				channels:  chans,
+				extra:     [][]byte{adj},
+			}),
+		)).
+		bytes()
+	doc, err := DecodeDocument(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestFlattenAdjustments(t *testing.T) {
+	const major = 7
+	px := [2]color.RGBA{{10, 100, 200, 255}, {200, 200, 200, 255}}
+	cases := []struct {
+		name    string
+		adj     []byte
+		opacity byte
+		mask    []byte
+		want    [2]color.RGBA
+	}{
+		{
+			name:    "invert",
+			adj:     adjustmentBytes(major, AdjustmentInvert),
+			opacity: 255,
+			want:    [2]color.RGBA{{245, 155, 55, 255}, {55, 55, 55, 255}},
+		},
+		{
+			name:    "brightness",
+			adj:     adjustmentBytes(major, AdjustmentBrightnessContrast, int32(20), int32(0)),
+			opacity: 255,
+			want:    [2]color.RGBA{{61, 151, 251, 255}, {251, 251, 251, 255}},
+		},
+		{
+			name:    "contrast",
+			adj:     adjustmentBytes(major, AdjustmentBrightnessContrast, int32(0), int32(-100)),
+			opacity: 255,
+			want:    [2]color.RGBA{{128, 128, 128, 255}, {128, 128, 128, 255}},
+		},
+		{
+			name:    "threshold",
+			adj:     adjustmentBytes(major, AdjustmentThreshold, int32(128)),
+			opacity: 255,
+			want:    [2]color.RGBA{{0, 0, 0, 255}, {255, 255, 255, 255}},
+		},
+		{
+			name:    "posterize",
+			adj:     adjustmentBytes(major, AdjustmentPosterize, int32(2)),
+			opacity: 255,
+			want:    [2]color.RGBA{{0, 0, 255, 255}, {255, 255, 255, 255}},
+		},
+		{
+			name:    "half opacity",
+			adj:     adjustmentBytes(major, AdjustmentInvert),
+			opacity: 128,
+			want:    [2]color.RGBA{{128, 128, 127, 255}, {127, 127, 127, 255}},
+		},
+		{
+			name:    "mask",
+			adj:     adjustmentBytes(major, AdjustmentInvert),
+			opacity: 255,
+			mask:    []byte{0, 255},
+			want:    [2]color.RGBA{{10, 100, 200, 255}, {55, 55, 55, 255}},
+		},
+	}
+	for _, c := range cases {
+		doc := adjustmentDoc(t, px, c.adj, c.opacity, c.mask)
+		img := doc.Flatten(&Options{ApplyAdjustments: true}).(*image.RGBA)
+		for x, want := range c.want {
+			if got := img.RGBAAt(x, 0); got != want {
+				t.Errorf("%s: pixel %d = %v, want %v", c.name, x, got, want)
+			}
+		}
+
+		img = doc.Flatten(nil).(*image.RGBA)
+		for x, want := range px {
+			if got := img.RGBAAt(x, 0); got != want {
+				t.Errorf("%s: adjustment applied without ApplyAdjustments", c.name)
+			}
+		}
+	}
+}
+
+func TestFlattenUnsupportedAdjustment(t *testing.T) {
+	px := [2]color.RGBA{{10, 100, 200, 255}, {200, 200, 200, 255}}
+	doc := adjustmentDoc(t, px, adjustmentBytes(7, AdjustmentCurve, []byte{1, 2, 3}), 255, nil)
+	var warnings []Warning
+	img := doc.Flatten(&Options{
+		ApplyAdjustments: true,
+		Warn:             func(w Warning) { warnings = append(warnings, w) },
+	}).(*image.RGBA)
+	if len(warnings) != 1 || warnings[0].Layer != 1 {
+		t.Errorf("got warnings %v", warnings)
+	}
+	if got := img.RGBAAt(0, 0); got != px[0] {
+		t.Errorf("unsupported adjustment changed pixel to %v", got)
+	}
+}
+
+func TestFlattenGroups(t *testing.T) {
+	doc, err := DecodeDocument(bytes.NewReader(nestedGroupsFile()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := doc.Flatten(nil).(*image.RGBA)
+	// The outer group flattens to blue and is drawn at half opacity over
+	// red, rather than blending green and blue individually.
+	if got, want := img.RGBAAt(0, 0), (color.RGBA{127, 0, 128, 255}); got != want {
+		t.Errorf("pixel 0 = %v, want %v", got, want)
+	}
+	if got, want := img.RGBAAt(1, 0), (color.RGBA{255, 255, 255, 255}); got != want {
+		t.Errorf("pixel 1 = %v, want %v", got, want)
+	}
+}
+
+func TestFlattenVisibilityOpacity(t *testing.T) {
+	const major = 7
+	r := image.Rect(0, 0, 2, 1)
+	// An opaque red background over the left pixel only, a hidden green
+	// layer and a blue layer at half opacity covering both pixels.
+	bg := solidRGBA(image.Rect(0, 0, 1, 1), color.RGBA{255, 0, 0, 255})
+	hidden := solidRGBA(r, color.RGBA{0, 255, 0, 255})
+	top := solidRGBA(r, color.RGBA{0, 0, 255, 255})
+	layer := func(m *image.RGBA, opacity byte, hidden bool) []byte {
+		return layerBytes(major, CompressionNone, testLayer{
+			layerType: byte(LayerRaster),
+			rect:      m.Rect,
+			opacity:   opacity,
+			hidden:    hidden,
+			channels:  rgbChannels(m),
+		})
+	}
+	data := newFileBuilder(major).
+		attrs(testAttrs{width: 2, height: 1, bitDepth: 24, layerCount: 3}).
+		block(LayerStartBlock, concat(layer(bg, 255, false), layer(hidden, 255, true), layer(top, 128, false))).
+		bytes()
+	doc, err := DecodeDocument(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := doc.Flatten(nil).(*image.RGBA)
+	want := []color.RGBA{
+		{127, 0, 128, 255}, // half blue over red
+		{0, 0, 128, 128},   // half blue over nothing, premultiplied
+	}
+	for x, c := range want {
+		if got := m.RGBAAt(x, 0); got != c {
+			t.Errorf("pixel %d: got %v, want %v", x, got, c)
+		}
+	}
+}
+
+func TestFlattenBlendModes(t *testing.T) {
+	bottom := color.RGBA{200, 100, 50, 255}
+	top := color.RGBA{100, 150, 250, 255}
+	for _, tc := range []struct {
+		mode    BlendMode
+		opacity byte
+		want    color.RGBA
+		want16  color.RGBA64
+	}{
+		{mode: BlendMultiply, opacity: 255, want: color.RGBA{78, 59, 49, 255}, want16: color.RGBA64{0x4ebd, 0x3b0e, 0x3136, 0xffff}},
+		{mode: BlendScreen, opacity: 255, want: color.RGBA{222, 191, 251, 255}, want16: color.RGBA64{0xde6f, 0xbfec, 0xfbf6, 0xffff}},
+		{mode: BlendDifference, opacity: 255, want: color.RGBA{100, 50, 200, 255}, want16: color.RGBA64{0x6464, 0x3232, 0xc8c8, 0xffff}},
+		{mode: BlendDifference, opacity: 128, want: color.RGBA{150, 75, 125, 255}, want16: color.RGBA64{0x9664, 0x4b32, 0x7dc9, 0xffff}},
+		// Modes without a separable formula are drawn as BlendNormal.
+		{mode: BlendDissolve, opacity: 255, want: top, want16: color.RGBA64{0x6464, 0x9696, 0xfafa, 0xffff}},
+	} {
+		for _, deep := range []bool{false, true} {
+			doc := &Document{Width: 1, Height: 1, ColorModel: color.RGBAModel}
+			var bg, fg image.Image = solidRGBA(image.Rect(0, 0, 1, 1), bottom), solidRGBA(image.Rect(0, 0, 1, 1), top)
+			if deep {
+				doc.ColorModel = color.RGBA64Model
+				bg, fg = to64(bg), to64(fg)
+			}
+			doc.Layers = []*Layer{
+				{Kind: LayerRaster, Opacity: 255, Visible: true, Image: bg},
+				{Kind: LayerRaster, Opacity: tc.opacity, BlendMode: tc.mode, Visible: true, Image: fg},
+			}
+			got := doc.Flatten(nil)
+			if deep {
+				if c := got.(*image.RGBA64).RGBA64At(0, 0); c != tc.want16 {
+					t.Errorf("%v at %d, 16 bit: got %#v, want %#v", tc.mode, tc.opacity, c, tc.want16)
+				}
+			} else if c := got.(*image.RGBA).RGBAAt(0, 0); c != tc.want {
+				t.Errorf("%v at %d: got %v, want %v", tc.mode, tc.opacity, c, tc.want)
+			}
+		}
+	}
+}
+
+func to64(m image.Image) *image.RGBA64 {
+	r := image.NewRGBA64(m.Bounds())
+	draw.Draw(r, r.Rect, m, r.Rect.Min, draw.Src)
+	return r
+}
+
+func TestFlattenFloatingSelection(t *testing.T) {
+	fill := func(r image.Rectangle, c color.RGBA) *image.RGBA {
+		m := image.NewRGBA(r)
+		draw.Draw(m, r, image.NewUniform(c), image.Point{}, draw.Src)
+		return m
+	}
+	bg := fill(image.Rect(0, 0, 4, 4), color.RGBA{255, 255, 255, 255})
+	target := fill(image.Rect(0, 0, 4, 4), color.RGBA{255, 0, 0, 255})
+	sel := fill(image.Rect(1, 1, 3, 3), color.RGBA{0, 255, 0, 255})
+	for _, major := range []uint16{5, 7} {
+		floating := byte(layerFloatingSelection)
+		if major >= 6 {
+			floating = byte(LayerFloatingSelection)
+		}
+		data := newFileBuilder(major).
+			attrs(testAttrs{width: 4, height: 4, bitDepth: 24, comp: CompressionRLE, layerCount: 3}).
+			block(LayerStartBlock, concat(
+				layerBytes(major, CompressionRLE, testLayer{
+					layerType: rasterType(major),
+					rect:      bg.Rect,
+					opacity:   255,
+					channels:  rgbChannels(bg),
+				}),
+				layerBytes(major, CompressionRLE, testLayer{
+					layerType: rasterType(major),
+					rect:      target.Rect,
+					opacity:   128,
+					channels:  rgbChannels(target),
+				}),
+				layerBytes(major, CompressionRLE, testLayer{
+					layerType: floating,
+					rect:      sel.Rect,
+					opacity:   255,
+					channels:  rgbChannels(sel),
+				}),
+			)).
+			bytes()
+		doc, err := DecodeDocument(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if k := doc.Layers[2].Kind; k != LayerFloatingSelection {
+			t.Fatalf("v%d: got kind %v for the floating selection", major, k)
+		}
+		if !reflect.DeepEqual(doc.Layers[2].Image, sel) {
+			t.Errorf("v%d: floating selection image mismatch", major)
+		}
+		// The selection replaces the pixels of the layer beneath it, which
+		// is then drawn at half opacity.
+		pasted := fill(target.Rect, color.RGBA{255, 0, 0, 255})
+		draw.Draw(pasted, sel.Rect, sel, sel.Rect.Min, draw.Src)
+		want := fill(bg.Rect, color.RGBA{255, 255, 255, 255})
+		draw.DrawMask(want, want.Rect, pasted, image.Point{}, image.NewUniform(color.Alpha{128}), image.Point{}, draw.Over)
+		if got := doc.Flatten(nil); !reflect.DeepEqual(got, want) {
+			t.Errorf("v%d: got %v, want %v", major, got.(*image.RGBA).Pix, want.Pix)
+		}
+
+		// A hidden target hides its floating selection.
+		doc.Layers[1].Visible = false
+		if got := doc.Flatten(nil); !reflect.DeepEqual(got, bg) {
+			t.Errorf("v%d: floating selection drawn over a hidden layer", major)
+		}
+	}
+}
+
+func TestFlattenWarnings(t *testing.T) {
+	r := image.Rect(0, 0, 2, 2)
+	doc := &Document{
+		Width:      2,
+		Height:     2,
+		ColorModel: color.RGBAModel,
+		Layers: []*Layer{
+			{Kind: LayerRaster, Opacity: 255, Visible: true, Image: testRGBA(r, 1)},
+			{Kind: LayerRaster, Opacity: 255, BlendMode: BlendHue, Visible: true, Image: testRGBA(r, 2)},
+			{Kind: LayerRaster, Opacity: 255, Visible: true, Image: testRGBA(r, 3), UserMask: image.NewGray(r)},
+			{Kind: LayerRaster, Opacity: 255, Visible: true, Image: testRGBA(r, 4), UserMask: image.NewGray(r), MaskDisabled: true},
+			{Kind: LayerVector, Opacity: 255, Visible: true},
+			{Kind: LayerVector, Opacity: 255},
+			{Kind: LayerRaster, Opacity: 255, BlendMode: BlendMultiply, Visible: true, Image: testRGBA(r, 5)},
+		},
+	}
+	var warnings []Warning
+	doc.Flatten(&Options{Warn: func(w Warning) { warnings = append(warnings, w) }})
+	want := []struct {
+		code  WarningCode
+		layer int
+	}{{WarnBlendMode, 1}, {WarnMask, 2}, {WarnLayerKind, 4}}
+	if len(warnings) != len(want) {
+		t.Fatalf("got warnings %v", warnings)
+	}
+	for i, w := range warnings {
+		if w.Code != want[i].code || w.Layer != want[i].layer || w.Offset != -1 {
+			t.Errorf("warning %d: got %v for layer %d at offset %d, want %v for layer %d", i, w.Code, w.Layer, w.Offset, want[i].code, want[i].layer)
+		}
+	}
+}
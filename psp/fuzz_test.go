@@ -0,0 +1,119 @@
+package psp
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/samuel/go-psp/internal/pspgen"
+)
+
+func FuzzDecode(f *testing.F) {
+	for _, pattern := range []string{"../testdata/*.psp", "../testdata/*.pspimage"} {
+		paths, _ := filepath.Glob(pattern)
+		for _, path := range paths {
+			b, err := os.ReadFile(path)
+			if err != nil {
+				f.Fatal(err)
+			}
+			f.Add(b)
+		}
+	}
+	for _, b := range pspgen.Corpus() {
+		f.Add(b)
+	}
+	// A palette claiming far more entries than the file holds.
+	f.Add(pspgen.NewFile(5).
+		Attrs(pspgen.Attrs{Width: 1, Height: 1, BitDepth: 8, LayerCount: 1}).
+		Block(pspgen.ColorBlock, pspgen.LE(uint32(8), uint32(0x40000000))).
+		Bytes())
+	// A channel block too short for its header.
+	f.Add(shortChannelFile())
+	// A palette in a 48 bit file, which has no indices into it.
+	f.Add(pspgen.NewFile(3).
+		Attrs(pspgen.Attrs{Width: 1, Height: 1, BitDepth: 48, LayerCount: 1}).
+		Block(pspgen.ColorBlock, pspgen.LE(uint32(1), uint32(0x303030))).
+		Layers(pspgen.LayerBytes(3, pspgen.None, pspgen.Layer{
+			Type:     pspgen.RasterType(3),
+			Rect:     image.Rect(0, 0, 1, 1),
+			Opacity:  255,
+			Channels: []pspgen.Channel{{Bitmap: pspgen.DIBImage, Channel: pspgen.ChannelRed, Data: make([]byte, 2)}},
+		})).
+		Bytes())
+	// A layer reaching past the top left corner of the canvas.
+	var offCanvas bytes.Buffer
+	doc := &Document{Width: 2, Height: 2, Layers: []*Layer{{Image: testRGBA(image.Rect(-2, -2, 1, 1), 0)}}}
+	if err := EncodeDocument(&offCanvas, doc, nil); err != nil {
+		f.Fatal(err)
+	}
+	f.Add(offCanvas.Bytes())
+	// Tight limits keep the work done for every input small, whatever the
+	// sizes of its canvas and layers.
+	opts := &Options{MaxWidth: 1 << 10, MaxHeight: 1 << 10, MaxPixels: 1 << 20, MaxLayers: 16}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		cfg, err := DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			checkError(t, err)
+			return
+		}
+		img, err := DecodeWithOptions(bytes.NewReader(data), opts)
+		if err != nil {
+			checkError(t, err)
+			if img != nil {
+				t.Error("image returned with an error")
+			}
+			return
+		}
+		model := img.ColorModel()
+		if p, ok := model.(color.Palette); ok {
+			// Palettes that pixels index beyond are extended.
+			if cp, ok := cfg.ColorModel.(color.Palette); ok && len(cp) < len(p) {
+				model = p[:len(cp)]
+			}
+		}
+		if !reflect.DeepEqual(model, cfg.ColorModel) {
+			t.Errorf("color models of Decode and DecodeConfig differ")
+		}
+		// Layers needn't lie within the canvas, so the image is checked
+		// against the saved rectangle of the layer it is the image of.
+		docOpts := *opts
+		docOpts.DIBTypes = DIBImage | DIBTransMask
+		doc, err := DecodeDocumentWithOptions(bytes.NewReader(data), &docOpts)
+		if err != nil {
+			checkError(t, err)
+			return
+		}
+		for _, l := range doc.Layers {
+			if l.Image != nil {
+				if b := img.Bounds(); b != l.SavedRect {
+					t.Errorf("bounds %v differ from the saved rectangle %v of the layer", b, l.SavedRect)
+				}
+				break
+			}
+		}
+	})
+}
+
+// checkError fails the test unless err is one of the errors the decoder
+// documents.
+func checkError(t *testing.T, err error) {
+	var derr *DecodeError
+	if !errors.As(err, &derr) {
+		t.Errorf("error %v is not a DecodeError", err)
+		return
+	}
+	switch derr.Err.(type) {
+	case FormatError, UnsupportedError, LimitError:
+		return
+	}
+	if derr.Err == io.ErrUnexpectedEOF {
+		return
+	}
+	t.Errorf("unexpected error %T: %v", derr.Err, err)
+}
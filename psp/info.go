@@ -0,0 +1,67 @@
+package psp
+
+import "io"
+
+// Info is the structure of a PSP file as described by its header and
+// general image attributes.
+type Info struct {
+	// VersionMajor and VersionMinor are the version of the file format
+	// rather than of the application that wrote it.
+	VersionMajor int
+	VersionMinor int
+
+	Width, Height int
+
+	// Resolution is in pixels per ResolutionUnit.
+	Resolution     float64
+	ResolutionUnit ResolutionUnit
+
+	// BitDepth is the number of bits per pixel of the layers, including
+	// the alpha of 32 and 64 bit images.
+	BitDepth    int
+	Grayscale   bool
+	Compression Compression
+
+	// LayerCount is the number of layers the file declares. Flattened
+	// reports a document holding just a background, as ContentsFlatImage
+	// tells. Files before version 4 don't store the flag, and are taken to
+	// be flattened if they hold a single layer.
+	LayerCount int
+	Flattened  bool
+
+	// Contents are the flags telling what the file holds, which are only
+	// stored since version 4.
+	Contents GraphicContents
+
+	// Features are the features Contents tells of. Those only found by
+	// reading the blocks are in Document.Features.
+	Features Features
+}
+
+// DecodeInfo returns the structure of a PSP file. Only the header and the
+// general image attributes are read, so that files can be cataloged
+// without touching their layers.
+func DecodeInfo(r io.Reader) (info *Info, err error) {
+	defer catchErrors(&err)
+	d := newDecoder(r, nil)
+	defer d.release()
+	flat := d.contents.IsFlat()
+	if d.versionMajor < 4 {
+		flat = d.layerCount == 1
+	}
+	return &Info{
+		VersionMajor:   int(d.versionMajor),
+		VersionMinor:   int(d.versionMinor),
+		Width:          d.width,
+		Height:         d.height,
+		Resolution:     d.meta.Resolution,
+		ResolutionUnit: d.meta.ResolutionUnit,
+		BitDepth:       int(d.bitDepth),
+		Grayscale:      d.grayscale,
+		Compression:    d.comp,
+		LayerCount:     int(d.layerCount),
+		Flattened:      flat,
+		Contents:       d.contents,
+		Features:       contentsFeatures(d.contents),
+	}, nil
+}
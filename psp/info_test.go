@@ -0,0 +1,77 @@
+package psp
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+func TestDecodeInfo(t *testing.T) {
+	data := newFileBuilder(7).
+		attrs(testAttrs{width: 4, height: 3, res: 300, unit: ResolutionInch, bitDepth: 8, grayscale: true, comp: CompressionRLE, layerCount: 2,
+			contents: ContentsRasterLayers | ContentsComposite | ContentsAlphaChannels}).
+		bytes()
+	info, err := DecodeInfo(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Info{
+		VersionMajor:   7,
+		Width:          4,
+		Height:         3,
+		Resolution:     300,
+		ResolutionUnit: ResolutionInch,
+		BitDepth:       8,
+		Grayscale:      true,
+		Compression:    CompressionRLE,
+		LayerCount:     2,
+		Contents:       ContentsRasterLayers | ContentsComposite | ContentsAlphaChannels,
+		Features:       FeatureRasterLayers | FeatureComposite | FeatureAlphaChannels,
+	}
+	if *info != want {
+		t.Errorf("got %+v, want %+v", *info, want)
+	}
+
+	if c := info.Contents; !c.HasComposite() || !c.HasAlphaChannels() || c.HasThumbnail() || c.IsFlat() {
+		t.Errorf("wrong predicates for contents %#x", uint32(c))
+	}
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, testRGBA(image.Rect(0, 0, 5, 2), 0)); err != nil {
+		t.Fatal(err)
+	}
+	info, err = DecodeInfo(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.VersionMajor != 5 || info.BitDepth != 24 || info.Compression != CompressionLZ77 || info.LayerCount != 1 || !info.Contents.HasRasterLayers() {
+		t.Errorf("got %+v for an encoded image", *info)
+	}
+}
+
+func TestDecodeInfoFlattened(t *testing.T) {
+	for _, tc := range []struct {
+		major    uint16
+		layers   uint16
+		contents GraphicContents
+		want     bool
+	}{
+		{7, 1, ContentsRasterLayers | ContentsFlatImage, true},
+		{7, 1, ContentsRasterLayers, false},
+		{7, 2, ContentsRasterLayers, false},
+		// Before version 4 the layer count is all there is to go by.
+		{3, 1, 0, true},
+		{3, 2, 0, false},
+	} {
+		data := newFileBuilder(tc.major).
+			attrs(testAttrs{width: 1, height: 1, bitDepth: 24, layerCount: tc.layers, contents: tc.contents}).
+			bytes()
+		info, err := DecodeInfo(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Flattened != tc.want {
+			t.Errorf("v%d with %d layers and contents %#x: got Flattened %v, want %v", tc.major, tc.layers, uint32(tc.contents), info.Flattened, tc.want)
+		}
+	}
+}
@@ -0,0 +1,842 @@
+package psp
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"strings"
+)
+
+// Document is a decoded PSP file.
+type Document struct {
+	Width      int
+	Height     int
+	ColorModel color.Model
+	Metadata   Metadata
+
+	// Layers holds every layer in the order they are stored in the file,
+	// which is bottom-most first.
+	Layers []*Layer
+
+	// AlphaChannels holds the saved alpha channels of the document in the
+	// order they are stored.
+	AlphaChannels []AlphaChannel
+
+	// Tables holds the paper and pattern fill resources of the document.
+	Tables []Table
+
+	// Root is a group holding the top-level layers of the document. Files
+	// without group layers have every layer at the top level.
+	Root *Layer
+
+	// Features are what the file holds, from its graphic contents flags
+	// and the blocks and layers read. Features.Unsupported tells which of
+	// them this package doesn't reproduce.
+	Features Features
+}
+
+// LinkGroups returns the linked layers of the document by their
+// LinkGroup, each group in the order the layers are stored. Layers that
+// aren't linked are left out.
+func (doc *Document) LinkGroups() map[uint8][]*Layer {
+	groups := make(map[uint8][]*Layer)
+	for _, l := range doc.Layers {
+		if l.LinkGroup != 0 {
+			groups[l.LinkGroup] = append(groups[l.LinkGroup], l)
+		}
+	}
+	return groups
+}
+
+// Layer is a single layer of a PSP document.
+type Layer struct {
+	// Name is the name of the layer converted to UTF-8 and RawName the
+	// bytes of the name as stored in the file.
+	Name    string
+	RawName []byte
+	Kind    LayerKind
+
+	// Rect is the rectangle the layer occupies in the document and
+	// SavedRect is the part of it for which pixel data is stored.
+	Rect      image.Rectangle
+	SavedRect image.Rectangle
+
+	Opacity               uint8
+	BlendMode             BlendMode
+	Visible               bool
+	TransparencyProtected bool
+
+	// LinkGroup identifies the group of linked layers, which move
+	// together, that the layer belongs to. Zero means it isn't linked.
+	LinkGroup uint8
+
+	// Mask rectangles and flags describe the layer's user mask. UserMask
+	// is the decoded mask with bounds SavedMaskRect, or nil if the layer
+	// has no user mask.
+	MaskRect          image.Rectangle
+	SavedMaskRect     image.Rectangle
+	MaskLinked        bool
+	MaskDisabled      bool
+	InvertMaskOnBlend bool
+	UserMask          *image.Gray
+
+	// BlendRanges holds the source and destination blend ranges of the
+	// layer, of which the first BlendRangeCount are in use.
+	BlendRangeCount uint16
+	BlendRanges     [5]BlendRange
+
+	// BitmapCount and ChannelCount are the number of bitmaps and channel
+	// blocks stored for the layer. Files with a major version of 10 or
+	// later don't record these, so BitmapCount is zero and ChannelCount
+	// is the number of channel blocks of raster layers found in the file.
+	BitmapCount  uint16
+	ChannelCount uint16
+
+	// Shapes holds the vector shapes of a vector layer.
+	Shapes []*Shape
+
+	// Adjustment holds the parameters of an adjustment layer and
+	// AdjustmentMask, if not nil, is the strength with which it is applied
+	// within SavedRect. The adjustment applies fully outside of it.
+	Adjustment     Adjustment
+	AdjustmentMask *image.Gray
+
+	// Children holds the layers of a group layer, bottom-most first.
+	Children []*Layer
+
+	// Image is the decoded color data of the layer with bounds SavedRect,
+	// or nil if the layer has no color channels.
+	Image image.Image
+
+	group      bool
+	groupCount int // number of direct children of a group layer
+}
+
+// BlendRange restricts blending to the pixels of the layer (Source) and of
+// the layers below (Destination) whose values lie within the range. Each is
+// stored as four bytes, as written by Paint Shop Pro.
+type BlendRange struct {
+	Source      [4]byte
+	Destination [4]byte
+}
+
+// IsGroup reports whether the layer is a group layer (since PSP8).
+func (l *Layer) IsGroup() bool {
+	return l.group
+}
+
+// decodeLayers reads the contents of the layer bank block, whose header
+// must already have been consumed, and leaves the input at the end of the
+// bank.
+func (d *decoder) decodeLayers() []*Layer {
+	if n := int(d.layerCount); n > d.limits.layers {
+		d.error(LimitError{"MaxLayers", n, d.limits.layers})
+	}
+	layers := make([]*Layer, 0, d.layerCount)
+	// With workers, this loop only finds the layers for them to decode.
+	var jobs []layerJob
+	parallel := d.parallelLayers()
+	var bh blockHeader
+	for d.offset < d.layerBankEnd {
+		d.readBlockHeader(&bh)
+		switch bh.id {
+		case LayerBlock:
+			// The count in the attributes may understate the layers stored.
+			if len(layers) == d.limits.layers {
+				d.error(LimitError{"MaxLayers", len(layers) + 1, d.limits.layers})
+			}
+			d.layer = len(layers)
+			end := d.offset + int64(bh.dataLen)
+			switch {
+			case parallel:
+				jobs = append(jobs, layerJob{index: len(layers), start: d.offset, end: end, init: d.blocks[len(d.blocks)-1].init})
+				layers = append(layers, nil)
+				d.skipTo(end)
+			case d.rows != nil:
+				d.decodeLayerRows(end)
+				layers = append(layers, nil)
+			default:
+				layers = append(layers, d.decodeLayer(end))
+			}
+			d.layer = -1
+		case RasterExtensionBlock:
+			d.skipRasterExtension(d.offset + int64(bh.dataLen))
+		default:
+			d.checkKnown(bh.id)
+			d.skip(int(bh.dataLen))
+		}
+		if !parallel {
+			d.reportProgress(d.offset)
+		}
+	}
+	if len(jobs) > 0 {
+		d.decodeLayerJobs(layers, jobs)
+	}
+	d.skipTo(d.layerBankEnd)
+	return layers
+}
+
+// skipRasterExtension skips a raster extension block ending at end. Files
+// since version 13 may store one in the layer bank, mostly zeros, whose
+// meaning is unknown. One file was seen with a chunk after the block that
+// its length doesn't cover, starting with its size; a chunk like it is
+// skipped, as a recoverable problem, only where no block header follows.
+func (d *decoder) skipRasterExtension(end int64) {
+	d.skipTo(end)
+	if d.offset >= d.layerBankEnd {
+		return
+	}
+	if b, _ := d.r.Peek(len(blockMagic)); bytes.Equal(b, blockMagic) {
+		return
+	}
+	start := d.offset
+	chunkEnd := d.readChunkSize()
+	if chunkEnd < d.offset || chunkEnd > d.layerBankEnd {
+		d.error(FormatError(fmt.Sprintf("data after %v at offset %d is neither a block nor a chunk", RasterExtensionBlock, start)))
+	}
+	d.recoverable("skipped a %d byte chunk after %v", chunkEnd-start, RasterExtensionBlock)
+	d.skipTo(chunkEnd)
+}
+
+// layerTree arranges layers into a hierarchy below a root group. A group
+// layer is stored ahead of its children, and its group extension block
+// records how many direct children follow.
+func layerTree(layers []*Layer) *Layer {
+	root := &Layer{Opacity: 255, Visible: true, group: true}
+	var build func(parent *Layer, n int)
+	i := 0
+	build = func(parent *Layer, n int) {
+		for ; n > 0 && i < len(layers); n-- {
+			l := layers[i]
+			i++
+			parent.Children = append(parent.Children, l)
+			if l.group {
+				build(l, l.groupCount)
+			}
+		}
+	}
+	// Every iteration consumes a layer, so this picks up all the layers
+	// even if a group claims more children than there are.
+	build(root, len(layers))
+	return root
+}
+
+// decodeLayer reads a layer block ending at end along with all of its
+// channels.
+func (d *decoder) decodeLayer(end int64) *Layer {
+	var bh blockHeader
+	l := &Layer{}
+	d.readLayerInfo(l)
+	// fmt.Printf("%+v\n", l)
+	var layerBytes, channel, channelBlocks int
+	var alpha bool
+	if d.hasChannels(l) && d.dibs.has(dibImage) {
+		layerBytes = d.newLayerImage(l)
+	}
+	// Besides channels, vector, adjustment and group layers store their
+	// contents in extension sub-blocks.
+	for d.offset < end {
+		d.readBlockHeader(&bh)
+		blockEnd := d.offset + int64(bh.dataLen)
+		switch bh.id {
+		case ChannelBlock:
+			d.channel = channelBlocks
+			channelBlocks++
+			if l.hasRaster() {
+				if channel < int(l.ChannelCount) || !d.channelsDeclared() {
+					if d.decodeChannel(l, blockEnd, layerBytes) == dibTransMask {
+						alpha = true
+					}
+					channel++
+				} else {
+					d.recoverable("skipped channel beyond the %d declared", l.ChannelCount)
+				}
+				break
+			}
+			compressedLen, bitmapType, _ := d.readChannelHeader()
+			switch {
+			case !d.dibs.has(bitmapType):
+			case bitmapType == dibUserMask:
+				l.UserMask = d.readGrayChannel(l.SavedMaskRect, compressedLen)
+			case l.Kind == LayerAdjustment && bitmapType == dibAdjustmentLayer:
+				l.AdjustmentMask = d.readGrayChannel(l.SavedRect, compressedLen)
+			}
+		case VectorExtensionBlock:
+			l.Shapes = append(l.Shapes, d.decodeVectorExtension(blockEnd)...)
+		case AdjustmentExtensionBlock:
+			l.Adjustment = d.decodeAdjustmentExtension(blockEnd)
+		case GroupExtensionBlock:
+			chunkEnd := d.readChunkSize()
+			l.group = true
+			l.groupCount = int(d.readUint32())
+			d.skipTo(chunkEnd)
+		default:
+			d.checkKnown(bh.id)
+		}
+		d.skipTo(blockEnd)
+		if bh.id == ChannelBlock {
+			d.channel = -1
+			d.reportProgress(d.offset)
+		}
+	}
+	if !d.channelsDeclared() && l.hasRaster() {
+		l.ChannelCount = uint16(channel)
+	}
+	if len(d.pending) > 0 {
+		d.decodePending(l.Image, layerBytes)
+	}
+	if m, ok := l.Image.(*image.Paletted); ok {
+		d.checkIndices(m)
+	}
+	if d.opts != nil && d.opts.NonPremultiplied {
+		l.Image = straightImage(l.Image)
+	} else if alpha {
+		premultiply(l.Image)
+	}
+	return l
+}
+
+// checkIndices extends the palette of an indexed image with opaque black up
+// to the largest index of its pixels, so that it can be drawn. Indices
+// beyond the palette are a recoverable problem.
+func (d *decoder) checkIndices(m *image.Paletted) {
+	n := len(m.Palette)
+	if n >= 256 {
+		return
+	}
+	i := maxIndex(m.Pix)
+	if int(i) < n {
+		return
+	}
+	d.recoverable("pixel index %d beyond the %d palette entries", i, n)
+	pal := make(color.Palette, int(i)+1)
+	copy(pal, m.Palette)
+	for j := n; j < len(pal); j++ {
+		pal[j] = color.RGBA{A: 255}
+	}
+	m.Palette = pal
+}
+
+// maxIndex returns the largest of the palette indices pix.
+func maxIndex(pix []byte) byte {
+	var m byte
+	for _, v := range pix {
+		m = max(m, v)
+	}
+	return m
+}
+
+// straightImage returns the color images of layers as the non-premultiplied
+// types holding the same pixel data, which is straight alpha until
+// premultiply is applied.
+func straightImage(m image.Image) image.Image {
+	switch m := m.(type) {
+	case *image.RGBA:
+		return &image.NRGBA{Pix: m.Pix, Stride: m.Stride, Rect: m.Rect}
+	case *image.RGBA64:
+		return &image.NRGBA64{Pix: m.Pix, Stride: m.Stride, Rect: m.Rect}
+	}
+	return m
+}
+
+// hasRaster reports whether the layer's contents are stored as channels.
+func (l *Layer) hasRaster() bool {
+	switch l.Kind {
+	case LayerUndefined, LayerRaster, LayerFloatingSelection:
+		return true
+	}
+	return false
+}
+
+// channelsDeclared reports whether layer blocks record the number of
+// channels that follow them, which files with a major version of 10 or
+// later don't. Their channels are counted as they are read instead.
+func (d *decoder) channelsDeclared() bool {
+	return d.versionMajor < 10
+}
+
+// hasChannels reports whether the layer stores raster channels, or may in
+// files that don't declare them.
+func (d *decoder) hasChannels(l *Layer) bool {
+	return l.hasRaster() && (l.ChannelCount != 0 || !d.channelsDeclared())
+}
+
+// readLayerInfo reads the layer information and, before version 10, the
+// layer bitmap information. Since version 4 these are chunks starting with
+// their size, of which fields added by later versions are skipped, and
+// before they end with the initial data of the layer block.
+func (d *decoder) readLayerInfo(l *Layer) {
+	var infoEnd int64
+	if d.versionMajor >= 4 {
+		infoEnd = d.readChunkSize()
+	}
+	l.Name, l.RawName = d.readName()
+	l.Kind = d.layerKind(d.readByte())
+	l.Rect = d.readRect()
+	l.SavedRect = d.readBitmapRect()
+	l.Opacity = d.readByte()
+	l.BlendMode = BlendMode(d.readByte())
+	l.Visible = d.readByte() != 0
+	l.TransparencyProtected = d.readByte() != 0
+	l.LinkGroup = d.readByte()
+	l.MaskRect = d.readRect()
+	l.SavedMaskRect = d.readBitmapRect()
+	l.MaskLinked = d.readByte() != 0
+	l.MaskDisabled = d.readByte() != 0
+	l.InvertMaskOnBlend = d.readByte() != 0
+	l.BlendRangeCount = d.readUint16()
+	// The five ranges are always stored, whatever the count.
+	for i := range l.BlendRanges {
+		d.read(l.BlendRanges[i].Source[:])
+		d.read(l.BlendRanges[i].Destination[:])
+	}
+	if d.versionMajor < 4 {
+		l.BitmapCount = d.readUint16()
+		l.ChannelCount = d.readUint16()
+		d.skipInitialData(d.offset)
+		return
+	}
+	// TODO: not sure what the 5 bytes since version 6 hold
+	known := d.offset
+	if d.versionMajor >= 6 {
+		known += 5
+	}
+	d.skipChunkRest(infoEnd, known)
+	if d.versionMajor >= 10 {
+		// The counts aren't stored; decodeLayer counts the channel blocks.
+		return
+	}
+	bitmapEnd := d.readChunkSize()
+	l.BitmapCount = d.readUint16()
+	l.ChannelCount = d.readUint16()
+	d.skipChunkRest(bitmapEnd, d.offset)
+}
+
+// skipChunkRest skips to end, the end of a chunk of which the fields up to
+// known are understood, passing over what later versions add to it. Some
+// files store sizes that don't cover the known fields, which are then
+// taken to be all of the chunk, as are sizes reaching past the block.
+func (d *decoder) skipChunkRest(end, known int64) {
+	if blockEnd, ok := d.blockEnd(); end < known || ok && end > blockEnd {
+		end = known
+	}
+	d.skipTo(end)
+}
+
+// readName reads the name of a layer or alpha channel, which is length
+// prefixed since version 4 and a fixed 256 byte field before that. It
+// returns the name converted to UTF-8 along with the bytes as stored, up to
+// the NUL ending a fixed field.
+func (d *decoder) readName() (string, []byte) {
+	if d.versionMajor >= 4 {
+		return d.readText(int(d.readUint16()))
+	}
+	raw := d.readStringBytes(256)
+	if i := bytes.IndexByte(raw, 0); i >= 0 {
+		raw = raw[:i]
+	}
+	raw = bytes.Clone(raw)
+	return strings.TrimSpace(d.text(raw)), raw
+}
+
+// layerKind maps a stored layer type to a LayerKind. Files before PSP6 use
+// a different enumeration in which 1 means a floating selection.
+func (d *decoder) layerKind(t byte) LayerKind {
+	if d.versionMajor >= 6 {
+		return LayerKind(t)
+	}
+	switch layerType(t) {
+	case layerNormal:
+		return LayerRaster
+	case layerFloatingSelection:
+		return LayerFloatingSelection
+	}
+	return LayerUndefined
+}
+
+// newLayerImage allocates the image for a layer's color data and returns
+// the number of bytes in a single uncompressed channel.
+func (d *decoder) newLayerImage(l *Layer) (layerBytes int) {
+	r := l.SavedRect
+	d.checkSize(r.Dx(), r.Dy())
+	d.allocPixels(r.Dx(), r.Dy())
+	if indexed(d.bitDepth, d.grayscale) && d.palette != nil {
+		l.Image = image.NewPaletted(r, d.layerPalette())
+		layerBytes = r.Dx() * r.Dy()
+		if d.bitDepth < 8 {
+			layerBytes = (r.Dx()*int(d.bitDepth) + 7) / 8 * r.Dy()
+		}
+	} else if d.bitDepth == 8 && d.grayscale {
+		l.Image = image.NewGray(r)
+		layerBytes = r.Dx() * r.Dy()
+	} else if d.bitDepth == 16 {
+		l.Image = image.NewGray16(r)
+		layerBytes = r.Dx() * r.Dy() * 2
+	} else if d.bitDepth == 24 || d.bitDepth == 32 {
+		img := image.NewRGBA(r)
+		for i := 3; i < len(img.Pix); i += 4 {
+			img.Pix[i] = 255
+		}
+		l.Image = img
+		layerBytes = r.Dx() * r.Dy()
+	} else if d.bitDepth == 48 || d.bitDepth == 64 {
+		img := image.NewRGBA64(r)
+		for i := 6; i < len(img.Pix); i += 8 {
+			img.Pix[i] = 255
+			img.Pix[i+1] = 255
+		}
+		l.Image = img
+		layerBytes = r.Dx() * r.Dy() * 2
+	}
+	return layerBytes
+}
+
+// layerPalette returns the palette of indexed layer images, in which the
+// entry named by the transparency index of the extended data is
+// transparent.
+func (d *decoder) layerPalette() color.Palette {
+	pal := d.palette
+	if i := d.xDataTrnsIndex; i >= 0 && i < len(pal) {
+		pal = append(color.Palette(nil), pal...)
+		c := color.RGBAModel.Convert(pal[i]).(color.RGBA)
+		pal[i] = color.NRGBA{R: c.R, G: c.G, B: c.B}
+	}
+	return pal
+}
+
+// premultiply converts an image whose alpha channel was read from a
+// transparency mask from straight to premultiplied alpha.
+func premultiply(m image.Image) {
+	switch img := m.(type) {
+	case *image.RGBA:
+		for i := 0; i < len(img.Pix); i += 4 {
+			a := uint32(img.Pix[i+3])
+			for j := i; j < i+3; j++ {
+				img.Pix[j] = uint8((uint32(img.Pix[j])*a + 127) / 255)
+			}
+		}
+	case *image.RGBA64:
+		for i := 0; i < len(img.Pix); i += 8 {
+			a := uint32(img.Pix[i+6])<<8 | uint32(img.Pix[i+7])
+			for j := i; j < i+6; j += 2 {
+				v := (uint32(img.Pix[j])<<8 | uint32(img.Pix[j+1])) * a / 0xffff
+				img.Pix[j], img.Pix[j+1] = uint8(v>>8), uint8(v)
+			}
+		}
+	}
+}
+
+// decodeChannel reads the channel block ending at end into the layer's
+// image and returns its bitmap type. A transparency mask is stored as
+// straight alpha; the caller premultiplies the image once every channel has
+// been read.
+func (d *decoder) decodeChannel(l *Layer, end int64, layerBytes int) bitmapType {
+	compressedLayerLen, bitmapType, channelType := d.readChannelHeader()
+	if !d.dibs.has(bitmapType) {
+		// Skipped transparency leaves the image opaque.
+		d.skipTo(end)
+		return dibImage
+	}
+	if bitmapType == dibUserMask {
+		l.UserMask = d.readGrayChannel(l.SavedMaskRect, compressedLayerLen)
+		return bitmapType
+	}
+	if bitmapType == dibTransMask {
+		// The mask becomes the alpha channel of images that have one.
+		// TODO: paletted and grayscale layers drop their transparency
+		switch l.Image.(type) {
+		case *image.RGBA, *image.RGBA64:
+			channelType = 4
+		default:
+			d.skipTo(end)
+			return dibImage
+		}
+	} else if bitmapType != dibImage || l.Image == nil {
+		// TODO: ignoring other bitmap types
+		d.skipTo(end)
+		return bitmapType
+	} else if channelType < channelRed || channelType > channelBlue {
+		switch l.Image.(type) {
+		case *image.RGBA, *image.RGBA64:
+			d.recoverable("skipped %v of a color layer", channelType)
+			d.skipTo(end)
+			return bitmapType
+		}
+	}
+	// fmt.Printf("Channel\n")
+	// fmt.Printf("\tcompressed layer len = %d\n", compressedLayerLen)
+	// fmt.Printf("\tbitmap type = %s\n", bitmapType)
+	// fmt.Printf("\tchannel type = %s\n", channelType)
+
+	if d.parallel() {
+		d.queueChannel(compressedLayerLen, channelType)
+		return bitmapType
+	}
+	if cap(d.tmpBuf) < layerBytes {
+		d.tmpBuf = make([]byte, layerBytes)
+	}
+	buf := d.tmpBuf[:layerBytes]
+	d.readChannelData(buf, compressedLayerLen)
+	d.storePlane(l.Image, buf, channelType)
+	return bitmapType
+}
+
+// storePlane copies the decompressed data of a channel of the given type
+// into a layer image.
+func (d *decoder) storePlane(m image.Image, buf []byte, channelType channelType) {
+	// Compression works on bytes, so whatever the method the data is
+	// the plane as stored: 16 bit samples are little-endian, and swapped
+	// into the big-endian order of the image package.
+	//
+	// The loops work on a pixel sliced out at a time, which leaves the
+	// compiler a single bounds check per pixel where strided indexing
+	// takes two. Channel offsets are masked for it to see they are in
+	// range.
+	switch img := m.(type) {
+	case *image.RGBA:
+		c := int(channelType-1) & 3
+		for i, v := range buf[:len(img.Pix)/4] {
+			p := img.Pix[4*i : 4*i+4 : 4*i+4]
+			p[c] = v
+		}
+	case *image.RGBA64:
+		c := (int(channelType-1) & 3) * 2
+		pix := img.Pix
+		for len(pix) >= 8 && len(buf) >= 2 {
+			pix[c], pix[c+1] = buf[1], buf[0]
+			pix, buf = pix[8:], buf[2:]
+		}
+	case *image.Gray:
+		copy(img.Pix, buf)
+	case *image.Gray16:
+		for i := 0; i+1 < len(buf); i += 2 {
+			s := buf[i : i+2 : i+2]
+			p := img.Pix[i : i+2 : i+2]
+			p[0], p[1] = s[1], s[0]
+		}
+	case *image.Paletted:
+		if bits := int(d.bitDepth); bits < 8 {
+			// Rows of 1 and 4 bit samples, the most significant first,
+			// are padded to whole bytes.
+			w := img.Rect.Dx()
+			stride := (w*bits + 7) / 8
+			mask := byte(1<<bits - 1)
+			for y := 0; y < img.Rect.Dy() && len(buf) >= stride; y++ {
+				row := img.Pix[y*img.Stride : y*img.Stride+w]
+				for x := range row {
+					i := x * bits
+					row[x] = buf[i/8] >> (8 - bits - i%8) & mask
+				}
+				buf = buf[stride:]
+			}
+		} else {
+			copy(img.Pix, buf)
+		}
+	}
+}
+
+// readChannelHeader reads the fixed fields at the start of a channel block.
+func (d *decoder) readChannelHeader() (compressedLen int, bt bitmapType, ct channelType) {
+	size := int64(12)
+	if d.versionMajor >= 4 {
+		size += 4
+	}
+	if end, ok := d.blockEnd(); ok && end-d.offset < size {
+		d.error(FormatError(fmt.Sprintf("channel block of %d bytes is shorter than its %d byte header", end-d.offset, size)))
+	}
+	var headerEnd int64
+	if d.versionMajor >= 4 {
+		headerEnd = d.readChunkSize()
+		if headerEnd-d.offset < 12 {
+			d.error(FormatError("invalid channel block info len"))
+		}
+	}
+	compressedLen = int(d.readUint32())
+	d.readUint32() // uncompressed length
+	bt = bitmapType(d.readUint16())
+	ct = channelType(d.readUint16())
+	if d.versionMajor >= 4 {
+		// Fields added by later versions are skipped.
+		d.skipTo(headerEnd)
+	} else {
+		d.skipInitialData(d.offset)
+	}
+	return compressedLen, bt, ct
+}
+
+// lz77Error maps errors about corrupt compressed data to a FormatError.
+// Errors of the underlying reader are returned as is.
+func lz77Error(err error) error {
+	if _, ok := err.(flate.CorruptInputError); ok || err == zlib.ErrHeader || err == zlib.ErrChecksum || err == zlib.ErrDictionary {
+		return FormatError("LZ77 data: " + err.Error())
+	}
+	return err
+}
+
+// zlibHeader reports whether the next n bytes of channel data start with a
+// plausible zlib header: deflate compression with a window of at most 32K
+// and a valid header checksum.
+func (d *decoder) zlibHeader(n int) bool {
+	if n < 2 {
+		return true // left to zlib to fail on
+	}
+	h, err := d.r.Peek(2)
+	if err != nil {
+		return true
+	}
+	return isZlibHeader(h)
+}
+
+func isZlibHeader(h []byte) bool {
+	return h[0]&0x0f == 8 && h[0]>>4 <= 7 && (uint16(h[0])<<8|uint16(h[1]))%31 == 0
+}
+
+// readGrayChannel decodes a single 8-bit channel covering r, as used by masks.
+func (d *decoder) readGrayChannel(r image.Rectangle, compressedLen int) *image.Gray {
+	d.checkSize(r.Dx(), r.Dy())
+	d.allocPixels(r.Dx(), r.Dy())
+	img := image.NewGray(r)
+	d.readChannelData(img.Pix, compressedLen)
+	return img
+}
+
+// readChannelData reads and decompresses compressedLen bytes of channel data
+// into buf. Channels without any data, as empty layers may be written, are
+// left empty.
+func (d *decoder) readChannelData(buf []byte, compressedLen int) {
+	d.checkContext()
+	if compressedLen == 0 {
+		clear(buf)
+		return
+	}
+	switch d.comp {
+	case CompressionLZ77:
+		if data, ok := d.inPlace(compressedLen); ok {
+			br := &d.scratch.br
+			br.Reset(data)
+			_, err := io.ReadFull(d.lz77Reader(br, len(data) < 2 || isZlibHeader(data)), buf)
+			if err != nil {
+				d.offset -= int64(br.Len())
+				d.error(lz77Error(err))
+			}
+			return
+		}
+		*d.lr = limitedInput{d.r, int64(compressedLen)}
+		lr := d.lr
+		_, err := io.ReadFull(d.lz77Reader(lr, d.zlibHeader(compressedLen)), buf)
+		d.offset += int64(compressedLen) - lr.n
+		if err != nil {
+			d.error(lz77Error(err))
+		}
+		// The decompressor may stop short of the checksum and padding.
+		d.skip(int(lr.n))
+	case CompressionRLE:
+		d.readRLE(buf, compressedLen)
+	case CompressionNone:
+		d.read(buf)
+	}
+}
+
+// lz77Reader returns a decompressor for the LZ77 data read from r, which
+// starts with a zlib header if zlibHeader is true. The decompressors are
+// kept with the pooled buffers of the decoder and reset onto the data of
+// every channel, as they are expensive to allocate.
+func (d *decoder) lz77Reader(r io.Reader, zlibHeader bool) io.Reader {
+	if !zlibHeader {
+		// Some other applications write raw deflate streams.
+		d.recoverable("LZ77 channel data without a zlib header")
+		if d.flateReader == nil {
+			d.flateReader = flate.NewReader(r)
+		} else if err := d.flateReader.(flate.Resetter).Reset(r, nil); err != nil {
+			d.error(lz77Error(err))
+		}
+		return d.flateReader
+	}
+	if d.zlibReader == nil {
+		zr, err := zlib.NewReader(r)
+		if err != nil {
+			d.error(lz77Error(err))
+		}
+		d.zlibReader = zr
+	} else if err := d.zlibReader.(zlib.Resetter).Reset(r, nil); err != nil {
+		d.error(lz77Error(err))
+	}
+	return d.zlibReader
+}
+
+// rleSlabSize is the most RLE data read from the input at a time.
+const rleSlabSize = 4096
+
+// readRLE decodes compressedLen bytes of RLE data into buf. A control byte
+// above 128 repeats the byte that follows it that many times less 128, and
+// any other is followed by that many literal bytes. The data is read in
+// slabs and decoded from them by indexing, as reading it a byte at a time
+// is slow.
+func (d *decoder) readRLE(buf []byte, compressedLen int) {
+	var slab []byte
+	left := compressedLen // bytes not yet read into slab
+	var s []byte          // bytes of slab not yet decoded
+	if data, ok := d.inPlace(compressedLen); ok {
+		// Data in memory is decoded where it lies.
+		s, left = data, 0
+	} else if d.scratch != nil {
+		slab = d.scratch.slab[:min(compressedLen, rleSlabSize)]
+	} else {
+		slab = make([]byte, min(compressedLen, rleSlabSize))
+	}
+	j := 0
+	for len(s) > 0 || left > 0 {
+		if len(s) == 0 {
+			s = d.fillSlab(slab, &left)
+		}
+		run := int(s[0])
+		s = s[1:]
+		if run > 128 {
+			run -= 128
+			if len(s) == 0 {
+				s = d.fillSlab(slab, &left)
+			}
+			if run > len(buf)-j {
+				d.error(FormatError("RLE run overruns the channel"))
+			}
+			b := s[0]
+			s = s[1:]
+			for i := j; i < j+run; i++ {
+				buf[i] = b
+			}
+			j += run
+			continue
+		}
+		if run > len(buf)-j {
+			d.error(FormatError("RLE run overruns the channel"))
+		}
+		for run > 0 {
+			if len(s) == 0 {
+				s = d.fillSlab(slab, &left)
+			}
+			n := copy(buf[j:j+run], s)
+			s = s[n:]
+			j += n
+			run -= n
+		}
+	}
+	// Data ending short of the channel leaves the rest of it empty rather
+	// than holding whatever buf did.
+	clear(buf[j:])
+}
+
+// fillSlab reads the next slab of RLE data, of which left bytes remain,
+// into slab and returns it.
+func (d *decoder) fillSlab(slab []byte, left *int) []byte {
+	if *left == 0 {
+		d.error(FormatError("RLE run extends past the channel data"))
+	}
+	n := min(len(slab), *left)
+	d.read(slab[:n])
+	*left -= n
+	return slab[:n]
+}
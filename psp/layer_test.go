@@ -0,0 +1,1699 @@
+package psp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/samuel/go-psp/internal/pspgen"
+)
+
+func testRGBA(r image.Rectangle, seed byte) *image.RGBA {
+	img := image.NewRGBA(r)
+	for i := range img.Pix {
+		if i%4 == 3 {
+			img.Pix[i] = 255
+		} else {
+			img.Pix[i] = seed + byte(i*7)
+		}
+	}
+	return img
+}
+
+// rasterType returns the stored layer type of a raster layer for the given
+// major version.
+func rasterType(major uint16) byte {
+	if major >= 6 {
+		return byte(LayerRaster)
+	}
+	return byte(layerNormal)
+}
+
+func TestDecodeDocument(t *testing.T) {
+	bottom := testRGBA(image.Rect(0, 0, 4, 3), 1)
+	top := testRGBA(image.Rect(1, 1, 3, 2), 100)
+	for _, major := range []uint16{3, 5, 7} {
+		for _, comp := range []Compression{CompressionNone, CompressionRLE, CompressionLZ77} {
+			data := newFileBuilder(major).
+				attrs(testAttrs{width: 4, height: 3, bitDepth: 24, comp: comp, layerCount: 2}).
+				block(LayerStartBlock, concat(
+					layerBytes(major, comp, testLayer{
+						name:      "Background",
+						layerType: rasterType(major),
+						rect:      bottom.Rect,
+						opacity:   255,
+						channels:  rgbChannels(bottom),
+						linkGroup: 2,
+					}),
+					layerBytes(major, comp, testLayer{
+						name:      "Top",
+						layerType: rasterType(major),
+						rect:      top.Rect,
+						opacity:   128,
+						blendMode: byte(BlendMultiply),
+						hidden:    true,
+						channels:  rgbChannels(top),
+					}),
+				)).
+				bytes()
+
+			doc, err := DecodeDocument(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("v%d %d: %v", major, comp, err)
+			}
+			if doc.Width != 4 || doc.Height != 3 || len(doc.Layers) != 2 {
+				t.Fatalf("v%d %d: got %dx%d with %d layers", major, comp, doc.Width, doc.Height, len(doc.Layers))
+			}
+			l0, l1 := doc.Layers[0], doc.Layers[1]
+			if l0.Name != "Background" || l0.Kind != LayerRaster || !l0.Visible || l0.Opacity != 255 || l0.LinkGroup != 2 {
+				t.Errorf("v%d %d: unexpected bottom layer %+v", major, comp, l0)
+			}
+			if l1.Name != "Top" || l1.Visible || l1.Opacity != 128 || l1.BlendMode != BlendMultiply || l1.Rect != top.Rect {
+				t.Errorf("v%d %d: unexpected top layer %+v", major, comp, l1)
+			}
+			if !reflect.DeepEqual(l0.Image, bottom) {
+				t.Errorf("v%d %d: bottom layer image mismatch", major, comp)
+			}
+			if !reflect.DeepEqual(l1.Image, top) {
+				t.Errorf("v%d %d: top layer image mismatch", major, comp)
+			}
+
+			img, err := Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(img, bottom) {
+				t.Errorf("v%d %d: Decode should return the first layer", major, comp)
+			}
+		}
+	}
+}
+
+func TestLinkGroups(t *testing.T) {
+	img := testRGBA(image.Rect(0, 0, 2, 2), 9)
+	var layers [][]byte
+	for i, group := range []byte{1, 0, 1} {
+		layers = append(layers, layerBytes(7, CompressionNone, testLayer{
+			name:      fmt.Sprint("Frame ", i),
+			layerType: rasterType(7),
+			rect:      img.Rect,
+			opacity:   255,
+			linkGroup: group,
+			channels:  rgbChannels(img),
+		}))
+	}
+	data := newFileBuilder(7).
+		attrs(testAttrs{width: 2, height: 2, bitDepth: 24, layerCount: 3}).
+		block(LayerStartBlock, concat(layers...)).
+		bytes()
+	doc, err := DecodeDocument(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[uint8][]*Layer{1: {doc.Layers[0], doc.Layers[2]}}
+	if got := doc.LinkGroups(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got link groups %v, want %v", got, want)
+	}
+	if doc.Layers[1].LinkGroup != 0 {
+		t.Errorf("unlinked layer has link group %d", doc.Layers[1].LinkGroup)
+	}
+}
+
+func TestDecodeDocumentPaletted(t *testing.T) {
+	pal := []byte{
+		0, 0, 255, 0, // red in BGR0 order
+		0, 255, 0, 0,
+		255, 0, 0, 0,
+	}
+	indices := []byte{0, 1, 2, 2, 1, 0}
+	r := image.Rect(0, 0, 3, 2)
+	data := newFileBuilder(5).
+		attrs(testAttrs{width: 3, height: 2, bitDepth: 8, comp: CompressionLZ77, layerCount: 1}).
+		block(ColorBlock, concat(uint32Bytes(8), uint32Bytes(3), pal)).
+		block(LayerStartBlock, layerBytes(5, CompressionLZ77, testLayer{
+			rect:     r,
+			channels: []testChannel{{bitmap: dibImage, data: indices}},
+		})).
+		bytes()
+	doc, err := DecodeDocument(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, ok := doc.Layers[0].Image.(*image.Paletted)
+	if !ok {
+		t.Fatalf("expected *image.Paletted, got %T", doc.Layers[0].Image)
+	}
+	if !bytes.Equal(img.Pix, indices) {
+		t.Errorf("got indices %v, want %v", img.Pix, indices)
+	}
+	if got := img.At(0, 0); got != (color.RGBA{255, 0, 0, 255}) {
+		t.Errorf("got color %v at 0,0", got)
+	}
+}
+
+func TestDecodeLegacyVersions(t *testing.T) {
+	img := testRGBA(image.Rect(0, 0, 3, 2), 40)
+	for _, major := range []uint16{1, 2} {
+		for _, comp := range []Compression{CompressionNone, CompressionRLE} {
+			data := newFileBuilder(major).
+				attrs(testAttrs{width: 3, height: 2, bitDepth: 24, comp: comp, layerCount: 1}).
+				block(LayerStartBlock, layerBytes(major, comp, testLayer{
+					name:      "Old",
+					layerType: byte(layerNormal),
+					rect:      img.Rect,
+					opacity:   255,
+					channels:  rgbChannels(img),
+				})).
+				bytes()
+			var warnings []Warning
+			var doc *Document
+			err := func() (err error) {
+				defer catchErrors(&err)
+				d := newDecoder(bytes.NewReader(data), &Options{Warn: func(w Warning) { warnings = append(warnings, w) }})
+				if !d.decodeMetadataBlocks() {
+					t.Fatalf("v%d: missing layer bank", major)
+				}
+				doc = &Document{Layers: d.decodeLayers()}
+				return nil
+			}()
+			if err != nil {
+				t.Fatalf("v%d %d: %v", major, comp, err)
+			}
+			if len(warnings) != 1 {
+				t.Errorf("v%d %d: got warnings %v, want one", major, comp, warnings)
+			}
+			if len(doc.Layers) != 1 || doc.Layers[0].Name != "Old" || !reflect.DeepEqual(doc.Layers[0].Image, img) {
+				t.Errorf("v%d %d: layer mismatch", major, comp)
+			}
+		}
+	}
+
+	data := newFileBuilder(0).attrs(testAttrs{width: 1, height: 1, bitDepth: 24}).bytes()
+	if _, err := DecodeDocument(bytes.NewReader(data)); err == nil {
+		t.Error("expected major version 0 to be rejected")
+	}
+}
+
+func TestDecodeUndeclaredChannels(t *testing.T) {
+	// Files since version 10 don't declare the channels of a layer, which
+	// are the same whatever the version.
+	for _, m := range pspgen.Images() {
+		for comp := pspgen.None; comp <= pspgen.LZ77; comp++ {
+			want, err := Decode(bytes.NewReader(pspgen.Image(9, comp, m)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var warnings []Warning
+			got, err := DecodeWithOptions(bytes.NewReader(pspgen.Image(10, comp, m)), &Options{
+				Warn: func(w Warning) { warnings = append(warnings, w) },
+			})
+			if err != nil || !reflect.DeepEqual(got, want) || len(warnings) != 0 {
+				t.Errorf("%T %d: got %v, warnings %v", m, comp, err, warnings)
+			}
+		}
+	}
+
+	// A layer with transparency in a 24 bit document has four channels,
+	// and the layer above it three.
+	bottom := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	for i := range bottom.Pix {
+		bottom.Pix[i] = byte(i * 10)
+	}
+	top := testRGBA(bottom.Rect, 7)
+	data := pspgen.NewFile(10).Attrs(pspgen.Attrs{
+		Width:       3,
+		Height:      2,
+		Compression: pspgen.LZ77,
+		BitDepth:    24,
+		LayerCount:  2,
+	}).Layers(
+		pspgen.LayerBytes(10, pspgen.LZ77, pspgen.Layer{
+			Type:     pspgen.RasterType(10),
+			Rect:     bottom.Rect,
+			Opacity:  255,
+			Channels: append(pspgen.RGBChannels(bottom.Pix), pspgen.Channel{Bitmap: pspgen.DIBTransMask, Channel: pspgen.ChannelComposite, Data: pspgen.Plane(bottom.Pix, 4, 3)}),
+		}),
+		pspgen.LayerBytes(10, pspgen.LZ77, pspgen.Layer{
+			Type:     pspgen.RasterType(10),
+			Rect:     top.Rect,
+			Opacity:  255,
+			Channels: pspgen.RGBChannels(top.Pix),
+		}),
+	).Bytes()
+	doc, err := DecodeDocumentWithOptions(bytes.NewReader(data), &Options{Strict: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l0, l1 := doc.Layers[0], doc.Layers[1]
+	if l0.ChannelCount != 4 || l1.ChannelCount != 3 {
+		t.Errorf("got %d and %d channels, want 4 and 3", l0.ChannelCount, l1.ChannelCount)
+	}
+	want, err := Decode(bytes.NewReader(pspgen.Image(9, pspgen.LZ77, bottom)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(l0.Image, want) {
+		t.Error("bottom layer image mismatch")
+	}
+	if !reflect.DeepEqual(l1.Image, top) {
+		t.Error("top layer image mismatch")
+	}
+}
+
+func TestLayerNameEncoding(t *testing.T) {
+	raw := "Arri\xe8re-plan\x00"
+	img := testRGBA(image.Rect(0, 0, 1, 1), 0)
+	for _, major := range []uint16{3, 5} {
+		data := newFileBuilder(major).
+			attrs(testAttrs{width: 1, height: 1, bitDepth: 24, layerCount: 1}).
+			block(LayerStartBlock, layerBytes(major, CompressionNone, testLayer{
+				name:      raw,
+				layerType: rasterType(major),
+				rect:      img.Rect,
+				opacity:   255,
+				channels:  rgbChannels(img),
+			})).
+			bytes()
+		doc, err := DecodeDocument(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("v%d: %v", major, err)
+		}
+		l := doc.Layers[0]
+		if l.Name != "Arrière-plan" {
+			t.Errorf("v%d: got name %q, want %q", major, l.Name, "Arrière-plan")
+		}
+		wantRaw := raw
+		if major < 4 {
+			wantRaw = raw[:len(raw)-1]
+		}
+		if string(l.RawName) != wantRaw {
+			t.Errorf("v%d: got raw name %q, want %q", major, l.RawName, wantRaw)
+		}
+
+		opts := &Options{DecodeText: func(b []byte) string { return strings.ToUpper(string(b[:4])) }}
+		var layers []*Layer
+		err = func() (err error) {
+			defer catchErrors(&err)
+			d := newDecoder(bytes.NewReader(data), opts)
+			d.decodeMetadataBlocks()
+			layers = d.decodeLayers()
+			return nil
+		}()
+		if err != nil {
+			t.Fatalf("v%d: %v", major, err)
+		}
+		if got := layers[0].Name; got != "ARRI" {
+			t.Errorf("v%d: got name %q with DecodeText, want %q", major, got, "ARRI")
+		}
+	}
+}
+
+func TestDecodeWindows1252(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"plain", "plain"},
+		{"\x80 \x93q\x94", "€ “q”"},
+		{"caf\xe9", "café"},
+		{"\x81\xff", "\u0081ÿ"},
+	}
+	for _, tt := range tests {
+		if got := decodeWindows1252([]byte(tt.in)); got != tt.want {
+			t.Errorf("decodeWindows1252(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeGray16(t *testing.T) {
+	// A gradient whose samples differ in both bytes, with runs of equal
+	// high bytes for RLE to pick up.
+	r := image.Rect(0, 0, 16, 4)
+	want := func(x, y int) uint16 { return uint16((y*16 + x) * 1021) }
+	m := image.NewGray16(r)
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			m.SetGray16(x, y, color.Gray16{want(x, y)})
+		}
+	}
+	for _, major := range []uint16{3, 5, 7} {
+		for _, comp := range []Compression{CompressionNone, CompressionRLE, CompressionLZ77} {
+			img, err := Decode(bytes.NewReader(pspgen.Image(major, uint16(comp), m)))
+			if err != nil {
+				t.Fatalf("v%d %v: %v", major, comp, err)
+			}
+			g, ok := img.(*image.Gray16)
+			if !ok {
+				t.Fatalf("v%d %v: got %T, want *image.Gray16", major, comp, img)
+			}
+			for y := 0; y < r.Dy(); y++ {
+				for x := 0; x < r.Dx(); x++ {
+					if v := g.Gray16At(x, y).Y; v != want(x, y) {
+						t.Fatalf("v%d %v: pixel %d,%d = %#04x, want %#04x", major, comp, x, y, v, want(x, y))
+					}
+				}
+			}
+		}
+	}
+}
+
+// checkerboardSize is the size of the 1 bit fixtures, whose rows of 10
+// bits are padded to 2 bytes.
+const checkerboardSize = 10
+
+// checkerboardFile returns a 1 bit image of a checkerboard with the given
+// palette block, if any.
+func checkerboardFile(comp uint16, grayscale bool, palette color.Palette) []byte {
+	var plane []byte
+	for y := 0; y < checkerboardSize; y++ {
+		var row uint16
+		for x := 0; x < checkerboardSize; x++ {
+			row |= uint16((x+y)%2) << (15 - x)
+		}
+		plane = append(plane, byte(row>>8), byte(row))
+	}
+	f := pspgen.NewFile(5).Attrs(pspgen.Attrs{
+		Width:       checkerboardSize,
+		Height:      checkerboardSize,
+		Compression: comp,
+		BitDepth:    1,
+		Grayscale:   grayscale,
+		LayerCount:  1,
+	})
+	if palette != nil {
+		f.Palette(palette)
+	}
+	return f.Layers(pspgen.LayerBytes(5, comp, pspgen.Layer{
+		Rect:     image.Rect(0, 0, checkerboardSize, checkerboardSize),
+		Opacity:  255,
+		Channels: []pspgen.Channel{{Bitmap: pspgen.DIBImage, Channel: pspgen.ChannelComposite, Data: plane}},
+	})).Bytes()
+}
+
+// checkCheckerboard checks that data decodes to a checkerboard with the
+// given palette, and that the rows and color model match.
+func checkCheckerboard(t *testing.T, name string, data []byte, palette color.Palette) {
+	t.Helper()
+	img, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	p, ok := img.(*image.Paletted)
+	if !ok {
+		t.Fatalf("%s: got %T, want *image.Paletted", name, img)
+	}
+	for y := 0; y < checkerboardSize; y++ {
+		for x := 0; x < checkerboardSize; x++ {
+			if i, want := p.ColorIndexAt(x, y), uint8((x+y)%2); i != want {
+				t.Fatalf("%s: pixel %d,%d = %d, want %d", name, x, y, i, want)
+			}
+		}
+	}
+	if !reflect.DeepEqual(p.Palette, palette) {
+		t.Errorf("%s: got palette %v, want %v", name, p.Palette, palette)
+	}
+	_, pix, err := decodeRows(t, bytes.NewReader(data))
+	if err != nil || !bytes.Equal(pix, p.Pix) {
+		t.Errorf("%s: rows differ from the image (%v)", name, err)
+	}
+	if config, err := DecodeConfig(bytes.NewReader(data)); err != nil || !reflect.DeepEqual(config.ColorModel, palette) {
+		t.Errorf("%s: got config %+v, %v", name, config, err)
+	}
+}
+
+func TestDecode1Bit(t *testing.T) {
+	palette := color.Palette{color.RGBA{10, 20, 30, 255}, color.RGBA{200, 210, 220, 255}}
+	for _, comp := range []uint16{pspgen.None, pspgen.RLE, pspgen.LZ77} {
+		checkCheckerboard(t, fmt.Sprintf("compression %d", comp), checkerboardFile(comp, false, palette), palette)
+	}
+}
+
+func TestDecode1BitWithoutPalette(t *testing.T) {
+	bw := color.Palette{color.RGBA{0, 0, 0, 255}, color.RGBA{255, 255, 255, 255}}
+	gray := color.Palette{color.Gray{0}, color.Gray{255}}
+	stored := color.Palette{color.RGBA{10, 20, 30, 255}, color.RGBA{200, 210, 220, 255}}
+	for _, tc := range []struct {
+		name      string
+		grayscale bool
+		palette   color.Palette // stored palette
+		want      color.Palette
+	}{
+		{"color", false, nil, bw},
+		{"grayscale", true, nil, gray},
+		// A stored palette wins over the grayscale flag.
+		{"grayscale with palette", true, stored, stored},
+	} {
+		checkCheckerboard(t, tc.name, checkerboardFile(pspgen.LZ77, tc.grayscale, tc.palette), tc.want)
+	}
+}
+
+// emptyLayerFile returns a file of an empty layer, whose channels are
+// written without data, over a populated background, or of the empty layer
+// alone.
+func emptyLayerFile(comp uint16, background *image.RGBA) []byte {
+	r := image.Rect(0, 0, 4, 3)
+	var layers [][]byte
+	if background != nil {
+		layers = append(layers, pspgen.LayerBytes(5, comp, pspgen.Layer{
+			Rect:     r,
+			Opacity:  255,
+			Channels: pspgen.RGBChannels(background.Pix),
+		}))
+	}
+	plane := make([]byte, r.Dx()*r.Dy())
+	layers = append(layers, pspgen.LayerBytes(5, comp, pspgen.Layer{
+		Rect:    r,
+		Opacity: 255,
+		Channels: []pspgen.Channel{
+			{Bitmap: pspgen.DIBImage, Channel: 1, Data: plane},
+			{Bitmap: pspgen.DIBImage, Channel: 2, Data: plane},
+			{Bitmap: pspgen.DIBImage, Channel: 3, Data: plane},
+			{Bitmap: pspgen.DIBTransMask, Channel: pspgen.ChannelComposite, Data: plane},
+		},
+		Empty: true,
+	}))
+	return pspgen.NewFile(5).Attrs(pspgen.Attrs{
+		Width:       r.Dx(),
+		Height:      r.Dy(),
+		Compression: comp,
+		BitDepth:    24,
+		LayerCount:  uint16(len(layers)),
+	}).Layers(layers...).Bytes()
+}
+
+// bitDepthSamples returns n samples of runs longer than an RLE run can
+// hold, short runs and literal stretches, of which only the low bits are
+// varied.
+func bitDepthSamples(n int, bits uint) []byte {
+	p := make([]byte, n)
+	for i := range p {
+		switch {
+		case i < 200:
+			p[i] = 3
+		case i%7 < 3:
+			p[i] = byte(i / 7)
+		default:
+			p[i] = byte(i*37 + i/5)
+		}
+		p[i] &= 1<<bits - 1
+	}
+	return p
+}
+
+func TestDecodeBitDepths(t *testing.T) {
+	r := image.Rect(0, 0, 61, 9)
+	indexed := func(bits uint) *image.Paletted {
+		var palette color.Palette
+		for i := 0; i < 1<<bits && i < 200; i++ {
+			palette = append(palette, color.RGBA{byte(i), byte(255 - i), byte(i * 3), 255})
+		}
+		m := image.NewPaletted(r, palette)
+		copy(m.Pix, bitDepthSamples(len(m.Pix), bits))
+		for i, v := range m.Pix {
+			m.Pix[i] = v % byte(len(palette))
+		}
+		return m
+	}
+	gray := image.NewGray(r)
+	copy(gray.Pix, bitDepthSamples(len(gray.Pix), 8))
+	gray16 := image.NewGray16(r)
+	copy(gray16.Pix, bitDepthSamples(len(gray16.Pix), 8))
+	rgb := image.NewRGBA(r)
+	copy(rgb.Pix, bitDepthSamples(len(rgb.Pix), 8))
+	rgba := image.NewNRGBA(r)
+	copy(rgba.Pix, rgb.Pix)
+	rgb48 := image.NewRGBA64(r)
+	copy(rgb48.Pix, bitDepthSamples(len(rgb48.Pix), 8))
+	rgba64 := image.NewNRGBA64(r)
+	copy(rgba64.Pix, rgb48.Pix)
+	for i := 3; i < len(rgb.Pix); i += 4 {
+		rgb.Pix[i] = 255
+		rgb48.Pix[2*i], rgb48.Pix[2*i+1] = 255, 255
+	}
+	// The decoded color images, premultiplied by their transparency.
+	rgbaWant := image.NewRGBA(r)
+	for i := 0; i < len(rgba.Pix); i += 4 {
+		a := uint32(rgba.Pix[i+3])
+		for j := i; j < i+3; j++ {
+			rgbaWant.Pix[j] = uint8((uint32(rgba.Pix[j])*a + 127) / 255)
+		}
+		rgbaWant.Pix[i+3] = rgba.Pix[i+3]
+	}
+	rgba64Want := image.NewRGBA64(r)
+	for i := 0; i < len(rgba64.Pix); i += 8 {
+		a := uint32(rgba64.Pix[i+6])<<8 | uint32(rgba64.Pix[i+7])
+		for j := i; j < i+6; j += 2 {
+			v := (uint32(rgba64.Pix[j])<<8 | uint32(rgba64.Pix[j+1])) * a / 0xffff
+			rgba64Want.Pix[j], rgba64Want.Pix[j+1] = uint8(v>>8), uint8(v)
+		}
+		rgba64Want.Pix[i+6], rgba64Want.Pix[i+7] = rgba64.Pix[i+6], rgba64.Pix[i+7]
+	}
+	for _, tc := range []struct {
+		bitDepth uint16
+		m        image.Image
+		want     image.Image
+	}{
+		{1, indexed(1), indexed(1)},
+		{4, indexed(4), indexed(4)},
+		{8, indexed(8), indexed(8)},
+		{8, gray, gray},
+		{16, gray16, gray16},
+		{24, rgb, rgb},
+		{32, rgba, rgbaWant},
+		{48, rgb48, rgb48},
+		{64, rgba64, rgba64Want},
+	} {
+		for comp := pspgen.None; comp <= pspgen.LZ77; comp++ {
+			name := fmt.Sprintf("%d bit %T, compression %d", tc.bitDepth, tc.m, comp)
+			data := pspgen.ImageDepth(5, comp, tc.bitDepth, tc.m)
+			for _, opts := range []*Options{{Strict: true}, {Strict: true, Parallelism: 4}} {
+				img, err := DecodeWithOptions(bytes.NewReader(data), opts)
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				if !reflect.DeepEqual(img, tc.want) {
+					t.Errorf("%s, parallelism %d: image mismatch", name, opts.Parallelism)
+				}
+			}
+			if img, err := DecodeBytes(data); err != nil || !reflect.DeepEqual(img, tc.want) {
+				t.Errorf("%s: DecodeBytes: %v", name, err)
+			}
+			for _, r := range []io.Reader{bytes.NewReader(data), struct{ io.Reader }{bytes.NewReader(data)}} {
+				_, pix, err := decodeRows(t, r)
+				if err != nil || !bytes.Equal(pix, pixOf(tc.want)) {
+					t.Errorf("%s: rows differ from the image (%v)", name, err)
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeEmptyChannels(t *testing.T) {
+	background := testRGBA(image.Rect(0, 0, 4, 3), 3)
+	empty := image.NewRGBA(background.Rect)
+	for comp := pspgen.None; comp <= pspgen.LZ77; comp++ {
+		data := emptyLayerFile(comp, background)
+		img, err := Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%d: %v", comp, err)
+		}
+		if !reflect.DeepEqual(img, background) {
+			t.Errorf("%d: background mismatch", comp)
+		}
+		for _, opts := range []*Options{nil, {Parallelism: 4}} {
+			doc, err := DecodeDocumentWithOptions(bytes.NewReader(data), opts)
+			if err != nil {
+				t.Fatalf("%d, %+v: %v", comp, opts, err)
+			}
+			if len(doc.Layers) != 2 || !reflect.DeepEqual(doc.Layers[1].Image, empty) {
+				t.Errorf("%d, %+v: empty layer not decoded as empty", comp, opts)
+			}
+			if !reflect.DeepEqual(doc.Flatten(nil), background) {
+				t.Errorf("%d, %+v: flattened image differs from the background", comp, opts)
+			}
+		}
+		if img, err := DecodeBytes(data); err != nil || !reflect.DeepEqual(img, background) {
+			t.Errorf("%d: DecodeBytes: %v", comp, err)
+		}
+		_, pix, err := decodeRows(t, bytes.NewReader(emptyLayerFile(comp, nil)))
+		if err != nil || !bytes.Equal(pix, empty.Pix) {
+			t.Errorf("%d: rows of the empty layer: %v", comp, err)
+		}
+	}
+}
+
+func TestDecodeIndexBeyondPalette(t *testing.T) {
+	palette := color.Palette{color.RGBA{10, 20, 30, 255}, color.RGBA{40, 50, 60, 255}}
+	m := image.NewPaletted(image.Rect(0, 0, 3, 2), palette)
+	copy(m.Pix, []byte{0, 1, 5, 1, 3, 0})
+	data := pspgen.Image(5, pspgen.LZ77, m)
+
+	var warnings []Warning
+	img, err := DecodeWithOptions(bytes.NewReader(data), &Options{Warn: func(w Warning) { warnings = append(warnings, w) }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(palette[:2:2], color.RGBA{A: 255}, color.RGBA{A: 255}, color.RGBA{A: 255}, color.RGBA{A: 255})
+	if p := img.(*image.Paletted).Palette; !reflect.DeepEqual(p, want) {
+		t.Errorf("got palette %v, want %v", p, want)
+	}
+	if len(warnings) != 1 || warnings[0].Message != "pixel index 5 beyond the 2 palette entries" {
+		t.Errorf("got warnings %v", warnings)
+	}
+	// The image can be drawn.
+	draw.Draw(image.NewRGBA(img.Bounds()), img.Bounds(), img, image.Point{}, draw.Src)
+
+	warnings = nil
+	err = DecodeRowsWithOptions(bytes.NewReader(data), &Options{Warn: func(w Warning) { warnings = append(warnings, w) }}, func(int, []byte) error { return nil })
+	if err != nil || len(warnings) != 1 {
+		t.Errorf("rows: got %v, warnings %v", err, warnings)
+	}
+
+	var ferr FormatError
+	if _, err := DecodeWithOptions(bytes.NewReader(data), &Options{Strict: true}); !errors.As(err, &ferr) {
+		t.Errorf("strict: got error %v, want a FormatError", err)
+	}
+}
+
+func TestDecodeDeepColor(t *testing.T) {
+	ramp := []uint16{0x0102, 0x7fff, 0xfffe, 0x0000, 0xffff, 0x8001}
+	r := image.Rect(0, 0, len(ramp), 2)
+	sample := func(x, y, c int) uint16 { return ramp[(x+y+c)%len(ramp)] }
+	alpha := func(x, y int) uint16 {
+		if y == 0 {
+			return 0xffff
+		}
+		return ramp[x]
+	}
+	opaque := image.NewRGBA64(r)
+	straight := image.NewNRGBA64(r)
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			opaque.SetRGBA64(x, y, color.RGBA64{sample(x, y, 0), sample(x, y, 1), sample(x, y, 2), 0xffff})
+			straight.SetNRGBA64(x, y, color.NRGBA64{sample(x, y, 0), sample(x, y, 1), sample(x, y, 2), alpha(x, y)})
+		}
+	}
+	for _, tc := range []struct {
+		name  string
+		m     image.Image
+		alpha func(x, y int) uint16
+	}{
+		{"48 bit", opaque, func(x, y int) uint16 { return 0xffff }},
+		{"64 bit", straight, alpha},
+	} {
+		for _, comp := range []Compression{CompressionNone, CompressionRLE, CompressionLZ77} {
+			img, err := Decode(bytes.NewReader(pspgen.Image(7, uint16(comp), tc.m)))
+			if err != nil {
+				t.Fatalf("%s %v: %v", tc.name, comp, err)
+			}
+			m, ok := img.(*image.RGBA64)
+			if !ok {
+				t.Fatalf("%s %v: got %T, want *image.RGBA64", tc.name, comp, img)
+			}
+			for y := 0; y < r.Dy(); y++ {
+				for x := 0; x < r.Dx(); x++ {
+					// Straight alpha is premultiplied, rounding down.
+					a := uint32(tc.alpha(x, y))
+					pm := func(c int) uint16 { return uint16(uint32(sample(x, y, c)) * a / 0xffff) }
+					want := color.RGBA64{pm(0), pm(1), pm(2), uint16(a)}
+					if got := m.RGBA64At(x, y); got != want {
+						t.Fatalf("%s %v: pixel %d,%d = %#v, want %#v", tc.name, comp, x, y, got, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeRawDeflate(t *testing.T) {
+	img := testRGBA(image.Rect(0, 0, 5, 3), 9)
+	// Channels holding the zlib stream without its header and checksum.
+	var channels [][]byte
+	for _, c := range pspgen.RGBChannels(img.Pix) {
+		z := pspgen.Compress(pspgen.LZ77, c.Data)
+		raw := z[2 : len(z)-4]
+		channels = append(channels, pspgen.Block(5, pspgen.ChannelBlock, concat(
+			leBytes(uint32(16), uint32(len(raw)), uint32(len(c.Data)), c.Bitmap, c.Channel), raw)))
+	}
+	layer := pspgen.LayerBytes(5, pspgen.LZ77, pspgen.Layer{Rect: img.Rect, Opacity: 255})
+	// Replace the channel count of the layer, which comes last.
+	layer = concat(layer[:len(layer)-2], leBytes(uint16(3)), concat(channels...))
+	binary.LittleEndian.PutUint32(layer[6:], uint32(len(layer)-10))
+	data := newFileBuilder(5).
+		attrs(testAttrs{width: 5, height: 3, bitDepth: 24, comp: CompressionLZ77, layerCount: 1}).
+		block(LayerStartBlock, layer).
+		bytes()
+
+	for _, parallelism := range []int{1, 4} {
+		var warnings []Warning
+		m, err := DecodeWithOptions(bytes.NewReader(data), &Options{
+			Parallelism: parallelism,
+			Warn:        func(w Warning) { warnings = append(warnings, w) },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(m, img) {
+			t.Errorf("parallelism %d: image mismatch", parallelism)
+		}
+		if len(warnings) != 3 {
+			t.Errorf("parallelism %d: got warnings %v, want one per channel", parallelism, warnings)
+		}
+		if _, err := DecodeWithOptions(bytes.NewReader(data), &Options{Parallelism: parallelism, Strict: true}); err == nil {
+			t.Errorf("parallelism %d: expected an error in strict mode", parallelism)
+		}
+	}
+}
+
+func TestDecodeNonPremultiplied(t *testing.T) {
+	straight := image.NewNRGBA(image.Rect(0, 0, 4, 2))
+	for i := range straight.Pix {
+		straight.Pix[i] = byte(i*29 + 3)
+	}
+	straight64 := image.NewNRGBA64(image.Rect(0, 0, 3, 2))
+	for i := range straight64.Pix {
+		straight64.Pix[i] = byte(i*31 + 7)
+	}
+	opaque := testRGBA(image.Rect(0, 0, 2, 2), 4)
+	wantOpaque := &image.NRGBA{Pix: opaque.Pix, Stride: opaque.Stride, Rect: opaque.Rect}
+	opts := &Options{NonPremultiplied: true}
+	for _, tc := range []struct {
+		in, want image.Image
+	}{
+		{straight, straight},
+		{straight64, straight64},
+		{opaque, wantOpaque},
+	} {
+		for _, comp := range []Compression{CompressionNone, CompressionRLE, CompressionLZ77} {
+			img, err := DecodeWithOptions(bytes.NewReader(pspgen.Image(7, uint16(comp), tc.in)), opts)
+			if err != nil {
+				t.Fatalf("%T %v: %v", tc.in, comp, err)
+			}
+			if !reflect.DeepEqual(img, tc.want) {
+				t.Errorf("%T %v: got %T not matching the stored values", tc.in, comp, img)
+			}
+		}
+	}
+}
+
+func TestDecodeV3MaskChannels(t *testing.T) {
+	pal := []byte{0, 0, 255, 0, 0, 255, 0, 0}
+	indices := []byte{0, 1, 1, 0}
+	r := image.Rect(0, 0, 2, 2)
+	mask := []byte{255, 0, 0, 255}
+	for _, comp := range []Compression{CompressionNone, CompressionRLE, CompressionLZ77} {
+		data := newFileBuilder(3).
+			attrs(testAttrs{width: 2, height: 2, bitDepth: 8, comp: comp, layerCount: 2}).
+			block(ColorBlock, concat(uint32Bytes(2), pal)).
+			block(LayerStartBlock, concat(
+				layerBytes(3, comp, testLayer{
+					rect: r,
+					channels: []testChannel{
+						{bitmap: dibTransMask, data: mask},
+						{bitmap: dibImage, data: indices},
+					},
+				}),
+				layerBytes(3, comp, testLayer{
+					rect:     r,
+					maskRect: r,
+					channels: []testChannel{
+						{bitmap: dibUserMask, data: mask},
+						{bitmap: dibImage, data: indices},
+					},
+				}),
+			)).
+			bytes()
+		doc, err := DecodeDocument(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%d: %v", comp, err)
+		}
+		for i, l := range doc.Layers {
+			img, ok := l.Image.(*image.Paletted)
+			if !ok || !bytes.Equal(img.Pix, indices) {
+				t.Errorf("%d: layer %d image mismatch", comp, i)
+			}
+		}
+		if m := doc.Layers[1].UserMask; m == nil || !bytes.Equal(m.Pix, mask) {
+			t.Errorf("%d: user mask mismatch", comp)
+		}
+	}
+}
+
+func TestDecodeVersion3InitialData(t *testing.T) {
+	// Version 3 block headers give the length of the fixed fields ahead of
+	// the sub-blocks, which here end with bytes this decoder doesn't know,
+	// as a PSP 5 file is laid out.
+	header := func(id BlockID, initLen, dataLen int) []byte {
+		return concat(blockMagic, leBytes(uint16(id), uint32(initLen), uint32(dataLen)))
+	}
+	img := testRGBA(image.Rect(0, 0, 3, 2), 7)
+	r := img.Rect
+	unknown := []byte{0xff, 0xfe, 0xfd, 0xfc}
+	info := concat(
+		pspgen.FixedName("Background", 256),
+		leBytes(byte(layerNormal), pspgen.Rect(r), pspgen.Rect(r), byte(255), byte(BlendNormal), byte(1), byte(0), byte(0)),
+		leBytes(pspgen.Rect(image.Rectangle{}), pspgen.Rect(image.Rectangle{}), byte(0), byte(0), byte(0)),
+		leBytes(uint16(0), make([]byte, 40), uint16(1), uint16(3)),
+		unknown,
+	)
+	var channels []byte
+	for _, c := range rgbChannels(img) {
+		fields := concat(leBytes(uint32(len(c.data)), uint32(len(c.data)), uint16(c.bitmap), uint16(c.channel)), unknown)
+		channels = concat(channels, header(ChannelBlock, len(fields), len(fields)+len(c.data)), fields, c.data)
+	}
+	layer := concat(header(LayerBlock, len(info), len(info)+len(channels)), info, channels)
+	data := newFileBuilder(3).
+		attrs(testAttrs{width: 3, height: 2, res: 72, unit: ResolutionInch, bitDepth: 24, layerCount: 1}).
+		block(LayerStartBlock, layer).
+		bytes()
+
+	for _, opts := range []*Options{{Strict: true}, {Strict: true, Parallelism: 4}} {
+		doc, err := DecodeDocumentWithOptions(bytes.NewReader(data), opts)
+		if err != nil {
+			t.Fatalf("parallelism %d: %v", opts.Parallelism, err)
+		}
+		if len(doc.Layers) != 1 || doc.Layers[0].Name != "Background" || !reflect.DeepEqual(doc.Layers[0].Image, img) {
+			t.Errorf("parallelism %d: got layers %+v", opts.Parallelism, doc.Layers)
+		}
+	}
+	rd, err := OpenReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, err := rd.LayerImage(0); err != nil || !reflect.DeepEqual(m, img) {
+		t.Errorf("reader: got %v", err)
+	}
+
+	// The encoder gives the same lengths.
+	var buf bytes.Buffer
+	if err := EncodeDocument(&buf, &Document{Width: 3, Height: 2, Layers: []*Layer{{Name: "Background", Opacity: 255, Visible: true, Image: img}}},
+		&EncodeOptions{Version: 3, Compression: CompressionNone}); err != nil {
+		t.Fatal(err)
+	}
+	enc := buf.Bytes()
+	at := bytes.Index(enc, concat(blockMagic, leBytes(uint16(LayerBlock))))
+	if at < 0 {
+		t.Fatal("no layer block encoded")
+	}
+	if initLen, dataLen := decodeUint32(enc[at+6:]), decodeUint32(enc[at+10:]); initLen != uint32(len(info)-len(unknown)) || dataLen <= initLen {
+		t.Errorf("encoded layer block has initial length %d of %d", initLen, dataLen)
+	}
+}
+
+func TestDIBTypes(t *testing.T) {
+	nrgba := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	for i := range nrgba.Pix {
+		nrgba.Pix[i] = byte(i*20 + 5)
+	}
+	mask := []byte{255, 0, 10, 20, 30, 40}
+	var layers [][]byte
+	for i := 0; i < 2; i++ {
+		layers = append(layers, pspgen.LayerBytes(7, pspgen.RLE, pspgen.Layer{
+			Type:     pspgen.RasterType(7),
+			Rect:     nrgba.Rect,
+			Opacity:  255,
+			MaskRect: nrgba.Rect,
+			Channels: append(pspgen.RGBChannels(nrgba.Pix),
+				pspgen.Channel{Bitmap: pspgen.DIBTransMask, Channel: pspgen.ChannelComposite, Data: pspgen.Plane(nrgba.Pix, 4, 3)},
+				pspgen.Channel{Bitmap: pspgen.DIBUserMask, Channel: pspgen.ChannelComposite, Data: mask}),
+		}))
+	}
+	data := pspgen.NewFile(7).Attrs(pspgen.Attrs{
+		Width:       3,
+		Height:      2,
+		Compression: pspgen.RLE,
+		BitDepth:    24,
+		LayerCount:  2,
+	}).Layers(layers...).Bytes()
+	withAlpha, err := Decode(bytes.NewReader(pspgen.Image(7, pspgen.RLE, nrgba)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opaque := &image.RGBA{Pix: bytes.Clone(nrgba.Pix), Stride: nrgba.Stride, Rect: nrgba.Rect}
+	for i := 3; i < len(opaque.Pix); i += 4 {
+		opaque.Pix[i] = 255
+	}
+	for _, tc := range []struct {
+		dibs     DIBTypes
+		image    image.Image
+		userMask []byte
+	}{
+		{0, withAlpha, mask},
+		{DIBAll, withAlpha, mask},
+		{DIBImage, opaque, nil},
+		{DIBImage | DIBUserMask, opaque, mask},
+		{DIBUserMask, nil, mask},
+	} {
+		// Skipped channels are passed over by seeking and by reading.
+		for _, r := range []io.Reader{bytes.NewReader(data), struct{ io.Reader }{bytes.NewReader(data)}} {
+			doc, err := DecodeDocumentWithOptions(r, &Options{DIBTypes: tc.dibs, Strict: true})
+			if err != nil {
+				t.Fatalf("%#x: %v", tc.dibs, err)
+			}
+			for i, l := range doc.Layers {
+				if tc.image == nil && l.Image != nil || tc.image != nil && !reflect.DeepEqual(l.Image, tc.image) {
+					t.Errorf("%#x: layer %d image mismatch", tc.dibs, i)
+				}
+				if tc.userMask == nil && l.UserMask != nil || tc.userMask != nil && (l.UserMask == nil || !bytes.Equal(l.UserMask.Pix, tc.userMask)) {
+					t.Errorf("%#x: layer %d user mask mismatch", tc.dibs, i)
+				}
+			}
+		}
+	}
+
+	// Decode skips user masks by default, and has no image without color
+	// data.
+	if img, err := Decode(bytes.NewReader(data)); err != nil || !reflect.DeepEqual(img, withAlpha) {
+		t.Errorf("Decode: %v", err)
+	}
+	if _, err := DecodeWithOptions(bytes.NewReader(data), &Options{DIBTypes: DIBUserMask}); err == nil {
+		t.Error("Decode without color bitmaps succeeded")
+	}
+	_, pix, err := decodeRows(t, bytes.NewReader(data))
+	if err != nil || !bytes.Equal(pix, withAlpha.(*image.RGBA).Pix) {
+		t.Errorf("DecodeRows: %v", err)
+	}
+}
+
+// shortChannelBlock is a channel block too short to hold its header,
+// followed by data that reads as the rest of it.
+var shortChannelBlock = concat(
+	blockBytes(5, ChannelBlock, leBytes(uint32(16))),
+	leBytes(uint32(0), uint32(4), uint16(dibTransMask), uint16(0)))
+
+// shortChannelFile returns a file with a shortChannelBlock in a layer.
+// Channels aren't declared since version 10, so every channel block of a
+// raster layer is read.
+func shortChannelFile() []byte {
+	img := testRGBA(image.Rect(0, 0, 2, 2), 0)
+	return pspgen.NewFile(10).
+		Attrs(pspgen.Attrs{Width: 2, Height: 2, BitDepth: 24, LayerCount: 1}).
+		Layers(pspgen.LayerBytes(10, pspgen.None, pspgen.Layer{
+			Type:     pspgen.RasterType(10),
+			Rect:     img.Rect,
+			Opacity:  255,
+			Channels: pspgen.RGBChannels(img.Pix),
+			Extra:    [][]byte{shortChannelBlock},
+		})).
+		Bytes()
+}
+
+func TestShortChannelHeader(t *testing.T) {
+	// The header is read before the bitmap type decides whether the
+	// channel is skipped.
+	for _, opts := range []*Options{nil, {DIBTypes: DIBImage}} {
+		_, err := DecodeDocumentWithOptions(bytes.NewReader(shortChannelFile()), opts)
+		var derr *DecodeError
+		var ferr FormatError
+		if !errors.As(err, &derr) || derr.Block != ChannelBlock.String() || !errors.As(err, &ferr) {
+			t.Errorf("got error %v, want a FormatError in a ChannelBlock", err)
+		}
+	}
+}
+
+func TestBlendRanges(t *testing.T) {
+	img := testRGBA(image.Rect(0, 0, 2, 1), 3)
+	ranges := []BlendRange{
+		{Source: [4]byte{0, 10, 245, 255}, Destination: [4]byte{0, 0, 255, 255}},
+		{Source: [4]byte{1, 2, 3, 4}, Destination: [4]byte{5, 6, 7, 8}},
+	}
+	for _, major := range []uint16{3, 5, 7, 10} {
+		for _, n := range []int{0, 2} {
+			data := newFileBuilder(major).
+				attrs(testAttrs{width: 2, height: 1, bitDepth: 24, layerCount: 1}).
+				block(LayerStartBlock, layerBytes(major, CompressionNone, testLayer{
+					layerType: rasterType(major),
+					rect:      img.Rect,
+					opacity:   255,
+					ranges:    ranges[:n],
+					channels:  rgbChannels(img),
+				})).
+				bytes()
+			doc, err := DecodeDocument(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("v%d count %d: %v", major, n, err)
+			}
+			l := doc.Layers[0]
+			var want [5]BlendRange
+			copy(want[:], ranges[:n])
+			if int(l.BlendRangeCount) != n || l.BlendRanges != want {
+				t.Errorf("v%d: got %d ranges %v, want %d %v", major, l.BlendRangeCount, l.BlendRanges, n, want)
+			}
+			if !reflect.DeepEqual(l.Image, img) {
+				t.Errorf("v%d count %d: layer image mismatch", major, n)
+			}
+		}
+	}
+}
+
+func TestLayerKind(t *testing.T) {
+	cases := []struct {
+		major     uint16
+		layerType byte
+		want      LayerKind
+	}{
+		{5, byte(layerNormal), LayerRaster},
+		{5, byte(layerFloatingSelection), LayerFloatingSelection},
+		{6, 1, LayerRaster},
+		{6, 2, LayerFloatingSelection},
+		{7, 3, LayerVector},
+		{7, 4, LayerAdjustment},
+		{8, 5, LayerMask},
+	}
+	for _, c := range cases {
+		data := newFileBuilder(c.major).
+			attrs(testAttrs{width: 1, height: 1, bitDepth: 24, layerCount: 1}).
+			block(LayerStartBlock, layerBytes(c.major, CompressionNone, testLayer{
+				layerType: c.layerType,
+				rect:      image.Rect(0, 0, 1, 1),
+			})).
+			bytes()
+		doc, err := DecodeDocument(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("v%d type %d: %v", c.major, c.layerType, err)
+		}
+		if got := doc.Layers[0].Kind; got != c.want {
+			t.Errorf("v%d type %d: got %s, want %s", c.major, c.layerType, got, c.want)
+		}
+	}
+}
+
+func TestSkipVectorLayer(t *testing.T) {
+	bottom := testRGBA(image.Rect(0, 0, 3, 2), 5)
+	top := testRGBA(image.Rect(0, 0, 2, 2), 50)
+	for _, major := range []uint16{6, 7, 10} {
+		shape := shapeBytes(major, "Text", ShapeText, ShapeVisible, bytes.Repeat([]byte{0xAB}, 37))
+		data := newFileBuilder(major).
+			attrs(testAttrs{width: 3, height: 2, bitDepth: 24, comp: CompressionLZ77, layerCount: 3}).
+			block(LayerStartBlock, concat(
+				layerBytes(major, CompressionLZ77, testLayer{
+					name:      "Background",
+					layerType: byte(LayerRaster),
+					rect:      bottom.Rect,
+					channels:  rgbChannels(bottom),
+				}),
+				layerBytes(major, CompressionLZ77, testLayer{
+					name:      "Vector",
+					layerType: byte(LayerVector),
+					rect:      bottom.Rect,
+					extra: [][]byte{
+						vectorExtensionBytes(major, shape),
+					},
+				}),
+				layerBytes(major, CompressionLZ77, testLayer{
+					name:      "Top",
+					layerType: byte(LayerRaster),
+					rect:      top.Rect,
+					channels:  rgbChannels(top),
+				}),
+			)).
+			bytes()
+		doc, err := DecodeDocument(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("v%d: %v", major, err)
+		}
+		if len(doc.Layers) != 3 {
+			t.Fatalf("v%d: got %d layers", major, len(doc.Layers))
+		}
+		if l := doc.Layers[1]; l.Kind != LayerVector || l.Image != nil {
+			t.Errorf("v%d: unexpected vector layer %+v", major, l)
+		}
+		if !reflect.DeepEqual(doc.Layers[0].Image, bottom) {
+			t.Errorf("v%d: bottom layer image mismatch", major)
+		}
+		if !reflect.DeepEqual(doc.Layers[2].Image, top) {
+			t.Errorf("v%d: top layer image mismatch", major)
+		}
+	}
+}
+
+// nestedGroupsFile returns a 2x1 v8 document with the layers, bottom to top:
+// a red background, a half-opacity group holding a green layer and a nested
+// group with a blue layer, and a white layer covering only the second pixel.
+func nestedGroupsFile() []byte {
+	const major = 8
+	r := image.Rect(0, 0, 2, 1)
+	raster := func(name string, img *image.RGBA) []byte {
+		return layerBytes(major, CompressionLZ77, testLayer{
+			name:      name,
+			layerType: byte(LayerRaster),
+			rect:      img.Rect,
+			opacity:   255,
+			channels:  rgbChannels(img),
+		})
+	}
+	group := func(name string, opacity byte, children int) []byte {
+		return layerBytes(major, CompressionLZ77, testLayer{
+			name:      name,
+			layerType: byte(LayerUndefined),
+			rect:      r,
+			opacity:   opacity,
+			extra:     [][]byte{groupExtensionBytes(major, children)},
+		})
+	}
+	return newFileBuilder(major).
+		attrs(testAttrs{width: 2, height: 1, bitDepth: 24, comp: CompressionLZ77, layerCount: 6}).
+		block(LayerStartBlock, concat(
+			raster("Background", solidRGBA(r, color.RGBA{255, 0, 0, 255})),
+			group("Outer", 128, 2),
+			raster("Green", solidRGBA(r, color.RGBA{0, 255, 0, 255})),
+			group("Inner", 255, 1),
+			raster("Blue", solidRGBA(r, color.RGBA{0, 0, 255, 255})),
+			raster("Top", solidRGBA(image.Rect(1, 0, 2, 1), color.RGBA{255, 255, 255, 255})),
+		)).
+		bytes()
+}
+
+func TestLayerTree(t *testing.T) {
+	doc, err := DecodeDocument(bytes.NewReader(nestedGroupsFile()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names func(l *Layer) string
+	names = func(l *Layer) string {
+		s := l.Name
+		if l.IsGroup() {
+			s += "["
+			for i, c := range l.Children {
+				if i > 0 {
+					s += " "
+				}
+				s += names(c)
+			}
+			s += "]"
+		}
+		return s
+	}
+	if got, want := names(doc.Root), "[Background Outer[Green Inner[Blue]] Top]"; got != want {
+		t.Errorf("got tree %s, want %s", got, want)
+	}
+	if len(doc.Layers) != 6 {
+		t.Errorf("got %d layers in the flat list", len(doc.Layers))
+	}
+}
+
+func TestRasterExtensionBlock(t *testing.T) {
+	bottom := testRGBA(image.Rect(0, 0, 3, 2), 11)
+	top := testRGBA(image.Rect(1, 0, 3, 2), 12)
+	layer := func(img *image.RGBA) []byte {
+		return layerBytes(13, CompressionLZ77, testLayer{
+			layerType: rasterType(13),
+			rect:      img.Rect,
+			opacity:   255,
+			channels:  rgbChannels(img),
+		})
+	}
+	file := func(bank ...[]byte) []byte {
+		return newFileBuilder(13).
+			attrs(testAttrs{width: 3, height: 2, bitDepth: 24, comp: CompressionLZ77, layerCount: 2}).
+			block(LayerStartBlock, concat(bank...)).
+			bytes()
+	}
+	ext := func(n int) []byte { return blockBytes(13, RasterExtensionBlock, make([]byte, n)) }
+	check := func(name string, data []byte, opts *Options) {
+		t.Helper()
+		doc, err := DecodeDocumentWithOptions(bytes.NewReader(data), opts)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			return
+		}
+		if len(doc.Layers) != 2 || !reflect.DeepEqual(doc.Layers[0].Image, bottom) || !reflect.DeepEqual(doc.Layers[1].Image, top) {
+			t.Errorf("%s: layers out of step", name)
+		}
+	}
+	for name, data := range map[string][]byte{
+		"without":        file(layer(bottom), layer(top)),
+		"after each":     file(layer(bottom), ext(0), layer(top), ext(0)),
+		"with data":      file(layer(bottom), ext(24), layer(top)),
+		"before a layer": file(ext(8), layer(bottom), layer(top)),
+	} {
+		for _, opts := range []*Options{{Strict: true}, {Strict: true, Parallelism: 4}} {
+			check(fmt.Sprintf("%s, parallelism %d", name, opts.Parallelism), data, opts)
+		}
+		if err := Validate(bytes.NewReader(data)); err != nil {
+			t.Errorf("%s: validating: %v", name, err)
+		}
+		r, err := OpenReader(bytes.NewReader(data))
+		if err != nil || r.NumLayers() != 2 {
+			t.Errorf("%s: reader: %v", name, err)
+		}
+	}
+
+	// A chunk following the block outside its length is skipped, with a
+	// warning, where no block header follows.
+	data := file(layer(bottom), ext(0), leBytes(uint32(12), make([]byte, 8)), layer(top))
+	var warnings []Warning
+	check("stray chunk", data, &Options{Warn: func(w Warning) { warnings = append(warnings, w) }})
+	if len(warnings) != 1 {
+		t.Errorf("stray chunk: got warnings %v, want one", warnings)
+	}
+	if _, err := DecodeDocumentWithOptions(bytes.NewReader(data), &Options{Strict: true}); err == nil {
+		t.Error("stray chunk: decoded in strict mode")
+	}
+	data = file(layer(bottom), ext(0), leBytes(uint32(1000)), layer(top))
+	if _, err := DecodeDocument(bytes.NewReader(data)); err == nil {
+		t.Error("chunk past the layer bank: decoded")
+	}
+}
+
+func TestDecodeUserMask(t *testing.T) {
+	img := testRGBA(image.Rect(0, 0, 4, 4), 9)
+	maskRect := image.Rect(1, 1, 4, 3)
+	mask := []byte{0, 64, 128, 192, 255, 7}
+	for _, major := range []uint16{5, 7} {
+		for _, comp := range []Compression{CompressionNone, CompressionRLE, CompressionLZ77} {
+			data := newFileBuilder(major).
+				attrs(testAttrs{width: 4, height: 4, bitDepth: 24, comp: comp, layerCount: 2}).
+				block(LayerStartBlock, concat(
+					layerBytes(major, comp, testLayer{
+						layerType: rasterType(major),
+						rect:      img.Rect,
+						channels:  rgbChannels(img),
+					}),
+					layerBytes(major, comp, testLayer{
+						layerType: rasterType(major),
+						rect:      img.Rect,
+						maskRect:  maskRect,
+						channels: append(rgbChannels(img),
+							testChannel{bitmap: dibUserMask, data: mask}),
+					}),
+				)).
+				bytes()
+			doc, err := DecodeDocument(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("v%d %d: %v", major, comp, err)
+			}
+			if doc.Layers[0].UserMask != nil {
+				t.Errorf("v%d %d: layer without a mask has a UserMask", major, comp)
+			}
+			m := doc.Layers[1].UserMask
+			if m == nil || m.Rect != maskRect || !bytes.Equal(m.Pix, mask) {
+				t.Errorf("v%d %d: got mask %+v", major, comp, m)
+			}
+			if !reflect.DeepEqual(doc.Layers[1].Image, img) {
+				t.Errorf("v%d %d: image mismatch", major, comp)
+			}
+		}
+	}
+}
+
+func TestDecodeParallel(t *testing.T) {
+	for i, data := range pspgen.Corpus() {
+		want, werr := Decode(bytes.NewReader(data))
+		got, err := DecodeWithOptions(bytes.NewReader(data), &Options{Parallelism: 3})
+		if err != nil || werr != nil {
+			t.Errorf("corpus file %d: got errors %v and %v", i, werr, err)
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("corpus file %d: image mismatch", i)
+		}
+	}
+
+	// A corrupt channel is reported as it is when decoding serially.
+	img := testRGBA(image.Rect(0, 0, 8, 8), 3)
+	for _, comp := range []Compression{CompressionRLE, CompressionLZ77} {
+		channels := rgbChannels(img)
+		data := newFileBuilder(5).
+			attrs(testAttrs{width: 8, height: 8, bitDepth: 24, comp: comp, layerCount: 1}).
+			block(LayerStartBlock, layerBytes(5, comp, testLayer{rect: img.Rect, opacity: 255, channels: channels})).
+			bytes()
+		// Overwrite the compressed data of the green channel, which ends
+		// its block.
+		green := channelBytes(5, comp, channels[1])
+		end := bytes.Index(data, green) + len(green)
+		n := len(pspgen.Compress(uint16(comp), channels[1].data))
+		for i := end - n; i < end; i++ {
+			data[i] = 0xff
+		}
+		var want, got *DecodeError
+		_, werr := Decode(bytes.NewReader(data))
+		_, err := DecodeWithOptions(bytes.NewReader(data), &Options{Parallelism: 4})
+		if !errors.As(werr, &want) || !errors.As(err, &got) {
+			t.Errorf("%v: got errors %v and %v", comp, werr, err)
+			continue
+		}
+		if *got != *want || got.Channel != 1 {
+			t.Errorf("%v: got error %+v, want %+v", comp, *got, *want)
+		}
+	}
+
+	// A channel whose data overruns its block is read past it with a
+	// warning, as it is when decoding serially. Channels are only read
+	// ahead from inputs the layers can't be found in by seeking.
+	for _, comp := range []Compression{CompressionRLE, CompressionLZ77} {
+		channels := rgbChannels(img)
+		data := newFileBuilder(5).
+			attrs(testAttrs{width: 8, height: 8, bitDepth: 24, comp: comp, layerCount: 1}).
+			block(LayerStartBlock, layerBytes(5, comp, testLayer{rect: img.Rect, opacity: 255, channels: channels})).
+			bytes()
+		// Shorten the block of the red channel, which its data then
+		// overruns.
+		size := data[bytes.Index(data, channelBytes(5, comp, channels[0]))+6:]
+		binary.LittleEndian.PutUint32(size, binary.LittleEndian.Uint32(size)-2)
+		var want, got []Warning
+		wantImg, werr := DecodeWithOptions(bytes.NewReader(data), &Options{
+			Warn: func(w Warning) { want = append(want, w) },
+		})
+		gotImg, err := DecodeWithOptions(struct{ io.Reader }{bytes.NewReader(data)}, &Options{
+			Parallelism: 4,
+			Warn:        func(w Warning) { got = append(got, w) },
+		})
+		if err != nil || werr != nil {
+			t.Errorf("%v overrun: got errors %v and %v", comp, werr, err)
+			continue
+		}
+		if !reflect.DeepEqual(gotImg, wantImg) || !reflect.DeepEqual(gotImg, img) {
+			t.Errorf("%v overrun: image mismatch", comp)
+		}
+		if len(want) != 1 || !reflect.DeepEqual(got, want) {
+			t.Errorf("%v overrun: got warnings %v, want %v", comp, got, want)
+		}
+	}
+}
+
+// readRLEBytewise is the RLE decoder as it was before readRLE, reading the
+// input a byte at a time. It serves as the reference for readRLE.
+func readRLEBytewise(d *decoder, buf []byte, compressedLen int) {
+	j := 0
+	for n := compressedLen; n > 0; n-- {
+		if run := int(d.readByte()); run > 128 {
+			b := d.readByte()
+			n--
+			for i := 0; i < run-128; i++ {
+				buf[j] = b
+				j++
+			}
+		} else {
+			n -= run
+			d.read(buf[j : j+run])
+			j += run
+		}
+	}
+}
+
+// randomRLE returns RLE data decoding to n bytes made of random runs and
+// literals, including literals of the longest and empty kinds.
+func randomRLE(rnd *rand.Rand, n int) []byte {
+	var data []byte
+	for n > 0 {
+		switch k := rnd.Intn(4); {
+		case k == 0:
+			data = append(data, 0)
+		case k == 1:
+			run := min(n, 1+rnd.Intn(127))
+			data = append(data, byte(128+run), byte(rnd.Intn(256)))
+			n -= run
+		default:
+			run := min(n, 1+rnd.Intn(128))
+			if k == 2 {
+				run = min(n, 128)
+			}
+			data = append(data, byte(run))
+			for i := 0; i < run; i++ {
+				data = append(data, byte(rnd.Intn(256)))
+			}
+			n -= run
+		}
+	}
+	return data
+}
+
+func TestReadRLE(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, n := range []int{0, 1, 100, rleSlabSize - 1, rleSlabSize, 3*rleSlabSize + 17, 100000} {
+		inputs := [][]byte{randomRLE(rnd, n), pspgen.Compress(pspgen.RLE, bytes.Repeat([]byte{1, 2, 2, 3, 3, 3}, n/6))}
+		for i, data := range inputs {
+			want := make([]byte, n)
+			d := newRawDecoder(context.Background(), bytes.NewReader(data), nil)
+			readRLEBytewise(d, want, len(data))
+			// Data in memory is decoded in place.
+			for _, r := range []io.Reader{bytes.NewReader(append(data, 0xff)), &sliceReader{b: append(data, 0xff)}} {
+				got := make([]byte, n)
+				d = newRawDecoder(context.Background(), r, nil)
+				d.readRLE(got, len(data))
+				if !bytes.Equal(got, want) {
+					t.Errorf("n %d, input %d, %T: decoded data differs", n, i, r)
+				}
+				if d.offset != int64(len(data)) {
+					t.Errorf("n %d, input %d, %T: read %d bytes of %d", n, i, r, d.offset, len(data))
+				}
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		n    int
+		err  error
+	}{
+		{"repeat overrun", []byte{130, 1}, 1, FormatError("RLE run overruns the channel")},
+		{"literal overrun", []byte{2, 1, 2}, 1, FormatError("RLE run overruns the channel")},
+		{"repeat past data", []byte{130}, 2, FormatError("RLE run extends past the channel data")},
+		{"literal past data", []byte{3, 1, 2}, 3, FormatError("RLE run extends past the channel data")},
+	} {
+		for _, r := range []io.Reader{bytes.NewReader(tc.data), &sliceReader{b: tc.data}} {
+			err := func() (err error) {
+				defer catchErrors(&err)
+				d := newRawDecoder(context.Background(), r, nil)
+				d.readRLE(make([]byte, tc.n), len(tc.data))
+				return nil
+			}()
+			if !errors.Is(err, tc.err) {
+				t.Errorf("%s, %T: got error %v, want %v", tc.name, r, err, tc.err)
+			}
+		}
+	}
+
+	// Data ending short of the channel leaves the rest of it empty.
+	buf := bytes.Repeat([]byte{7}, 4)
+	d := newRawDecoder(context.Background(), bytes.NewReader([]byte{1, 5}), nil)
+	d.readRLE(buf, 2)
+	if want := []byte{5, 0, 0, 0}; !bytes.Equal(buf, want) {
+		t.Errorf("short data: got %v, want %v", buf, want)
+	}
+}
+
+func BenchmarkReadRLE(b *testing.B) {
+	const n = 1 << 20
+	data := randomRLE(rand.New(rand.NewSource(1)), n)
+	buf := make([]byte, n)
+	b.SetBytes(n)
+	for i := 0; i < b.N; i++ {
+		d := newRawDecoder(context.Background(), bytes.NewReader(data), nil)
+		d.readRLE(buf, len(data))
+	}
+}
+
+// storePlaneStrided is the strided form of storePlane that it replaced,
+// kept as a reference.
+func storePlaneStrided(m image.Image, buf []byte, channelType channelType) {
+	switch img := m.(type) {
+	case *image.RGBA:
+		for i := int(channelType) - 1; i < len(img.Pix); i += 4 {
+			img.Pix[i] = buf[i/4]
+		}
+	case *image.RGBA64:
+		for i := (int(channelType) - 1) * 2; i < len(img.Pix); i += 8 {
+			img.Pix[i] = buf[2*(i/8)+1]
+			img.Pix[i+1] = buf[2*(i/8)]
+		}
+	case *image.Gray16:
+		for i := 0; i < len(buf); i += 2 {
+			img.Pix[i] = buf[i+1]
+			img.Pix[i+1] = buf[i]
+		}
+	}
+}
+
+func TestStorePlane(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	r := image.Rect(0, 0, 37, 11)
+	d := &decoder{}
+	for _, newImage := range []func() image.Image{
+		func() image.Image { return image.NewRGBA(r) },
+		func() image.Image { return image.NewRGBA64(r) },
+		func() image.Image { return image.NewGray16(r) },
+	} {
+		got, want := newImage(), newImage()
+		for ct := channelRed; ct <= 4; ct++ {
+			buf := make([]byte, len(pixOf(got))/4)
+			if _, ok := got.(*image.Gray16); ok {
+				buf = make([]byte, len(pixOf(got)))
+			}
+			rnd.Read(buf)
+			d.storePlane(got, buf, ct)
+			storePlaneStrided(want, buf, ct)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%T %v: pixels differ", got, ct)
+			}
+		}
+	}
+
+	// Channels of other types in color layers are skipped.
+	img := testRGBA(image.Rect(0, 0, 4, 4), 1)
+	channels := rgbChannels(img)
+	channels = append(channels, testChannel{bitmap: dibImage, channel: channelComposite, data: make([]byte, 16)})
+	data := newFileBuilder(5).
+		attrs(testAttrs{width: 4, height: 4, bitDepth: 24, comp: CompressionRLE, layerCount: 1}).
+		block(LayerStartBlock, layerBytes(5, CompressionRLE, testLayer{rect: img.Rect, opacity: 255, channels: channels})).
+		bytes()
+	var warnings []Warning
+	m, err := DecodeWithOptions(bytes.NewReader(data), &Options{Warn: func(w Warning) { warnings = append(warnings, w) }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, img) || len(warnings) != 1 {
+		t.Errorf("got warnings %v", warnings)
+	}
+}
+
+func pixOf(m image.Image) []byte {
+	switch m := m.(type) {
+	case *image.RGBA:
+		return m.Pix
+	case *image.RGBA64:
+		return m.Pix
+	case *image.Gray16:
+		return m.Pix
+	case *image.Gray:
+		return m.Pix
+	case *image.Paletted:
+		return m.Pix
+	}
+	return nil
+}
+
+func BenchmarkDeinterleave(b *testing.B) {
+	r := image.Rect(0, 0, 1024, 1024)
+	buf := make([]byte, r.Dx()*r.Dy())
+	for _, bc := range []struct {
+		name  string
+		store func(image.Image, []byte, channelType)
+	}{
+		{"strided", storePlaneStrided},
+		{"sliced", (&decoder{}).storePlane},
+	} {
+		b.Run(bc.name+"/RGBA", func(b *testing.B) {
+			m := image.NewRGBA(r)
+			b.SetBytes(int64(len(buf)))
+			for i := 0; i < b.N; i++ {
+				bc.store(m, buf, channelGreen)
+			}
+		})
+		b.Run(bc.name+"/RGBA64", func(b *testing.B) {
+			m := image.NewRGBA64(r)
+			buf := make([]byte, 2*len(buf))
+			b.SetBytes(int64(len(buf)))
+			for i := 0; i < b.N; i++ {
+				bc.store(m, buf, channelGreen)
+			}
+		})
+	}
+}
+
+// layersDocument returns a file of n layers of size by size pixels, each
+// followed by a sub-block of unknown type to warn about.
+func layersDocument(n, size int, comp Compression) (data []byte, imgs []*image.RGBA) {
+	var layers [][]byte
+	for i := 0; i < n; i++ {
+		img := testRGBA(image.Rect(0, 0, size, size), byte(i))
+		imgs = append(imgs, img)
+		layers = append(layers, layerBytes(5, comp, testLayer{
+			rect:     img.Rect,
+			opacity:  255,
+			channels: rgbChannels(img),
+			extra:    [][]byte{blockBytes(5, 99, nil)},
+		}))
+	}
+	data = newFileBuilder(5).
+		attrs(testAttrs{width: size, height: size, bitDepth: 24, comp: comp, layerCount: uint16(n)}).
+		block(LayerStartBlock, concat(layers...)).
+		bytes()
+	return data, imgs
+}
+
+func TestDecodeLayersParallel(t *testing.T) {
+	for _, comp := range []Compression{CompressionNone, CompressionRLE, CompressionLZ77} {
+		data, imgs := layersDocument(16, 8, comp)
+		var want, got []Warning
+		var progress []int64
+		wantDoc, err := DecodeDocumentWithOptions(bytes.NewReader(data), &Options{
+			Warn: func(w Warning) { want = append(want, w) },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc, err := DecodeDocumentWithOptions(bytes.NewReader(data), &Options{
+			Parallelism: 4,
+			Warn:        func(w Warning) { got = append(got, w) },
+			Progress:    func(done, total int64) { progress = append(progress, done) },
+		})
+		if err != nil {
+			t.Fatalf("%v: %v", comp, err)
+		}
+		if !reflect.DeepEqual(doc, wantDoc) {
+			t.Errorf("%v: document mismatch", comp)
+		}
+		for i, l := range doc.Layers {
+			if !reflect.DeepEqual(l.Image, imgs[i]) {
+				t.Errorf("%v: layer %d image mismatch", comp, i)
+			}
+		}
+		if len(want) != 16 || !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got warnings %v, want %v", comp, got, want)
+		}
+		if len(progress) != 16 {
+			t.Errorf("%v: got %d progress reports, want one per layer", comp, len(progress))
+		}
+		for i := 1; i < len(progress); i++ {
+			if progress[i] <= progress[i-1] {
+				t.Errorf("%v: progress went from %d to %d", comp, progress[i-1], progress[i])
+			}
+		}
+	}
+
+	// A corrupt layer fails decoding with its index, as it does when
+	// decoding in turn.
+	data, imgs := layersDocument(16, 8, CompressionRLE)
+	green := channelBytes(5, CompressionRLE, rgbChannels(imgs[9])[1])
+	end := bytes.Index(data, green) + len(green)
+	n := len(pspgen.Compress(pspgen.RLE, rgbChannels(imgs[9])[1].data))
+	for i := end - n; i < end; i++ {
+		data[i] = 0xff
+	}
+	var want, got *DecodeError
+	_, werr := DecodeDocument(bytes.NewReader(data))
+	_, err := DecodeDocumentWithOptions(bytes.NewReader(data), &Options{Parallelism: 4})
+	if !errors.As(werr, &want) || !errors.As(err, &got) {
+		t.Fatalf("got errors %v and %v", werr, err)
+	}
+	if *got != *want || got.Layer != 9 {
+		t.Errorf("got error %+v, want %+v", *got, *want)
+	}
+}
+
+func BenchmarkDecodeLayersParallel(b *testing.B) {
+	data, _ := layersDocument(16, 256, CompressionLZ77)
+	for _, parallelism := range []int{1, 4} {
+		b.Run(fmt.Sprint(parallelism), func(b *testing.B) {
+			opts := &Options{Parallelism: parallelism}
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if _, err := DecodeDocumentWithOptions(bytes.NewReader(data), opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecodeDocument(b *testing.B) {
+	// A document of many small layers, where the cost of setting up the
+	// decompression of every channel stands out.
+	doc := &Document{Width: 32, Height: 32}
+	for i := 0; i < 100; i++ {
+		img := testRGBA(image.Rect(0, 0, 32, 32), byte(i))
+		img.Pix[3] = 0 // adds a transparency mask channel
+		doc.Layers = append(doc.Layers, &Layer{Kind: LayerRaster, Opacity: 255, Visible: true, Image: img})
+	}
+	var buf bytes.Buffer
+	if err := EncodeDocument(&buf, doc, &EncodeOptions{Compression: CompressionLZ77}); err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(buf.Len()))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := DecodeDocument(bytes.NewReader(buf.Bytes())); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package psp
+
+import (
+	"fmt"
+	"time"
+)
+
+// Metadata is the document information stored in the creator block of a PSP
+// file, along with the settings of picture tube files. Fields that are not
+// present in the file are left as zero values.
+type Metadata struct {
+	Title       string
+	Artist      string
+	Copyright   string
+	Description string
+
+	// RawTitle, RawArtist, RawCopyright and RawDescription are the bytes
+	// of the fields above as stored in the file, before their conversion
+	// to UTF-8.
+	RawTitle       []byte
+	RawArtist      []byte
+	RawCopyright   []byte
+	RawDescription []byte
+
+	// Created and Modified are the creation and modification times of the
+	// document. They are stored as seconds since the Unix epoch, taken to
+	// be in UTC, and are returned in UTC unless Options.Location says
+	// otherwise. A zero Time means the field was not present or is zero,
+	// which Paint Shop Pro stores for unset times. RawCreated and
+	// RawModified are the values as stored.
+	Created     time.Time
+	Modified    time.Time
+	RawCreated  uint32
+	RawModified uint32
+
+	// AppID identifies the application that wrote the file and AppVersion
+	// is its version, both exactly as stored.
+	AppID      CreatorApp
+	AppVersion AppVersion
+
+	// Resolution is the resolution of the document from its general image
+	// attributes, in pixels per ResolutionUnit.
+	Resolution     float64
+	ResolutionUnit ResolutionUnit
+
+	// Grid holds the grid settings saved with the document, or is nil if
+	// there are none.
+	Grid *Grid
+
+	// Guides holds the image guides in the order they are stored. Guides
+	// may lie outside the canvas.
+	Guides []Guide
+
+	// EXIF is the Exif data of the original photo, as stored (since PSP8).
+	EXIF []byte
+
+	// Tube holds the settings of a picture tube file, or is nil for other
+	// files.
+	Tube *Tube
+
+	// Composites describes the composite images of the file in the order
+	// they are stored, without their pixel data. Before version 4 only a
+	// thumbnail may be stored.
+	Composites []Composite
+}
+
+// AppVersion is the version of the application that wrote a file, packed
+// with the major version in the high 16 bits and the minor version in the
+// low 16 bits, so that Paint Shop Pro 7 writes 0x00070000.
+type AppVersion uint32
+
+// Major returns the major version.
+func (v AppVersion) Major() int { return int(v >> 16) }
+
+// Minor returns the minor version.
+func (v AppVersion) Minor() int { return int(v & 0xffff) }
+
+func (v AppVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.Major(), v.Minor())
+}
+
+// PixelsPerInch returns the resolution of the document in pixels per inch,
+// whatever unit it is stored in. It returns false if the unit is unknown.
+func (m *Metadata) PixelsPerInch() (float64, bool) {
+	switch m.ResolutionUnit {
+	case ResolutionInch:
+		return m.Resolution, true
+	case ResolutionCentimeter:
+		return m.Resolution * 2.54, true
+	}
+	return 0, false
+}
+
+// Grid is the grid of a document (since PSP7). The spacing is measured in
+// Units.
+type Grid struct {
+	HorizontalSpacing int
+	VerticalSpacing   int
+	Units             GridUnits
+}
+
+// Guide is an image guide (since PSP7). Position is the row of a horizontal
+// guide or the column of a vertical one.
+type Guide struct {
+	Orientation GuideOrientation
+	Position    int
+}
@@ -0,0 +1,448 @@
+package psp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeMetadata(t *testing.T) {
+	created := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	data := newFileBuilder(5).
+		attrs(testAttrs{width: 1, height: 1, bitDepth: 24}).
+		block(CreatorBlock, concat(
+			chunkBytes(crtrFldTitle, []byte("Title")),
+			chunkBytes(crtrFldCrtDate, uint32Bytes(uint32(created.Unix()))),
+			chunkBytes(crtrFldArtist, []byte("Artist")),
+			chunkBytes(crtrFldAppID, uint32Bytes(uint32(CreatorAppPaintShopPro))),
+			chunkBytes(crtrFldAppVer, uint32Bytes(0x00070000)),
+		)).
+		block(LayerStartBlock, nil).
+		bytes()
+
+	meta, err := DecodeMetadata(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Metadata{
+		Title:      "Title",
+		Artist:     "Artist",
+		RawTitle:   []byte("Title"),
+		RawArtist:  []byte("Artist"),
+		Created:    created,
+		RawCreated: uint32(created.Unix()),
+		AppID:      CreatorAppPaintShopPro,
+		AppVersion: 0x00070000,
+	}
+	if !reflect.DeepEqual(*meta, want) {
+		t.Fatalf("got %+v, want %+v", *meta, want)
+	}
+}
+
+func TestAppVersion(t *testing.T) {
+	for _, tc := range []struct {
+		v            AppVersion
+		major, minor int
+		s            string
+	}{
+		{0x00070000, 7, 0, "7.0"},   // Paint Shop Pro 7
+		{0x00070004, 7, 4, "7.4"},   // Paint Shop Pro 7.04
+		{0x000a0000, 10, 0, "10.0"}, // Paint Shop Pro X
+		{786432, 12, 0, "12.0"},     // Paint Shop Pro X2
+		{0x0012ffff, 18, 65535, "18.65535"},
+	} {
+		if tc.v.Major() != tc.major || tc.v.Minor() != tc.minor || tc.v.String() != tc.s {
+			t.Errorf("%#x: got %d, %d and %s, want %d, %d and %s", uint32(tc.v), tc.v.Major(), tc.v.Minor(), tc.v, tc.major, tc.minor, tc.s)
+		}
+	}
+
+	data := newFileBuilder(10).
+		attrs(testAttrs{width: 1, height: 1, bitDepth: 24}).
+		block(CreatorBlock, chunkBytes(crtrFldAppVer, uint32Bytes(0x000a0000))).
+		block(LayerStartBlock, nil).
+		bytes()
+	meta, err := DecodeMetadata(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.AppVersion != 0x000a0000 || meta.AppVersion.String() != "10.0" {
+		t.Errorf("got version %v (%#x)", meta.AppVersion, uint32(meta.AppVersion))
+	}
+}
+
+func TestCreatorApp(t *testing.T) {
+	for _, tc := range []struct {
+		chunks []byte
+		want   CreatorApp
+		s      string
+	}{
+		{chunkBytes(crtrFldAppID, uint32Bytes(1)), CreatorAppPaintShopPro, "CreatorAppPaintShopPro"},
+		{chunkBytes(crtrFldAppID, uint32Bytes(0)), CreatorAppUnknown, "CreatorAppUnknown"},
+		{chunkBytes(crtrFldTitle, []byte("No app")), CreatorAppUnknown, "CreatorAppUnknown"},
+		{chunkBytes(crtrFldAppID, uint32Bytes(7)), 7, "CreatorApp(7)"},
+	} {
+		data := newFileBuilder(7).
+			attrs(testAttrs{width: 1, height: 1, bitDepth: 24}).
+			block(CreatorBlock, tc.chunks).
+			block(LayerStartBlock, nil).
+			bytes()
+		meta, err := DecodeMetadata(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.AppID != tc.want || meta.AppID.String() != tc.s {
+			t.Errorf("got %v, want %v", meta.AppID, tc.s)
+		}
+	}
+}
+
+func TestCreatorTimes(t *testing.T) {
+	// 2001-02-03 04:05:06 on the clock of the machine that wrote the file.
+	const stored = 981173106
+	data := newFileBuilder(5).
+		attrs(testAttrs{width: 1, height: 1, bitDepth: 24}).
+		block(CreatorBlock, concat(
+			chunkBytes(crtrFldCrtDate, uint32Bytes(stored)),
+			chunkBytes(crtrFldModDate, uint32Bytes(0)),
+		)).
+		block(LayerStartBlock, nil).
+		bytes()
+
+	meta, err := DecodeMetadata(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC); !meta.Created.Equal(want) || meta.Created.Location() != time.UTC {
+		t.Errorf("got created %v, want %v", meta.Created, want)
+	}
+	// A zero time is unset.
+	if !meta.Modified.IsZero() || meta.RawCreated != stored || meta.RawModified != 0 {
+		t.Errorf("got modified %v and raw times %d, %d", meta.Modified, meta.RawCreated, meta.RawModified)
+	}
+
+	loc := time.FixedZone("UTC-5", -5*60*60)
+	meta, err = decodeMetadataWithOptions(data, &Options{Location: loc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2001, 2, 3, 4, 5, 6, 0, loc); !meta.Created.Equal(want) || meta.Created.Location() != loc {
+		t.Errorf("got created %v in a location, want %v", meta.Created, want)
+	}
+	if !meta.Modified.IsZero() {
+		t.Errorf("got modified %v in a location, want the zero time", meta.Modified)
+	}
+}
+
+func TestDecodeChunkBounds(t *testing.T) {
+	title := chunkBytes(crtrFldTitle, []byte("Title"))
+	// A chunk with a length reaching into the next block, which used to
+	// be consumed as part of it.
+	long := chunkBytes(crtrFldAppID, uint32Bytes(uint32(CreatorAppPaintShopPro)))
+	binary.LittleEndian.PutUint32(long[6:], 40)
+	longGrid := chunkBytes(xDataGrid, leBytes(uint32(4), uint32(8), uint16(GridUnitsInches)))
+	binary.LittleEndian.PutUint32(longGrid[6:], 40)
+	for name, payload := range map[string][]byte{
+		"creator":       concat(title, long),
+		"extended data": longGrid,
+	} {
+		id := CreatorBlock
+		if name == "extended data" {
+			id = ExtendedDataBlock
+		}
+		data := newFileBuilder(5).
+			attrs(testAttrs{width: 1, height: 1, bitDepth: 24}).
+			block(id, payload).
+			block(CreatorBlock, chunkBytes(crtrFldArtist, []byte("Next block"))).
+			block(LayerStartBlock, nil).
+			bytes()
+		_, err := decodeMetadataWithOptions(data, &Options{Strict: true})
+		var ferr FormatError
+		if !errors.As(err, &ferr) || !strings.Contains(string(ferr), "claims 40 bytes") {
+			t.Errorf("%s: got error %v, want a FormatError", name, err)
+		}
+		// Leniently, the rest of the block is skipped and the next one
+		// read from its start.
+		var warnings []Warning
+		meta, err := decodeMetadataWithOptions(data, &Options{Warn: func(w Warning) { warnings = append(warnings, w) }})
+		if err != nil || meta.Artist != "Next block" || len(warnings) != 1 {
+			t.Errorf("%s: got %v, artist %q and warnings %v", name, err, meta.Artist, warnings)
+		}
+		if name == "creator" && meta.Title != "Title" {
+			t.Errorf("%s: got title %q before the long chunk", name, meta.Title)
+		}
+	}
+
+	// Empty chunks and slack too short for another chunk at the end of a
+	// block are passed over.
+	data := newFileBuilder(5).
+		attrs(testAttrs{width: 1, height: 1, bitDepth: 24}).
+		block(CreatorBlock, concat(chunkBytes(crtrFldDesc, nil), title, []byte{0, 0, 0})).
+		block(ExtendedDataBlock, concat(chunkBytes(0x7fff, nil), []byte{0})).
+		block(CreatorBlock, chunkBytes(crtrFldArtist, []byte("Next block"))).
+		block(LayerStartBlock, nil).
+		bytes()
+	meta, err := DecodeMetadata(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Title != "Title" || meta.Artist != "Next block" {
+		t.Errorf("got %+v", meta)
+	}
+}
+
+func TestDecodeMetadataNoCreator(t *testing.T) {
+	data := newFileBuilder(5).
+		attrs(testAttrs{width: 1, height: 1, bitDepth: 24}).
+		bytes()
+	meta, err := DecodeMetadata(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*meta, Metadata{}) {
+		t.Fatalf("expected zero metadata, got %+v", *meta)
+	}
+}
+
+func TestDecodeGrid(t *testing.T) {
+	data := newFileBuilder(7).
+		attrs(testAttrs{width: 1, height: 1, bitDepth: 24}).
+		block(ExtendedDataBlock, concat(
+			chunkBytes(xDataTrnsIndex, []byte{0, 0}),
+			chunkBytes(xDataGrid, leBytes(uint32(10), uint32(10), uint16(GridUnitsPixels))),
+		)).
+		block(LayerStartBlock, nil).
+		bytes()
+	meta, err := DecodeMetadata(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Grid{HorizontalSpacing: 10, VerticalSpacing: 10, Units: GridUnitsPixels}
+	if meta.Grid == nil || *meta.Grid != want {
+		t.Fatalf("got grid %+v, want %+v", meta.Grid, want)
+	}
+}
+
+func TestDecodeResolution(t *testing.T) {
+	for _, tc := range []struct {
+		res  float64
+		unit ResolutionUnit
+		ppi  float64
+		ok   bool
+	}{
+		{300, ResolutionInch, 300, true},
+		{118.11, ResolutionCentimeter, 118.11 * 2.54, true},
+		{72, ResolutionUndefined, 0, false},
+	} {
+		data := newFileBuilder(5).
+			attrs(testAttrs{width: 1, height: 1, res: tc.res, unit: tc.unit, bitDepth: 24}).
+			block(LayerStartBlock, nil).
+			bytes()
+		meta, err := DecodeMetadata(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.Resolution != tc.res || meta.ResolutionUnit != tc.unit {
+			t.Errorf("got resolution %v %v, want %v %v", meta.Resolution, meta.ResolutionUnit, tc.res, tc.unit)
+		}
+		if ppi, ok := meta.PixelsPerInch(); ppi != tc.ppi || ok != tc.ok {
+			t.Errorf("%v: got %v pixels per inch (%v), want %v (%v)", tc.unit, ppi, ok, tc.ppi, tc.ok)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, testRGBA(image.Rect(0, 0, 1, 1), 0)); err != nil {
+		t.Fatal(err)
+	}
+	_, meta, err := DecodeWithMetadata(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ppi, ok := meta.PixelsPerInch(); ppi != 72 || !ok {
+		t.Errorf("encoded file: got %v pixels per inch (%v), want 72", ppi, ok)
+	}
+}
+
+func TestDecodeGuides(t *testing.T) {
+	guide := func(o GuideOrientation, pos int32) []byte {
+		return chunkBytes(xDataGuide, leBytes(uint16(o), pos))
+	}
+	data := newFileBuilder(7).
+		attrs(testAttrs{width: 10, height: 10, bitDepth: 24}).
+		block(ExtendedDataBlock, concat(
+			guide(GuideVertical, 3),
+			guide(GuideHorizontal, 5),
+			guide(GuideVertical, 3),
+			guide(GuideHorizontal, -20),
+			guide(GuideVertical, 400),
+		)).
+		block(LayerStartBlock, nil).
+		bytes()
+	meta, err := DecodeMetadata(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Guide{
+		{GuideVertical, 3},
+		{GuideHorizontal, 5},
+		{GuideVertical, 3},
+		{GuideHorizontal, -20},
+		{GuideVertical, 400},
+	}
+	if !reflect.DeepEqual(meta.Guides, want) {
+		t.Fatalf("got guides %v, want %v", meta.Guides, want)
+	}
+}
+
+func TestDecodeEXIF(t *testing.T) {
+	exif := bytes.Repeat([]byte("Exif\x00\x00MM"), 5000)
+	data := newFileBuilder(8).
+		attrs(testAttrs{width: 1, height: 1, bitDepth: 24}).
+		block(ExtendedDataBlock, chunkBytes(xDataEXIF, exif)).
+		block(LayerStartBlock, nil).
+		bytes()
+	meta, err := DecodeMetadata(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(meta.EXIF, exif) {
+		t.Fatalf("got %d bytes of Exif data, want %d", len(meta.EXIF), len(exif))
+	}
+}
+
+func TestDecodeTruncatedEXIF(t *testing.T) {
+	exif := bytes.Repeat([]byte{0xA5}, 100)
+	// The chunk claims more data than its block holds.
+	block := chunkBytes(xDataEXIF, exif)
+	binary.LittleEndian.PutUint32(block[6:], 200)
+	inBlock := newFileBuilder(8).
+		attrs(testAttrs{width: 1, height: 1, bitDepth: 24}).
+		block(ExtendedDataBlock, block).
+		block(CreatorBlock, chunkBytes(crtrFldTitle, []byte("After"))).
+		block(LayerStartBlock, nil).
+		bytes()
+	// The input ends in the middle of the chunk.
+	atEOF := newFileBuilder(8).
+		attrs(testAttrs{width: 1, height: 1, bitDepth: 24}).
+		block(ExtendedDataBlock, chunkBytes(xDataEXIF, exif)).
+		bytes()
+	atEOF = atEOF[:len(atEOF)-40]
+
+	for name, data := range map[string][]byte{"block": inBlock, "eof": atEOF} {
+		var warnings []Warning
+		var meta *Metadata
+		err := func() (err error) {
+			defer catchErrors(&err)
+			opts := &Options{Warn: func(w Warning) { warnings = append(warnings, w) }}
+			// The input is a stream, whose length isn't checked up front.
+			d := newDecoder(io.MultiReader(bytes.NewReader(data)), opts)
+			d.decodeMetadataBlocks()
+			meta = &d.meta
+			return nil
+		}()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(warnings) != 1 {
+			t.Errorf("%s: got warnings %v, want one", name, warnings)
+		}
+		if len(meta.EXIF) == 0 || !bytes.Equal(meta.EXIF, exif[:len(meta.EXIF)]) {
+			t.Errorf("%s: got %d bytes of Exif data", name, len(meta.EXIF))
+		}
+		if name == "block" && meta.Title != "After" {
+			t.Errorf("%s: blocks after the extended data were not read", name)
+		}
+	}
+}
+
+func TestDecodeMetadataAfterLayers(t *testing.T) {
+	img := testRGBA(image.Rect(0, 0, 2, 1), 9)
+	// The layer count in the attributes is deliberately wrong; the layer
+	// bank length is what counts.
+	data := newFileBuilder(7).
+		attrs(testAttrs{width: 2, height: 1, bitDepth: 24, layerCount: 5}).
+		block(CreatorBlock, concat(
+			chunkBytes(crtrFldTitle, []byte("Before")),
+			chunkBytes(crtrFldArtist, []byte("Artist")),
+		)).
+		block(LayerStartBlock, layerBytes(7, CompressionNone, testLayer{
+			layerType: rasterType(7),
+			rect:      img.Rect,
+			opacity:   255,
+			channels:  rgbChannels(img),
+		})).
+		block(CreatorBlock, chunkBytes(crtrFldTitle, []byte("After"))).
+		block(ExtendedDataBlock, chunkBytes(xDataGrid, leBytes(uint32(4), uint32(8), uint16(GridUnitsInches)))).
+		bytes()
+
+	check := func(name string, meta *Metadata) {
+		if meta.Title != "After" || meta.Artist != "Artist" {
+			t.Errorf("%s: got title %q and artist %q", name, meta.Title, meta.Artist)
+		}
+		if meta.Grid == nil || meta.Grid.Units != GridUnitsInches {
+			t.Errorf("%s: got grid %+v", name, meta.Grid)
+		}
+	}
+
+	meta, err := DecodeMetadata(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("DecodeMetadata", meta)
+
+	_, meta, err = DecodeWithMetadata(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("DecodeWithMetadata", meta)
+
+	doc, err := DecodeDocument(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("DecodeDocument", &doc.Metadata)
+	if len(doc.Layers) != 1 {
+		t.Errorf("got %d layers, want 1", len(doc.Layers))
+	}
+}
+
+func TestDecodeLongDescription(t *testing.T) {
+	desc := strings.Repeat("A long description. ", 200)
+	data := newFileBuilder(5).
+		attrs(testAttrs{width: 1, height: 1, bitDepth: 24}).
+		block(CreatorBlock, chunkBytes(crtrFldDesc, []byte(desc))).
+		block(LayerStartBlock, nil).
+		bytes()
+	meta, err := DecodeMetadata(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Description != desc {
+		t.Errorf("got a description of %d bytes, want %d", len(meta.Description), len(desc))
+	}
+
+	// A string can't be longer than its block.
+	bad := newFileBuilder(5).
+		attrs(testAttrs{width: 1, height: 1, bitDepth: 24}).
+		block(CreatorBlock, leBytes(chunkMagic, uint16(crtrFldDesc), uint32(1<<30), []byte("short"))).
+		bytes()
+	var ferr FormatError
+	if _, err := decodeMetadataWithOptions(bad, &Options{Strict: true}); !errors.As(err, &ferr) {
+		t.Errorf("got error %v, want a FormatError", err)
+	}
+}
+
+// decodeMetadataWithOptions returns the metadata ahead of the layer bank of
+// data, decoded with the given options.
+func decodeMetadataWithOptions(data []byte, opts *Options) (meta *Metadata, err error) {
+	defer catchErrors(&err)
+	d := newDecoder(bytes.NewReader(data), opts)
+	defer d.release()
+	d.decodeMetadataBlocks()
+	return &d.meta, nil
+}
@@ -0,0 +1,241 @@
+package psp
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// Default resource limits, used for limits left at zero in Options and by
+// the decoding functions that don't take options.
+const (
+	DefaultMaxWidth          = 1 << 14
+	DefaultMaxHeight         = 1 << 14
+	DefaultMaxPixels         = 1 << 26
+	DefaultMaxPaletteEntries = 256
+	DefaultMaxLayers         = 1000
+	DefaultMaxStringLength   = 1 << 20
+)
+
+// Options control optional behavior of the package. The zero value gives
+// the default behavior.
+type Options struct {
+	// Flatten makes DecodeWithOptions return the composite of all layers,
+	// as given by Document.Flatten, rather than the first raster layer.
+	Flatten bool
+
+	// SkipHidden makes DecodeWithOptions pass over hidden layers when
+	// picking the raster layer to return.
+	SkipHidden bool
+
+	// NonPremultiplied makes color layers decode to *image.NRGBA and
+	// *image.NRGBA64 rather than *image.RGBA and *image.RGBA64, holding
+	// the color and transparency mask values exactly as stored.
+	NonPremultiplied bool
+
+	// ApplyAdjustments applies invert, brightness/contrast, threshold and
+	// posterize adjustment layers to the layers beneath them when
+	// flattening. Other kinds of adjustments are skipped with a warning.
+	ApplyAdjustments bool
+
+	// Parallelism is the number of layers or channels decoded at the same
+	// time. When all layers are decoded from an input that can be read at
+	// any offset, such as an *os.File or *bytes.Reader, that many workers
+	// each decode whole layers, which are found by seeking past them
+	// first. Otherwise the compressed data of a layer's channels is read
+	// ahead, one layer at a time, and decompressed concurrently. Values
+	// below 2 decode everything in turn as it is read. The decoded images
+	// are the same either way.
+	Parallelism int
+
+	// DIBTypes selects the kinds of bitmap whose channels are
+	// decompressed. The channels of the others are skipped unread, and
+	// what they would have filled in is left out: a layer without
+	// DIBImage has no Image, and one without DIBUserMask no UserMask.
+	// Zero selects what the function needs: DIBImage and DIBTransMask for
+	// those returning the image of a layer, such as DecodeWithOptions
+	// unless flattening and DecodeRowsWithOptions, and DIBAll otherwise.
+	// Selections aren't decoded whatever the types.
+	DIBTypes DIBTypes
+
+	// Strict makes recoverable deviations from the format, such as unknown
+	// blocks, structures longer than their declared length, trailing data
+	// and blocks out of place, fail decoding with a FormatError. By
+	// default they are skipped and reported to Warn.
+	Strict bool
+
+	// MaxWidth and MaxHeight limit the dimensions of the canvas and of
+	// every bitmap in the file. MaxPixels limits the number of pixels of
+	// all the bitmaps allocated while decoding a file taken together,
+	// at up to 8 bytes each, since layers needn't lie within the canvas.
+	// MaxPaletteEntries limits the size of the color palette and MaxLayers
+	// the number of layers. Limits are checked before anything is
+	// allocated for them, and exceeding one fails decoding with a
+	// LimitError. MaxStringLength limits text fields such as names and
+	// descriptions, which are also bounded by the block holding them. A
+	// limit of zero takes its default and a negative one disables it.
+	MaxWidth          int
+	MaxHeight         int
+	MaxPixels         int
+	MaxPaletteEntries int
+	MaxLayers         int
+	MaxStringLength   int
+
+	// DecodeText, if not nil, converts the text of names and creator
+	// fields to UTF-8. By default text is taken to be in the Windows-1252
+	// code page. Trailing NULs are removed beforehand.
+	DecodeText func([]byte) string
+
+	// BlockHandler, if not nil, is called for every top-level block the
+	// decoder doesn't interpret itself, including blocks of unknown type,
+	// with a reader limited to the data of the block. Data it leaves
+	// unread is skipped. An error it returns fails decoding in strict mode
+	// and is reported to Warn otherwise.
+	BlockHandler func(id BlockID, data io.Reader) error
+
+	// Progress, if not nil, is called as the layer bank is decoded, after
+	// every channel and layer. done is the number of bytes of the file read
+	// so far and total the offset of the end of the layer bank, which holds
+	// nearly all of the pixel data. It is never called concurrently. A
+	// panic in Progress stops decoding with a ProgressError.
+	Progress func(done, total int64)
+
+	// Warn, if not nil, is called for every feature of the file that was
+	// ignored or could not be honored.
+	Warn func(Warning)
+
+	// Location, if not nil, is the time zone the creator timestamps were
+	// written in. They are time_t values, seconds since the Unix epoch in
+	// UTC, but Paint Shop Pro on Windows counted them from the local
+	// wall-clock time instead, so that they are off by the offset of the
+	// time zone of the machine that wrote the file. With Location they
+	// are read as wall-clock times in it.
+	Location *time.Location
+}
+
+// A Warning describes a feature of a file that was ignored or could not be
+// honored.
+type Warning struct {
+	Code    WarningCode
+	Offset  int64  // offset in the input at which it was found, or -1 when flattening
+	Block   string // innermost enclosing block, or "" outside of blocks
+	Layer   int    // index into Document.Layers, or -1
+	Message string
+}
+
+// WarningCode classifies a Warning.
+type WarningCode int
+
+const (
+	WarnFormat       WarningCode = iota // a recoverable deviation from the format
+	WarnUnknownBlock                    // a block of unknown type was skipped
+	WarnIgnoredBlock                    // a block out of place was skipped
+	WarnVersion                         // the version is read as an earlier one
+	WarnBlockHandler                    // the BlockHandler returned an error
+	WarnLayerKind                       // a layer of a kind without an image wasn't drawn
+	WarnBlendMode                       // a blend mode was drawn as BlendNormal
+	WarnMask                            // a user mask wasn't applied
+	WarnAdjustment                      // an adjustment wasn't applied
+)
+
+var warningCodes = map[WarningCode]string{
+	WarnFormat:       "WarnFormat",
+	WarnUnknownBlock: "WarnUnknownBlock",
+	WarnIgnoredBlock: "WarnIgnoredBlock",
+	WarnVersion:      "WarnVersion",
+	WarnBlockHandler: "WarnBlockHandler",
+	WarnLayerKind:    "WarnLayerKind",
+	WarnBlendMode:    "WarnBlendMode",
+	WarnMask:         "WarnMask",
+	WarnAdjustment:   "WarnAdjustment",
+}
+
+func (c WarningCode) String() string {
+	if s := warningCodes[c]; s != "" {
+		return s
+	}
+	return fmt.Sprintf("WarningCode(%d)", int(c))
+}
+
+func (w Warning) String() string {
+	if w.Layer >= 0 {
+		return fmt.Sprintf("psp: layer %d: %s", w.Layer, w.Message)
+	}
+	return "psp: " + w.Message
+}
+
+func (o *Options) warn(w Warning) {
+	if o != nil && o.Warn != nil {
+		o.Warn(w)
+	}
+}
+
+// dibTypes returns the kinds of bitmap decoded, given the default for
+// options that don't select any.
+func (o *Options) dibTypes(def DIBTypes) DIBTypes {
+	if o != nil && o.DIBTypes != 0 {
+		return o.DIBTypes
+	}
+	return def
+}
+
+// limits holds the resource limits in effect, with the defaults applied.
+type limits struct {
+	width, height, pixels, paletteEntries, layers, stringLength int
+}
+
+func (o *Options) limits() limits {
+	var l limits
+	if o != nil {
+		l = limits{o.MaxWidth, o.MaxHeight, o.MaxPixels, o.MaxPaletteEntries, o.MaxLayers, o.MaxStringLength}
+	}
+	return limits{
+		width:          limit(l.width, DefaultMaxWidth),
+		height:         limit(l.height, DefaultMaxHeight),
+		pixels:         limit(l.pixels, DefaultMaxPixels),
+		paletteEntries: limit(l.paletteEntries, DefaultMaxPaletteEntries),
+		layers:         limit(l.layers, DefaultMaxLayers),
+		stringLength:   limit(l.stringLength, DefaultMaxStringLength),
+	}
+}
+
+func limit(v, def int) int {
+	switch {
+	case v == 0:
+		return def
+	case v < 0:
+		return math.MaxInt
+	}
+	return v
+}
+
+// A ProgressError reports a panic in the Progress callback of Options.
+// Value is the value passed to panic.
+type ProgressError struct {
+	Value interface{}
+}
+
+func (e ProgressError) Error() string {
+	return fmt.Sprintf("psp: progress callback panicked: %v", e.Value)
+}
+
+// reportProgress calls the Progress callback, if any, with done bytes of
+// the layer bank read.
+func (d *decoder) reportProgress(done int64) {
+	if d.opts == nil || d.opts.Progress == nil {
+		return
+	}
+	var perr *ProgressError
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				perr = &ProgressError{r}
+			}
+		}()
+		d.opts.Progress(done, d.layerBankEnd)
+	}()
+	if perr != nil {
+		d.error(*perr)
+	}
+}
@@ -0,0 +1,43 @@
+package psp
+
+import (
+	"errors"
+	"image/color"
+	"io"
+)
+
+// ErrNoPalette is returned by DecodePalette for files that aren't indexed,
+// or that don't hold a color palette block.
+var ErrNoPalette = errors.New("psp: no palette")
+
+// DecodePalette returns the color palette of an indexed PSP image, as
+// stored in the file, without decoding anything else. It reads no further
+// than the color palette block, which comes ahead of the layers, and skips
+// the blocks before it unread. 1 bit images without a palette give the
+// black and white one Decode uses.
+func DecodePalette(r io.Reader) (palette color.Palette, err error) {
+	defer catchErrors(&err)
+	d := newDecoder(r, nil)
+	defer d.release()
+	if !indexed(d.bitDepth, d.grayscale) {
+		return nil, ErrNoPalette
+	}
+	var bh blockHeader
+	for !d.atEOF() {
+		d.readBlockHeader(&bh)
+		if bh.id == LayerStartBlock {
+			break
+		}
+		end := d.offset + int64(bh.dataLen)
+		if bh.id == ColorBlock {
+			d.decodeColorBlock(d.bitDepth)
+			return d.palette, nil
+		}
+		d.skipTo(end)
+	}
+	d.defaultPalette()
+	if d.palette == nil {
+		return nil, ErrNoPalette
+	}
+	return d.palette, nil
+}
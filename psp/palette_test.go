@@ -0,0 +1,63 @@
+package psp
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+
+	"github.com/samuel/go-psp/internal/pspgen"
+)
+
+func TestDecodePalette(t *testing.T) {
+	for _, m := range pspgen.Images() {
+		data := pspgen.Image(5, pspgen.LZ77, m)
+		palette, err := DecodePalette(bytes.NewReader(data))
+		if p, ok := m.(*image.Paletted); ok {
+			if err != nil || !reflect.DeepEqual(palette, p.Palette) {
+				t.Errorf("%T: got %v, %v, want %v", m, palette, err, p.Palette)
+			}
+		} else if err != ErrNoPalette {
+			t.Errorf("%T: got %v, %v, want ErrNoPalette", m, palette, err)
+		}
+	}
+
+	// The layer bank isn't read, nor blocks after the palette.
+	want := color.Palette{color.RGBA{1, 2, 3, 255}, color.RGBA{4, 5, 6, 255}}
+	data := pspgen.NewFile(5).
+		Attrs(pspgen.Attrs{Width: 1, Height: 1, BitDepth: 8}).
+		Block(pspgen.CreatorBlock, []byte("not a creator block")).
+		Palette(want).
+		Raw([]byte("not a block")).
+		Bytes()
+	if palette, err := DecodePalette(bytes.NewReader(data)); err != nil || !reflect.DeepEqual(palette, want) {
+		t.Errorf("got %v, %v, want %v", palette, err, want)
+	}
+
+	// Indexed images without a palette have none, but for 1 bit ones.
+	data = pspgen.NewFile(5).Attrs(pspgen.Attrs{Width: 1, Height: 1, BitDepth: 8}).Bytes()
+	if _, err := DecodePalette(bytes.NewReader(data)); err != ErrNoPalette {
+		t.Errorf("8 bit image without a palette: got error %v, want ErrNoPalette", err)
+	}
+	data = checkerboardFile(pspgen.None, false, nil)
+	want = color.Palette{color.RGBA{0, 0, 0, 255}, color.RGBA{255, 255, 255, 255}}
+	if palette, err := DecodePalette(bytes.NewReader(data)); err != nil || !reflect.DeepEqual(palette, want) {
+		t.Errorf("1 bit image without a palette: got %v, %v, want %v", palette, err, want)
+	}
+}
+
+func BenchmarkDecodePalette(b *testing.B) {
+	palette := make(color.Palette, 256)
+	for i := range palette {
+		palette[i] = color.RGBA{byte(i), byte(i * 3), byte(i * 7), 255}
+	}
+	m := image.NewPaletted(image.Rect(0, 0, 64, 64), palette)
+	data := pspgen.Image(5, pspgen.LZ77, m)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := DecodePalette(bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package psp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"io"
+	"math"
+	"sync"
+)
+
+// channelJob is a channel of a layer whose compressed data has been read
+// ahead to be decompressed along with the other channels of the layer.
+type channelJob struct {
+	channel     int   // index of the channel block within the layer
+	offset      int64 // offset of the compressed data
+	channelType channelType
+	data        []byte
+	plane       []byte // decompressed data
+	err         error
+}
+
+// parallel reports whether the channels of layers are decompressed
+// concurrently. Uncompressed channels have nothing to gain from it.
+func (d *decoder) parallel() bool {
+	return d.opts != nil && d.opts.Parallelism > 1 && (d.comp == CompressionLZ77 || d.comp == CompressionRLE)
+}
+
+// queueChannel reads the compressedLen bytes of data of a channel block
+// for decodePending to decompress. Data overrunning the block is read as
+// it is when decoding in turn, leaving skipTo to report it.
+func (d *decoder) queueChannel(compressedLen int, ct channelType) {
+	job := channelJob{channel: d.channel, offset: d.offset, channelType: ct}
+	if data, ok := d.inPlace(compressedLen); ok {
+		job.data = data
+	} else {
+		// The data is read as it arrives rather than trusting the length
+		// up front.
+		var buf bytes.Buffer
+		m, err := io.CopyN(&buf, d.r, int64(compressedLen))
+		d.offset += m
+		if err != nil {
+			d.error(err)
+		}
+		job.data = buf.Bytes()
+	}
+	// The decompressing decoders don't report problems, so this one does
+	// ahead of them.
+	if d.comp == CompressionLZ77 && len(job.data) >= 2 && !isZlibHeader(job.data) {
+		d.recoverable("LZ77 channel data without a zlib header")
+	}
+	d.pending = append(d.pending, job)
+}
+
+// decodePending decompresses the queued channels of a layer, up to
+// Parallelism at a time, and stores them in its image in the order they
+// were read. A failure is reported for the first channel that failed, as
+// it would have been had the channels been decoded in turn.
+func (d *decoder) decodePending(img image.Image, layerBytes int) {
+	jobs := d.pending
+	d.pending = nil
+	sem := make(chan struct{}, d.opts.Parallelism)
+	var wg sync.WaitGroup
+	for i := range jobs {
+		job := &jobs[i]
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			job.plane, job.err = d.inflate(job.data, layerBytes)
+		}()
+	}
+	wg.Wait()
+	for i := range jobs {
+		job := &jobs[i]
+		if job.err != nil {
+			// The offsets of the decompressing decoder start at the
+			// channel data.
+			e := &DecodeError{Offset: job.offset, Block: ChannelBlock.String(), Layer: d.layer, Channel: job.channel, Err: job.err}
+			if derr, ok := job.err.(*DecodeError); ok {
+				e.Offset += derr.Offset
+				e.Err = derr.Err
+			}
+			panic(e)
+		}
+		d.storePlane(img, job.plane, job.channelType)
+	}
+}
+
+// inflate decompresses the data of a channel into a new plane of n bytes.
+// It uses a decoder of its own, so that channels can be decompressed
+// concurrently.
+func (d *decoder) inflate(data []byte, n int) (plane []byte, err error) {
+	defer catchErrors(&err)
+	sub := &decoder{
+		ctx:      d.ctx,
+		comp:     d.comp,
+		layer:    -1,
+		channel:  -1,
+		inputEnd: int64(len(data)),
+	}
+	sub.useScratch(&sliceReader{b: data})
+	defer sub.release()
+	plane = make([]byte, n)
+	sub.readChannelData(plane, len(data))
+	return plane, nil
+}
+
+// layerJob is a layer block for one of the workers of decodeLayerJobs to
+// decode.
+type layerJob struct {
+	index      int   // index of the layer
+	start, end int64 // offsets of the data of the layer block
+	init       int64 // end of its initial data in version 3 files
+	layer      *Layer
+	features   Features // of the blocks read for the layer
+	warnings   []Warning
+	err        error
+}
+
+// parallelLayers reports whether the layers are decoded by workers, which
+// takes more than one of them and an input they can each read from. The
+// layers are then found by seeking past them. Layers streamed by
+// DecodeRows are not.
+func (d *decoder) parallelLayers() bool {
+	return d.opts != nil && d.opts.Parallelism > 1 && d.readerAt != nil && d.rows == nil
+}
+
+// decodeLayerJobs decodes the layers of jobs into layers with up to
+// Parallelism workers. A failure stops the other workers, and the error
+// of the first layer that failed is the one reported. Warnings are passed
+// on in the order of the layers once they are all decoded, and progress
+// is reported as each one is.
+func (d *decoder) decodeLayerJobs(layers []*Layer, jobs []layerJob) {
+	ctx, cancel := context.WithCancel(d.ctx)
+	var wg sync.WaitGroup
+	// Workers are not left running if Progress panics.
+	defer wg.Wait()
+	defer cancel()
+	queue := make(chan *layerJob, len(jobs))
+	for i := range jobs {
+		queue <- &jobs[i]
+	}
+	close(queue)
+	done := make(chan *layerJob, len(jobs))
+	for n := min(d.opts.Parallelism, len(jobs)); n > 0; n-- {
+		// Workers are made here, as d changes once the layers are in.
+		w := d.layerWorker(ctx)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer w.release()
+			for job := range queue {
+				w.decodeLayerJob(job)
+				if job.err != nil {
+					cancel()
+				}
+				done <- job
+			}
+		}()
+	}
+	progress := jobs[0].start
+	for range jobs {
+		job := <-done
+		if job.err == nil {
+			progress += job.end - job.start
+			d.reportProgress(progress)
+		}
+	}
+	for i := range jobs {
+		job := &jobs[i]
+		for _, w := range job.warnings {
+			d.opts.warn(w)
+		}
+		d.features |= job.features
+		// Layers stopped because another failed are not the failure.
+		if job.err != nil && (d.ctx.Err() != nil || !errors.Is(job.err, context.Canceled)) {
+			panic(job.err)
+		}
+		layers[job.index] = job.layer
+	}
+}
+
+// layerWorker returns a decoder for a worker of decodeLayerJobs, with
+// buffers and decompressors of its own. It neither reports progress nor
+// decodes channels concurrently.
+func (d *decoder) layerWorker(ctx context.Context) *decoder {
+	w := *d
+	opts := *d.opts
+	opts.Parallelism, opts.Progress = 0, nil
+	w.opts = &opts
+	w.ctx = ctx
+	w.useScratch(nil)
+	w.pending = nil
+	w.seeker = nil
+	return &w
+}
+
+// decodeLayerJob decodes the layer of job, reading the input from the
+// start of the layer. Warnings are kept in the job.
+func (d *decoder) decodeLayerJob(job *layerJob) {
+	defer catchErrors(&job.err)
+	d.opts.Warn = func(w Warning) { job.warnings = append(job.warnings, w) }
+	// A layer may overrun its block, as it can when decoded in turn.
+	off := d.base + job.start
+	if s, ok := d.readerAt.(*sliceReader); ok {
+		// A file in memory is read in place by every worker.
+		d.r = &sliceReader{b: s.b, off: int(off)}
+	} else {
+		d.scratch.r.Reset(&contextReader{d.ctx, io.NewSectionReader(d.readerAt, off, math.MaxInt64-off)})
+	}
+	d.offset = job.start
+	d.blocks = append(d.blocks[:0], openBlock{LayerStartBlock, d.layerBankEnd, 0}, openBlock{LayerBlock, job.end, job.init})
+	d.layer, d.channel = job.index, -1
+	d.features = 0
+	job.layer = d.decodeLayer(job.end)
+	job.features = d.features
+}
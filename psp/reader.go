@@ -0,0 +1,108 @@
+package psp
+
+import (
+	"image"
+	"io"
+)
+
+// A Reader gives access to the layers of a PSP file one at a time. Opening
+// it only reads the headers of the layers, and the channels of a layer are
+// read and decompressed when its image is asked for. A Reader is not safe
+// for concurrent use.
+type Reader struct {
+	d      *decoder
+	layers []indexedLayer
+}
+
+// indexedLayer is a layer as found by OpenReader.
+type indexedLayer struct {
+	start, end int64 // offsets of the data of the layer block
+	init       int64 // end of its initial data in version 3 files
+	info       Layer
+}
+
+// OpenReader indexes the layer bank of the PSP file read from rs, starting
+// at its current position. Blocks other than the layer headers are skipped
+// by seeking rather than read.
+func OpenReader(rs io.ReadSeeker) (r *Reader, err error) {
+	// The decoder skips by seeking only if it can.
+	if _, err := rs.Seek(0, io.SeekCurrent); err != nil {
+		return nil, err
+	}
+	defer catchErrors(&err)
+	d := newDecoder(rs, nil)
+	if !d.decodeMetadataBlocks() {
+		d.error(FormatError("missing layer bank block"))
+	}
+	if n := int(d.layerCount); n > d.limits.layers {
+		d.error(LimitError{"MaxLayers", n, d.limits.layers})
+	}
+	r = &Reader{d: d}
+	var bh blockHeader
+	for d.offset < d.layerBankEnd {
+		d.readBlockHeader(&bh)
+		end := d.offset + int64(bh.dataLen)
+		switch bh.id {
+		case LayerBlock:
+			if len(r.layers) == d.limits.layers {
+				d.error(LimitError{"MaxLayers", len(r.layers) + 1, d.limits.layers})
+			}
+			d.layer = len(r.layers)
+			r.layers = append(r.layers, d.indexLayer(end))
+			d.layer = -1
+		case RasterExtensionBlock:
+			d.skipRasterExtension(end)
+			continue
+		}
+		d.skipTo(end)
+	}
+	return r, nil
+}
+
+// indexLayer reads the information of a layer block ending at end, passing
+// over its channels.
+func (d *decoder) indexLayer(end int64) indexedLayer {
+	b, _ := d.innermostBlock()
+	il := indexedLayer{start: d.offset, end: end, init: b.init}
+	d.readLayerInfo(&il.info)
+	var bh blockHeader
+	for d.offset < end {
+		d.readBlockHeader(&bh)
+		blockEnd := d.offset + int64(bh.dataLen)
+		if bh.id == GroupExtensionBlock {
+			chunkEnd := d.readChunkSize()
+			il.info.group = true
+			il.info.groupCount = int(d.readUint32())
+			d.skipTo(chunkEnd)
+		}
+		d.skipTo(blockEnd)
+	}
+	return il
+}
+
+// NumLayers returns the number of layers in the file.
+func (r *Reader) NumLayers() int {
+	return len(r.layers)
+}
+
+// LayerInfo returns the information of layer i, in the order the layers
+// are stored, without its image, masks or other contents.
+func (r *Reader) LayerInfo(i int) *Layer {
+	l := r.layers[i].info
+	return &l
+}
+
+// LayerImage decodes the image of layer i, which is nil for layers without
+// color data. MaxPixels applies to each call on its own.
+func (r *Reader) LayerImage(i int) (img image.Image, err error) {
+	defer catchErrors(&err)
+	il := r.layers[i]
+	d := r.d
+	d.pixels.Store(0)
+	d.seekTo(il.start)
+	d.blocks = append(d.blocks[:0], openBlock{LayerStartBlock, d.layerBankEnd, 0}, openBlock{LayerBlock, il.end, il.init})
+	d.pending = nil // left over if decoding the previous layer failed
+	d.layer = i
+	defer func() { d.layer, d.channel = -1, -1 }()
+	return d.decodeLayer(il.end).Image, nil
+}
@@ -0,0 +1,110 @@
+package psp
+
+import (
+	"bytes"
+	"image"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/samuel/go-psp/internal/pspgen"
+)
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.ReadSeeker
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadSeeker.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func TestReader(t *testing.T) {
+	big := testRGBA(image.Rect(0, 0, 300, 200), 1)
+	small := testRGBA(image.Rect(10, 20, 30, 40), 2)
+	doc := &Document{
+		Width:  300,
+		Height: 200,
+		Layers: []*Layer{
+			{Name: "Big", Opacity: 255, Visible: true, Image: big},
+			{Name: "Small", Opacity: 128, Image: small},
+		},
+	}
+	var buf bytes.Buffer
+	if err := EncodeDocument(&buf, doc, &EncodeOptions{Compression: CompressionNone}); err != nil {
+		t.Fatal(err)
+	}
+	// Start within a larger stream to check offsets are relative to the
+	// file.
+	data := append([]byte("prefix"), buf.Bytes()...)
+	rs := &countingReader{ReadSeeker: bytes.NewReader(data)}
+	rs.Seek(6, io.SeekStart)
+
+	r, err := OpenReader(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.n > int64(len(data)/4) {
+		t.Errorf("opening read %d of %d bytes", rs.n, len(data))
+	}
+	if r.NumLayers() != 2 {
+		t.Fatalf("got %d layers, want 2", r.NumLayers())
+	}
+	for i, want := range doc.Layers {
+		l := r.LayerInfo(i)
+		if l.Name != want.Name || l.Opacity != want.Opacity || l.Visible != want.Visible || l.Image != nil {
+			t.Errorf("layer %d: got %+v", i, l)
+		}
+	}
+	// Decode out of order and twice.
+	for _, i := range []int{1, 0, 1} {
+		img, err := r.LayerImage(i)
+		if err != nil {
+			t.Fatalf("layer %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(img, doc.Layers[i].Image) {
+			t.Errorf("layer %d: image mismatch", i)
+		}
+	}
+}
+
+func TestReaderTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, testRGBA(image.Rect(0, 0, 8, 8), 0)); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if _, err := OpenReader(bytes.NewReader(data[:len(data)-10])); err == nil {
+		t.Error("expected an error for a truncated file")
+	}
+}
+
+func TestReaderRepeated(t *testing.T) {
+	// Each layer image is within MaxPixels, however many are decoded.
+	r := image.Rect(0, 0, 4000, 4000)
+	data := pspgen.NewFile(7).
+		Attrs(pspgen.Attrs{Width: 4000, Height: 4000, BitDepth: 8, Grayscale: true, LayerCount: 1}).
+		Layers(pspgen.LayerBytes(7, pspgen.None, pspgen.Layer{
+			Type:     pspgen.RasterType(7),
+			Rect:     r,
+			Opacity:  255,
+			Channels: []pspgen.Channel{{Bitmap: pspgen.DIBImage, Channel: pspgen.ChannelComposite}},
+		})).
+		Bytes()
+	rd, err := OpenReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		img, err := rd.LayerImage(0)
+		if err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+		if img.Bounds() != r {
+			t.Fatalf("call %d: got bounds %v", i, img.Bounds())
+		}
+	}
+}
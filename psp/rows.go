@@ -0,0 +1,390 @@
+package psp
+
+import (
+	"fmt"
+	"image"
+	"io"
+)
+
+// rowFunc is the function DecodeRows passes rows to.
+type rowFunc func(y int, row []byte) error
+
+// DecodeRows decodes the image Decode would return a row at a time, without
+// holding all of it in memory, and calls fn with every row from top to
+// bottom. A row holds the pixels of a row of the Pix of the image Decode
+// returns, and y is its coordinate in the image. fn must not keep the row,
+// whose bytes are reused for the next one. An error returned by fn stops
+// decoding and is returned as is.
+//
+// Grayscale and indexed images are decompressed as the rows are passed on.
+// The red, green, blue and transparency channels of color images are
+// stored one after another, so they are read in step from their offsets in
+// the file when r implements io.ReaderAt and io.Seeker, as an *os.File
+// does. Otherwise the channels are held decompressed until the last has
+// been read.
+func DecodeRows(r io.Reader, fn func(y int, row []byte) error) error {
+	return DecodeRowsWithOptions(r, nil, fn)
+}
+
+// DecodeRowsWithOptions is like DecodeRows but with the given options, of
+// which Flatten and Parallelism have no effect. Images larger than the
+// default limits need larger MaxWidth and MaxHeight.
+func DecodeRowsWithOptions(r io.Reader, opts *Options, fn func(y int, row []byte) error) (err error) {
+	defer func() {
+		if e, ok := err.(rowError); ok {
+			err = e.err
+		}
+	}()
+	defer catchErrors(&err)
+	d := newDecoder(r, opts)
+	defer d.release()
+	d.dibs = opts.dibTypes(DIBImage | DIBTransMask)
+	d.checkSize(d.width, d.height)
+	if !d.decodeMetadataBlocks() {
+		d.error(FormatError("missing layer bank block"))
+	}
+	d.rows = fn
+	d.decodeLayers()
+	if !d.rowsDone {
+		d.error(FormatError("no raster layers"))
+	}
+	return nil
+}
+
+// rowError carries an error returned by the function of DecodeRows past
+// catchErrors.
+type rowError struct {
+	err error
+}
+
+func (e rowError) Error() string {
+	return e.err.Error()
+}
+
+// rowChannel is a channel of the layer streamed by DecodeRows, read from
+// either a stream or a plane decompressed ahead.
+type rowChannel struct {
+	channelType channelType
+	stream      *channelStream
+	plane       []byte
+}
+
+// readRow reads the next len(row) bytes of the channel.
+func (c *rowChannel) readRow(row []byte) {
+	if c.stream != nil {
+		c.stream.readRow(row)
+		return
+	}
+	n := copy(row, c.plane)
+	c.plane = c.plane[n:]
+}
+
+// decodeLayerRows reads the layer block ending at end and, if it is the
+// first holding color data, passes its rows to d.rows as decodeLayer would
+// have stored them in its image. Later layers are skipped.
+func (d *decoder) decodeLayerRows(end int64) {
+	if d.rowsDone {
+		d.skipTo(end)
+		return
+	}
+	l := &Layer{}
+	d.readLayerInfo(l)
+	skipHidden := d.opts != nil && d.opts.SkipHidden
+	if !d.hasChannels(l) || !d.dibs.has(dibImage) || !l.Visible && skipHidden {
+		d.skipTo(end)
+		return
+	}
+	d.checkSize(l.SavedRect.Dx(), l.SavedRect.Dy())
+	// A row sized image to store the channels in as decodeLayer does.
+	row := &Layer{SavedRect: image.Rect(l.SavedRect.Min.X, 0, l.SavedRect.Max.X, 1)}
+	rowBytes := d.newLayerImage(row)
+	single := true
+	switch row.Image.(type) {
+	case *image.RGBA, *image.RGBA64:
+		single = false
+	}
+	// Channels whose data comes later in the file are read with a decoder
+	// of their own, which needs an input that can be read at any offset.
+	type channelAt struct {
+		channel       int
+		offset, end   int64
+		compressedLen int
+		channelType   channelType
+	}
+	var at []channelAt
+	var chans []*rowChannel
+	var alpha bool
+	var bh blockHeader
+	channel, channelBlocks := 0, 0
+	for d.offset < end && !d.rowsDone {
+		d.readBlockHeader(&bh)
+		blockEnd := d.offset + int64(bh.dataLen)
+		if bh.id != ChannelBlock {
+			d.checkKnown(bh.id)
+			d.skipTo(blockEnd)
+			continue
+		}
+		d.channel = channelBlocks
+		channelBlocks++
+		if channel == int(l.ChannelCount) && d.channelsDeclared() {
+			d.recoverable("skipped channel beyond the %d declared", l.ChannelCount)
+			d.skipTo(blockEnd)
+			d.channel = -1
+			continue
+		}
+		channel++
+		compressedLen, bitmapType, channelType := d.readChannelHeader()
+		switch {
+		case bitmapType == dibTransMask && !single && d.dibs.has(dibTransMask):
+			channelType = 4
+			alpha = true
+		case bitmapType != dibImage:
+			// TODO: paletted and grayscale layers drop their transparency
+			d.skipTo(blockEnd)
+			d.channel = -1
+			continue
+		case !single && (channelType < channelRed || channelType > channelBlue):
+			d.recoverable("skipped %v of a color layer", channelType)
+			d.skipTo(blockEnd)
+			d.channel = -1
+			continue
+		}
+		if n := blockEnd - d.offset; int64(compressedLen) > n {
+			d.error(FormatError(fmt.Sprintf("channel data of %d bytes overruns its block of %d", compressedLen, n)))
+		}
+		switch {
+		case single:
+			// The one channel is passed on as it is decompressed.
+			s := d.openChannel(compressedLen)
+			d.emitRows(l, row, rowBytes, []*rowChannel{{channelType: channelType, stream: s}}, false)
+			s.close()
+		case d.readerAt != nil:
+			at = append(at, channelAt{d.channel, d.offset, blockEnd, compressedLen, channelType})
+		default:
+			d.allocPixels(l.SavedRect.Dx(), l.SavedRect.Dy())
+			c := &rowChannel{channelType: channelType, plane: make([]byte, rowBytes*l.SavedRect.Dy())}
+			d.readChannelData(c.plane, compressedLen)
+			chans = append(chans, c)
+		}
+		d.skipTo(blockEnd)
+		d.channel = -1
+		d.reportProgress(d.offset)
+	}
+	if !d.rowsDone {
+		for _, c := range at {
+			w := d.channelReader(c.offset, c.end)
+			w.channel = c.channel
+			defer w.release()
+			chans = append(chans, &rowChannel{channelType: c.channelType, stream: w.openChannel(c.compressedLen)})
+		}
+		d.emitRows(l, row, rowBytes, chans, alpha)
+		for _, c := range chans {
+			if c.stream != nil {
+				c.stream.close()
+			}
+		}
+	}
+	d.skipTo(end)
+}
+
+// channelReader returns a decoder with buffers and decompressors of its
+// own that reads the input from offset, within a channel block ending at
+// end.
+func (d *decoder) channelReader(offset, end int64) *decoder {
+	w := *d
+	w.useScratch(io.NewSectionReader(d.readerAt, d.base+offset, end-offset))
+	w.offset = offset
+	w.blocks = append(w.blocks, openBlock{ChannelBlock, end, 0})
+	w.seeker, w.readerAt = nil, nil
+	return &w
+}
+
+// emitRows passes the rows of l, read from chans, to d.rows. row is a layer
+// of a single row whose image the channels are stored in, and rowBytes the
+// size of a row of a channel.
+func (d *decoder) emitRows(l *Layer, row *Layer, rowBytes int, chans []*rowChannel, alpha bool) {
+	d.rowsDone = true
+	var pix []byte
+	switch m := row.Image.(type) {
+	case *image.Paletted:
+		pix = m.Pix
+	case *image.Gray:
+		pix = m.Pix
+	case *image.Gray16:
+		pix = m.Pix
+	case *image.RGBA:
+		pix = m.Pix
+	case *image.RGBA64:
+		pix = m.Pix
+	}
+	buf := make([]byte, rowBytes)
+	premultiplied := alpha && (d.opts == nil || !d.opts.NonPremultiplied)
+	// Indices beyond the palette are reported once, as decodeLayer does.
+	var beyondPalette bool
+	for y := l.SavedRect.Min.Y; y < l.SavedRect.Max.Y; y++ {
+		for _, c := range chans {
+			c.readRow(buf)
+			d.storePlane(row.Image, buf, c.channelType)
+		}
+		if m, ok := row.Image.(*image.Paletted); ok && !beyondPalette && len(m.Palette) < 256 {
+			if i := maxIndex(m.Pix); int(i) >= len(m.Palette) {
+				d.recoverable("pixel index %d beyond the %d palette entries", i, len(m.Palette))
+				beyondPalette = true
+			}
+		}
+		if premultiplied {
+			premultiply(row.Image)
+		}
+		if err := d.rows(y, pix); err != nil {
+			panic(rowError{err})
+		}
+	}
+}
+
+// channelStream is the data of a channel decompressed as it is read.
+type channelStream struct {
+	d   *decoder
+	r   io.Reader
+	rle *rleReader
+	end int64 // offset of the end of the compressed data
+}
+
+// openChannel returns a stream of the compressedLen bytes of channel data
+// that follow.
+func (d *decoder) openChannel(compressedLen int) *channelStream {
+	d.checkContext()
+	s := &channelStream{d: d, end: d.offset + int64(compressedLen)}
+	switch {
+	case compressedLen == 0:
+		// As readChannelData, a channel without data is empty.
+		*d.lr = limitedInput{d.r, 0}
+		s.r = zeros{}
+	case d.comp == CompressionLZ77:
+		*d.lr = limitedInput{d.r, int64(compressedLen)}
+		s.r = d.lz77Reader(d.lr, d.zlibHeader(compressedLen))
+	case d.comp == CompressionRLE:
+		s.rle = d.newRLEReader(compressedLen)
+		s.r = s.rle
+	default:
+		*d.lr = limitedInput{d.r, int64(compressedLen)}
+		s.r = d.lr
+	}
+	return s
+}
+
+// zeros reads as an endless run of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// readRow reads the next len(row) bytes of the channel.
+func (s *channelStream) readRow(row []byte) {
+	d := s.d
+	_, err := io.ReadFull(s.r, row)
+	if s.rle == nil {
+		d.offset = s.end - d.lr.n
+	}
+	if err != nil {
+		d.error(lz77Error(err))
+	}
+}
+
+// close reads the rest of the channel data, as readChannelData does once
+// the plane is full.
+func (s *channelStream) close() {
+	if s.rle != nil {
+		s.rle.close()
+		return
+	}
+	// The decompressor may stop short of the checksum and padding.
+	s.d.skip(int(s.d.lr.n))
+}
+
+// rleReader decodes RLE data, as described at readRLE, a read at a time.
+type rleReader struct {
+	d      *decoder
+	slab   []byte
+	s      []byte // bytes of slab not yet decoded
+	left   int    // bytes not yet read into slab
+	run    int    // bytes left of the current run
+	repeat bool   // whether the run repeats value rather than being literal
+	value  byte
+}
+
+// newRLEReader returns a reader of the compressedLen bytes of RLE data
+// that follow.
+func (d *decoder) newRLEReader(compressedLen int) *rleReader {
+	r := &rleReader{d: d, left: compressedLen}
+	if d.scratch != nil {
+		r.slab = d.scratch.slab[:]
+	} else {
+		r.slab = make([]byte, rleSlabSize)
+	}
+	r.slab = r.slab[:min(compressedLen, rleSlabSize)]
+	return r
+}
+
+func (r *rleReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if r.run == 0 {
+			if len(r.s) == 0 && r.left == 0 {
+				break
+			}
+			r.next()
+			continue
+		}
+		m := min(r.run, len(p)-n)
+		if r.repeat {
+			for i := n; i < n+m; i++ {
+				p[i] = r.value
+			}
+		} else {
+			if len(r.s) == 0 {
+				r.s = r.d.fillSlab(r.slab, &r.left)
+			}
+			m = copy(p[n:n+m], r.s)
+			r.s = r.s[m:]
+		}
+		n += m
+		r.run -= m
+	}
+	if n == 0 && len(p) > 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// next reads the control byte of the next run, and the byte it repeats.
+func (r *rleReader) next() {
+	run := int(r.byte())
+	r.repeat = run > 128
+	if r.repeat {
+		run -= 128
+		r.value = r.byte()
+	}
+	r.run = run
+}
+
+func (r *rleReader) byte() byte {
+	if len(r.s) == 0 {
+		r.s = r.d.fillSlab(r.slab, &r.left)
+	}
+	b := r.s[0]
+	r.s = r.s[1:]
+	return b
+}
+
+// close reads the rest of the data once the channel has been read, which
+// may only hold empty runs, as readRLE requires.
+func (r *rleReader) close() {
+	for r.run == 0 && (len(r.s) > 0 || r.left > 0) {
+		r.next()
+	}
+	if r.run > 0 {
+		r.d.error(FormatError("RLE run overruns the channel"))
+	}
+}
@@ -0,0 +1,158 @@
+package psp
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io"
+	"testing"
+
+	"github.com/samuel/go-psp/internal/pspgen"
+)
+
+// decodeRows returns the rows DecodeRows passes on, checking that they come
+// in order.
+func decodeRows(t *testing.T, r io.Reader) (image.Rectangle, []byte, error) {
+	t.Helper()
+	var pix []byte
+	var rect image.Rectangle
+	err := DecodeRows(r, func(y int, row []byte) error {
+		if pix == nil {
+			rect = image.Rect(0, y, 0, y)
+		} else if y != rect.Max.Y {
+			t.Fatalf("got row %d after %d", y, rect.Max.Y-1)
+		}
+		rect.Max.Y++
+		pix = append(pix, row...)
+		return nil
+	})
+	return rect, pix, err
+}
+
+func TestDecodeRows(t *testing.T) {
+	for i, data := range pspgen.Corpus() {
+		want, werr := Decode(bytes.NewReader(data))
+		if werr != nil {
+			t.Fatalf("corpus file %d: %v", i, werr)
+		}
+		for _, r := range []io.Reader{bytes.NewReader(data), struct{ io.Reader }{bytes.NewReader(data)}} {
+			rect, pix, err := decodeRows(t, r)
+			if err != nil {
+				t.Errorf("corpus file %d, %T: %v", i, r, err)
+				continue
+			}
+			b := want.Bounds()
+			if rect.Min.Y != b.Min.Y || rect.Max.Y != b.Max.Y {
+				t.Errorf("corpus file %d, %T: got rows %d to %d, want %d to %d", i, r, rect.Min.Y, rect.Max.Y, b.Min.Y, b.Max.Y)
+			}
+			if !bytes.Equal(pix, pixOf(want)) {
+				t.Errorf("corpus file %d, %T: rows differ from the decoded image", i, r)
+			}
+		}
+		// Input Decode fails on fails DecodeRows as well.
+		for _, n := range []int{len(data) - 1, len(data) / 2} {
+			for _, r := range []io.Reader{bytes.NewReader(data[:n]), struct{ io.Reader }{bytes.NewReader(data[:n])}} {
+				if _, err := Decode(bytes.NewReader(data[:n])); err == nil {
+					continue
+				}
+				if _, _, err := decodeRows(t, r); err == nil {
+					t.Errorf("corpus file %d cut to %d bytes, %T: no error", i, n, r)
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeRowsStreams(t *testing.T) {
+	m := image.NewGray16(image.Rect(0, 0, 300, 200))
+	for i := range m.Pix {
+		m.Pix[i] = byte(i * i >> 5)
+	}
+	rgb := image.NewRGBA(m.Rect)
+	copy(rgb.Pix, m.Pix)
+	for _, tc := range []struct {
+		name string
+		m    image.Image
+	}{
+		{"Gray16", m},
+		{"RGB", rgb},
+	} {
+		for comp := pspgen.None; comp <= pspgen.LZ77; comp++ {
+			data := pspgen.Image(5, comp, tc.m)
+			rs := &countingReader{ReadSeeker: bytes.NewReader(data)}
+			var first int64 = -1
+			err := DecodeRows(struct {
+				io.ReadSeeker
+				io.ReaderAt
+			}{rs, bytes.NewReader(data)}, func(y int, row []byte) error {
+				if first < 0 {
+					first = rs.n
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("%s, compression %d: %v", tc.name, comp, err)
+			}
+			// The last channel is read as the rows are passed on, with
+			// no more than the buffer of the input read ahead.
+			if limit := int64(len(data)*3/4) + 4096; first > limit {
+				t.Errorf("%s, compression %d: read %d of %d bytes before the first row", tc.name, comp, first, len(data))
+			}
+		}
+	}
+}
+
+func TestDecodeRowsError(t *testing.T) {
+	errStop := errors.New("stop")
+	for _, m := range pspgen.Images() {
+		data := pspgen.Image(5, pspgen.LZ77, m)
+		for _, r := range []io.Reader{bytes.NewReader(data), struct{ io.Reader }{bytes.NewReader(data)}} {
+			calls := 0
+			err := DecodeRows(r, func(y int, row []byte) error {
+				calls++
+				return errStop
+			})
+			if err != errStop {
+				t.Errorf("%T, %T: got error %v, want %v", m, r, err, errStop)
+			}
+			if calls != 1 {
+				t.Errorf("%T, %T: called %d times", m, r, calls)
+			}
+		}
+	}
+}
+
+func TestDecodeRowsLimits(t *testing.T) {
+	// The channels of color layers read from an input that can't seek are
+	// held whole, and count against MaxPixels.
+	r := image.Rect(0, 0, 1000, 1000)
+	var channels []pspgen.Channel
+	for _, c := range []uint16{pspgen.ChannelRed, pspgen.ChannelGreen, pspgen.ChannelBlue} {
+		channels = append(channels, pspgen.Channel{Bitmap: pspgen.DIBImage, Channel: c})
+	}
+	data := pspgen.NewFile(7).
+		Attrs(pspgen.Attrs{Width: 1, Height: 1, BitDepth: 24, LayerCount: 1}).
+		Layers(pspgen.LayerBytes(7, pspgen.None, pspgen.Layer{
+			Type:     pspgen.RasterType(7),
+			Rect:     r,
+			Opacity:  255,
+			Channels: channels,
+		})).
+		Bytes()
+	for _, tc := range []struct {
+		max int
+		err error
+	}{
+		{3 << 20, nil},
+		{2_500_000, LimitError{"MaxPixels", 3_001_000, 2_500_000}},
+	} {
+		err := DecodeRowsWithOptions(struct{ io.Reader }{bytes.NewReader(data)}, &Options{MaxPixels: tc.max}, func(int, []byte) error { return nil })
+		var lerr LimitError
+		if errors.As(err, &lerr) {
+			err = lerr
+		}
+		if err != tc.err {
+			t.Errorf("MaxPixels %d: got error %v, want %v", tc.max, err, tc.err)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package psp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// BlockHeader is the header of a block of a PSP file.
+type BlockHeader struct {
+	ID BlockID
+
+	// InitialLength is the length of the fixed fields at the start of the
+	// block data, which is only stored before version 4 and otherwise
+	// zero. It is not the length of any decompressed data.
+	InitialLength uint32
+
+	// Length is the length of the block data following the header.
+	Length uint32
+
+	// Offset is the position of the block data from the start of the file.
+	Offset int64
+}
+
+// A BlockScanner reads the top-level blocks of a PSP file in sequence
+// without interpreting them.
+type BlockScanner struct {
+	r            *bufio.Reader
+	versionMajor int
+	versionMinor int
+	offset       int64
+	block        *io.LimitedReader // data of the current block
+	buf          [14]byte
+}
+
+// NewBlockScanner reads the file header from r and returns a scanner for
+// the blocks that follow it.
+func NewBlockScanner(r io.Reader) (*BlockScanner, error) {
+	s := &BlockScanner{r: bufio.NewReader(r)}
+	var h [36]byte
+	if _, err := io.ReadFull(s.r, h[:]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if !bytes.Equal(h[:32], fileMagic) {
+		return nil, FormatError("not a PSP file")
+	}
+	s.versionMajor = int(decodeUint16(h[32:34]))
+	s.versionMinor = int(decodeUint16(h[34:36]))
+	s.offset = int64(len(h))
+	return s, nil
+}
+
+// Version returns the version of the file format.
+func (s *BlockScanner) Version() (major, minor int) {
+	return s.versionMajor, s.versionMinor
+}
+
+// Next skips the rest of the current block and returns the header of the
+// next one along with a reader limited to its data. It returns io.EOF at
+// the end of the input. The reader is valid until the next call to Next.
+func (s *BlockScanner) Next() (BlockHeader, io.Reader, error) {
+	if s.block != nil {
+		n, err := s.r.Discard(int(s.block.N))
+		s.offset += int64(n)
+		s.block = nil
+		if err != nil {
+			return BlockHeader{}, nil, unexpectedEOF(err)
+		}
+	}
+	// Version 3 and older store the initial length ahead of the length.
+	n := 10
+	if s.versionMajor <= 3 {
+		n = 14
+	}
+	m, err := io.ReadFull(s.r, s.buf[:n])
+	s.offset += int64(m)
+	if err != nil {
+		if err == io.EOF {
+			return BlockHeader{}, nil, io.EOF
+		}
+		return BlockHeader{}, nil, err
+	}
+	if !bytes.Equal(s.buf[:4], blockMagic) {
+		return BlockHeader{}, nil, FormatError("bad block magic")
+	}
+	h := BlockHeader{ID: BlockID(decodeUint16(s.buf[4:6])), Offset: s.offset}
+	if n == 14 {
+		h.InitialLength = decodeUint32(s.buf[6:10])
+	}
+	h.Length = decodeUint32(s.buf[n-4 : n])
+	s.block = &io.LimitedReader{R: s.r, N: int64(h.Length)}
+	return h, &blockReader{s, s.block}, nil
+}
+
+// blockReader reads the data of the current block of a scanner, keeping
+// its offset up to date.
+type blockReader struct {
+	s  *BlockScanner
+	lr *io.LimitedReader
+}
+
+func (r *blockReader) Read(p []byte) (int, error) {
+	if r.s.block != r.lr {
+		return 0, io.EOF // the scanner has moved on
+	}
+	n, err := r.lr.Read(p)
+	r.s.offset += int64(n)
+	if err == io.EOF && r.lr.N > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// A BlockNotFoundError reports that a file holds fewer top-level blocks of
+// a type than requested.
+type BlockNotFoundError struct {
+	ID BlockID
+	N  int
+}
+
+func (e BlockNotFoundError) Error() string {
+	return fmt.Sprintf("psp: %s number %d not found", e.ID, e.N)
+}
+
+// ExtractBlock returns the data of the nth (counting from zero) top-level
+// block of type id in the PSP file read from r. Compressed data is returned
+// as stored. If there are not enough blocks of that type the error is a
+// BlockNotFoundError.
+func ExtractBlock(r io.Reader, id BlockID, n int) ([]byte, error) {
+	s, err := NewBlockScanner(r)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; ; {
+		h, br, err := s.Next()
+		if err == io.EOF {
+			return nil, BlockNotFoundError{id, n}
+		} else if err != nil {
+			return nil, err
+		}
+		if h.ID != id {
+			continue
+		}
+		if i == n {
+			return io.ReadAll(br)
+		}
+		i++
+	}
+}
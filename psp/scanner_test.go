@@ -0,0 +1,139 @@
+package psp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"testing"
+
+	"github.com/samuel/go-psp/internal/pspgen"
+)
+
+func TestBlockScanner(t *testing.T) {
+	for _, major := range []uint16{3, 5} {
+		data := pspgen.NewFile(major).
+			Block(pspgen.CreatorBlock, []byte("abc")).
+			Block(pspgen.ExtendedDataBlock, nil).
+			Block(pspgen.LayerStartBlock, []byte("0123456789")).
+			Bytes()
+		s, err := NewBlockScanner(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, _ := s.Version(); v != int(major) {
+			t.Errorf("got version %d, want %d", v, major)
+		}
+		var got []string
+		for {
+			h, r, err := s.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("v%d: %v", major, err)
+			}
+			// Read only part of the layer bank to check the rest is
+			// skipped.
+			b := make([]byte, 2)
+			n, _ := io.ReadFull(r, b)
+			got = append(got, fmt.Sprintf("%s:%d:%s", h.ID, h.Length, b[:n]))
+			if major <= 3 && h.InitialLength != h.Length {
+				t.Errorf("v%d: got initial length %d, want %d", major, h.InitialLength, h.Length)
+			}
+			if !bytes.Equal(data[h.Offset:h.Offset+int64(n)], b[:n]) {
+				t.Errorf("v%d: wrong offset %d for %s", major, h.Offset, h.ID)
+			}
+		}
+		want := fmt.Sprint([]string{"CreatorBlock:3:ab", "ExtendedDataBlock:0:", "LayerStartBlock:10:01"})
+		if fmt.Sprint(got) != want {
+			t.Errorf("v%d: got %v, want %v", major, got, want)
+		}
+	}
+}
+
+func TestBlockScannerErrors(t *testing.T) {
+	if _, err := NewBlockScanner(bytes.NewReader([]byte("not a psp file"))); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("short header: got error %v", err)
+	}
+	data := pspgen.NewFile(5).Block(pspgen.CreatorBlock, []byte("abcdef")).Bytes()
+	for _, tc := range []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"cut header", data[:len(data)-10], io.ErrUnexpectedEOF},
+		{"cut data", data[:len(data)-2], io.ErrUnexpectedEOF},
+		{"bad magic", append(pspgen.NewFile(5).Bytes(), "~XX\x00\x00\x00\x00\x00\x00\x00"...), FormatError("bad block magic")},
+	} {
+		s, err := NewBlockScanner(bytes.NewReader(tc.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, r, err := s.Next()
+		if err == nil {
+			_, err = io.ReadAll(r)
+		}
+		if err != tc.err {
+			t.Errorf("%s: got error %v, want %v", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestExtractBlock(t *testing.T) {
+	data := pspgen.NewFile(5).
+		Block(pspgen.CreatorBlock, []byte("first")).
+		Block(pspgen.ExtendedDataBlock, []byte("skipped")).
+		Block(pspgen.CreatorBlock, []byte("second")).
+		Bytes()
+	for n, want := range []string{"first", "second"} {
+		b, err := ExtractBlock(bytes.NewReader(data), CreatorBlock, n)
+		if err != nil {
+			t.Fatalf("block %d: %v", n, err)
+		}
+		if string(b) != want {
+			t.Errorf("block %d: got %q, want %q", n, b, want)
+		}
+	}
+	_, err := ExtractBlock(bytes.NewReader(data), CreatorBlock, 2)
+	var nerr BlockNotFoundError
+	if !errors.As(err, &nerr) || nerr.ID != CreatorBlock || nerr.N != 2 {
+		t.Errorf("missing block: got error %v", err)
+	}
+	if _, err := ExtractBlock(bytes.NewReader(data[:len(data)-2]), CreatorBlock, 1); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated block: got error %v", err)
+	}
+}
+
+func ExampleBlockScanner() {
+	var buf bytes.Buffer
+	if err := Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		panic(err)
+	}
+	s, err := NewBlockScanner(&buf)
+	if err != nil {
+		panic(err)
+	}
+	counts := make(map[BlockID]int)
+	var ids []BlockID
+	for {
+		h, _, err := s.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			panic(err)
+		}
+		if counts[h.ID] == 0 {
+			ids = append(ids, h.ID)
+		}
+		counts[h.ID]++
+	}
+	for _, id := range ids {
+		fmt.Println(id, counts[id])
+	}
+	// Output:
+	// ImageBlock 1
+	// LayerStartBlock 1
+}
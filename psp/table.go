@@ -0,0 +1,126 @@
+package psp
+
+import "image"
+
+// Table is a named collection of fill resources stored in the table bank of
+// a document (since PSP7). Vector layers refer to papers and patterns in
+// these tables by name.
+type Table struct {
+	Name    string
+	Kind    TableKind
+	Entries []TableEntry
+}
+
+// TableEntry is a single paper or pattern of a table. Image is an
+// *image.Gray for papers and an *image.RGBA for patterns, or nil if the
+// entry stores no bitmap.
+type TableEntry struct {
+	Name  string
+	Image image.Image
+}
+
+// decodeTableBank reads a table bank block ending at end. The bank starts
+// with an information chunk holding the table count, followed by a table
+// sub-block for each table.
+func (d *decoder) decodeTableBank(end int64) []Table {
+	chunkEnd := d.readChunkSize()
+	d.readUint16() // table count
+	d.skipTo(chunkEnd)
+	var tables []Table
+	var bh blockHeader
+	for d.offset < end {
+		d.readBlockHeader(&bh)
+		blockEnd := d.offset + int64(bh.dataLen)
+		if bh.id == TableBlock {
+			tables = append(tables, d.decodeTable(blockEnd))
+		}
+		d.skipTo(blockEnd)
+	}
+	return tables
+}
+
+// decodeTable reads a table block ending at end. An information chunk with
+// the name, type and entry count of the table is followed by one sub-block
+// per entry. Only paper and pattern tables are decoded; the contents of
+// other tables are left for the caller to skip.
+func (d *decoder) decodeTable(end int64) Table {
+	var t Table
+	chunkEnd := d.readChunkSize()
+	t.Name, _ = d.readText(int(d.readUint16()))
+	t.Kind = TableKind(d.readUint16())
+	d.readUint16() // entry count
+	d.skipTo(chunkEnd)
+	if t.Kind != TablePaper && t.Kind != TablePattern {
+		return t
+	}
+	var bh blockHeader
+	for d.offset < end {
+		d.readBlockHeader(&bh)
+		blockEnd := d.offset + int64(bh.dataLen)
+		if bh.id == PaperBlock || bh.id == PatternBlock {
+			t.Entries = append(t.Entries, d.decodeTableEntry(blockEnd))
+		}
+		d.skipTo(blockEnd)
+	}
+	return t
+}
+
+// decodeTableEntry reads a paper or pattern block ending at end. It holds an
+// information chunk with the name and dimensions of the bitmap, followed by
+// its channel sub-blocks. A paper is a single grayscale channel while a
+// pattern has red, green and blue channels and an optional transparency
+// mask.
+func (d *decoder) decodeTableEntry(end int64) TableEntry {
+	var e TableEntry
+	chunkEnd := d.readChunkSize()
+	e.Name, _ = d.readText(int(d.readUint16()))
+	r := image.Rect(0, 0, int(int32(d.readUint32())), int(int32(d.readUint32())))
+	d.skipTo(chunkEnd)
+
+	var pattern *image.RGBA
+	var alpha bool
+	var bh blockHeader
+	for d.offset < end {
+		d.readBlockHeader(&bh)
+		blockEnd := d.offset + int64(bh.dataLen)
+		if bh.id != ChannelBlock {
+			d.skipTo(blockEnd)
+			continue
+		}
+		compressedLen, bitmapType, channelType := d.readChannelHeader()
+		if !d.dibs.has(bitmapType) {
+			d.skipTo(blockEnd)
+			continue
+		}
+		switch bitmapType {
+		case dibPaper:
+			e.Image = d.readGrayChannel(r, compressedLen)
+		case dibPattern, dibPatternTransMask:
+			if pattern == nil {
+				d.checkSize(r.Dx(), r.Dy())
+				d.allocPixels(r.Dx(), r.Dy())
+				pattern = image.NewRGBA(r)
+				for i := 3; i < len(pattern.Pix); i += 4 {
+					pattern.Pix[i] = 255
+				}
+				e.Image = pattern
+			}
+			c := int(channelType) - 1
+			if bitmapType == dibPatternTransMask {
+				c = 3
+				alpha = true
+			} else if channelType < channelRed || channelType > channelBlue {
+				break
+			}
+			buf := d.readGrayChannel(r, compressedLen).Pix
+			for i, v := range buf {
+				pattern.Pix[i*4+c] = v
+			}
+		}
+		d.skipTo(blockEnd)
+	}
+	if alpha {
+		premultiply(pattern)
+	}
+	return e
+}
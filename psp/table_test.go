@@ -0,0 +1,81 @@
+package psp
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestDecodeTables(t *testing.T) {
+	const major = 7
+	img := testRGBA(image.Rect(0, 0, 1, 1), 0)
+	bank := tableBankBytes(
+		tableBytes(major, "Papers", TablePaper,
+			tableEntryBytes(major, CompressionRLE, PaperBlock, "Canvas", 2, 2,
+				testChannel{bitmap: dibPaper, data: []byte{1, 2, 3, 4}}),
+		),
+		tableBytes(major, "Gradients", TableGradient,
+			blockBytes(major, GradientBlock, []byte{1, 2, 3}),
+		),
+		tableBytes(major, "Mystery", 9, []byte("ignored")),
+		tableBytes(major, "Patterns", TablePattern,
+			tableEntryBytes(major, CompressionRLE, PatternBlock, "Bricks", 2, 1,
+				testChannel{bitmap: dibPattern, channel: channelRed, data: []byte{200, 100}},
+				testChannel{bitmap: dibPattern, channel: channelGreen, data: []byte{100, 50}},
+				testChannel{bitmap: dibPattern, channel: channelBlue, data: []byte{50, 25}},
+				testChannel{bitmap: dibPatternTransMask, data: []byte{255, 0}}),
+		),
+	)
+	data := newFileBuilder(major).
+		attrs(testAttrs{width: 1, height: 1, bitDepth: 24, comp: CompressionRLE, layerCount: 1}).
+		block(TableBankBlock, bank).
+		block(LayerStartBlock, layerBytes(major, CompressionRLE, testLayer{
+			rect:     img.Rect,
+			opacity:  255,
+			channels: rgbChannels(img),
+		})).
+		bytes()
+
+	doc, err := DecodeDocument(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Tables) != 4 {
+		t.Fatalf("got %d tables, want 4", len(doc.Tables))
+	}
+	kinds := []TableKind{TablePaper, TableGradient, 9, TablePattern}
+	for i, k := range kinds {
+		if doc.Tables[i].Kind != k {
+			t.Errorf("table %d kind %v, want %v", i, doc.Tables[i].Kind, k)
+		}
+	}
+	if n := len(doc.Tables[1].Entries) + len(doc.Tables[2].Entries); n != 0 {
+		t.Errorf("got %d entries for gradient and unknown tables, want 0", n)
+	}
+
+	papers := doc.Tables[0].Entries
+	if len(papers) != 1 || papers[0].Name != "Canvas" {
+		t.Fatalf("got papers %+v", papers)
+	}
+	paper, ok := papers[0].Image.(*image.Gray)
+	if !ok || !bytes.Equal(paper.Pix, []byte{1, 2, 3, 4}) {
+		t.Errorf("got paper image %#v", papers[0].Image)
+	}
+
+	patterns := doc.Tables[3].Entries
+	if len(patterns) != 1 || patterns[0].Name != "Bricks" {
+		t.Fatalf("got patterns %+v", patterns)
+	}
+	want := []color.RGBA{{200, 100, 50, 255}, {}}
+	for x, c := range want {
+		if got := patterns[0].Image.At(x, 0); got != c {
+			t.Errorf("pattern pixel %d = %v, want %v", x, got, c)
+		}
+	}
+
+	// Metadata decoding skips the bank without touching its contents.
+	if _, err := DecodeMetadata(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,87 @@
+package psp
+
+import (
+	"bytes"
+	"strings"
+	"unicode/utf8"
+)
+
+// windows1252 maps the bytes 0x80 to 0x9F of the Windows-1252 code page to
+// runes. The five bytes the code page leaves undefined map to the C1
+// control characters of the same value, as in Latin-1, which covers the
+// rest of the code page.
+var windows1252 = [32]rune{
+	'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8D, 'Ž', 0x8F,
+	0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9D, 'ž', 'Ÿ',
+}
+
+// decodeWindows1252 converts text in the Windows-1252 code page to UTF-8.
+func decodeWindows1252(b []byte) string {
+	ascii := true
+	for _, c := range b {
+		if c >= utf8.RuneSelf {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return string(b)
+	}
+	var sb strings.Builder
+	sb.Grow(len(b) + len(b)/2)
+	for _, c := range b {
+		switch {
+		case c < 0x80:
+			sb.WriteByte(c)
+		case c < 0xA0:
+			sb.WriteRune(windows1252[c-0x80])
+		default:
+			sb.WriteRune(rune(c))
+		}
+	}
+	return sb.String()
+}
+
+// encodeWindows1252 converts UTF-8 text to the Windows-1252 code page, as
+// decodeWindows1252 reads it. It reports false if s holds runes the code
+// page can't represent.
+func encodeWindows1252(s string) ([]byte, bool) {
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		switch {
+		case r < 0x80 || r >= 0xA0 && r <= 0xFF:
+			b = append(b, byte(r))
+		default:
+			i := 0
+			for i < len(windows1252) && windows1252[i] != r {
+				i++
+			}
+			if i == len(windows1252) {
+				return nil, false
+			}
+			b = append(b, byte(0x80+i))
+		}
+	}
+	return b, true
+}
+
+// text converts a string field as stored in the file to UTF-8, dropping
+// trailing NULs. Paint Shop Pro writes text in the ANSI code page of the
+// system, which is taken to be Windows-1252 unless Options.DecodeText says
+// otherwise.
+func (d *decoder) text(raw []byte) string {
+	for len(raw) > 0 && raw[len(raw)-1] == 0 {
+		raw = raw[:len(raw)-1]
+	}
+	if d.opts != nil && d.opts.DecodeText != nil {
+		return d.opts.DecodeText(raw)
+	}
+	return decodeWindows1252(raw)
+}
+
+// readText reads a text field of n bytes and returns it converted to UTF-8
+// along with the bytes as stored.
+func (d *decoder) readText(n int) (string, []byte) {
+	raw := bytes.Clone(d.readStringBytes(n))
+	return d.text(raw), raw
+}
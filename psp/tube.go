@@ -0,0 +1,89 @@
+package psp
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"io"
+)
+
+// Tube holds the settings of a picture tube. A tube's image is a sheet of
+// Columns by Rows cells of which the first CellCount, in row-major order,
+// are used.
+type Tube struct {
+	Name      string
+	StepSize  int
+	Columns   int
+	Rows      int
+	CellCount int
+	Placement TubePlacement
+	Selection TubeSelection
+}
+
+// Cell returns the rectangle of cell i within a sheet with bounds b. Cells
+// are sized by rounding up the sheet size divided by the grid, so the cells
+// in the last column and row may be smaller than the others.
+func (t *Tube) Cell(b image.Rectangle, i int) image.Rectangle {
+	if t.Columns <= 0 || t.Rows <= 0 {
+		return image.Rectangle{}
+	}
+	w := (b.Dx() + t.Columns - 1) / t.Columns
+	h := (b.Dy() + t.Rows - 1) / t.Rows
+	x, y := i%t.Columns, i/t.Columns
+	r := image.Rect(x*w, y*h, (x+1)*w, (y+1)*h).Add(b.Min)
+	return r.Intersect(b)
+}
+
+// Frames slices sheet into the individual cells of the tube.
+func (t *Tube) Frames(sheet image.Image) []image.Image {
+	n := t.CellCount
+	if max := t.Columns * t.Rows; n > max || n < 0 {
+		n = max
+	}
+	frames := make([]image.Image, 0, n)
+	for i := 0; i < n; i++ {
+		r := t.Cell(sheet.Bounds(), i)
+		if s, ok := sheet.(interface {
+			SubImage(image.Rectangle) image.Image
+		}); ok {
+			frames = append(frames, s.SubImage(r))
+			continue
+		}
+		dst := image.NewRGBA(r)
+		draw.Draw(dst, r, sheet, r.Min, draw.Src)
+		frames = append(frames, dst)
+	}
+	return frames
+}
+
+// DecodeTube reads a picture tube file from r and returns the tube settings
+// along with its frames, which are cut from the flattened image. It returns a
+// FormatError if the file has no picture tube block.
+func DecodeTube(r io.Reader) (tube *Tube, frames []image.Image, err error) {
+	doc, err := DecodeDocument(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if doc.Metadata.Tube == nil {
+		return nil, nil, FormatError("not a picture tube")
+	}
+	return doc.Metadata.Tube, doc.Metadata.Tube.Frames(doc.Flatten(nil)), nil
+}
+
+// decodeTubeBlock reads a picture tube block.
+func (d *decoder) decodeTubeBlock() *Tube {
+	t := &Tube{}
+	d.readUint16() // version
+	name := []byte(d.readString(513))
+	if i := bytes.IndexByte(name, 0); i >= 0 {
+		name = name[:i]
+	}
+	t.Name = d.text(name)
+	t.StepSize = int(d.readUint32())
+	t.Columns = int(d.readUint32())
+	t.Rows = int(d.readUint32())
+	t.CellCount = int(d.readUint32())
+	t.Placement = TubePlacement(d.readUint32())
+	t.Selection = TubeSelection(d.readUint32())
+	return t
+}
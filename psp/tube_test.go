@@ -0,0 +1,132 @@
+package psp
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestDecodeTube(t *testing.T) {
+	sheet := testRGBA(image.Rect(0, 0, 5, 3), 20)
+	data := newFileBuilder(5).
+		attrs(testAttrs{width: 5, height: 3, bitDepth: 24, comp: CompressionRLE, layerCount: 1}).
+		block(TubeBlock, tubeBytes("Leaves", 40, 2, 2, 3, TubePlacementConstant, TubeSelectionAngular)).
+		block(LayerStartBlock, layerBytes(5, CompressionRLE, testLayer{
+			rect:     sheet.Rect,
+			opacity:  255,
+			channels: rgbChannels(sheet),
+		})).
+		bytes()
+	tube, frames, err := DecodeTube(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Tube{
+		Name:      "Leaves",
+		StepSize:  40,
+		Columns:   2,
+		Rows:      2,
+		CellCount: 3,
+		Placement: TubePlacementConstant,
+		Selection: TubeSelectionAngular,
+	}
+	if *tube != want {
+		t.Errorf("got %+v, want %+v", *tube, want)
+	}
+	rects := []image.Rectangle{
+		image.Rect(0, 0, 3, 2),
+		image.Rect(3, 0, 5, 2),
+		image.Rect(0, 2, 3, 3),
+	}
+	if len(frames) != len(rects) {
+		t.Fatalf("got %d frames, want %d", len(frames), len(rects))
+	}
+	for i, f := range frames {
+		if f.Bounds() != rects[i] {
+			t.Errorf("frame %d bounds %v, want %v", i, f.Bounds(), rects[i])
+			continue
+		}
+		r := rects[i]
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				if f.At(x, y) != sheet.At(x, y) {
+					t.Errorf("frame %d differs at %d,%d", i, x, y)
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeTubeNotATube(t *testing.T) {
+	img := testRGBA(image.Rect(0, 0, 1, 1), 0)
+	data := newFileBuilder(5).
+		attrs(testAttrs{width: 1, height: 1, bitDepth: 24, layerCount: 1}).
+		block(LayerStartBlock, layerBytes(5, CompressionNone, testLayer{rect: img.Rect, channels: rgbChannels(img)})).
+		bytes()
+	if _, _, err := DecodeTube(bytes.NewReader(data)); err == nil {
+		t.Fatal("expected an error for a file without a tube block")
+	}
+}
+
+// transparentTube returns a 4x2 picture tube of two frames with a
+// transparency mask that clears the right column of each frame.
+func transparentTube() []byte {
+	sheet := solidRGBA(image.Rect(0, 0, 4, 2), color.RGBA{200, 100, 50, 255})
+	mask := []byte{255, 0, 255, 0, 255, 0, 255, 128}
+	return newFileBuilder(7).
+		attrs(testAttrs{width: 4, height: 2, bitDepth: 24, comp: CompressionLZ77, layerCount: 1}).
+		block(TubeBlock, tubeBytes("Dots", 10, 2, 1, 2, TubePlacementRandom, TubeSelectionIncremental)).
+		block(LayerStartBlock, layerBytes(7, CompressionLZ77, testLayer{
+			rect:     sheet.Rect,
+			opacity:  255,
+			channels: append(rgbChannels(sheet), testChannel{bitmap: dibTransMask, data: mask}),
+		})).
+		bytes()
+}
+
+func TestTubeFile(t *testing.T) {
+	data := transparentTube()
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "psp" || cfg.Width != 4 || cfg.Height != 2 {
+		t.Errorf("got %s %dx%d, want psp 4x2", format, cfg.Width, cfg.Height)
+	}
+
+	meta, err := DecodeMetadata(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Tube == nil || meta.Tube.Name != "Dots" || meta.Tube.CellCount != 2 {
+		t.Errorf("got tube %+v in metadata", meta.Tube)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[image.Point]color.RGBA{
+		{0, 0}: {200, 100, 50, 255},
+		{1, 0}: {},
+		{3, 1}: {100, 50, 25, 128},
+	}
+	for p, c := range want {
+		if got := img.At(p.X, p.Y); got != c {
+			t.Errorf("pixel %v = %v, want %v", p, got, c)
+		}
+	}
+
+	_, frames, err := DecodeTube(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 2 {
+		t.Fatalf("got %d frames, want 2", len(frames))
+	}
+	if _, _, _, a := frames[1].At(3, 0).RGBA(); a != 0 {
+		t.Errorf("frame 1 is opaque where the mask clears it")
+	}
+}
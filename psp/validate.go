@@ -0,0 +1,83 @@
+package psp
+
+import (
+	"fmt"
+	"io"
+)
+
+// Validate checks that the PSP file read from r is well formed without
+// decoding its pixels. It reads the header and general image attributes,
+// and walks every block and sub-block checking that their lengths are
+// consistent and that the file has a layer bank with at least one raster
+// layer. Channel data is skipped rather than decompressed. Deviations that
+// Decode gets past by default, such as unknown blocks, are accepted.
+//
+// The error returned for an invalid file is a *DecodeError giving the block
+// and offset at which the problem was found.
+func Validate(r io.Reader) (err error) {
+	defer catchErrors(&err)
+	d := newDecoder(r, nil)
+	defer d.release()
+	if !d.decodeMetadataBlocks() {
+		d.error(FormatError("missing layer bank block"))
+	}
+	if n := int(d.layerCount); n > d.limits.layers {
+		d.error(LimitError{"MaxLayers", n, d.limits.layers})
+	}
+	var layers int
+	raster := false
+	var bh blockHeader
+	for d.offset < d.layerBankEnd {
+		d.readBlockHeader(&bh)
+		end := d.offset + int64(bh.dataLen)
+		if bh.id == LayerBlock {
+			if layers == d.limits.layers {
+				d.error(LimitError{"MaxLayers", layers + 1, d.limits.layers})
+			}
+			d.layer = layers
+			if d.validateLayer(end) {
+				raster = true
+			}
+			d.layer = -1
+			layers++
+		}
+		if bh.id == RasterExtensionBlock {
+			d.skipRasterExtension(end)
+			continue
+		}
+		d.skipTo(end)
+	}
+	if !raster {
+		d.error(FormatError("no raster layers"))
+	}
+	d.decodeTrailingBlocks()
+	return nil
+}
+
+// validateLayer checks a layer block ending at end and the headers of its
+// sub-blocks. It reports whether the layer holds raster data.
+func (d *decoder) validateLayer(end int64) bool {
+	var l Layer
+	d.readLayerInfo(&l)
+	raster := d.hasChannels(&l)
+	if raster {
+		d.checkSize(l.SavedRect.Dx(), l.SavedRect.Dy())
+	}
+	var bh blockHeader
+	var channels int
+	for d.offset < end {
+		d.readBlockHeader(&bh)
+		blockEnd := d.offset + int64(bh.dataLen)
+		if bh.id == ChannelBlock {
+			d.channel = channels
+			channels++
+			compressedLen, _, _ := d.readChannelHeader()
+			if n := blockEnd - d.offset; int64(compressedLen) > n {
+				d.error(FormatError(fmt.Sprintf("channel data of %d bytes overruns its block of %d", compressedLen, n)))
+			}
+		}
+		d.skipTo(blockEnd)
+		d.channel = -1
+	}
+	return raster
+}
@@ -0,0 +1,59 @@
+package psp
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"strings"
+	"testing"
+
+	"github.com/samuel/go-psp/internal/pspgen"
+)
+
+func TestValidate(t *testing.T) {
+	for i, data := range pspgen.Corpus() {
+		if err := Validate(bytes.NewReader(data)); err != nil {
+			t.Errorf("corpus file %d: %v", i, err)
+		}
+	}
+
+	img := testRGBA(image.Rect(0, 0, 2, 2), 0)
+	file := func(l testLayer) []byte {
+		return newFileBuilder(5).
+			attrs(testAttrs{width: 2, height: 2, bitDepth: 24, layerCount: 1}).
+			block(LayerStartBlock, layerBytes(5, CompressionNone, l)).
+			bytes()
+	}
+	good := file(testLayer{rect: img.Rect, opacity: 255, channels: rgbChannels(img)})
+	if err := Validate(bytes.NewReader(good)); err != nil {
+		t.Errorf("valid file: %v", err)
+	}
+
+	overrun := blockBytes(5, ChannelBlock, concat(
+		leBytes(uint32(16), uint32(100), uint32(4), uint16(dibImage), uint16(channelRed)),
+		[]byte{1, 2, 3, 4}))
+	for _, tc := range []struct {
+		name   string
+		data   []byte
+		layer  int
+		reason string
+	}{
+		{"not psp", []byte(strings.Repeat("x", 64)), -1, "not a PSP file"},
+		{"no layer bank", newFileBuilder(5).attrs(testAttrs{width: 2, height: 2, bitDepth: 24}).bytes(), -1, "missing layer bank block"},
+		{"no raster layers", file(testLayer{rect: img.Rect, opacity: 255}), -1, "no raster layers"},
+		{"channel overrun", file(testLayer{rect: img.Rect, opacity: 255, extra: [][]byte{overrun}}), 0, "overruns its block"},
+		{"block overrun", good[:len(good)-1], -1, "remain"},
+		{"short channel header", file(testLayer{rect: img.Rect, opacity: 255, extra: [][]byte{shortChannelBlock}}), 0, "shorter than its 16 byte header"},
+	} {
+		err := Validate(bytes.NewReader(tc.data))
+		var derr *DecodeError
+		if !errors.As(err, &derr) {
+			t.Errorf("%s: got error %v, want a DecodeError", tc.name, err)
+			continue
+		}
+		var ferr FormatError
+		if !errors.As(err, &ferr) || !strings.Contains(string(ferr), tc.reason) || derr.Layer != tc.layer {
+			t.Errorf("%s: got error %v in layer %d, want %q in layer %d", tc.name, err, derr.Layer, tc.reason, tc.layer)
+		}
+	}
+}
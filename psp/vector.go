@@ -0,0 +1,137 @@
+package psp
+
+import (
+	"image"
+	"math"
+)
+
+// Point is a position in document coordinates.
+type Point struct {
+	X, Y float64
+}
+
+// Node is a single node of a polyline or polygon shape. Handle1 and Handle2
+// are the Bézier control points before and after the node.
+type Node struct {
+	Point   Point
+	Handle1 Point
+	Handle2 Point
+	Flags   NodeFlags
+}
+
+// Shape is a vector shape of a vector layer. Only the node list of polylines
+// and polygons and the children of groups are parsed. The definition of every
+// other kind of shape, including kinds this package doesn't know about, is
+// kept verbatim in Data.
+type Shape struct {
+	Name  string
+	Kind  ShapeKind
+	Flags ShapeFlags
+
+	Nodes    []Node
+	Children []*Shape
+	Data     []byte
+}
+
+// Closed reports whether the shape is a closed path. Polygons are always
+// closed; polylines are closed if their last node carries NodeClosed.
+func (s *Shape) Closed() bool {
+	switch s.Kind {
+	case ShapePolygon:
+		return true
+	case ShapePolyline:
+		return len(s.Nodes) != 0 && s.Nodes[len(s.Nodes)-1].Flags&NodeClosed != 0
+	}
+	return false
+}
+
+// Bounds returns the smallest rectangle containing every node and control
+// point of the shape and its children.
+func (s *Shape) Bounds() image.Rectangle {
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	var walk func(*Shape)
+	walk = func(s *Shape) {
+		for _, n := range s.Nodes {
+			for _, p := range []Point{n.Point, n.Handle1, n.Handle2} {
+				minX, maxX = math.Min(minX, p.X), math.Max(maxX, p.X)
+				minY, maxY = math.Min(minY, p.Y), math.Max(maxY, p.Y)
+			}
+		}
+		for _, c := range s.Children {
+			walk(c)
+		}
+	}
+	walk(s)
+	if minX > maxX {
+		return image.Rectangle{}
+	}
+	return image.Rect(int(math.Floor(minX)), int(math.Floor(minY)),
+		int(math.Ceil(maxX)), int(math.Ceil(maxY)))
+}
+
+// decodeVectorExtension reads a vector extension block, which holds an
+// information chunk with the shape count followed by the shape sub-blocks.
+func (d *decoder) decodeVectorExtension(end int64) []*Shape {
+	chunkEnd := d.readChunkSize()
+	d.readUint32() // shape count
+	d.skipTo(chunkEnd)
+	return d.decodeShapes(end)
+}
+
+// decodeShapes reads shape sub-blocks up to the absolute offset end.
+func (d *decoder) decodeShapes(end int64) []*Shape {
+	var shapes []*Shape
+	var bh blockHeader
+	for d.offset < end {
+		d.readBlockHeader(&bh)
+		blockEnd := d.offset + int64(bh.dataLen)
+		if bh.id == ShapeBlock {
+			shapes = append(shapes, d.decodeShape(blockEnd))
+		}
+		d.skipTo(blockEnd)
+	}
+	return shapes
+}
+
+// decodeShape reads the shape block ending at end. It starts with the shape
+// attributes chunk (name, type and flags) and is followed by the definition
+// of the shape, which depends on its type.
+func (d *decoder) decodeShape(end int64) *Shape {
+	s := &Shape{}
+	chunkEnd := d.readChunkSize()
+	s.Name, _ = d.readText(int(d.readUint16()))
+	s.Kind = ShapeKind(d.readUint16())
+	s.Flags = ShapeFlags(d.readUint32())
+	d.skipTo(chunkEnd)
+
+	switch s.Kind {
+	case ShapePolyline, ShapePolygon:
+		chunkEnd = d.readChunkSize()
+		nodes := int(d.readUint32())
+		d.skipTo(chunkEnd)
+		for i := 0; i < nodes && d.offset < end; i++ {
+			chunkEnd = d.readChunkSize()
+			var n Node
+			n.Point = d.readPoint()
+			n.Handle1 = d.readPoint()
+			n.Handle2 = d.readPoint()
+			n.Flags = NodeFlags(d.readUint16())
+			d.skipTo(chunkEnd)
+			s.Nodes = append(s.Nodes, n)
+		}
+	case ShapeGroup:
+		chunkEnd = d.readChunkSize()
+		d.readUint32() // child count
+		d.skipTo(chunkEnd)
+		s.Children = d.decodeShapes(end)
+	default:
+		s.Data = make([]byte, end-d.offset)
+		d.read(s.Data)
+	}
+	return s
+}
+
+func (d *decoder) readPoint() Point {
+	return Point{X: d.readFloat64(), Y: d.readFloat64()}
+}
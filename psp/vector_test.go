@@ -0,0 +1,72 @@
+package psp
+
+import (
+	"bytes"
+	"image"
+	"reflect"
+	"testing"
+)
+
+func nodeBytes(n Node) []byte {
+	return sizedChunk(n.Point.X, n.Point.Y, n.Handle1.X, n.Handle1.Y, n.Handle2.X, n.Handle2.Y, uint16(n.Flags))
+}
+
+func TestDecodeVectorShapes(t *testing.T) {
+	const major = 7
+	nodes := []Node{
+		{Point: Point{1, 2}, Handle1: Point{0.5, 2}, Handle2: Point{1.5, 2}},
+		{Point: Point{10, 2}, Handle1: Point{10, 2}, Handle2: Point{10, 2}, Flags: NodeSmooth},
+		{Point: Point{10, 8.5}, Handle1: Point{10, 8.5}, Handle2: Point{10, 8.5}, Flags: NodeClosed},
+	}
+	polyline := shapeBytes(major, "Path", ShapePolyline, ShapeVisible|ShapeAntiAliased,
+		sizedChunk(uint32(len(nodes))), nodeBytes(nodes[0]), nodeBytes(nodes[1]), nodeBytes(nodes[2]),
+		blockBytes(major, PaintstyleBlock, make([]byte, 12)))
+	ellipse := shapeBytes(major, "Ellipse", ShapeEllipse, ShapeVisible, []byte{1, 2, 3, 4})
+	unknown := shapeBytes(major, "Future", 42, 0, []byte{9, 8, 7})
+	group := shapeBytes(major, "Group", ShapeGroup, ShapeVisible,
+		sizedChunk(uint32(1)), ellipse)
+
+	data := newFileBuilder(major).
+		attrs(testAttrs{width: 16, height: 16, bitDepth: 24, layerCount: 1}).
+		block(LayerStartBlock, layerBytes(major, CompressionNone, testLayer{
+			name:      "Vector",
+			layerType: byte(LayerVector),
+			rect:      image.Rect(0, 0, 16, 16),
+			extra:     [][]byte{vectorExtensionBytes(major, polyline, group, unknown)},
+		})).
+		bytes()
+	doc, err := DecodeDocument(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	shapes := doc.Layers[0].Shapes
+	if len(shapes) != 3 {
+		t.Fatalf("got %d shapes, want 3", len(shapes))
+	}
+
+	p := shapes[0]
+	if p.Name != "Path" || p.Kind != ShapePolyline || p.Flags != ShapeVisible|ShapeAntiAliased {
+		t.Errorf("unexpected polyline %+v", p)
+	}
+	if !reflect.DeepEqual(p.Nodes, nodes) {
+		t.Errorf("got nodes %+v, want %+v", p.Nodes, nodes)
+	}
+	if !p.Closed() {
+		t.Error("polyline should be closed")
+	}
+	if b := p.Bounds(); b != image.Rect(0, 2, 10, 9) {
+		t.Errorf("got bounds %v", b)
+	}
+
+	g := shapes[1]
+	if g.Kind != ShapeGroup || len(g.Children) != 1 {
+		t.Fatalf("unexpected group %+v", g)
+	}
+	if e := g.Children[0]; e.Kind != ShapeEllipse || !bytes.Equal(e.Data, []byte{1, 2, 3, 4}) {
+		t.Errorf("unexpected ellipse %+v", e)
+	}
+
+	if u := shapes[2]; u.Kind != 42 || u.Kind.String() != "ShapeKind(42)" || !bytes.Equal(u.Data, []byte{9, 8, 7}) {
+		t.Errorf("unknown shape not preserved: %+v", u)
+	}
+}